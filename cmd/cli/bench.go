@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+// benchZstdLevels are measured with the zstd binary, if installed, to show
+// what it would save. Archives are always gzip.
+var benchZstdLevels = []int{1, 3, 9, 19}
+
+// benchResult is one codec and level measured on the sample.
+type benchResult struct {
+	codec    string
+	level    int
+	size     int64
+	duration time.Duration
+}
+
+func (r benchResult) ratio(sampleSize int) float64 {
+	return float64(sampleSize) / float64(r.size)
+}
+
+// throughput is how much of the dump is compressed per second, in MB/s.
+func (r benchResult) throughput(sampleSize int) float64 {
+	return float64(sampleSize) / 1e6 / r.duration.Seconds()
+}
+
+// handleBenchCompression dumps the start of a project through the service
+// and compresses it with every gzip level (and some zstd levels) on this
+// machine, then recommends a COMPRESSION_LEVEL.
+func handleBenchCompression(cfg *config.Config, apiURL string, args []string) error {
+	fs := flag.NewFlagSet("bench-compression", flag.ContinueOnError)
+	sampleFlag := fs.String("sample", "64MB", "How much of the dump to compress")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: bench-compression <project> [--sample 64MB]")
+	}
+	project := positional[0]
+	sampleBytes, err := config.ParseBytes(*sampleFlag)
+	if err != nil || sampleBytes <= 0 {
+		return fmt.Errorf("invalid --sample %q", *sampleFlag)
+	}
+
+	fmt.Printf("Dumping up to %s of %s...\n", *sampleFlag, project)
+	sample, err := dumpSample(apiURL, project, sampleBytes)
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		return fmt.Errorf("the dump of %s is empty", project)
+	}
+
+	var results []benchResult
+	for level := gzip.BestSpeed; level <= gzip.BestCompression; level++ {
+		result, err := benchGzip(sample, level)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		for _, level := range benchZstdLevels {
+			result, err := benchZstd(sample, level)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: zstd level %d failed: %v\n", level, err)
+				continue
+			}
+			results = append(results, result)
+		}
+	}
+
+	fmt.Printf("Sample: %d bytes (the start of the dump: schema and the first tables)\n\n", len(sample))
+	fmt.Printf("  %-5s %5s %12s %7s %10s\n", "codec", "level", "size", "ratio", "MB/s")
+	for _, r := range results {
+		fmt.Printf("  %-5s %5d %12d %6.2fx %10.1f\n", r.codec, r.level, r.size, r.ratio(len(sample)), r.throughput(len(sample)))
+	}
+	fmt.Println()
+
+	gzipResults := results[:gzip.BestCompression]
+	current := cfg.ProjectOptionInt(project, "COMPRESSION_LEVEL", cfg.CompressionLevel)
+	recommended := recommendGzipLevel(gzipResults)
+	fmt.Printf("Current:     level %d\n", current)
+	fmt.Printf("Recommended: BACKUP_%s_COMPRESSION_LEVEL=%d (within 2%% of the smallest gzip output)\n", strings.ToUpper(project), recommended.level)
+	if fastest := gzipResults[0]; fastest.level != recommended.level {
+		fmt.Printf("For speed:   level %d is %.1fx as fast and %.0f%% larger\n",
+			fastest.level,
+			fastest.throughput(len(sample))/recommended.throughput(len(sample)),
+			(float64(fastest.size)/float64(recommended.size)-1)*100)
+	}
+	for _, r := range results[gzip.BestCompression:] {
+		if r.size < recommended.size && r.duration <= recommended.duration {
+			fmt.Printf("Note:        zstd level %d would be %.0f%% smaller and faster, but archives are gzip\n", r.level, (1-float64(r.size)/float64(recommended.size))*100)
+			break
+		}
+	}
+	return nil
+}
+
+// dumpSample reads up to limit bytes of a plain SQL dump of project from the
+// service and then hangs up, which stops the dump.
+func dumpSample(apiURL, project string, limit int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/projects/%s/dump", apiURL, project), nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to API at %s: %w", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		var result map[string]interface{}
+		_ = json.Unmarshal(bodyBytes, &result)
+		return nil, newAPIError(resp, result, string(bodyBytes))
+	}
+
+	sample, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("dump failed: %w", err)
+	}
+	return sample, nil
+}
+
+// benchGzip compresses sample with gzip at level, like createArchive does.
+func benchGzip(sample []byte, level int) (benchResult, error) {
+	counter := &countingWriter{}
+	started := time.Now()
+	gzw, err := gzip.NewWriterLevel(counter, level)
+	if err != nil {
+		return benchResult{}, err
+	}
+	if _, err := gzw.Write(sample); err != nil {
+		return benchResult{}, err
+	}
+	if err := gzw.Close(); err != nil {
+		return benchResult{}, err
+	}
+	return benchResult{codec: "gzip", level: level, size: counter.n, duration: time.Since(started)}, nil
+}
+
+// benchZstd compresses sample with the zstd binary on one thread, matching
+// gzip's single stream.
+func benchZstd(sample []byte, level int) (benchResult, error) {
+	counter := &countingWriter{}
+	cmd := exec.Command("zstd", "-q", "-c", "-T1", "-"+strconv.Itoa(level))
+	cmd.Stdin = bytes.NewReader(sample)
+	cmd.Stdout = counter
+	started := time.Now()
+	if err := cmd.Run(); err != nil {
+		return benchResult{}, err
+	}
+	return benchResult{codec: "zstd", level: level, size: counter.n, duration: time.Since(started)}, nil
+}
+
+// recommendGzipLevel picks the fastest gzip level whose output is within 2%
+// of the smallest: the higher levels mostly cost time.
+func recommendGzipLevel(results []benchResult) benchResult {
+	smallest := results[0]
+	for _, r := range results {
+		if r.size < smallest.size {
+			smallest = r
+		}
+	}
+	best := smallest
+	for _, r := range results {
+		if float64(r.size) <= float64(smallest.size)*1.02 && r.duration < best.duration {
+			best = r
+		}
+	}
+	return best
+}
+
+// countingWriter discards what is written and counts the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
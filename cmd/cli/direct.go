@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
+	"go.uber.org/zap"
+)
+
+// directShutdownTimeout bounds the delivery of events still queued when a
+// direct backup ends, like --once.
+const directShutdownTimeout = time.Minute
+
+// directProject matches project names given with --url, which end up in
+// directory names and remote keys.
+var directProject = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// backupDirect backs up a project or group in this process with the service
+// library instead of through the API, for machines without a running
+// service. url, if set, is backed up as project in place of (or without) a
+// configured BACKUP_<PROJECT>. It prints the run report and fails unless
+// every backup succeeded.
+func backupDirect(cfg *config.Config, apiURL, project, group, url string, tags []string) error {
+	if url != "" {
+		if project == "" {
+			return fmt.Errorf("--url needs a project name, not --group")
+		}
+		project = strings.ToLower(project)
+		if !directProject.MatchString(project) {
+			return fmt.Errorf("invalid project name %q: use letters, digits, - and _", project)
+		}
+		if _, err := database.ParseConnString(url); err != nil {
+			return fmt.Errorf("invalid --url: %w", err)
+		}
+		if cfg.Databases == nil {
+			cfg.Databases = make(map[string]string)
+		}
+		cfg.Databases[project] = url
+	}
+	tags, err := backup.NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	// A service using the same backup directory and Docker daemon would take
+	// this run's helper containers and temporary files for leftovers of a
+	// crash, and the other way around
+	if serviceRunning(apiURL) {
+		return fmt.Errorf("the service is running at %s: back up through it without --direct", apiURL)
+	}
+
+	logger, err := config.NewLogger(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backupService, err := service.NewOneShot(ctx, cfg, logger)
+	if err != nil {
+		return fmt.Errorf("failed to initialize backup service: %w", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), directShutdownTimeout)
+		defer cancel()
+		if err := backupService.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to deliver remaining events", zap.Error(err))
+		}
+	}()
+
+	runCtx := service.WithTrigger(backup.WithTags(ctx, tags), service.TriggerCLI)
+	var result map[string]interface{}
+	if group != "" {
+		result, err = backupService.RunBackupGroup(runCtx, group)
+	} else {
+		result, err = backupService.RunBackupProjects(runCtx, []string{project})
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(report))
+	if status := result["status"]; status != "success" {
+		return fmt.Errorf("backup %s", status)
+	}
+	return nil
+}
+
+// serviceRunning reports whether the service's API answers at apiURL.
+func serviceRunning(apiURL string) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(apiURL + "/healthz")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// handleDump streams a one-off plain SQL dump of a project from the service
+// to stdout, e.g. `cli dump app --stdout | psql staging`.
+func handleDump(apiURL string, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	stdout := fs.Bool("stdout", false, "Write the dump to stdout")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	// --stdout is required so a bare `dump <project>` doesn't flood a terminal
+	if len(positional) != 1 || !*stdout {
+		return fmt.Errorf("usage: dump <project> --stdout")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/projects/%s/dump", apiURL, positional[0]), nil)
+	if err != nil {
+		return err
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to API at %s: %w", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		var result map[string]interface{}
+		_ = json.Unmarshal(bodyBytes, &result)
+		return newAPIError(resp, result, string(bodyBytes))
+	}
+
+	// The service aborts the response when pg_dump fails midway
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return fmt.Errorf("dump was cut short, the output is incomplete: %w", err)
+	}
+	return nil
+}
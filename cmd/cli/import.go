@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/importer"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/layout"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+// handleImport registers a backup file taken outside the service (an older
+// installation's archive or a manual pg_dump) in the catalog. It works on the
+// backup directory directly, so the service picks it up on its next listing.
+func handleImport(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	project := fs.String("project", "", "Project to import into (defaults to the project named in the archive)")
+	move := fs.Bool("move", false, "Move the file into the backup directory instead of copying it")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: import <file> [--project <name>] [--move]")
+	}
+
+	l, err := layout.Parse(cfg.LayoutTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid LAYOUT_TEMPLATE: %w", err)
+	}
+	entry, err := importer.Import(cfg, l, positional[0], importer.Options{Project: *project, Move: *move})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("imported backup not found in the catalog")
+	}
+
+	fmt.Printf("Imported %s as %s/%s (%s, %s)\n", positional[0], entry.Project, entry.RunID, entry.ImportFormat, entry.Date)
+	if entry.ArchivePath == "" {
+		fmt.Println("Note: only backup archives can be restored; this backup is listed and retained but not restorable")
+	}
+	return nil
+}
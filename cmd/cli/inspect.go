@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+)
+
+// handleInspect describes a backup archive from its embedded manifest, without
+// the manifest file or the service, and checks the files inside against it.
+func handleInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the embedded manifest as JSON")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: inspect <archive.tar.gz> [--json]")
+	}
+
+	manifest, verifyErr := backup.VerifyArchive(positional[0])
+	if manifest == nil {
+		if verifyErr != nil {
+			return verifyErr
+		}
+		return fmt.Errorf("%s has no embedded manifest (archive format 1)", positional[0])
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(manifest); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Archive format: %d\n", manifest.Format)
+		fmt.Printf("Project:        %s\n", manifest.DatabaseID)
+		fmt.Printf("Run ID:         %s\n", manifest.RunID)
+		fmt.Printf("Started:        %s\n", manifest.StartedAt)
+		fmt.Printf("PostgreSQL:     %s\n", manifest.PGVersion)
+		fmt.Printf("Dump image:     %s\n", manifest.DumpOptions.Image)
+		if env := manifest.Environment; env != nil {
+			if env.DumpImageDigest != "" {
+				fmt.Printf("Image digest:   %s\n", env.DumpImageDigest)
+			}
+			if env.PgDumpVersion != "" {
+				fmt.Printf("pg_dump:        %s\n", env.PgDumpVersion)
+			}
+			scheduler := env.SchedulerVersion
+			if env.SchedulerRevision != "" {
+				scheduler += " (" + env.SchedulerRevision + ")"
+			}
+			fmt.Printf("Scheduler:      %s, %s, %s/%s on %s\n", scheduler, env.GoVersion, env.OS, env.Arch, env.Hostname)
+		}
+		fmt.Printf("Data style:     %s\n", manifest.DumpOptions.DataDumpStyle)
+		fmt.Printf("Roles:          %s\n", manifest.DumpOptions.RolesDump)
+		if manifest.LargeObjects != nil {
+			fmt.Printf("Large objects:  %d (%s)\n", *manifest.LargeObjects, manifest.DumpOptions.LargeObjects)
+		}
+		for _, ext := range manifest.Extensions {
+			fmt.Printf("Extension:      %s %s (schema %s)\n", ext.Name, ext.Version, ext.Schema)
+		}
+		if manifest.Incremental != nil {
+			fmt.Printf("Incremental:    %s (base %s)\n", manifest.Incremental.Type, manifest.Incremental.BaseRunID)
+		}
+		fmt.Println("Files:")
+		for _, file := range manifest.Files {
+			fmt.Printf("  %-14s %12d bytes  sha256 %s\n", file.Name, file.Size, file.SHA256)
+		}
+		for _, warning := range manifest.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+	}
+
+	if verifyErr != nil {
+		return fmt.Errorf("archive verification failed: %w", verifyErr)
+	}
+	fmt.Fprintln(os.Stderr, "All files match the embedded checksums")
+	return nil
+}
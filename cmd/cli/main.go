@@ -1,18 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"github.com/mxschmitt/pg-backup-scheduler/internal/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [status|backup <project>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [status [--watch]|backup <project>|--group <name> [--tag <tag>] [--direct [--url <url>]]|check <project>|dump <project> --stdout|bench-compression <project> [--sample <size>]|restore <project> <run_id|latest> --target-url <url>|restore --interactive|pause|resume|verify [project] [--signatures]|inspect <archive>|import <file> [--project <name>] [--move]]\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -25,42 +30,122 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Backups read from disk (verify, import) are dated in the zone the service uses
+	_, _ = cfg.ApplyTimestampZone()
+
 	apiURL := os.Getenv("API_URL")
 	if apiURL == "" {
 		// Use 127.0.0.1 instead of localhost to avoid IPv6 resolution issues
 		apiURL = fmt.Sprintf("http://127.0.0.1:%d", cfg.ServicePort)
 	}
+	apiToken = os.Getenv("API_TOKEN")
+	if apiToken == "" {
+		apiToken = strongestToken(cfg.APITokens, cfg.APITokenNamespaces)
+	}
 
 	switch command {
 	case "status":
-		if err := handleStatus(apiURL); err != nil {
+		if err := handleStatus(apiURL, os.Args[2:]); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 	case "backup":
+		if err := handleBackup(cfg, apiURL, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "check":
 		if len(os.Args) < 3 {
 			fmt.Fprintf(os.Stderr, "Error: project name required\n")
-			fmt.Fprintf(os.Stderr, "Usage: %s backup <project>\n", os.Args[0])
+			fmt.Fprintf(os.Stderr, "Usage: %s check <project>\n", os.Args[0])
+			os.Exit(1)
+		}
+		if err := handleCheck(apiURL, os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "dump":
+		if err := handleDump(apiURL, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "bench-compression":
+		if err := handleBenchCompression(cfg, apiURL, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "restore":
+		if err := handleRestore(apiURL, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "pause", "resume":
+		if err := handleScheduler(apiURL, command); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "verify":
+		if err := handleVerify(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "inspect":
+		if err := handleInspect(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		projectID := os.Args[2]
-		if err := handleBackup(apiURL, projectID); err != nil {
+	case "import":
+		if err := handleImport(cfg, os.Args[2:]); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
-		fmt.Fprintf(os.Stderr, "Usage: %s [status|backup <project>]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [status [--watch]|backup <project>|--group <name> [--tag <tag>] [--direct [--url <url>]]|check <project>|dump <project> --stdout|bench-compression <project> [--sample <size>]|restore <project> <run_id|latest> --target-url <url>|restore --interactive|pause|resume|verify [project] [--signatures]|inspect <archive>|import <file> [--project <name>] [--move]]\n", os.Args[0])
 		os.Exit(1)
 	}
 }
 
-func makeRequest(apiURL, method, path string) (map[string]interface{}, error) {
+// apiToken is sent as bearer token with every request, if set.
+var apiToken string
+
+// strongestToken picks the most privileged of the configured API tokens, so
+// the CLI running next to the service (same environment) just works. Tokens
+// scoped to a namespace are skipped: they can't pause the scheduler and only
+// see their namespace's projects.
+func strongestToken(tokens, namespaces map[string]string) string {
+	best, bestRank := "", 0
+	for token, role := range tokens {
+		if _, scoped := namespaces[token]; scoped {
+			continue
+		}
+		if rank := config.RoleRank(role); rank > bestRank || (rank == bestRank && token < best) {
+			best, bestRank = token, rank
+		}
+	}
+	return best
+}
+
+func makeRequest(apiURL, method, path string, body interface{}) (map[string]interface{}, error) {
 	url := fmt.Sprintf("%s%s", apiURL, path)
-	req, err := http.NewRequest(method, url, nil)
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
 	if err != nil {
 		return nil, err
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -80,17 +165,55 @@ func makeRequest(apiURL, method, path string) (map[string]interface{}, error) {
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		if errMsg, ok := result["error"].(string); ok {
-			return nil, fmt.Errorf("HTTP error: %d %s - %s", resp.StatusCode, resp.Status, errMsg)
-		}
-		return nil, fmt.Errorf("HTTP error: %d %s - %s", resp.StatusCode, resp.Status, string(bodyBytes))
+		return nil, newAPIError(resp, result, string(bodyBytes))
 	}
 
 	return result, nil
 }
 
-func handleStatus(apiURL string) error {
-	data, err := makeRequest(apiURL, "GET", "/status")
+// apiError is a failed API response. Code is the machine-readable error code
+// from the response's error envelope, if any.
+type apiError struct {
+	StatusCode int
+	Status     string
+	Code       string
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("HTTP error: %s - %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("HTTP error: %s - %s", e.Status, e.Message)
+}
+
+// newAPIError reads the error envelope {"error": {"code", "message"}} from a
+// decoded response body, falling back to raw for other bodies.
+func newAPIError(resp *http.Response, body map[string]interface{}, raw string) *apiError {
+	apiErr := &apiError{StatusCode: resp.StatusCode, Status: resp.Status, Message: raw}
+	if envelope, ok := body["error"].(map[string]interface{}); ok {
+		apiErr.Code, _ = envelope["code"].(string)
+		apiErr.Message, _ = envelope["message"].(string)
+	}
+	return apiErr
+}
+
+func handleStatus(apiURL string, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	watch := fs.Bool("watch", false, "Keep showing running backups, the queue and recent results")
+	interval := fs.Duration("interval", 2*time.Second, "How often --watch polls the service")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 || *interval <= 0 {
+		return fmt.Errorf("usage: status [--watch [--interval 2s]]")
+	}
+	if *watch {
+		return watchStatus(apiURL, *interval)
+	}
+
+	data, err := makeRequest(apiURL, "GET", "/status", nil)
 	if err != nil {
 		return err
 	}
@@ -104,48 +227,243 @@ func handleStatus(apiURL string) error {
 	return nil
 }
 
-func handleBackup(apiURL, projectID string) error {
-	path := fmt.Sprintf("/run/%s", projectID)
-	url := fmt.Sprintf("%s%s", apiURL, path)
-	req, err := http.NewRequest("POST", url, nil)
+func handleBackup(cfg *config.Config, apiURL string, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	group := fs.String("group", "", "Back up the projects of this group")
+	var tags stringList
+	fs.Var(&tags, "tag", "Tag the backup, e.g. pre-upgrade-v5 (repeatable)")
+	direct := fs.Bool("direct", false, "Back up in this process instead of through the service")
+	url := fs.String("url", "", "With --direct: the database to back up as the project")
+	positional, err := parseInterspersed(fs, args)
 	if err != nil {
 		return err
 	}
+	if (len(positional) == 1) == (*group != "") || len(positional) > 1 || *url != "" && !*direct {
+		return fmt.Errorf("usage: backup <project>|--group <name> [--tag <tag>]... [--direct [--url <url>]]")
+	}
+	if *direct {
+		project := ""
+		if len(positional) == 1 {
+			project = positional[0]
+		}
+		return backupDirect(cfg, apiURL, project, *group, *url, tags)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	// Group jobs are triggered at /run/group/{name}
+	path := "/run/group/" + *group
+	if *group == "" {
+		path = "/run/" + positional[0]
+	}
+	var body interface{}
+	if len(tags) > 0 {
+		body = map[string]interface{}{"tags": tags}
+	}
+	data, err := makeRequest(apiURL, "POST", path, body)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Code == "already_running" {
+		return fmt.Errorf("a backup is already running, try again when it has finished")
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to API at %s: %w", apiURL, err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+	if status, _ := data["status"].(string); status == "accepted" {
+		if message, ok := data["message"].(string); ok {
+			fmt.Println(message)
+		} else {
+			fmt.Printf("Backup started: %s\n", strings.TrimPrefix(path, "/run/"))
+		}
+		return nil
+	}
+
+	// Print full response if not in expected format
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
 		return err
 	}
+	fmt.Println(string(jsonData))
+	return nil
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		if errMsg, ok := data["error"].(string); ok {
-			return fmt.Errorf("HTTP error: %d %s - %s", resp.StatusCode, resp.Status, errMsg)
-		}
-		return fmt.Errorf("HTTP error: %d %s", resp.StatusCode, resp.Status)
+// handleCheck prints the preflight checks of a project and fails if any of
+// them failed.
+func handleCheck(apiURL, projectID string) error {
+	data, err := makeRequest(apiURL, "GET", fmt.Sprintf("/projects/%s/check", projectID), nil)
+	if err != nil {
+		return err
 	}
 
-	if status, ok := data["status"].(string); ok {
-		if status == "accepted" {
-			if message, ok := data["message"].(string); ok {
-				fmt.Println(message)
-			} else {
-				fmt.Printf("Backup started for project: %s\n", projectID)
-			}
-			return nil
+	checks, _ := data["checks"].([]interface{})
+	for _, c := range checks {
+		check, _ := c.(map[string]interface{})
+		fmt.Printf("%-8s %-15s %s\n", check["status"], check["name"], check["message"])
+		if hint, ok := check["hint"].(string); ok && hint != "" {
+			fmt.Printf("%-8s %-15s hint: %s\n", "", "", hint)
 		}
 	}
 
-	// Print full response if not in expected format
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if data["status"] == "failed" {
+		return fmt.Errorf("preflight check failed for %s", projectID)
+	}
+	fmt.Printf("Preflight check %s for %s\n", data["status"], projectID)
+	return nil
+}
+
+func handleScheduler(apiURL, action string) error {
+	data, err := makeRequest(apiURL, "POST", "/scheduler/"+action, nil)
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(jsonData))
+
+	if message, ok := data["message"].(string); ok {
+		fmt.Println(message)
+	}
 	return nil
 }
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// stringList is a flag that can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func handleRestore(apiURL string, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	targetURL := fs.String("target-url", "", "PostgreSQL URL of the server/database to restore into (required)")
+	renameDB := fs.String("rename-db", "", "Restore into this database name on the target server (created if missing)")
+	owner := fs.String("owner", "", "Role that should own the restored objects")
+	skipRoles := fs.Bool("skip-roles", false, "Don't apply roles.sql")
+	skipVerify := fs.Bool("skip-verify", false, "Don't read the archives in full before applying them")
+	analyze := fs.Bool("analyze", false, "Run ANALYZE after the restore (default: RESTORE_ANALYZE)")
+	refreshMatviews := fs.Bool("refresh-matviews", false, "Refresh materialized views after the restore (default: RESTORE_REFRESH_MATVIEWS)")
+	skipValidation := fs.Bool("skip-validation", false, "Don't run the RESTORE_VALIDATION_SQL files")
+	interactive := fs.Bool("interactive", false, "Pick the project, backup and target step by step and confirm before restoring")
+	var tables, schemas stringList
+	fs.Var(&tables, "table", "Only restore this table (schema.table, repeatable)")
+	fs.Var(&schemas, "schema", "Only restore objects in this schema (repeatable)")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if *interactive && len(positional) > 2 || !*interactive && (len(positional) != 2 || *targetURL == "") {
+		return fmt.Errorf("usage: restore <project> <run_id|latest> --target-url <url> [--rename-db <name>] [--owner <role>] [--skip-roles] [--skip-verify] [--analyze[=false]] [--refresh-matviews[=false]] [--skip-validation] [--table <schema.table>]... [--schema <name>]...\n       restore --interactive [<project> [<run_id|latest>]] [options]")
+	}
+
+	body := map[string]interface{}{
+		"target_url":  *targetURL,
+		"rename_db":   *renameDB,
+		"owner":       *owner,
+		"skip_roles":  *skipRoles,
+		"skip_verify": *skipVerify,
+		"tables":      tables,
+		"schemas":     schemas,
+	}
+	// The hooks default to the project's settings unless given explicitly
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "analyze":
+			body["analyze"] = *analyze
+		case "refresh-matviews":
+			body["refresh_matviews"] = *refreshMatviews
+		}
+	})
+	if *skipValidation {
+		body["skip_validation"] = true
+	}
+	if *interactive {
+		project, runID, err := restoreWizard(apiURL, positional, body)
+		if err != nil {
+			return err
+		}
+		positional = []string{project, runID}
+	}
+	path := fmt.Sprintf("/backups/%s/%s/restore", positional[0], positional[1])
+	data, err := makeRequest(apiURL, "POST", path, body)
+	if err != nil {
+		return err
+	}
+
+	restoreID, _ := data["restore_id"].(string)
+	if message, ok := data["message"].(string); ok {
+		fmt.Println(message)
+	}
+	return waitForRestore(apiURL, restoreID)
+}
+
+// waitForRestore polls a restore until it finishes, printing each step and
+// the progress of the one running whenever it moved.
+func waitForRestore(apiURL, restoreID string) error {
+	printed := 0
+	lastProgress := ""
+	for {
+		report, err := makeRequest(apiURL, "GET", "/restores/"+restoreID, nil)
+		if err != nil {
+			return err
+		}
+
+		steps, _ := report["steps"].([]interface{})
+		for ; printed < len(steps); printed++ {
+			step, _ := steps[printed].(map[string]interface{})
+			if step["status"] == "running" {
+				break
+			}
+			fmt.Printf("  %-16s %s (%.0f ms)\n", step["name"], step["status"], step["duration_ms"])
+			if output, _ := step["output"].(string); output != "" {
+				for _, line := range strings.Split(output, "\n") {
+					fmt.Printf("      %s\n", line)
+				}
+			}
+		}
+
+		switch report["status"] {
+		case "running":
+			if progress, ok := report["progress"].(map[string]interface{}); ok {
+				if line := formatRestoreProgress(progress); line != lastProgress {
+					fmt.Println(line)
+					lastProgress = line
+				}
+			}
+			time.Sleep(2 * time.Second)
+		case "success":
+			fmt.Printf("Restore %s completed\n", restoreID)
+			return nil
+		default:
+			return fmt.Errorf("restore %s failed: %v", restoreID, report["error"])
+		}
+	}
+}
+
+// formatRestoreProgress describes a restore's progress in one line, e.g.
+// "  data 42.5% (1200 of 2824 MB, 1520000 rows, about 3m20s left)".
+func formatRestoreProgress(progress map[string]interface{}) string {
+	step, _ := progress["step"].(string)
+	applied, _ := progress["bytes_applied"].(float64)
+	total, _ := progress["bytes_total"].(float64)
+	rows, _ := progress["rows_applied"].(float64)
+	if total == 0 {
+		return fmt.Sprintf("  %-16s %.0f MB, %.0f rows", step, applied/1e6, rows)
+	}
+	percent, _ := progress["percent"].(float64)
+	line := fmt.Sprintf("  %-16s %.1f%% (%.0f of %.0f MB, %.0f rows", step, percent, applied/1e6, total/1e6, rows)
+	if remaining, ok := progress["estimated_remaining_ms"].(float64); ok {
+		line += fmt.Sprintf(", about %s left", (time.Duration(remaining) * time.Millisecond).Round(time.Second))
+	}
+	return line + ")"
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestStrongestToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     map[string]string
+		namespaces map[string]string
+		want       string
+	}{
+		{name: "none", want: ""},
+		{name: "most privileged", tokens: map[string]string{"r": "read", "o": "operator", "a": "admin"}, want: "a"},
+		{name: "ties by token", tokens: map[string]string{"b": "admin", "a": "admin"}, want: "a"},
+		{
+			name:       "namespace admin skipped",
+			tokens:     map[string]string{"o": "operator", "team": "admin"},
+			namespaces: map[string]string{"team": "payments"},
+			want:       "o",
+		},
+		{
+			name:       "only namespace tokens",
+			tokens:     map[string]string{"team": "admin"},
+			namespaces: map[string]string{"team": "payments"},
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strongestToken(tt.tokens, tt.namespaces); got != tt.want {
+				t.Fatalf("strongestToken = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+// handleVerify checks successful backups on disk without going through the
+// API: archive checksums always, and with --signatures the manifest
+// signatures and the chain linking each backup to its predecessor.
+func handleVerify(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	signatures := fs.Bool("signatures", false, "Verify manifest signatures and the signature chain")
+	publicKey := fs.String("public-key", "", "PEM Ed25519 public key (defaults to the public half of SIGNING_KEY_FILE)")
+	dir := fs.String("dir", cfg.LocalBackupDir, "Backup directory")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: verify [project] [--signatures] [--public-key <file>] [--dir <path>]")
+	}
+
+	var key ed25519.PublicKey
+	if *signatures {
+		keyFile := *publicKey
+		if keyFile == "" {
+			keyFile = cfg.SigningKeyFile
+		}
+		if keyFile == "" {
+			return fmt.Errorf("--signatures needs --public-key or SIGNING_KEY_FILE")
+		}
+		if key, err = backup.LoadPublicKey(keyFile); err != nil {
+			return err
+		}
+		fmt.Printf("Verifying signatures with key %s\n", backup.KeyID(key))
+	}
+
+	projects := positional
+	if len(projects) == 0 {
+		if projects, err = catalog.Projects(*dir); err != nil {
+			return err
+		}
+	}
+
+	checked, failed := 0, 0
+	for _, project := range projects {
+		entries, err := catalog.List(*dir, project)
+		if err != nil {
+			return err
+		}
+		chain := newSignatureChain(key, entries)
+		for _, entry := range entries {
+			if entry.Status != "success" {
+				continue
+			}
+			checked++
+			notes, err := verifyBackup(entry, chain)
+			status := "OK"
+			if err != nil {
+				status = "FAIL"
+				notes = append(notes, err.Error())
+				failed++
+			}
+			line := fmt.Sprintf("%-6s %s %s", status, project, entry.RunID)
+			if len(notes) > 0 {
+				line += ": " + strings.Join(notes, "; ")
+			}
+			fmt.Println(line)
+		}
+	}
+
+	fmt.Printf("%d backups checked, %d failed\n", checked, failed)
+	if failed > 0 {
+		return fmt.Errorf("verification failed for %d backups", failed)
+	}
+	return nil
+}
+
+// signatureChain follows the signature links of a project's backups while
+// they are verified from oldest to newest. key is nil without --signatures.
+type signatureChain struct {
+	key ed25519.PublicKey
+	// onDisk are the run IDs of the project's backups in the catalog
+	onDisk map[string]bool
+	// signatures of the backups verified so far, by run ID; signed is set
+	// once one of them was signed
+	signatures map[string]*backup.Signature
+	signed     bool
+}
+
+func newSignatureChain(key ed25519.PublicKey, entries []*catalog.Entry) *signatureChain {
+	chain := &signatureChain{key: key, onDisk: make(map[string]bool), signatures: make(map[string]*backup.Signature)}
+	for _, entry := range entries {
+		chain.onDisk[entry.RunID] = true
+	}
+	return chain
+}
+
+// link checks the link of sig, the signature of runID, to its predecessor
+// and records it. Retention deletes backups in the middle of a chain (pins
+// and incremental chains keep older ones), so a predecessor that is gone is
+// a note; only one that is there with another signature breaks the chain.
+func (c *signatureChain) link(runID string, sig *backup.Signature) (string, error) {
+	defer func() {
+		c.signatures[runID] = sig
+		c.signed = true
+	}()
+	switch previous, ok := c.signatures[sig.PreviousRunID]; {
+	case sig.PreviousRunID == "" && c.signed:
+		return "", fmt.Errorf("signature chain broken: not linked to the earlier signed backups")
+	case sig.PreviousRunID == "":
+		return "", nil
+	case ok && (previous == nil || sig.Previous != previous.Value):
+		return "", fmt.Errorf("signature chain broken: %s doesn't have the signature linked to", sig.PreviousRunID)
+	case ok:
+		return "", nil
+	case c.onDisk[sig.PreviousRunID]:
+		return "", fmt.Errorf("signature chain broken: linked to %s, which isn't an earlier successful backup", sig.PreviousRunID)
+	default:
+		return fmt.Sprintf("links to %s, no longer on disk", sig.PreviousRunID), nil
+	}
+}
+
+// verifyBackup checks one backup and returns notes that don't fail it.
+func verifyBackup(entry *catalog.Entry, chain *signatureChain) ([]string, error) {
+	var notes []string
+	data, err := os.ReadFile(entry.ManifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest backup.BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if chain.key != nil {
+		sig, err := backup.VerifyManifest(data, chain.key)
+		switch {
+		case errors.Is(err, backup.ErrUnsigned) && manifest.Imported != nil:
+			// Imported backups were never signed and stay outside the chain
+			notes = append(notes, "imported, unsigned")
+		case errors.Is(err, backup.ErrUnsigned):
+			// Backups taken before signing was enabled precede the chain
+			if chain.signed {
+				return nil, fmt.Errorf("manifest is not signed, but an earlier backup is")
+			}
+			chain.signatures[entry.RunID] = nil
+			notes = append(notes, "unsigned")
+		case err != nil:
+			// Keep following the chain so only the tampered backup is reported
+			if sig != nil {
+				chain.link(entry.RunID, sig)
+			}
+			return nil, err
+		default:
+			note, err := chain.link(entry.RunID, sig)
+			if err != nil {
+				return nil, err
+			}
+			if note != "" {
+				notes = append(notes, note)
+			}
+		}
+	}
+
+	// Parts first, so a damaged part is named; the archive is then checked
+	// reassembled
+	for _, part := range manifest.Parts {
+		sum, err := backup.FileSHA256(filepath.Join(entry.Dir, part.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", part.Name, err)
+		}
+		if sum != part.SHA256 {
+			return nil, fmt.Errorf("%s checksum mismatch", part.Name)
+		}
+	}
+	if len(manifest.Parts) > 0 {
+		notes = append(notes, fmt.Sprintf("split into %d parts", len(manifest.Parts)))
+	}
+
+	for _, file := range manifest.Files {
+		if file.SHA256 == "" {
+			notes = append(notes, fmt.Sprintf("no checksum recorded for %s", file.Name))
+			continue
+		}
+		sum, err := backup.ArchiveSHA256(filepath.Join(entry.Dir, file.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", file.Name, err)
+		}
+		if sum != file.SHA256 {
+			return nil, fmt.Errorf("%s checksum mismatch", file.Name)
+		}
+	}
+	return notes, nil
+}
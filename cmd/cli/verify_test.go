@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/retention"
+)
+
+// writeSignedBackup stores a signed backup of project app taken on date,
+// chained to previous like BackupRunner.signManifest does.
+func writeSignedBackup(t *testing.T, dir, date string, key ed25519.PrivateKey, previous *backup.BackupManifest) *backup.BackupManifest {
+	t.Helper()
+	runID := "app-" + date + "-003000"
+	backupDir := filepath.Join(dir, "app", date)
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := "backup-" + runID + ".tar.gz"
+	if err := os.WriteFile(filepath.Join(backupDir, archive), []byte("archive of "+runID), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := backup.ArchiveSHA256(filepath.Join(backupDir, archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &backup.BackupManifest{
+		RunID:      runID,
+		DatabaseID: "app",
+		StartedAt:  date + "T00:30:00Z",
+		FinishedAt: date + "T00:31:00Z",
+		Status:     "success",
+		Files:      []backup.File{{Name: archive, Size: int64(len("archive of " + runID)), SHA256: sum}},
+	}
+	var previousRunID string
+	var previousSig *backup.Signature
+	if previous != nil {
+		previousRunID, previousSig = previous.RunID, previous.Signature
+	}
+	if err := backup.SignManifest(manifest, key, previousRunID, previousSig); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup.SaveManifest(filepath.Join(backupDir, "manifest-"+runID+".json"), manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// writePublicKey writes the public half of key as PEM and returns its path.
+func writePublicKey(t *testing.T, dir string, key ed25519.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "signing.pub.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newSigningKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifySignaturesAfterPruningBetweenPinnedBackups(t *testing.T) {
+	dir := t.TempDir()
+	key := newSigningKey(t)
+	publicKey := writePublicKey(t, t.TempDir(), key)
+
+	a := writeSignedBackup(t, dir, "2026-01-01", key, nil)
+	b := writeSignedBackup(t, dir, "2026-01-02", key, a)
+	writeSignedBackup(t, dir, "2026-01-03", key, b)
+
+	entries, err := catalog.List(dir, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.SetPin(entries[0], &catalog.Pin{PinnedAt: "2026-01-01T12:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A is pinned and C is the newest restorable backup, so only B goes
+	pruned, _, err := retention.PruneToSize(dir, []string{"app"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].RunID != b.RunID {
+		t.Fatalf("pruned %+v, want only %s", pruned, b.RunID)
+	}
+
+	cfg := &config.Config{LocalBackupDir: dir}
+	if err := handleVerify(cfg, []string{"--signatures", "--public-key", publicKey}); err != nil {
+		t.Fatalf("verify after pruning: %v", err)
+	}
+}
+
+func TestVerifySignaturesDetectsReplacedPredecessor(t *testing.T) {
+	dir := t.TempDir()
+	key := newSigningKey(t)
+	publicKey := writePublicKey(t, t.TempDir(), key)
+
+	a := writeSignedBackup(t, dir, "2026-01-01", key, nil)
+	b := writeSignedBackup(t, dir, "2026-01-02", key, a)
+	writeSignedBackup(t, dir, "2026-01-03", key, b)
+
+	// Re-signing B gives it a valid signature, but not the one C links to
+	writeSignedBackup(t, dir, "2026-01-02", key, nil)
+
+	cfg := &config.Config{LocalBackupDir: dir}
+	err := handleVerify(cfg, []string{"--signatures", "--public-key", publicKey})
+	if err == nil || !strings.Contains(err.Error(), "verification failed for 2 backups") {
+		t.Fatalf("verify = %v, want B and C to fail", err)
+	}
+}
+
+func TestSignatureChainLink(t *testing.T) {
+	entries := []*catalog.Entry{{RunID: "a"}, {RunID: "c"}}
+	tests := []struct {
+		name     string
+		previous map[string]*backup.Signature
+		sig      *backup.Signature
+		wantNote string
+		wantErr  string
+	}{
+		{name: "first", sig: &backup.Signature{}},
+		{name: "linked", previous: map[string]*backup.Signature{"a": {Value: "A"}}, sig: &backup.Signature{PreviousRunID: "a", Previous: "A"}},
+		{name: "gap", previous: map[string]*backup.Signature{"a": {Value: "A"}}, sig: &backup.Signature{PreviousRunID: "b", Previous: "B"}, wantNote: "links to b, no longer on disk"},
+		{name: "mismatch", previous: map[string]*backup.Signature{"a": {Value: "A"}}, sig: &backup.Signature{PreviousRunID: "a", Previous: "X"}, wantErr: "a doesn't have the signature"},
+		{name: "linked to unsigned", previous: map[string]*backup.Signature{"a": nil}, sig: &backup.Signature{PreviousRunID: "a", Previous: "A"}, wantErr: "a doesn't have the signature"},
+		{name: "unlinked after signed", previous: map[string]*backup.Signature{"a": {Value: "A"}}, sig: &backup.Signature{}, wantErr: "not linked"},
+		{name: "linked to later", previous: map[string]*backup.Signature{"a": {Value: "A"}}, sig: &backup.Signature{PreviousRunID: "c", Previous: "C"}, wantErr: "isn't an earlier successful backup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newSignatureChain(nil, entries)
+			for runID, sig := range tt.previous {
+				chain.signatures[runID] = sig
+				chain.signed = chain.signed || sig != nil
+			}
+			note, err := chain.link("new", tt.sig)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if note != tt.wantNote {
+				t.Fatalf("note = %q, want %q", note, tt.wantNote)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// watchRecentJobs is how many completed jobs the watch view lists.
+const watchRecentJobs = 5
+
+// watchStatus redraws running backups, the queue, recent results and every
+// project's last success until interrupted. On a terminal the screen is
+// cleared for every frame; otherwise a frame is only printed when it differs
+// from the last one, so the output can be piped into a log.
+func watchStatus(apiURL string, interval time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	info, err := os.Stdout.Stat()
+	terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+
+	// The first poll fails the command (wrong URL or token); later failures
+	// are shown and retried, e.g. while the service restarts
+	good, err := renderWatch(apiURL)
+	if err != nil {
+		return err
+	}
+	frame, last := good, ""
+	for {
+		header := fmt.Sprintf("Every %s: %s    %s\n", interval, apiURL, time.Now().Format("2006-01-02 15:04:05"))
+		switch {
+		case terminal:
+			fmt.Print("\033[H\033[2J" + header + "\n" + frame)
+		case frame != last:
+			fmt.Print(header + "\n" + frame + "\n")
+		}
+		last = frame
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+		if next, err := renderWatch(apiURL); err != nil {
+			// Keep the last data on screen under the error
+			frame = fmt.Sprintf("Error: %v (retrying)\n\n", err) + good
+		} else {
+			good, frame = next, next
+		}
+	}
+}
+
+// renderWatch polls the service once and renders a frame of the watch view.
+func renderWatch(apiURL string) (string, error) {
+	current, err := makeRequest(apiURL, "GET", "/runs/current", nil)
+	if err != nil {
+		return "", err
+	}
+	queue, err := makeRequest(apiURL, "GET", "/queue", nil)
+	if err != nil {
+		return "", err
+	}
+	status, err := makeRequest(apiURL, "GET", "/status?next=1", nil)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	if paused, _ := status["scheduler_paused"].(bool); paused {
+		buf.WriteString("Scheduler paused\n\n")
+	}
+
+	buf.WriteString("RUNNING\n")
+	backups, _ := current["backups"].([]interface{})
+	if len(backups) == 0 {
+		buf.WriteString("  (none)\n")
+	} else {
+		tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  PROJECT\tPHASE\tWRITTEN\tELAPSED\tIN PHASE")
+		for _, b := range backups {
+			backup, _ := b.(map[string]interface{})
+			written, _ := backup["bytes_written"].(float64)
+			fmt.Fprintf(tw, "  %s\t%s\t%.1f MB\t%s\t%s\n", backup["project"], backup["phase"], written/1e6,
+				since(backup["started_at"], now), since(backup["phase_started_at"], now))
+		}
+		tw.Flush()
+	}
+
+	var active, completed []map[string]interface{}
+	jobs, _ := queue["jobs"].([]interface{})
+	for _, j := range jobs {
+		job, _ := j.(map[string]interface{})
+		if job["state"] == "completed" {
+			completed = append(completed, job)
+		} else {
+			active = append(active, job)
+		}
+	}
+
+	buf.WriteString("\nQUEUE\n")
+	if len(active) == 0 {
+		buf.WriteString("  (empty)\n")
+	} else {
+		tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  JOB\tTRIGGER\tSTATE\tSTART\tPROJECTS")
+		for _, job := range active {
+			start := clock(job["started_at"])
+			if job["state"] != "running" {
+				if start = clock(job["estimated_start"]); start != "-" {
+					start = "~" + start
+				}
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", job["id"], jobTrigger(job), job["state"], start, jobProjects(job))
+		}
+		tw.Flush()
+	}
+
+	buf.WriteString("\nRECENT\n")
+	if len(completed) == 0 {
+		buf.WriteString("  (none)\n")
+	} else {
+		tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  JOB\tTRIGGER\tSTATUS\tFINISHED\tPROJECTS\tERROR")
+		for i, job := range completed {
+			if i == watchRecentJobs {
+				break
+			}
+			errMsg, _ := job["error"].(string)
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\n", job["id"], jobTrigger(job), job["status"], clock(job["finished_at"]), jobProjects(job), firstLine(errMsg))
+		}
+		tw.Flush()
+	}
+
+	buf.WriteString("\nPROJECTS\n")
+	projects, _ := status["projects"].(map[string]interface{})
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  PROJECT\tLAST SUCCESS\tRPO\tNEXT RUN")
+	for _, name := range names {
+		project, _ := projects[name].(map[string]interface{})
+		lastSuccess := "never"
+		if project["last_success_at"] != nil {
+			lastSuccess = clock(project["last_success_at"])
+		}
+		rpo := "-"
+		if r, ok := project["rpo"].(map[string]interface{}); ok {
+			target, _ := r["target_seconds"].(float64)
+			rpo = "breached"
+			if compliant, _ := r["compliant"].(bool); compliant {
+				rpo = "ok"
+			}
+			rpo += fmt.Sprintf(" (%s)", time.Duration(target)*time.Second)
+		}
+		next := "-"
+		if runs, _ := project["next_runs"].([]interface{}); len(runs) > 0 {
+			next = clock(runs[0])
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", name, lastSuccess, rpo, next)
+	}
+	tw.Flush()
+	return buf.String(), nil
+}
+
+// since formats how long ago an RFC 3339 timestamp was, "-" if unset.
+func since(value interface{}, now time.Time) string {
+	s, _ := value.(string)
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "-"
+	}
+	return now.Sub(t).Round(time.Second).String()
+}
+
+// clock formats an RFC 3339 timestamp as a time of day, with the date if it
+// isn't today.
+func clock(value interface{}) string {
+	s, _ := value.(string)
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "-"
+	}
+	t = t.Local()
+	if t.Format(time.DateOnly) != time.Now().Format(time.DateOnly) {
+		return t.Format("01-02 15:04:05")
+	}
+	return t.Format(time.TimeOnly)
+}
+
+func jobTrigger(job map[string]interface{}) string {
+	if group, _ := job["group"].(string); group != "" {
+		return fmt.Sprintf("%s (%s)", job["trigger"], group)
+	}
+	trigger, _ := job["trigger"].(string)
+	return trigger
+}
+
+// jobProjects lists a job's projects with the state of those that are done
+// or running.
+func jobProjects(job map[string]interface{}) string {
+	projects, _ := job["projects"].([]interface{})
+	parts := make([]string, 0, len(projects))
+	for _, p := range projects {
+		project, _ := p.(map[string]interface{})
+		name, _ := project["project"].(string)
+		if state, _ := project["state"].(string); state != "" && state != "pending" {
+			name += ":" + state
+		}
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, " ")
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -14,8 +14,8 @@ import (
 	"time"
 
 	"github.com/mxschmitt/pg-backup-scheduler/internal/api"
-	"github.com/mxschmitt/pg-backup-scheduler/internal/config"
-	"github.com/mxschmitt/pg-backup-scheduler/internal/service"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
 	"go.uber.org/zap"
 )
 
@@ -3,13 +3,26 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/mxschmitt/pg-backup-scheduler/internal/config"
-	"github.com/mxschmitt/pg-backup-scheduler/internal/service"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/restore"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/systemd"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
 	"go.uber.org/zap"
 )
 
@@ -18,37 +31,107 @@ type Server struct {
 	service    *service.Service
 	logger     *zap.Logger
 	httpServer *http.Server
+	listener   net.Listener
+	// runSlots limits backups triggered through the API that run at once
+	runSlots chan struct{}
+
+	// started is set once the service is attached (see SetService); until
+	// then only the probes answer
+	started   atomic.Bool
+	createdAt time.Time
 }
 
+// New creates the API server. svc may be nil to serve the probes while the
+// service is still starting; SetService attaches it.
 func New(cfg *config.Config, svc *service.Service, logger *zap.Logger) *Server {
 	s := &Server{
-		config:  cfg,
-		service: svc,
-		logger:  logger,
+		config:    cfg,
+		service:   svc,
+		logger:    logger,
+		createdAt: time.Now(),
+	}
+	if svc != nil {
+		s.started.Store(true)
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", s.handleHealth)
 	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/startupz", s.handleStartup)
 	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/check", s.handleCheck)
+	mux.HandleFunc("/metrics", s.handleMetrics)
 	mux.HandleFunc("/run", s.handleRun)
 	mux.HandleFunc("/run/", s.handleRunProject)
+	mux.HandleFunc("/runs/current", s.handleCurrentRun)
+	mux.HandleFunc("/runs/", s.handleRunByID)
+	mux.HandleFunc("/queue", s.handleQueue)
+	mux.HandleFunc("/schedule", s.handleSchedule)
+	mux.HandleFunc("/scheduler/pause", s.handleSchedulerPause)
+	mux.HandleFunc("/scheduler/resume", s.handleSchedulerResume)
+	mux.HandleFunc("/retention", s.handleRetention)
+	mux.HandleFunc("/retention/run", s.handleRetentionRun)
+	mux.HandleFunc("/projects/", s.handleProjects)
+	mux.HandleFunc("/backups/", s.handleBackups)
+	mux.HandleFunc("/history/export", s.handleHistoryExport)
+	mux.HandleFunc("/restores/", s.handleRestoreStatus)
+	mux.HandleFunc("/restore-points/", s.handleRestorePoints)
+	mux.HandleFunc("/rehearsals", s.handleRehearsals)
+	mux.HandleFunc("/rehearsals/run", s.handleRehearsalRun)
+	mux.HandleFunc("/rehearsals/", s.handleRehearsalStatus)
+	mux.HandleFunc("/digest", s.handleDigest)
+	mux.HandleFunc("/digest/send", s.handleDigestSend)
+	mux.HandleFunc("/debug/containers", s.handleDebugContainers)
+	mux.HandleFunc("/debug/tempdirs", s.handleDebugTempDirs)
 	mux.HandleFunc("/", s.handleRoot)
 
 	s.httpServer = &http.Server{
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Handler:        s.limitRate(s.limitBody(s.requireStarted(s.authenticate(mux)))),
+		ReadTimeout:    cfg.APIReadTimeout,
+		WriteTimeout:   cfg.APIWriteTimeout,
+		IdleTimeout:    cfg.APIIdleTimeout,
+		MaxHeaderBytes: int(cfg.APIMaxHeaderBytes),
+	}
+	if cfg.APIMaxConcurrentRuns > 0 {
+		s.runSlots = make(chan struct{}, cfg.APIMaxConcurrentRuns)
+	}
+	if len(cfg.APITokens) > 0 {
+		logger.Info("API token authentication enabled", zap.Int("tokens", len(cfg.APITokens)))
 	}
 
 	return s
 }
 
-func (s *Server) Start() error {
+// Listen opens the API socket: the one passed by systemd socket activation if
+// present, otherwise SERVICE_PORT on all interfaces. Start calls it if needed.
+func (s *Server) Listen() error {
+	listener, err := systemd.Listener()
+	if err != nil {
+		return err
+	}
+	if listener != nil {
+		s.logger.Info("API server using socket from systemd", zap.String("address", listener.Addr().String()))
+		s.listener = listener
+		return nil
+	}
+
 	addr := fmt.Sprintf("0.0.0.0:%d", s.config.ServicePort)
-	s.httpServer.Addr = addr
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
 	s.logger.Info("API server listening", zap.String("address", addr))
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	s.listener = listener
+	return nil
+}
+
+func (s *Server) Start() error {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
+	if err := s.httpServer.Serve(s.listener); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("HTTP server failed: %w", err)
 	}
 	return nil
@@ -56,41 +139,201 @@ func (s *Server) Start() error {
 
 func (s *Server) Shutdown(ctx context.Context) error {
 	if err := s.httpServer.Shutdown(ctx); err != nil {
+		// Requests still running, e.g. a followed log, are cut off
+		_ = s.httpServer.Close()
 		return fmt.Errorf("failed to shutdown HTTP server: %w", err)
 	}
 	return nil
 }
 
+// SetService attaches the service once it has started, which makes the
+// server answer every endpoint and /startupz report success.
+func (s *Server) SetService(svc *service.Service) {
+	s.service = svc
+	s.started.Store(true)
+}
+
+// isProbe reports whether r is a health probe, which is open to everyone,
+// exempt from rate limiting and answered while the service starts. Deep
+// health checks are not: they reveal projects and hosts and are expensive.
+func isProbe(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz":
+		deep, _ := strconv.ParseBool(r.URL.Query().Get("deep"))
+		return !deep
+	case "/readyz", "/startupz":
+		return true
+	}
+	return false
+}
+
+// requireStarted answers everything but the probes with 503 until the
+// service is attached.
+func (s *Server) requireStarted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.started.Load() && !isProbe(r) {
+			w.Header().Set("Retry-After", "5")
+			s.errorResponse(w, http.StatusServiceUnavailable, codeStarting, "the service is still starting")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody rejects request bodies larger than API_MAX_BODY_SIZE: up front
+// with 413 if the request declares its length, otherwise reading past the
+// limit fails.
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.config.APIMaxBodyBytes
+		if limit > 0 {
+			if r.ContentLength > limit {
+				s.errorResponse(w, http.StatusRequestEntityTooLarge, codeRequestTooLarge, fmt.Sprintf("request body exceeds %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stream lifts the server's timeouts for a response that may take longer
+// than API_WRITE_TIMEOUT to send, like a dump or a followed log. The read
+// deadline goes too: once it passes, the server would cancel the request's
+// context.
+func (s *Server) stream(w http.ResponseWriter) *http.ResponseController {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		s.logger.Warn("Failed to lift write deadline for streaming response", zap.Error(err))
+	}
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		s.logger.Warn("Failed to lift read deadline for streaming response", zap.Error(err))
+	}
+	return rc
+}
+
 // Handler returns the HTTP handler for testing purposes
 func (s *Server) Handler() http.Handler {
 	return s.httpServer.Handler
 }
 
+// handleHealth is the liveness probe. With ?deep=true it checks every
+// dependency instead (&databases=true adds the source databases) and
+// answers 503 if one fails.
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	s.jsonResponse(w, map[string]interface{}{
+	query := r.URL.Query()
+	deep, databases := false, false
+	for name, value := range map[string]*bool{"deep": &deep, "databases": &databases} {
+		if query.Get(name) == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(query.Get(name))
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, name+" must be true or false")
+			return
+		}
+		*value = parsed
+	}
+	if !deep {
+		s.jsonResponse(w, map[string]interface{}{
+			"status":    "healthy",
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+
+	checks := s.service.DeepHealth(r.Context(), databases)
+	data := map[string]interface{}{
 		"status":    "healthy",
+		"checks":    checks,
 		"timestamp": time.Now().Format(time.RFC3339),
-	})
+	}
+	for _, check := range checks {
+		if !check.OK {
+			data["status"] = "unhealthy"
+			s.jsonStatusResponse(w, http.StatusServiceUnavailable, data)
+			return
+		}
+	}
+	s.jsonResponse(w, data)
+}
+
+// handleStartup is the startup probe: 503 while the service starts (Docker
+// check, leftover cleanup, import scan), 200 from then on.
+func (s *Server) handleStartup(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"status":    "started",
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+	if !s.started.Load() {
+		data["status"] = "starting"
+		data["starting_for_s"] = int64(time.Since(s.createdAt).Seconds())
+		s.jsonStatusResponse(w, http.StatusServiceUnavailable, data)
+		return
+	}
+	s.jsonResponse(w, data)
 }
 
+// handleReady is the readiness probe: 503 while the service starts or if a
+// dependency of backups (Docker, the backup directory) fails its check.
 func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.started.Load() {
+		s.jsonStatusResponse(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":    "starting",
+			"timestamp": time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+
 	running, err := s.service.GetRunning()
 	if err != nil {
-		s.errorResponse(w, "Failed to get running status", http.StatusInternalServerError)
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to get running status")
 		return
 	}
 
-	s.jsonResponse(w, map[string]interface{}{
+	checks := s.service.Readiness(r.Context())
+	data := map[string]interface{}{
 		"status":    "ready",
 		"running":   running,
+		"checks":    checks,
 		"timestamp": time.Now().Format(time.RFC3339),
-	})
+	}
+	for _, check := range checks {
+		if !check.OK {
+			data["status"] = "not_ready"
+			s.jsonStatusResponse(w, http.StatusServiceUnavailable, data)
+			return
+		}
+	}
+	s.jsonResponse(w, data)
 }
 
+// handleStatus reports the scheduler and every project's backups.
+// ?namespace= limits it to a namespace's projects, which is all tokens scoped
+// to a namespace get.
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	namespace := strings.ToLower(r.URL.Query().Get("namespace"))
+	if scoped := tokenNamespace(r); scoped != "" {
+		if namespace != "" && namespace != scoped {
+			s.errorResponse(w, http.StatusForbidden, codeForbidden, "this request is outside the token's namespace "+scoped)
+			return
+		}
+		namespace = scoped
+	}
+	namespaces := make(map[string]interface{})
+	for _, info := range s.service.Namespaces() {
+		if namespace == "" || info.Name == namespace {
+			namespaces[info.Name] = info
+		}
+	}
+	if namespace != "" && len(namespaces) == 0 {
+		s.errorResponse(w, http.StatusNotFound, codeNamespaceNotFound, fmt.Sprintf("Namespace not found: %s", namespace))
+		return
+	}
+
 	running, err := s.service.GetRunning()
 	if err != nil {
-		s.errorResponse(w, "Failed to get running status", http.StatusInternalServerError)
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to get running status")
 		return
 	}
 
@@ -99,18 +342,110 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		s.logger.Warn("Failed to get last run", zap.Error(err))
 	}
 
-	databases := s.service.GetDatabases()
+	nextCount := 3
+	if value := r.URL.Query().Get("next"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, "next must be between 1 and 100")
+			return
+		}
+		nextCount = n
+	}
+
+	var databases []*database.Database
+	for _, db := range s.service.GetDatabases() {
+		if namespace == "" || s.config.ProjectNamespace(db.Identifier) == namespace {
+			databases = append(databases, db)
+		}
+	}
 	dbNames := make([]string, len(databases))
+	projects := make(map[string]interface{}, len(databases))
 	for i, db := range databases {
 		dbNames[i] = db.Identifier
+
+		project := map[string]interface{}{
+			"next_runs":                  formatTimes(s.service.NextRunsForProject(db.Identifier, nextCount)),
+			"last_success_at":            nil,
+			"seconds_since_last_success": nil,
+		}
+		if group := s.config.ProjectGroup(db.Identifier); group != "" {
+			project["group"] = group
+		}
+		if projectNamespace := s.config.ProjectNamespace(db.Identifier); projectNamespace != "" {
+			project["namespace"] = projectNamespace
+		}
+		if quota, err := s.service.ProjectQuota(db.Identifier); err != nil {
+			s.logger.Warn("Failed to get quota usage", zap.String("project", db.Identifier), zap.Error(err))
+		} else if quota != nil {
+			project["quota"] = quota
+		}
+		if rpo, err := s.service.ProjectRPO(db.Identifier); err != nil {
+			s.logger.Warn("Failed to get RPO status", zap.String("project", db.Identifier), zap.Error(err))
+		} else if rpo != nil {
+			project["rpo"] = rpo
+		}
+		lastSuccess, err := s.service.LastSuccessfulBackup(db.Identifier)
+		if err != nil {
+			s.logger.Warn("Failed to find last successful backup", zap.String("project", db.Identifier), zap.Error(err))
+		} else if lastSuccess != nil {
+			project["last_success_at"] = lastSuccess.FinishedAt
+			if finished := lastSuccess.FinishedTime(); !finished.IsZero() {
+				project["seconds_since_last_success"] = int64(time.Since(finished).Seconds())
+			}
+		}
+		projects[db.Identifier] = project
+	}
+
+	groups := make(map[string]interface{})
+	for _, group := range s.service.Groups() {
+		if namespace != "" {
+			group.Projects = slices.DeleteFunc(group.Projects, func(project string) bool {
+				return s.config.ProjectNamespace(project) != namespace
+			})
+			if len(group.Projects) == 0 {
+				continue
+			}
+		}
+		groups[group.Name] = map[string]interface{}{
+			"projects":       group.Projects,
+			"cron":           group.Cron,
+			"retention_days": group.RetentionDays,
+			"next_runs":      formatTimes(s.service.NextRunsForGroup(group.Name, nextCount)),
+		}
+	}
+
+	schedulerState, err := s.service.GetSchedulerState()
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to get scheduler state")
+		return
 	}
 
 	statusData := map[string]interface{}{
+		"scheduler_paused":     schedulerState.Paused,
 		"databases_configured": len(databases),
 		"database_names":       dbNames,
 		"currently_running":    running,
 		"scheduler_cron":       s.config.BackupCron,
+		"retention_cron":       s.config.RetentionCron,
 		"timezone":             s.config.TZ,
+		"next_runs":            formatTimes(s.service.NextRuns(nextCount)),
+		"projects":             projects,
+		"groups":               groups,
+		"namespaces":           namespaces,
+	}
+	if namespace != "" {
+		statusData["namespace"] = namespace
+		statusData["currently_running"] = s.namespaceRunning(databases)
+		if lastRun != nil {
+			lastRun = namespaceRun(lastRun, databases)
+		}
+	}
+
+	if s.config.InstanceName != "" {
+		statusData["instance"] = s.config.InstanceName
+	}
+	if schedulerState.Paused {
+		statusData["scheduler_paused_at"] = schedulerState.PausedAt
 	}
 
 	if lastRun == nil {
@@ -124,29 +459,118 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	s.jsonResponse(w, statusData)
 }
 
-func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		s.errorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+// namespaceRunning reports whether a backup of one of databases is in
+// progress. The job flag would tell a namespace's token about backups of
+// other namespaces.
+func (s *Server) namespaceRunning(databases []*database.Database) bool {
+	status, err := s.service.GetRunStatus()
+	if err != nil {
+		s.logger.Warn("Failed to get running status", zap.Error(err))
+		return false
+	}
+	for _, backup := range status.Backups {
+		if slices.ContainsFunc(databases, func(db *database.Database) bool { return db.Identifier == backup.Project }) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceRun is the part of a backup job's result about databases: its
+// times and their backup results. Counts, failures and retention results
+// cover every project of the job and are left out.
+func namespaceRun(run map[string]interface{}, databases []*database.Database) map[string]interface{} {
+	filtered := make(map[string]interface{})
+	for _, key := range []string{"run_id", "started_at", "finished_at", "duration_ms", "group"} {
+		if value, ok := run[key]; ok {
+			filtered[key] = value
+		}
+	}
+	backups := []interface{}{}
+	results, _ := run["backups"].([]interface{})
+	for _, result := range results {
+		fields, _ := result.(map[string]interface{})
+		project, _ := fields["database_identifier"].(string)
+		if slices.ContainsFunc(databases, func(db *database.Database) bool { return db.Identifier == project }) {
+			backups = append(backups, result)
+		}
+	}
+	filtered["backups"] = backups
+	return filtered
+}
+
+// handleSchedule previews the scheduled backup job for the next days (7 by
+// default, at most 90): a backup and a retention event per project and run.
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	running, err := s.service.GetRunning()
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 90 {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, "days must be between 1 and 90")
+			return
+		}
+		days = n
+	}
+
+	schedulerState, err := s.service.GetSchedulerState()
 	if err != nil {
-		s.errorResponse(w, "Failed to get running status", http.StatusInternalServerError)
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to get scheduler state")
 		return
 	}
 
-	if running {
-		w.WriteHeader(http.StatusConflict)
-		s.jsonResponse(w, map[string]interface{}{
-			"detail": "Backup job is already running",
-		})
+	now := time.Now()
+	until := now.AddDate(0, 0, days)
+	events, truncated := s.service.PlannedSchedule(until)
+	events = slices.DeleteFunc(events, func(event service.PlannedEvent) bool {
+		return !s.inScope(r, event.Project)
+	})
+
+	s.jsonResponse(w, map[string]interface{}{
+		"from":             now.Format(time.RFC3339),
+		"until":            until.Format(time.RFC3339),
+		"days":             days,
+		"scheduler_cron":   s.config.BackupCron,
+		"timezone":         s.config.TZ,
+		"schedule_jitter":  s.config.ScheduleJitter.String(),
+		"blackout_windows": s.config.BlackoutWindows,
+		"retention_days":   s.config.RetentionDays,
+		"retention_cron":   s.config.RetentionCron,
+		"scheduler_paused": schedulerState.Paused,
+		"events":           events,
+		"truncated":        truncated,
+	})
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	tags, ok := s.decodeTags(w, r)
+	if !ok {
+		return
+	}
+	release, ok := s.acquireRunSlot()
+	if !ok {
+		s.errorResponse(w, http.StatusConflict, codeAlreadyRunning, "too many backups triggered through the API are still running")
+		return
+	}
+	if err := s.service.CheckRunnable(r.Context(), ""); err != nil {
+		release()
+		s.serviceError(w, err)
 		return
 	}
 
 	// Run backup in background
 	go func() {
-		ctx := context.Background()
+		defer release()
+		ctx := service.WithTrigger(backup.WithTags(context.Background(), tags), service.TriggerAPI)
 		if _, err := s.service.RunBackupJob(ctx); err != nil {
 			s.logger.Error("Background backup job failed", zap.Error(err))
 		}
@@ -161,20 +585,40 @@ func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleRunProject(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		s.errorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	// Extract project ID from path: /run/{project}
 	projectID := strings.TrimPrefix(r.URL.Path, "/run/")
+	if group, ok := strings.CutPrefix(projectID, "group/"); ok {
+		s.handleRunGroup(w, r, group)
+		return
+	}
 	if projectID == "" {
-		s.errorResponse(w, "Project ID is required", http.StatusBadRequest)
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, "Project ID is required")
+		return
+	}
+
+	tags, ok := s.decodeTags(w, r)
+	if !ok {
+		return
+	}
+	release, ok := s.acquireRunSlot()
+	if !ok {
+		s.errorResponse(w, http.StatusConflict, codeAlreadyRunning, "too many backups triggered through the API are still running")
+		return
+	}
+	if err := s.service.CheckRunnable(r.Context(), projectID); err != nil {
+		release()
+		s.serviceError(w, err)
 		return
 	}
 
 	// Run backup in background
 	go func() {
-		ctx := context.Background()
+		defer release()
+		ctx := service.WithTrigger(backup.WithTags(context.Background(), tags), service.TriggerAPI)
 		result, err := s.service.RunBackupForProject(ctx, projectID)
 		if err != nil {
 			s.logger.Error("Project backup failed", zap.String("project", projectID), zap.Error(err))
@@ -196,31 +640,897 @@ func (s *Server) handleRunProject(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+// handleRunGroup starts a backup job for the projects of a group:
+// /run/group/{name}.
+func (s *Server) handleRunGroup(w http.ResponseWriter, r *http.Request, group string) {
+	group = strings.ToLower(strings.Trim(group, "/"))
+	if group == "" {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, "Group name is required")
+		return
+	}
+
+	tags, ok := s.decodeTags(w, r)
+	if !ok {
+		return
+	}
+	release, ok := s.acquireRunSlot()
+	if !ok {
+		s.errorResponse(w, http.StatusConflict, codeAlreadyRunning, "too many backups triggered through the API are still running")
+		return
+	}
+	if err := s.service.CheckGroupRunnable(r.Context(), group); err != nil {
+		release()
+		s.serviceError(w, err)
+		return
+	}
+
+	// Run backup in background
+	go func() {
+		defer release()
+		ctx := service.WithTrigger(backup.WithTags(context.Background(), tags), service.TriggerAPI)
+		if _, err := s.service.RunBackupGroup(ctx, group); err != nil {
+			s.logger.Error("Group backup job failed", zap.String("group", group), zap.Error(err))
+		}
+	}()
+
 	s.jsonResponse(w, map[string]interface{}{
-		"service": "PostgreSQL Backup Service",
-		"version": "1.0.0",
-		"endpoints": map[string]string{
-			"health":          "/healthz",
-			"readiness":       "/readyz",
-			"status":          "/status",
-			"trigger_all":     "/run (POST)",
-			"trigger_project": "/run/{project} (POST)",
-		},
+		"status":    "accepted",
+		"message":   fmt.Sprintf("Backup job started for group: %s", group),
+		"timestamp": time.Now().Format(time.RFC3339),
 	})
 }
 
-func (s *Server) jsonResponse(w http.ResponseWriter, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		s.logger.Error("Failed to encode JSON response", zap.Error(err))
+// decodeTags reads the tags of a backup trigger from the optional request
+// body {"tags": [...]}. It writes the error response and reports false for
+// invalid bodies.
+func (s *Server) decodeTags(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return nil, false
+	}
+	tags, err := backup.NormalizeTags(req.Tags)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return nil, false
 	}
+	return tags, true
 }
 
-func (s *Server) errorResponse(w http.ResponseWriter, message string, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": message,
+func (s *Server) handleCurrentRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	status, err := s.service.GetRunStatus()
+	if err != nil {
+		s.serviceError(w, fmt.Errorf("failed to get running status: %w", err))
+		return
+	}
+
+	data := map[string]interface{}{
+		"running": status.Running || status.Current != nil,
+		"current": status.Current,
+		"backups": status.Backups,
+	}
+	if status.Backups == nil {
+		data["backups"] = []metadata.RunProgress{}
+	}
+	if status.Current != nil {
+		if updated, err := time.Parse(time.RFC3339, status.Current.UpdatedAt); err == nil {
+			data["seconds_since_progress"] = int64(time.Since(updated).Seconds())
+		}
+	}
+	s.jsonResponse(w, data)
+}
+
+// handleRunByID returns the backup with a run ID, without knowing its
+// project: its status, stats and phase timings.
+func (s *Server) handleRunByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	runID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	entry, err := s.service.FindRun(runID)
+	if errors.Is(err, service.ErrBackupNotFound) || err == nil && !s.inScope(r, entry.Project) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Run not found: %s", runID))
+		return
+	}
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, entry)
+}
+
+// handleQueue lists pending, running and recently completed backup jobs.
+func (s *Server) handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	jobs := s.service.Queue()
+	counts := map[string]int{service.JobPending: 0, service.JobRunning: 0, service.JobCompleted: 0}
+	for _, job := range jobs {
+		counts[job.State]++
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"pending":   counts[service.JobPending],
+		"running":   counts[service.JobRunning],
+		"completed": counts[service.JobCompleted],
+		"jobs":      jobs,
+	})
+}
+
+func (s *Server) handleDebugContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	containers, err := s.service.HelperContainers(r.Context())
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"count":      len(containers),
+		"containers": containers,
+	})
+}
+
+// handleDebugTempDirs lists the temp area of the backup directory: the
+// directories of running backups and leftovers of crashed ones.
+func (s *Server) handleDebugTempDirs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	dirs, err := s.service.TempDirs()
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to list temp directories")
+		return
+	}
+	var totalBytes, orphanedBytes int64
+	for _, dir := range dirs {
+		totalBytes += dir.SizeBytes
+		if dir.Orphaned {
+			orphanedBytes += dir.SizeBytes
+		}
+	}
+	if dirs == nil {
+		dirs = []service.TempDir{}
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"count":          len(dirs),
+		"total_bytes":    totalBytes,
+		"orphaned_bytes": orphanedBytes,
+		"max_age":        s.config.TempMaxAge.String(),
+		"tempdirs":       dirs,
+	})
+}
+
+func (s *Server) handleSchedulerPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	state, err := s.service.PauseScheduler()
+	if err != nil {
+		s.logger.Error("Failed to pause scheduler", zap.Error(err))
+		s.serviceError(w, fmt.Errorf("failed to pause scheduler: %w", err))
+		return
+	}
+
+	s.jsonResponse(w, map[string]interface{}{
+		"status":    "paused",
+		"message":   "Scheduled backups paused; manual triggers still run",
+		"paused_at": state.PausedAt,
+	})
+}
+
+func (s *Server) handleSchedulerResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if _, err := s.service.ResumeScheduler(); err != nil {
+		s.logger.Error("Failed to resume scheduler", zap.Error(err))
+		s.serviceError(w, fmt.Errorf("failed to resume scheduler: %w", err))
+		return
+	}
+
+	s.jsonResponse(w, map[string]interface{}{
+		"status":  "resumed",
+		"message": "Scheduled backups resumed",
+	})
+}
+
+// handleRetention reports the retention settings and the last retention run.
+func (s *Server) handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	report, err := s.service.GetRetentionReport()
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"retention_days":    s.config.RetentionDays,
+		"retention_cron":    s.config.RetentionCron,
+		"keep_last_success": s.config.KeepLastSuccess,
+		"last_run":          report,
+	})
+}
+
+// handleRetentionRun starts a retention run for all projects in the
+// background; its report replaces the last run at GET /retention.
+func (s *Server) handleRetentionRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	runID, err := s.service.StartRetention()
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"status":    "accepted",
+		"run_id":    runID,
+		"message":   "Retention cleanup started in background",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// handleBackups routes /backups/{project}, /backups/{project}/{run_id}/{action}
+// and /backups/{project}/{run_id}/file/{name}
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/backups/"), "/"), "/")
+	if len(parts) == 1 && parts[0] != "" {
+		s.handleListBackups(w, r, parts[0])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "restore" {
+		s.handleRestore(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "contents" {
+		s.handleContents(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "pin" {
+		s.handlePin(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "log" {
+		s.handleRunLog(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "share" {
+		s.handleShare(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 4 && parts[2] == "file" {
+		s.handleBackupFile(w, r, parts[0], parts[1], parts[3])
+		return
+	}
+	s.errorResponse(w, http.StatusNotFound, codeNotFound, "Not found")
+}
+
+// handleBackupFile streams a single file (schema.sql, roles.sql) out of a
+// backup's archive.
+func (s *Server) handleBackupFile(w http.ResponseWriter, r *http.Request, projectID, runID, name string) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	entry, file, err := s.service.OpenBackupFile(projectID, runID, name)
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// schema.sql of a large database can take a while to read out of the
+	// archive
+	s.stream(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s-%s"`, entry.RunID, name))
+	if _, err := io.Copy(w, file); err != nil {
+		s.logger.Error("Failed to write backup file", zap.String("project", projectID), zap.String("run_id", entry.RunID), zap.String("file", name), zap.Error(err))
+	}
+}
+
+// handleRunLog returns the run log of a backup (RUN_LOGS) as it was written.
+func (s *Server) handleRunLog(w http.ResponseWriter, r *http.Request, projectID, runID string) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	entry, file, err := s.service.OpenRunLog(projectID, runID)
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	if file == nil {
+		s.errorResponse(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Backup %s/%s has no run log", projectID, entry.RunID))
+		return
+	}
+	defer file.Close()
+
+	s.stream(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, catalog.RunLogName(entry.RunID)))
+	if _, err := io.Copy(w, file); err != nil {
+		s.logger.Error("Failed to write run log", zap.String("project", projectID), zap.String("run_id", entry.RunID), zap.Error(err))
+	}
+}
+
+// shareRequest is the optional body of POST /backups/{project}/{run_id}/share.
+type shareRequest struct {
+	// TTL is how long the URLs stay valid, e.g. "15m"; at most and by
+	// default SHARE_URL_TTL
+	TTL string `json:"ttl"`
+	// Target is the remote to share from, by name as in the manifest's
+	// storage list; by default the first holding a copy that can share
+	Target string `json:"target"`
+}
+
+// handleShare returns expiring download URLs for a backup's remote copy.
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request, projectID, runID string) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid ttl %q: use a positive duration like 15m", req.TTL))
+			return
+		}
+		if ttl > s.config.ShareURLTTL {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("ttl %s exceeds SHARE_URL_TTL (%s)", ttl, s.config.ShareURLTTL))
+			return
+		}
+	}
+
+	share, err := s.service.ShareBackup(r.Context(), projectID, runID, req.Target, ttl)
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, share)
+}
+
+// pinRequest is the optional body of POST /backups/{project}/{run_id}/pin.
+type pinRequest struct {
+	// Until is an RFC 3339 time or a date (YYYY-MM-DD, midnight local time);
+	// without it the pin holds until removed
+	Until  string `json:"until"`
+	Reason string `json:"reason"`
+}
+
+// handlePin pins a backup (POST) so retention keeps it, or unpins it (DELETE).
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request, projectID, runID string) {
+	var entry *catalog.Entry
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		var req pinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		var until time.Time
+		if req.Until != "" {
+			if until, err = parseTimeParam("until", req.Until); err != nil {
+				s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+				return
+			}
+		}
+		entry, err = s.service.PinBackup(projectID, runID, until, req.Reason)
+	case http.MethodDelete:
+		entry, err = s.service.UnpinBackup(projectID, runID)
+	default:
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	s.jsonResponse(w, map[string]interface{}{
+		"project": entry.Project,
+		"run_id":  entry.RunID,
+		"pinned":  entry.Pin != nil,
+		"pin":     entry.Pin,
+	})
+}
+
+// parseTimeParam parses a time given as RFC 3339 or as a local date.
+func parseTimeParam(name, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: use RFC 3339 or YYYY-MM-DD", name, value)
+}
+
+// handleListBackups lists the backups of a project, oldest first. ?tag=
+// (repeatable or comma-separated) keeps those carrying all given tags.
+func (s *Server) handleListBackups(w http.ResponseWriter, r *http.Request, projectID string) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var tags []string
+	for _, value := range r.URL.Query()["tag"] {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	backups, err := s.service.ListBackups(projectID, tags)
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	data := map[string]interface{}{
+		"project": projectID,
+		"backups": backups,
+	}
+	if len(tags) > 0 {
+		data["tags"] = tags
+	}
+	s.jsonResponse(w, data)
+}
+
+func (s *Server) handleContents(w http.ResponseWriter, r *http.Request, projectID, runID string) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	entry, contents, err := s.service.BackupContents(projectID, runID)
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to read backup contents", zap.String("project", projectID), zap.String("run_id", runID), zap.Error(err))
+		s.serviceError(w, err)
+		return
+	}
+
+	s.jsonResponse(w, map[string]interface{}{
+		"project": entry.Project,
+		"run_id":  entry.RunID,
+		"status":  entry.Status,
+		"schemas": contents.Schemas,
+		"tables":  contents.Tables,
+		"objects": contents.Objects,
+	})
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request, projectID, runID string) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var opts restore.Options
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	report, err := s.service.StartRestore(projectID, runID, opts)
+	if errors.Is(err, service.ErrBackupNotFound) {
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, fmt.Sprintf("Backup not found: %s/%s", projectID, runID))
+		return
+	}
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	s.jsonStatusResponse(w, http.StatusAccepted, map[string]interface{}{
+		"status":     "accepted",
+		"message":    fmt.Sprintf("Restore of %s started into database %s", report.RunID, report.TargetDatabase),
+		"restore_id": report.ID,
+		"timestamp":  time.Now().Format(time.RFC3339),
+	})
+}
+
+// preflightTimeout keeps a preflight check within the server's write timeout
+// when the database doesn't answer.
+const preflightTimeout = 8 * time.Second
+
+func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
+	// Path format: /projects/{project}/check or /projects/{project}/dump
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/projects/"), "/")
+	if len(parts) == 2 && parts[0] != "" && parts[1] == "dump" {
+		s.handleDump(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "check" {
+		s.errorResponse(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), preflightTimeout)
+	defer cancel()
+	report, err := s.service.CheckProject(ctx, parts[0])
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, report)
+}
+
+// handleDump streams a one-off plain SQL dump of a project. Errors before
+// the dump starts get a JSON error response; later ones abort the response,
+// so clients see a truncated body instead of a dump that looks complete.
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request, projectID string) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Dumps take longer than the server's write timeout
+	s.stream(w)
+
+	out := &dumpWriter{w: w}
+	err := s.service.Dump(r.Context(), projectID, out)
+	if err == nil {
+		return
+	}
+	if !out.started {
+		s.serviceError(w, err)
+		return
+	}
+	s.logger.Error("Dump failed while streaming", zap.String("project", projectID), zap.Error(err))
+	panic(http.ErrAbortHandler)
+}
+
+// dumpWriter sets the headers of a dump response on its first write.
+type dumpWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (d *dumpWriter) Write(p []byte) (int, error) {
+	if !d.started {
+		d.started = true
+		d.w.Header().Set("Content-Type", "application/sql; charset=utf-8")
+	}
+	return d.w.Write(p)
+}
+
+// handleRestorePoints lists the points a project can be restored to, newest
+// first, with the RPO they achieve, for DR tooling choosing a restore target.
+func (s *Server) handleRestorePoints(w http.ResponseWriter, r *http.Request) {
+	projectID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/restore-points/"), "/")
+	if projectID == "" || strings.Contains(projectID, "/") {
+		s.errorResponse(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	points, rpo, err := s.service.RestorePoints(projectID)
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"project":        projectID,
+		"restore_points": points,
+		"rpo":            rpo,
+		"pitr":           false,
+		"timestamp":      time.Now().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleRestoreStatus(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/restores/")
+	id, log := strings.CutSuffix(id, "/log")
+	report, err := s.service.GetRestore(id)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to read restore report")
+		return
+	}
+	if project, _ := report["project"].(string); report == nil || !s.inScope(r, project) {
+		s.errorResponse(w, http.StatusNotFound, codeRestoreNotFound, fmt.Sprintf("Restore not found: %s", id))
+		return
+	}
+	if log {
+		s.handleRestoreLog(w, r, id)
+		return
+	}
+	s.jsonResponse(w, report)
+}
+
+// restoreLogPollInterval is how often a followed restore log is checked for
+// new output.
+const restoreLogPollInterval = time.Second
+
+// handleRestoreLog serves the psql output of a restore. With ?follow=true the
+// response stays open and streams new output until the restore ends.
+func (s *Server) handleRestoreLog(w http.ResponseWriter, r *http.Request, id string) {
+	file, err := s.service.OpenRestoreLog(id)
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	if file == nil {
+		s.errorResponse(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Restore %s has no log", id))
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := io.Copy(w, file); err != nil || r.URL.Query().Get("follow") != "true" {
+		return
+	}
+
+	// Restores take longer than the server's write timeout
+	rc := s.stream(w)
+	ticker := time.NewTicker(restoreLogPollInterval)
+	defer ticker.Stop()
+	for {
+		_ = rc.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		// Read the status first: output written before the restore ended is
+		// then copied below
+		report, err := s.service.GetRestore(id)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(w, file); err != nil {
+			return
+		}
+		if report == nil || report["status"] != "running" {
+			return
+		}
+	}
+}
+
+// handleRehearsals summarizes the restore rehearsals of a month (?month=
+// YYYY-MM, default the current one).
+func (s *Server) handleRehearsals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	month := time.Now()
+	if value := r.URL.Query().Get("month"); value != "" {
+		parsed, err := time.ParseInLocation("2006-01", value, time.Local)
+		if err != nil {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid month %q, expected YYYY-MM", value))
+			return
+		}
+		month = parsed
+	}
+
+	summary, err := s.service.RehearsalSummary(month)
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	summary["rehearsal_cron"] = s.config.RehearsalCron
+	s.jsonResponse(w, summary)
+}
+
+// handleRehearsalRun starts restore rehearsals of the projects given as
+// ?project= (repeatable), or of all projects with rehearsals enabled.
+func (s *Server) handleRehearsalRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	ids, err := s.service.StartRehearsals(r.URL.Query()["project"])
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"status":        "accepted",
+		"rehearsal_ids": ids,
+		"message":       "Restore rehearsals started in background",
+		"timestamp":     time.Now().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleRehearsalStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/rehearsals/")
+	report, err := s.service.GetRehearsal(id)
+	if err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to read rehearsal report")
+		return
+	}
+	if report == nil {
+		s.errorResponse(w, http.StatusNotFound, codeRehearsalNotFound, fmt.Sprintf("Rehearsal not found: %s", id))
+		return
+	}
+	s.jsonResponse(w, report)
+}
+
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	s.jsonResponse(w, map[string]interface{}{
+		"service": "PostgreSQL Backup Service",
+		"version": "1.0.0",
+		"endpoints": map[string]string{
+			"health":          "/healthz",
+			"readiness":       "/readyz",
+			"startup":         "/startupz",
+			"status":          "/status",
+			"check":           "/check?project={project}&max_age=26h",
+			"metrics":         "/metrics",
+			"trigger_all":     "/run (POST)",
+			"trigger_project": "/run/{project} (POST)",
+			"trigger_group":   "/run/group/{name} (POST)",
+			"check_project":   "/projects/{project}/check",
+			"dump":            "/projects/{project}/dump (POST)",
+			"current_run":     "/runs/current",
+			"run":             "/runs/{run_id}",
+			"queue":           "/queue",
+			"schedule":        "/schedule?days=7",
+			"restore":         "/backups/{project}/{run_id}/restore (POST)",
+			"restore_status":  "/restores/{id}",
+			"restore_log":     "/restores/{id}/log",
+			"restore_points":  "/restore-points/{project}",
+			"rehearsals":      "/rehearsals?month=YYYY-MM",
+			"rehearsal_run":   "/rehearsals/run?project={project} (POST)",
+			"rehearsal":       "/rehearsals/{id}",
+			"digest":          "/digest?period=24h&format=json|markdown|html",
+			"digest_send":     "/digest/send?period=24h (POST)",
+			"backups":         "/backups/{project}?tag={tag}",
+			"history_export":  "/history/export?format=jsonl|csv&since={date}&project={project}",
+			"contents":        "/backups/{project}/{run_id}/contents",
+			"pin":             "/backups/{project}/{run_id}/pin (POST, DELETE)",
+			"log":             "/backups/{project}/{run_id}/log",
+			"share":           "/backups/{project}/{run_id}/share (POST)",
+			"file":            "/backups/{project}/{run_id}/file/{name}",
+			"containers":      "/debug/containers",
+			"tempdirs":        "/debug/tempdirs",
+			"retention":       "/retention",
+			"retention_run":   "/retention/run (POST)",
+			"pause":           "/scheduler/pause (POST)",
+			"resume":          "/scheduler/resume (POST)",
+		},
+	})
+}
+
+func formatTimes(times []time.Time) []string {
+	formatted := make([]string, len(times))
+	for i, t := range times {
+		formatted[i] = t.Format(time.RFC3339)
+	}
+	return formatted
+}
+
+func (s *Server) jsonResponse(w http.ResponseWriter, data interface{}) {
+	s.jsonStatusResponse(w, http.StatusOK, data)
+}
+
+// jsonStatusResponse is jsonResponse with another status than 200.
+func (s *Server) jsonStatusResponse(w http.ResponseWriter, statusCode int, data interface{}) {
+	// Errors from pgx, Docker or rclone deep in a result may carry
+	// credentials
+	body, err := json.Marshal(redactMessages(data))
+	if err != nil {
+		s.logger.Error("Failed to encode JSON response", zap.Error(err))
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, "Failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// redactMessages returns a copy of a result map with the "error" and
+// "message" strings in it redacted, at any depth. Other values, such as URLs
+// and image names, are left alone; typed results store their errors
+// redacted already.
+func redactMessages(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if text, ok := value.(string); ok && (key == "error" || key == "message") {
+				out[key] = redact.String(text)
+			} else {
+				out[key] = redactMessages(value)
+			}
+		}
+		return out
+	case []map[string]interface{}:
+		out := make([]map[string]interface{}, len(v))
+		for i, value := range v {
+			out[i] = redactMessages(value).(map[string]interface{})
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, value := range v {
+			out[i] = redactMessages(value)
+		}
+		return out
+	default:
+		return data
+	}
+}
+
+// errorResponse writes the error envelope: {"error": {"code": ..., "message": ...}}.
+// Codes are stable identifiers clients can branch on; messages are for humans.
+func (s *Server) errorResponse(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": redact.String(message),
+		},
 	})
 }
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"go.uber.org/zap"
+)
+
+// requiredRole returns the least privileged role allowed to make a request,
+// or "" for endpoints that are always open (health probes). Reads need the
+// read role; anything that changes state needs admin unless it is listed as
+// an operator action here. roles.sql is admin-only because it holds the
+// role password hashes unless dumped with --no-role-passwords.
+func requiredRole(r *http.Request) string {
+	switch {
+	case isProbe(r):
+		return ""
+	case strings.HasPrefix(r.URL.Path, "/backups/") && strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/file/roles.sql"):
+		return config.RoleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return config.RoleRead
+	case r.URL.Path == "/run" || strings.HasPrefix(r.URL.Path, "/run/") || strings.HasPrefix(r.URL.Path, "/scheduler/"):
+		return config.RoleOperator
+	default:
+		return config.RoleAdmin
+	}
+}
+
+// authenticate wraps next with bearer token authentication when API tokens
+// are configured.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if len(s.config.APITokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredRole(r)
+		if required == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, namespace, ok := s.tokenRole(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pg-backup-scheduler"`)
+			s.errorResponse(w, http.StatusUnauthorized, codeUnauthorized, "missing or invalid API token")
+			return
+		}
+		if config.RoleRank(role) < config.RoleRank(required) {
+			s.logger.Warn("API request denied",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("role", role),
+				zap.String("required_role", required))
+			s.errorResponse(w, http.StatusForbidden, codeForbidden, "this endpoint requires the "+required+" role")
+			return
+		}
+		if namespace != "" {
+			if !s.scopeAllows(r, namespace) {
+				s.logger.Warn("API request denied",
+					zap.String("method", r.Method),
+					zap.String("path", r.URL.Path),
+					zap.String("namespace", namespace))
+				s.errorResponse(w, http.StatusForbidden, codeForbidden, "this request is outside the token's namespace "+namespace)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), namespaceKey{}, namespace))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenRole returns the role of the request's bearer token and, for tokens
+// of NAMESPACE_<NAME>_API_TOKENS, its namespace. Every configured token is
+// compared in constant time so timing doesn't reveal a match.
+func (s *Server) tokenRole(r *http.Request) (role, namespace string, ok bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", "", false
+	}
+
+	var match string
+	for candidate, candidateRole := range s.config.APITokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			role, match = candidateRole, candidate
+		}
+	}
+	return role, s.config.APITokenNamespaces[match], role != ""
+}
+
+// namespaceKey is the request context key of a namespace-scoped token's
+// namespace.
+type namespaceKey struct{}
+
+// tokenNamespace returns the namespace the request's token is scoped to, or
+// "" if it isn't (including when the API is unauthenticated).
+func tokenNamespace(r *http.Request) string {
+	namespace, _ := r.Context().Value(namespaceKey{}).(string)
+	return namespace
+}
+
+// inScope reports whether the request's token may see project.
+func (s *Server) inScope(r *http.Request, project string) bool {
+	namespace := tokenNamespace(r)
+	return namespace == "" || s.config.ProjectNamespace(strings.ToLower(project)) == namespace
+}
+
+// scopeAllows reports whether a token scoped to namespace may make a
+// request: one about a project of the namespace (or a group whose projects
+// all are), or a listing or run lookup its handler filters to the
+// namespace. Everything else concerns all projects or the instance itself
+// (scheduler, retention, queue, metrics, debugging) and is left to unscoped
+// tokens.
+func (s *Server) scopeAllows(r *http.Request, namespace string) bool {
+	inNamespace := func(project string) bool {
+		return project != "" && s.config.ProjectNamespace(strings.ToLower(project)) == namespace
+	}
+	pathProject := func(prefix string) string {
+		project, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		return project
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/" || path == "/status" || path == "/schedule" || path == "/history/export" || strings.HasPrefix(path, "/restores/"):
+		return true
+	case strings.HasPrefix(path, "/runs/") && path != "/runs/current":
+		return true
+	case path == "/check":
+		return inNamespace(r.URL.Query().Get("project"))
+	case strings.HasPrefix(path, "/run/group/"):
+		group := strings.ToLower(pathProject("/run/group/"))
+		for _, info := range s.service.Groups() {
+			if info.Name == group {
+				return !slices.ContainsFunc(info.Projects, func(project string) bool { return !inNamespace(project) })
+			}
+		}
+		return false
+	}
+	for _, prefix := range []string{"/run/", "/backups/", "/restore-points/", "/projects/"} {
+		if strings.HasPrefix(path, prefix) {
+			return inNamespace(pathProject(prefix))
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
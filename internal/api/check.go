@@ -0,0 +1,160 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+)
+
+// defaultCheckMaxAge fits a daily schedule with some slack for long dumps.
+const defaultCheckMaxAge = 26 * time.Hour
+
+// Monitoring plugin states, from best to worst.
+const (
+	checkOK       = "OK"
+	checkWarning  = "WARNING"
+	checkCritical = "CRITICAL"
+	checkUnknown  = "UNKNOWN"
+)
+
+var checkRank = map[string]int{checkOK: 0, checkWarning: 1, checkUnknown: 2, checkCritical: 3}
+
+// projectCheck is the freshness of one project's backups.
+type projectCheck struct {
+	project string
+	state   string
+	message string
+	// age is the time since the last successful backup, -1 without one
+	age time.Duration
+}
+
+// handleCheck reports backup freshness for Nagios/CheckMK style monitoring:
+// a plain-text summary line with perfdata, one line per project, and 200 when
+// every project's last successful backup is younger than max_age (503
+// otherwise). A project whose newest backup failed is a WARNING as long as
+// its last success is still fresh.
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	maxAge := defaultCheckMaxAge
+	if value := r.URL.Query().Get("max_age"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			s.textResponse(w, http.StatusBadRequest, fmt.Sprintf("BACKUP UNKNOWN - invalid max_age %q (expected a duration like 26h)\n", value))
+			return
+		}
+		maxAge = d
+	}
+
+	var databases []*database.Database
+	if project := r.URL.Query().Get("project"); project != "" {
+		db := s.service.GetDatabase(project)
+		if db == nil {
+			s.textResponse(w, http.StatusNotFound, fmt.Sprintf("BACKUP UNKNOWN - project not found: %s\n", project))
+			return
+		}
+		databases = []*database.Database{db}
+	} else {
+		databases = s.service.GetDatabases()
+	}
+	if len(databases) == 0 {
+		s.textResponse(w, http.StatusServiceUnavailable, "BACKUP UNKNOWN - no projects configured\n")
+		return
+	}
+
+	now := time.Now()
+	state := checkOK
+	checks := make([]projectCheck, len(databases))
+	var problems, perfdata []string
+	for i, db := range databases {
+		checks[i] = s.checkProject(db.Identifier, maxAge, now)
+		if checkRank[checks[i].state] > checkRank[state] {
+			state = checks[i].state
+		}
+		if checks[i].state != checkOK {
+			problems = append(problems, fmt.Sprintf("%s %s", db.Identifier, checks[i].message))
+		}
+		if checks[i].age >= 0 {
+			perfdata = append(perfdata, fmt.Sprintf("'%s_age'=%ds;;%d", db.Identifier, int64(checks[i].age.Seconds()), int64(maxAge.Seconds())))
+		}
+	}
+
+	var b strings.Builder
+	switch {
+	case len(problems) > 0:
+		fmt.Fprintf(&b, "BACKUP %s - %s", state, strings.Join(problems, "; "))
+	case len(checks) == 1:
+		fmt.Fprintf(&b, "BACKUP %s - %s %s", state, checks[0].project, checks[0].message)
+	default:
+		fmt.Fprintf(&b, "BACKUP %s - %d projects backed up within %s", state, len(checks), formatAge(maxAge))
+	}
+	if len(perfdata) > 0 {
+		b.WriteString(" | " + strings.Join(perfdata, " "))
+	}
+	b.WriteString("\n")
+	if len(checks) > 1 {
+		for _, check := range checks {
+			fmt.Fprintf(&b, "%s: %s - %s\n", check.project, check.state, check.message)
+		}
+	}
+
+	status := http.StatusOK
+	if state == checkCritical || state == checkUnknown {
+		status = http.StatusServiceUnavailable
+	}
+	s.textResponse(w, status, b.String())
+}
+
+func (s *Server) checkProject(project string, maxAge time.Duration, now time.Time) projectCheck {
+	check := projectCheck{project: project, age: -1}
+	lastSuccess, err := s.service.LastSuccessfulBackup(project)
+	if err != nil {
+		check.state, check.message = checkUnknown, fmt.Sprintf("failed to read backups: %v", err)
+		return check
+	}
+	if lastSuccess == nil || lastSuccess.FinishedTime().IsZero() {
+		check.state, check.message = checkCritical, "has no successful backup"
+		return check
+	}
+
+	check.age = now.Sub(lastSuccess.FinishedTime())
+	if check.age > maxAge {
+		check.state = checkCritical
+		check.message = fmt.Sprintf("last success %s ago, older than %s", formatAge(check.age), formatAge(maxAge))
+		return check
+	}
+	check.state = checkOK
+	check.message = fmt.Sprintf("last success %s ago", formatAge(check.age))
+
+	last, err := s.service.LastBackup(project)
+	if err == nil && last != nil && last.Status != "success" {
+		check.state = checkWarning
+		check.message += fmt.Sprintf(", but the latest backup %s failed", last.RunID)
+	}
+	return check
+}
+
+// formatAge formats a duration to the minute, e.g. "3h12m".
+func formatAge(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	if d < time.Minute {
+		return "<1m"
+	}
+	age := strings.TrimSuffix(d.String(), "0s")
+	if strings.HasSuffix(age, "h0m") {
+		age = strings.TrimSuffix(age, "0m")
+	}
+	return age
+}
+
+func (s *Server) textResponse(w http.ResponseWriter, statusCode int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	fmt.Fprint(w, text)
+}
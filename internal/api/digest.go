@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// digestPeriod returns ?period= or DIGEST_PERIOD.
+func (s *Server) digestPeriod(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("period")
+	if value == "" {
+		return s.config.DigestPeriod, nil
+	}
+	period, err := time.ParseDuration(value)
+	if err != nil || period <= 0 {
+		return 0, fmt.Errorf("invalid period %q, expected a positive duration such as 168h", value)
+	}
+	return period, nil
+}
+
+// handleDigest previews the digest report of the past ?period= (default
+// DIGEST_PERIOD) as JSON, or as sent with ?format=markdown or html.
+func (s *Server) handleDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	period, err := s.digestPeriod(r)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "markdown" && format != "html" {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid format %q: use json, markdown or html", format))
+		return
+	}
+
+	digest, err := s.service.Digest(period, time.Now())
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	switch format {
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		_, _ = io.WriteString(w, digest.Markdown())
+	case "html":
+		body, err := digest.HTML()
+		if err != nil {
+			s.serviceError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, body)
+	default:
+		s.jsonResponse(w, digest)
+	}
+}
+
+// handleDigestSend sends the digest of the past ?period= (default
+// DIGEST_PERIOD) to its receivers now.
+func (s *Server) handleDigestSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	period, err := s.digestPeriod(r)
+	if err != nil {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if s.config.DigestURL == "" && s.config.DigestEmailTo == "" {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, "No digest receivers configured: set DIGEST_URL or DIGEST_EMAIL_TO")
+		return
+	}
+	if err := s.service.SendDigest(period); err != nil {
+		s.errorResponse(w, http.StatusBadGateway, codeDeliveryFailed, fmt.Sprintf("Failed to send digest: %v", err))
+		return
+	}
+	s.jsonResponse(w, map[string]interface{}{
+		"status":    "sent",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"syscall"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
+)
+
+// Error codes returned in the "code" field of the error envelope.
+const (
+	codeBadRequest        = "bad_request"
+	codeUnauthorized      = "unauthorized"
+	codeForbidden         = "forbidden"
+	codeRateLimited       = "rate_limited"
+	codeMethodNotAllowed  = "method_not_allowed"
+	codeNotFound          = "not_found"
+	codeProjectNotFound   = "project_not_found"
+	codeGroupNotFound     = "group_not_found"
+	codeNamespaceNotFound = "namespace_not_found"
+	codeBackupNotFound    = "backup_not_found"
+	codeRestoreNotFound   = "restore_not_found"
+	codeRehearsalNotFound = "rehearsal_not_found"
+	codeAlreadyRunning    = "already_running"
+	codeDockerUnavailable = "docker_unavailable"
+	codeStorageFull       = "storage_full"
+	codeQuotaExceeded     = "quota_exceeded"
+	codeNotShareable      = "not_shareable"
+	codeStarting          = "starting"
+	codeFileNotFound      = "file_not_found"
+	codeDeliveryFailed    = "delivery_failed"
+	codeRequestTooLarge   = "request_too_large"
+	codeShuttingDown      = "shutting_down"
+	codeInternal          = "internal_error"
+)
+
+// serviceError maps errors returned by the service to a status and code.
+// Unknown errors are reported as internal errors with their message.
+func (s *Server) serviceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrProjectNotFound):
+		s.errorResponse(w, http.StatusNotFound, codeProjectNotFound, err.Error())
+	case errors.Is(err, service.ErrGroupNotFound):
+		s.errorResponse(w, http.StatusNotFound, codeGroupNotFound, err.Error())
+	case errors.Is(err, service.ErrBackupNotFound):
+		s.errorResponse(w, http.StatusNotFound, codeBackupNotFound, err.Error())
+	case errors.Is(err, service.ErrAlreadyRunning), errors.Is(err, service.ErrProjectRunning), errors.Is(err, service.ErrRetentionRunning),
+		errors.Is(err, service.ErrRehearsalRunning):
+		s.errorResponse(w, http.StatusConflict, codeAlreadyRunning, err.Error())
+	case errors.Is(err, service.ErrShuttingDown):
+		s.errorResponse(w, http.StatusServiceUnavailable, codeShuttingDown, err.Error())
+	case errors.Is(err, service.ErrDockerUnavailable):
+		s.errorResponse(w, http.StatusServiceUnavailable, codeDockerUnavailable, err.Error())
+	case errors.Is(err, service.ErrStorageFull), errors.Is(err, syscall.ENOSPC):
+		s.errorResponse(w, http.StatusInsufficientStorage, codeStorageFull, err.Error())
+	case errors.Is(err, service.ErrQuotaExceeded):
+		s.errorResponse(w, http.StatusInsufficientStorage, codeQuotaExceeded, err.Error())
+	case errors.Is(err, service.ErrNotShareable):
+		s.errorResponse(w, http.StatusConflict, codeNotShareable, err.Error())
+	case errors.Is(err, service.ErrFileNotFound):
+		s.errorResponse(w, http.StatusNotFound, codeFileNotFound, err.Error())
+	default:
+		s.errorResponse(w, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
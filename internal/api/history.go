@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// historyRecord is one backup in a history export. It is flat so it loads
+// into BI tools as a table row.
+type historyRecord struct {
+	Project    string   `json:"project"`
+	Date       string   `json:"date"`
+	RunID      string   `json:"run_id"`
+	Status     string   `json:"status"`
+	BackupType string   `json:"backup_type"`
+	StartedAt  string   `json:"started_at"`
+	FinishedAt string   `json:"finished_at"`
+	DurationMs int64    `json:"duration_ms"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Tags       []string `json:"tags"`
+	Pinned     bool     `json:"pinned"`
+	Error      string   `json:"error"`
+}
+
+var historyCSVHeader = []string{
+	"project", "date", "run_id", "status", "backup_type", "started_at", "finished_at",
+	"duration_ms", "size_bytes", "tags", "pinned", "error",
+}
+
+func newHistoryRecord(entry *catalog.Entry, now time.Time) historyRecord {
+	backupType := entry.BackupType
+	if backupType == "" {
+		backupType = "full"
+	}
+	tags := entry.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return historyRecord{
+		Project:    entry.Project,
+		Date:       entry.Date,
+		RunID:      entry.RunID,
+		Status:     entry.Status,
+		BackupType: backupType,
+		StartedAt:  entry.StartedAt,
+		FinishedAt: entry.FinishedAt,
+		DurationMs: entry.DurationMs,
+		SizeBytes:  entry.SizeBytes,
+		Tags:       tags,
+		Pinned:     entry.Pinned(now),
+		Error:      entry.Error,
+	}
+}
+
+func (rec historyRecord) csvRow() []string {
+	return []string{
+		rec.Project, rec.Date, rec.RunID, rec.Status, rec.BackupType, rec.StartedAt, rec.FinishedAt,
+		strconv.FormatInt(rec.DurationMs, 10), strconv.FormatInt(rec.SizeBytes, 10),
+		strings.Join(rec.Tags, ","), strconv.FormatBool(rec.Pinned), rec.Error,
+	}
+}
+
+// handleHistoryExport exports every backup on disk as one record per line,
+// in JSON Lines (default) or CSV, for capacity planning dashboards.
+// ?since= (RFC 3339 or YYYY-MM-DD) skips older backups, ?project= limits
+// the export to one project. Namespace-scoped tokens only get their
+// namespace's projects.
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		s.errorResponse(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Invalid format %q: use jsonl or csv", format))
+		return
+	}
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = parseTimeParam("since", value); err != nil {
+			s.errorResponse(w, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+	}
+
+	if project := query.Get("project"); project != "" && !s.inScope(r, project) {
+		s.errorResponse(w, http.StatusForbidden, codeForbidden, "this request is outside the token's namespace "+tokenNamespace(r))
+		return
+	}
+	entries, err := s.service.History(query.Get("project"), since)
+	if err != nil {
+		s.serviceError(w, err)
+		return
+	}
+	entries = slices.DeleteFunc(entries, func(entry *catalog.Entry) bool {
+		return !s.inScope(r, entry.Project)
+	})
+
+	// Long histories take a while to export
+	s.stream(w)
+	now := time.Now()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="backup-history.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write(historyCSVHeader)
+		for _, entry := range entries {
+			_ = cw.Write(newHistoryRecord(entry, now).csvRow())
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			s.logger.Error("Failed to write history export", zap.Error(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="backup-history.jsonl"`)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(newHistoryRecord(entry, now)); err != nil {
+			s.logger.Error("Failed to write history export", zap.Error(err))
+			return
+		}
+	}
+}
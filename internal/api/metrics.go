@@ -0,0 +1,16 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleMetrics serves Service.Metrics to Prometheus.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.errorResponse(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, s.service.Metrics())
+}
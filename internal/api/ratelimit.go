@@ -0,0 +1,128 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idle buckets are dropped after this long, so the map doesn't grow with
+// every client address ever seen
+const (
+	bucketIdleTimeout = 10 * time.Minute
+	bucketSweepEvery  = time.Minute
+)
+
+// rateLimiter keeps a token bucket per client: each request takes a token,
+// tokens refill at rate per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token for key. Without one left it returns false and how long
+// until the next token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketSweepEvery {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limitRate wraps next with per-client rate limiting. Clients are identified
+// by their API token, or by remote address for requests without a valid
+// token. Health probes are not limited.
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	if s.config.APIRateLimit <= 0 {
+		return next
+	}
+	limiter := newRateLimiter(s.config.APIRateLimit, s.config.APIRateBurst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProbe(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := "ip:" + clientIP(r)
+		if _, _, ok := s.tokenRole(r); ok {
+			token, _ := bearerToken(r)
+			key = "token:" + token
+		}
+		if ok, wait := limiter.allow(key, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.errorResponse(w, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the host part of the request's remote address. Proxy
+// headers such as X-Forwarded-For are not trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireRunSlot reserves one of the API_MAX_CONCURRENT_RUNS slots for a
+// triggered backup. The returned release must be called once the backup has
+// finished (or wasn't started).
+func (s *Server) acquireRunSlot() (release func(), ok bool) {
+	if s.runSlots == nil {
+		return func() {}, true
+	}
+	select {
+	case s.runSlots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-s.runSlots }) }, true
+	default:
+		return nil, false
+	}
+}
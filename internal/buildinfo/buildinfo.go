@@ -0,0 +1,42 @@
+// Package buildinfo reports which build of the scheduler is running.
+package buildinfo
+
+import "runtime/debug"
+
+// version is set at build time with
+// -ldflags "-X github.com/mxschmitt/pg-backup-scheduler/internal/buildinfo.version=v1.2.3".
+var version string
+
+// Version returns the version set at build time, else the module version
+// for binaries built with go install, else "dev".
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// Revision returns the commit the binary was built from, with "+dirty" for
+// builds with uncommitted changes, or "" if the build has no VCS information.
+func Revision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision != "" && modified == "true" {
+		revision += "+dirty"
+	}
+	return revision
+}
@@ -2,8 +2,12 @@ package database
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type Database struct {
@@ -12,16 +16,107 @@ type Database struct {
 }
 
 func New(connectionURL, projectName string) (*Database, error) {
-	// Validate connection URL
-	_, err := url.Parse(connectionURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid connection URL: %w", err)
+	// Validate connection string
+	if _, err := ParseConnString(connectionURL); err != nil {
+		return nil, err
 	}
 
 	identifier := strings.ToLower(projectName)
 
 	return &Database{
-		ConnectionURL: connectionURL,
+		ConnectionURL: NormalizeConnString(connectionURL),
 		Identifier:    identifier,
 	}, nil
 }
+
+// ParseConnString parses a connection string the way libpq does: a
+// postgres:// or postgresql:// URL, a key/value DSN ("host=db dbname=app"),
+// or either naming a service from pg_service.conf ("service=prod", looked up
+// in PGSERVICEFILE or ~/.pg_service.conf). Settings missing from it come from
+// the PG* environment variables, ~/.pgpass and libpq's defaults.
+func ParseConnString(connString string) (*pgconn.Config, error) {
+	config, err := pgconn.ParseConfig(NormalizeConnString(connString))
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	return config, nil
+}
+
+// NormalizeConnString rewrites URLs whose host is a percent-encoded Unix
+// socket directory ("postgresql://user@%2Fvar%2Frun%2Fpostgresql/app"), which
+// libpq accepts but Go's URL parser doesn't, to the equivalent host query
+// parameter. Other connection strings are returned unchanged.
+func NormalizeConnString(connString string) string {
+	if !IsURL(connString) {
+		return connString
+	}
+	schemeEnd := strings.Index(connString, "://") + len("://")
+	rest := connString[schemeEnd:]
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd < 0 {
+		authorityEnd = len(rest)
+	}
+	authority, tail := rest[:authorityEnd], rest[authorityEnd:]
+	userinfo, hostport := "", authority
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, hostport = authority[:at+1], authority[at+1:]
+	}
+	if !strings.HasPrefix(strings.ToLower(hostport), "%2f") {
+		return connString
+	}
+
+	host, port := hostport, ""
+	if colon := strings.LastIndex(hostport, ":"); colon >= 0 {
+		host, port = hostport[:colon], hostport[colon+1:]
+	}
+	socketDir, err := url.PathUnescape(host)
+	if err != nil {
+		return connString
+	}
+	params := url.Values{"host": {socketDir}}
+	if port != "" {
+		params.Set("port", port)
+	}
+
+	path, query := tail, ""
+	if q := strings.Index(tail, "?"); q >= 0 {
+		path, query = tail[:q], tail[q+1:]
+	}
+	if path == "" {
+		path = "/"
+	}
+	if query != "" {
+		query += "&"
+	}
+	return connString[:schemeEnd] + userinfo + path + "?" + query + params.Encode()
+}
+
+// IsURL reports whether connString uses URL syntax rather than key/value pairs.
+func IsURL(connString string) bool {
+	return strings.HasPrefix(connString, "postgresql://") || strings.HasPrefix(connString, "postgres://")
+}
+
+// Address formats a host and port for display: host:port, with brackets
+// around IPv6 addresses, or the socket path for a Unix socket directory.
+func Address(host string, port int) string {
+	if strings.HasPrefix(host, "/") {
+		return fmt.Sprintf("%s/.s.PGSQL.%d", host, port)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// WithDatabase returns connString pointing at database name instead.
+func WithDatabase(connString, name string) (string, error) {
+	connString = NormalizeConnString(connString)
+	if !IsURL(connString) {
+		// The last occurrence of a keyword wins
+		value := strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), `'`, `\'`)
+		return fmt.Sprintf("%s dbname='%s'", connString, value), nil
+	}
+	parsed, err := url.Parse(connString)
+	if err != nil {
+		return "", fmt.Errorf("invalid connection URL: %w", err)
+	}
+	parsed.Path = "/" + name
+	return parsed.String(), nil
+}
@@ -0,0 +1,64 @@
+package database
+
+import "testing"
+
+func TestNormalizeConnString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "socket host", in: "postgresql://user@%2Fvar%2Frun%2Fpostgresql/app", want: "postgresql://user@/app?host=%2Fvar%2Frun%2Fpostgresql"},
+		{name: "lower-case escapes", in: "postgres://%2ftmp/app", want: "postgres:///app?host=%2Ftmp"},
+		{name: "socket host with port", in: "postgresql://user:secret@%2Ftmp:5433/app", want: "postgresql://user:secret@/app?host=%2Ftmp&port=5433"},
+		{name: "existing query", in: "postgresql://%2Ftmp/app?sslmode=disable", want: "postgresql:///app?sslmode=disable&host=%2Ftmp"},
+		{name: "no database", in: "postgresql://user@%2Ftmp", want: "postgresql://user@/?host=%2Ftmp"},
+		{name: "query without database", in: "postgresql://%2Ftmp?application_name=x", want: "postgresql:///?application_name=x&host=%2Ftmp"},
+		{name: "@ in password", in: "postgresql://user:p@ss@%2Ftmp/app", want: "postgresql://user:p@ss@/app?host=%2Ftmp"},
+
+		{name: "tcp host", in: "postgresql://user@db.internal:5432/app", want: "postgresql://user@db.internal:5432/app"},
+		{name: "socket in query already", in: "postgresql:///app?host=/tmp", want: "postgresql:///app?host=/tmp"},
+		{name: "key/value DSN", in: "host=/tmp dbname=app", want: "host=/tmp dbname=app"},
+		{name: "service", in: "service=prod", want: "service=prod"},
+		{name: "invalid escape", in: "postgresql://user@%2Fvar%zz/app", want: "postgresql://user@%2Fvar%zz/app"},
+		{name: "other scheme", in: "mysql://%2Ftmp/app", want: "mysql://%2Ftmp/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeConnString(tt.in); got != tt.want {
+				t.Fatalf("NormalizeConnString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConnStringSocketHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		wantHost string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{name: "socket URL", in: "postgresql://user@%2Fvar%2Frun%2Fpostgresql:5433/app", wantHost: "/var/run/postgresql", wantPort: 5433},
+		{name: "socket DSN", in: "host=/tmp port=5434 dbname=app", wantHost: "/tmp", wantPort: 5434},
+		{name: "invalid escape", in: "postgresql://user@%2Fvar%zz/app", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseConnString(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseConnString(%q) = %s, want an error", tt.in, config.Host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Host != tt.wantHost || config.Port != tt.wantPort {
+				t.Fatalf("ParseConnString(%q) = %s:%d, want %s:%d", tt.in, config.Host, config.Port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+// dockerHub is the key Docker Hub credentials are stored under.
+const dockerHub = "docker.io"
+
+// RegistryAuth holds credentials for pulling images from private registries,
+// keyed by registry host ("registry.internal:5000", "docker.io").
+type RegistryAuth map[string]registry.AuthConfig
+
+// Registries returns the hosts there are credentials for, sorted.
+func (a RegistryAuth) Registries() []string {
+	hosts := make([]string, 0, len(a))
+	for host := range a {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+var registryAuth RegistryAuth
+
+// SetRegistryAuth sets the credentials PullImageIfNotCached sends.
+func SetRegistryAuth(auth RegistryAuth) {
+	registryAuth = auth
+}
+
+// dockerConfig is the part of a Docker CLI config file (config.json) that
+// holds registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		// IdentityToken is an OAuth refresh token, e.g. from Azure
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// LoadRegistryAuth reads registry credentials from a Docker config file, as
+// written by docker login. path "" reads the Docker CLI's own file
+// ($DOCKER_CONFIG/config.json, else ~/.docker/config.json) if there is one.
+// Only credentials stored in the file are used; registries whose
+// credentials live in a credential helper (credsStore, credHelpers) are
+// returned as unsupported.
+func LoadRegistryAuth(path string) (auth RegistryAuth, unsupported []string, err error) {
+	explicit := path != ""
+	if !explicit {
+		if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+			path = filepath.Join(dir, "config.json")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".docker", "config.json")
+		} else {
+			return nil, nil, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read registry credentials: %w", err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse registry credentials %s: %w", path, err)
+	}
+
+	auth = make(RegistryAuth)
+	for key, entry := range config.Auths {
+		host := registryKey(key)
+		credentials := registry.AuthConfig{ServerAddress: key, IdentityToken: entry.IdentityToken}
+		switch {
+		case entry.Auth != "":
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid credentials for %s in %s: %w", key, path, err)
+			}
+			var ok bool
+			if credentials.Username, credentials.Password, ok = strings.Cut(string(decoded), ":"); !ok {
+				return nil, nil, fmt.Errorf("invalid credentials for %s in %s: expected user:password", key, path)
+			}
+		case entry.Username != "" || entry.IdentityToken != "":
+			credentials.Username, credentials.Password = entry.Username, entry.Password
+		default:
+			// An empty entry is a registry logged into through credsStore
+			if config.CredsStore != "" {
+				unsupported = append(unsupported, host)
+			}
+			continue
+		}
+		auth[host] = credentials
+	}
+	for key := range config.CredHelpers {
+		if _, ok := auth[registryKey(key)]; !ok {
+			unsupported = append(unsupported, registryKey(key))
+		}
+	}
+	sort.Strings(unsupported)
+	return auth, unsupported, nil
+}
+
+// registryAuthHeader returns the X-Registry-Auth value for pulling image, or
+// "" without credentials for its registry.
+func registryAuthHeader(image string) (string, error) {
+	credentials, ok := registryAuth[imageRegistry(image)]
+	if !ok {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(credentials)
+}
+
+// imageRegistry returns the registry host of an image reference; references
+// without one ("postgres:17", "bitnami/postgresql:16") are on Docker Hub.
+func imageRegistry(ref string) string {
+	first, _, found := strings.Cut(ref, "/")
+	if !found || !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return dockerHub
+	}
+	return registryKey(first)
+}
+
+// registryKey normalizes a config.json key ("https://index.docker.io/v1/",
+// "registry.internal:5000") to a registry host.
+func registryKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	switch key {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHub
+	}
+	return key
+}
@@ -2,8 +2,10 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -14,15 +16,42 @@ import (
 
 var cli *client.Client
 
+// PullPolicy controls when dump images are pulled from the registry.
+type PullPolicy string
+
+const (
+	PullIfNotPresent PullPolicy = "ifnotpresent"
+	PullAlways       PullPolicy = "always"
+	PullNever        PullPolicy = "never"
+)
+
+var pullPolicy = PullIfNotPresent
+
+// ParsePullPolicy validates an IMAGE_PULL_POLICY value.
+func ParsePullPolicy(value string) (PullPolicy, error) {
+	switch policy := PullPolicy(strings.ToLower(value)); policy {
+	case PullIfNotPresent, PullAlways, PullNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid image pull policy %q (expected ifnotpresent, always or never)", value)
+	}
+}
+
+// SetPullPolicy sets the pull policy used by PullImageIfNotCached.
+func SetPullPolicy(policy PullPolicy) {
+	pullPolicy = policy
+}
+
 func Init() (*client.Client, error) {
 	if cli != nil {
 		return cli, nil
 	}
 
 	// Use default Docker client which auto-discovers socket on macOS and Linux
+	// and the named pipe (npipe:////./pipe/docker_engine) on Windows
 	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+		return nil, daemonError(fmt.Errorf("failed to create Docker client: %w", err))
 	}
 
 	cli = c
@@ -43,16 +72,32 @@ func CheckDocker(ctx context.Context) error {
 	}
 	_, err := cli.Ping(ctx)
 	if err != nil {
-		return fmt.Errorf("Docker daemon is not accessible: %w", err)
+		return daemonError(fmt.Errorf("Docker daemon is not accessible: %w", err))
 	}
 	return nil
 }
 
 func PullImageIfNotCached(ctx context.Context, imageName string) error {
-	// Try to pull image - Docker will use cache if it exists
-	out, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
+	if pullPolicy != PullAlways {
+		present, err := imageExists(ctx, imageName)
+		if err != nil {
+			return err
+		}
+		if present {
+			return nil
+		}
+		if pullPolicy == PullNever {
+			return fmt.Errorf("image %s is not present locally and IMAGE_PULL_POLICY is never", imageName)
+		}
+	}
+
+	auth, err := registryAuthHeader(imageName)
 	if err != nil {
-		return fmt.Errorf("failed to pull docker image: %w", err)
+		return fmt.Errorf("failed to encode registry credentials: %w", err)
+	}
+	out, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return daemonError(fmt.Errorf("failed to pull docker image: %w", err))
 	}
 	defer out.Close()
 
@@ -62,29 +107,123 @@ func PullImageIfNotCached(ctx context.Context, imageName string) error {
 	return nil
 }
 
+func imageExists(ctx context.Context, imageName string) (bool, error) {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, imageName); err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, daemonError(fmt.Errorf("failed to inspect docker image: %w", err))
+	}
+	return true, nil
+}
+
+// HasTagOrDigest reports whether an image reference names a tag or digest
+// (e.g. postgres:17, postgres@sha256:...) rather than a bare repository.
+func HasTagOrDigest(ref string) bool {
+	if strings.Contains(ref, "@") {
+		return true
+	}
+	// A colon before the last slash belongs to a registry host:port
+	return strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":")
+}
+
+// ImageDigest returns the pinned digest of an image reference, or "" if the
+// reference is not pinned.
+func ImageDigest(ref string) string {
+	if idx := strings.LastIndex(ref, "@"); idx >= 0 {
+		return ref[idx+1:]
+	}
+	return ""
+}
+
+// ImageIdentity returns the ID of a local image and the repository digest
+// (repo@sha256:...) it was pulled by: the pinned one for pinned references,
+// else the first. The digest is empty for images built locally.
+func ImageIdentity(ctx context.Context, ref string) (id, repoDigest string, err error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", "", daemonError(fmt.Errorf("failed to inspect image %s: %w", ref, err))
+	}
+	if len(inspect.RepoDigests) > 0 {
+		repoDigest = inspect.RepoDigests[0]
+	}
+	if digest := ImageDigest(ref); digest != "" {
+		for _, candidate := range inspect.RepoDigests {
+			if strings.HasSuffix(candidate, "@"+digest) {
+				repoDigest = candidate
+			}
+		}
+	}
+	return inspect.ID, repoDigest, nil
+}
+
+// ServerInfo describes the Docker daemon and the host it runs on.
+type ServerInfo struct {
+	Version       string
+	OS            string
+	Arch          string
+	KernelVersion string
+}
+
+// Server returns the version and platform of the Docker daemon.
+func Server(ctx context.Context) (ServerInfo, error) {
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return ServerInfo{}, daemonError(fmt.Errorf("failed to get docker version: %w", err))
+	}
+	return ServerInfo{Version: version.Version, OS: version.Os, Arch: version.Arch, KernelVersion: version.KernelVersion}, nil
+}
+
+// VerifyImageDigest checks that a digest-pinned image present in the local
+// image store actually carries the pinned digest, so a retagged or tampered
+// local image is never used in place of the pinned one.
+func VerifyImageDigest(ctx context.Context, ref string) error {
+	digest := ImageDigest(ref)
+	if digest == "" {
+		return nil
+	}
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return daemonError(fmt.Errorf("failed to inspect image %s: %w", ref, err))
+	}
+
+	for _, repoDigest := range inspect.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s does not match pinned digest %s (found %v)", ref, digest, inspect.RepoDigests)
+}
+
 func RunOnceWithConfig(ctx context.Context, cfg container.Config, hostConfig container.HostConfig, stdout, stderr *ContainerOutput) error {
 	// Pull image if needed
 	if err := PullImageIfNotCached(ctx, cfg.Image); err != nil {
 		return err
 	}
 
+	if err := VerifyImageDigest(ctx, cfg.Image); err != nil {
+		return err
+	}
+
 	// Create container
+	cfg.Labels = containerLabels(ctx, cfg.Labels)
 	resp, err := cli.ContainerCreate(ctx, &cfg, &hostConfig, &network.NetworkingConfig{}, nil, "")
 	if err != nil {
-		return fmt.Errorf("failed to create container: %w", err)
+		return daemonError(fmt.Errorf("failed to create container: %w", err))
 	}
 	containerID := resp.ID
 
-	// Ensure container is removed
+	// Ensure container is removed, also when ctx has expired (Force kills it)
 	defer func() {
-		_ = cli.ContainerRemove(ctx, containerID, container.RemoveOptions{
+		_ = cli.ContainerRemove(context.Background(), containerID, container.RemoveOptions{
 			Force: true,
 		})
 	}()
 
 	// Start container
 	if err := cli.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
-		return fmt.Errorf("failed to start container: %w", err)
+		return daemonError(fmt.Errorf("failed to start container: %w", err))
 	}
 
 	// Wait for container to finish first, then read logs
@@ -94,7 +233,10 @@ func RunOnceWithConfig(ctx context.Context, cfg container.Config, hostConfig con
 	case result := <-waitCh:
 		exitCode = int(result.StatusCode)
 	case err := <-errCh:
-		return fmt.Errorf("error waiting for container: %w", err)
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+		return daemonError(fmt.Errorf("error waiting for container: %w", err))
 	}
 
 	// Stream logs (now that container has finished, this will read all logs)
@@ -104,7 +246,7 @@ func RunOnceWithConfig(ctx context.Context, cfg container.Config, hostConfig con
 		Follow:     false, // Container is already finished, no need to follow
 	})
 	if err != nil {
-		return fmt.Errorf("failed to read container logs: %w", err)
+		return daemonError(fmt.Errorf("failed to read container logs: %w", err))
 	}
 	defer logs.Close()
 
@@ -117,17 +259,189 @@ func RunOnceWithConfig(ctx context.Context, cfg container.Config, hostConfig con
 		stderrStr := stderr.String()
 		stdoutStr := stdout.String()
 		if stderrStr != "" {
-			return fmt.Errorf("container exited with code %d: %s", exitCode, stderrStr)
+			return &ExitError{Code: exitCode, Output: stderrStr}
 		}
 		if stdoutStr != "" {
 			// Sometimes errors go to stdout
-			return fmt.Errorf("container exited with code %d: %s", exitCode, stdoutStr)
+			return &ExitError{Code: exitCode, Output: stdoutStr}
+		}
+		return &ExitError{Code: exitCode}
+	}
+	return nil
+}
+
+// RunStreaming runs a container like RunOnceWithConfig, but stdout and stderr
+// receive the output as it is produced instead of after the container exits,
+// so large outputs (dumps) never have to fit in memory.
+func RunStreaming(ctx context.Context, cfg container.Config, hostConfig container.HostConfig, stdout, stderr io.Writer) error {
+	return RunWithStdin(ctx, cfg, hostConfig, nil, stdout, stderr)
+}
+
+// RunWithStdin runs a container like RunOnceWithConfig, streaming stdin into
+// the container's standard input (e.g. SQL into psql). stdout and stderr
+// receive the container output as it is produced. A nil stdin leaves the
+// container's standard input closed.
+func RunWithStdin(ctx context.Context, cfg container.Config, hostConfig container.HostConfig, stdin io.Reader, stdout, stderr io.Writer) error {
+	if err := PullImageIfNotCached(ctx, cfg.Image); err != nil {
+		return err
+	}
+
+	if err := VerifyImageDigest(ctx, cfg.Image); err != nil {
+		return err
+	}
+
+	cfg.OpenStdin = stdin != nil
+	cfg.StdinOnce = stdin != nil
+	cfg.AttachStdin = stdin != nil
+	cfg.AttachStdout = true
+	cfg.AttachStderr = true
+	cfg.Labels = containerLabels(ctx, cfg.Labels)
+
+	resp, err := cli.ContainerCreate(ctx, &cfg, &hostConfig, &network.NetworkingConfig{}, nil, "")
+	if err != nil {
+		return daemonError(fmt.Errorf("failed to create container: %w", err))
+	}
+	containerID := resp.ID
+
+	defer func() {
+		_ = cli.ContainerRemove(context.Background(), containerID, container.RemoveOptions{
+			Force: true,
+		})
+	}()
+
+	// Attach before starting so no input or output is lost
+	attach, err := cli.ContainerAttach(ctx, containerID, container.AttachOptions{
+		Stream: true,
+		Stdin:  stdin != nil,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return daemonError(fmt.Errorf("failed to attach to container: %w", err))
+	}
+	defer attach.Close()
+
+	if err := cli.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
+		return daemonError(fmt.Errorf("failed to start container: %w", err))
+	}
+
+	// The attach stream doesn't observe ctx; closing it unblocks the copies
+	// below when ctx expires
+	stop := context.AfterFunc(ctx, attach.Close)
+	defer stop()
+
+	inputErr := make(chan error, 1)
+	readErr := make(chan error, 1)
+	if stdin == nil {
+		inputErr <- nil
+	} else {
+		go func() {
+			input := &inputReader{r: stdin}
+			_, err := io.Copy(attach.Conn, input)
+			if input.err != nil {
+				// Input that couldn't be read in full must not look complete:
+				// kill the process before its stdin is closed, so that e.g.
+				// psql --single-transaction doesn't commit a truncated script
+				readErr <- input.err
+				_ = cli.ContainerKill(context.Background(), containerID, "KILL")
+			}
+			// Closing stdin signals EOF to the process (StdinOnce)
+			_ = attach.CloseWrite()
+			inputErr <- err
+		}()
+	}
+
+	stderrCapture := NewContainerOutput()
+	if _, err := stdcopy.StdCopy(stdout, io.MultiWriter(stderr, stderrCapture), attach.Reader); err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+		return daemonError(fmt.Errorf("failed to read container output: %w", err))
+	}
+
+	waitCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	var exitCode int
+	select {
+	case result := <-waitCh:
+		exitCode = int(result.StatusCode)
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+		return daemonError(fmt.Errorf("error waiting for container: %w", err))
+	}
+
+	if exitCode != 0 {
+		select {
+		case err := <-readErr:
+			return fmt.Errorf("failed to read container input: %w", err)
+		default:
+		}
+		if stderrStr := strings.TrimSpace(stderrCapture.String()); stderrStr != "" {
+			return &ExitError{Code: exitCode, Output: stderrStr}
 		}
-		return fmt.Errorf("container exited with code %d", exitCode)
+		return &ExitError{Code: exitCode}
+	}
+
+	if err := <-inputErr; err != nil {
+		return fmt.Errorf("failed to write container input: %w", err)
 	}
 	return nil
 }
 
+// inputReader records the error of a failed read, as opposed to a failed
+// write to the container.
+type inputReader struct {
+	r   io.Reader
+	err error
+}
+
+func (i *inputReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if err != nil && err != io.EOF {
+		i.err = err
+	}
+	return n, err
+}
+
+// contextError describes why a container was stopped early. The context error
+// is wrapped so callers can match context.DeadlineExceeded.
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("container timed out: %w", ctx.Err())
+	}
+	return fmt.Errorf("container cancelled: %w", ctx.Err())
+}
+
+// ExitError is returned when a container ran and exited non-zero. Output is
+// what it printed to stderr (or stdout, when stderr was empty).
+type ExitError struct {
+	Code   int
+	Output string
+}
+
+func (e *ExitError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("container exited with code %d", e.Code)
+	}
+	return fmt.Sprintf("container exited with code %d: %s", e.Code, e.Output)
+}
+
+// DaemonError marks a failure of Docker itself (daemon unreachable, image
+// pull, creating or starting a container), as opposed to a container that
+// ran and failed (ExitError).
+type DaemonError struct {
+	Err error
+}
+
+func (e *DaemonError) Error() string { return e.Err.Error() }
+
+func (e *DaemonError) Unwrap() error { return e.Err }
+
+func daemonError(err error) error {
+	return &DaemonError{Err: err}
+}
+
 type ContainerOutput struct {
 	data []byte
 }
@@ -0,0 +1,120 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels set on helper containers. Every container started by this package
+// carries LabelManagedBy; the others describe what it is working on.
+const (
+	LabelManagedBy = "managed-by"
+	LabelProject   = "pg-backup-scheduler.project"
+	LabelRunID     = "pg-backup-scheduler.run-id"
+	LabelRestoreID = "pg-backup-scheduler.restore-id"
+	LabelTask      = "pg-backup-scheduler.task"
+
+	managedByValue = "pg-backup-scheduler"
+)
+
+type labelsKey struct{}
+
+// WithLabels returns a context whose helper containers get labels, in
+// addition to labels from parent contexts.
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	merged := make(map[string]string)
+	for k, v := range contextLabels(ctx) {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, labelsKey{}, merged)
+}
+
+func contextLabels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(labelsKey{}).(map[string]string)
+	return labels
+}
+
+// containerLabels combines a container's own labels with those from ctx and
+// the managed-by label.
+func containerLabels(ctx context.Context, own map[string]string) map[string]string {
+	labels := map[string]string{LabelManagedBy: managedByValue}
+	for k, v := range contextLabels(ctx) {
+		labels[k] = v
+	}
+	for k, v := range own {
+		labels[k] = v
+	}
+	return labels
+}
+
+// ManagedContainer is a helper container started by the scheduler.
+type ManagedContainer struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	State     string    `json:"state"`
+	Status    string    `json:"status"`
+	Task      string    `json:"task,omitempty"`
+	Project   string    `json:"project,omitempty"`
+	RunID     string    `json:"run_id,omitempty"`
+	RestoreID string    `json:"restore_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListManagedContainers returns all helper containers, running or not.
+func ListManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelManagedBy+"="+managedByValue)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	result := make([]ManagedContainer, 0, len(containers))
+	for _, c := range containers {
+		name := ""
+		if len(c.Names) > 0 {
+			name = c.Names[0]
+		}
+		result = append(result, ManagedContainer{
+			ID:        c.ID,
+			Name:      name,
+			Image:     c.Image,
+			State:     c.State,
+			Status:    c.Status,
+			Task:      c.Labels[LabelTask],
+			Project:   c.Labels[LabelProject],
+			RunID:     c.Labels[LabelRunID],
+			RestoreID: c.Labels[LabelRestoreID],
+			CreatedAt: time.Unix(c.Created, 0),
+		})
+	}
+	return result, nil
+}
+
+// RemoveManagedContainers force-removes all helper containers and returns
+// them. Only call it when no backup or restore is running, e.g. at startup,
+// where any helper container was left behind by a process that crashed.
+func RemoveManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	containers, err := ListManagedContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []ManagedContainer
+	for _, c := range containers {
+		if err := cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
+			return removed, fmt.Errorf("failed to remove container %s: %w", c.ID, err)
+		}
+		removed = append(removed, c)
+	}
+	return removed, nil
+}
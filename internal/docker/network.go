@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/system"
+)
+
+// NetworkMode controls how helper containers reach databases.
+type NetworkMode string
+
+const (
+	// NetworkAuto uses host networking where the daemon supports it and
+	// falls back to bridge networking otherwise
+	NetworkAuto   NetworkMode = "auto"
+	NetworkHost   NetworkMode = "host"
+	NetworkBridge NetworkMode = "bridge"
+)
+
+var networkMode = NetworkAuto
+
+// ParseNetworkMode validates a NETWORK_MODE value.
+func ParseNetworkMode(value string) (NetworkMode, error) {
+	switch mode := NetworkMode(strings.ToLower(value)); mode {
+	case NetworkAuto, NetworkHost, NetworkBridge:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid network mode %q (expected auto, host or bridge)", value)
+	}
+}
+
+// SetNetworkMode sets the network mode used by helper containers.
+func SetNetworkMode(mode NetworkMode) {
+	networkMode = mode
+}
+
+// ResolveNetworkMode replaces NetworkAuto with host or bridge networking for
+// the connected daemon. It returns the mode in use and, if bridge networking
+// was chosen automatically, the reason.
+func ResolveNetworkMode(ctx context.Context) (NetworkMode, string, error) {
+	if networkMode != NetworkAuto {
+		return networkMode, "", nil
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query Docker daemon info: %w", err)
+	}
+	reason := hostNetworkUnsupported(info)
+	if reason == "" {
+		networkMode = NetworkHost
+	} else {
+		networkMode = NetworkBridge
+	}
+	return networkMode, reason, nil
+}
+
+// HostNetwork reports whether helper containers share the host's network.
+// An unresolved auto mode keeps the historical default of host networking.
+func HostNetwork() bool {
+	return networkMode != NetworkBridge
+}
+
+// hostNetworkUnsupported explains why the daemon's "host" network is not the
+// network of the machine running the scheduler, or returns "" if it is.
+// Docker Desktop runs containers in a VM and rootless Docker in its own
+// network namespace.
+func hostNetworkUnsupported(info system.Info) string {
+	if strings.Contains(info.OperatingSystem, "Docker Desktop") {
+		return "Docker Desktop"
+	}
+	for _, opt := range info.SecurityOptions {
+		if strings.Contains(opt, "name=rootless") {
+			return "rootless Docker"
+		}
+	}
+	return ""
+}
+
+// PublishedPort finds a running container that publishes the TCP port port
+// on the host. It returns the network to attach to and the container's
+// address and port on it, so a database running in a container can be
+// reached directly instead of through the host.
+func PublishedPort(ctx context.Context, port int) (network, ip string, containerPort int, found bool, err error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return "", "", 0, false, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.Type != "tcp" || int(p.PublicPort) != port || c.NetworkSettings == nil {
+				continue
+			}
+			// Prefer the default bridge network, otherwise pick deterministically
+			names := make([]string, 0, len(c.NetworkSettings.Networks))
+			for name, endpoint := range c.NetworkSettings.Networks {
+				if endpoint != nil && endpoint.IPAddress != "" {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			sort.Strings(names)
+			name := names[0]
+			if endpoint := c.NetworkSettings.Networks["bridge"]; endpoint != nil && endpoint.IPAddress != "" {
+				name = "bridge"
+			}
+			return name, c.NetworkSettings.Networks[name].IPAddress, int(p.PrivatePort), true, nil
+		}
+	}
+	return "", "", 0, false, nil
+}
@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// ServiceContainer is a long-running helper container, such as the throwaway
+// database of a restore rehearsal.
+type ServiceContainer struct {
+	ID string
+	// IP is the container's address on its network, reachable from the host
+	// and from helper containers on the default bridge
+	IP string
+}
+
+// StartService starts a container and waits until its healthcheck
+// (cfg.Healthcheck, required) reports healthy. The container is removed
+// again if it doesn't become healthy.
+func StartService(ctx context.Context, cfg container.Config, hostConfig container.HostConfig) (*ServiceContainer, error) {
+	if cfg.Healthcheck == nil {
+		return nil, fmt.Errorf("service container needs a healthcheck")
+	}
+	if err := PullImageIfNotCached(ctx, cfg.Image); err != nil {
+		return nil, err
+	}
+	if err := VerifyImageDigest(ctx, cfg.Image); err != nil {
+		return nil, err
+	}
+
+	cfg.Labels = containerLabels(ctx, cfg.Labels)
+	resp, err := cli.ContainerCreate(ctx, &cfg, &hostConfig, &network.NetworkingConfig{}, nil, "")
+	if err != nil {
+		return nil, daemonError(fmt.Errorf("failed to create container: %w", err))
+	}
+	service := &ServiceContainer{ID: resp.ID}
+
+	if err := cli.ContainerStart(ctx, service.ID, container.StartOptions{}); err != nil {
+		service.Remove()
+		return nil, daemonError(fmt.Errorf("failed to start container: %w", err))
+	}
+	if err := service.waitHealthy(ctx); err != nil {
+		service.Remove()
+		return nil, err
+	}
+	return service, nil
+}
+
+// waitHealthy polls the container until it is healthy and records its IP.
+func (s *ServiceContainer) waitHealthy(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		inspect, err := cli.ContainerInspect(ctx, s.ID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx)
+			}
+			return daemonError(fmt.Errorf("failed to inspect container: %w", err))
+		}
+		if inspect.State != nil && !inspect.State.Running {
+			return fmt.Errorf("container exited with code %d before becoming healthy", inspect.State.ExitCode)
+		}
+		if inspect.State != nil && inspect.State.Health != nil && inspect.State.Health.Status == types.Unhealthy {
+			return fmt.Errorf("container is unhealthy")
+		}
+		if inspect.State != nil && inspect.State.Health != nil && inspect.State.Health.Status == types.Healthy {
+			if inspect.NetworkSettings != nil {
+				if endpoint := inspect.NetworkSettings.Networks["bridge"]; endpoint != nil {
+					s.IP = endpoint.IPAddress
+				}
+				for _, endpoint := range inspect.NetworkSettings.Networks {
+					if s.IP == "" && endpoint != nil {
+						s.IP = endpoint.IPAddress
+					}
+				}
+			}
+			if s.IP == "" {
+				return fmt.Errorf("container has no IP address")
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Remove stops and deletes the container, also when ctx has expired.
+func (s *ServiceContainer) Remove() error {
+	return cli.ContainerRemove(context.Background(), s.ID, container.RemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	})
+}
@@ -0,0 +1,175 @@
+// Package durable makes the writes a backup depends on survive a host crash
+// (DURABLE_WRITES): files are synced to disk before they count as written,
+// and directories after entries were created, renamed or removed in them.
+// Without it the page cache decides, and a crash right after a "successful"
+// backup can leave empty or missing files.
+package durable
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+var enabled bool
+
+// SetEnabled turns syncing on or off.
+func SetEnabled(on bool) {
+	enabled = on
+}
+
+// Enabled reports whether writes are synced.
+func Enabled() bool {
+	return enabled
+}
+
+// SyncFile flushes an open file's data to disk.
+func SyncFile(file *os.File) error {
+	if !enabled {
+		return nil
+	}
+	return file.Sync()
+}
+
+// SyncDir flushes a directory's entries to disk, making files created,
+// renamed or removed in it permanent.
+func SyncDir(path string) error {
+	if !enabled {
+		return nil
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Windows can't open directories for syncing; NTFS journals them
+	if err := dir.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
+
+// SyncDirs syncs dir and each directory above it up to and including root,
+// for paths created with os.MkdirAll below root.
+func SyncDirs(root, dir string) error {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if err := SyncDir(dir); err != nil {
+			return err
+		}
+		if dir == root || !strings.HasPrefix(dir, root) || filepath.Dir(dir) == dir {
+			return nil
+		}
+	}
+}
+
+// WriteFile replaces the file at path atomically: data is written to a
+// temporary file next to it and renamed over path, so readers and crashes
+// never see a partial file. When enabled, the temporary file is synced
+// before the rename and the directory after it.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := SyncFile(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// Rename renames oldpath to newpath like os.Rename, then syncs the
+// directories of both.
+func Rename(oldpath, newpath string) error {
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	if err := SyncDir(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+		return SyncDir(filepath.Dir(oldpath))
+	}
+	return nil
+}
+
+// Move moves oldpath to newpath like os.Rename, but also across file systems
+// (STAGING_DIR on a different volume than the backups): the file is copied
+// to a temporary file next to newpath, synced, renamed into place and only
+// then removed from oldpath. The copy is synced even when syncing is off,
+// since it is the only one left afterwards.
+func Move(oldpath, newpath string) error {
+	err := os.Rename(oldpath, newpath)
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+
+	src, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(newpath), filepath.Base(newpath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), newpath); err != nil {
+		return err
+	}
+	if err := SyncDir(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(oldpath)
+}
+
+// crossDevice reports whether a rename failed because the paths are on
+// different file systems.
+func crossDevice(err error) bool {
+	if errors.Is(err, syscall.EXDEV) {
+		return true
+	}
+	// ERROR_NOT_SAME_DEVICE
+	var errno syscall.Errno
+	return runtime.GOOS == "windows" && errors.As(err, &errno) && errno == 17
+}
@@ -0,0 +1,438 @@
+package importer
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/layout"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+// Formats of imported files. Only FormatArchive, this tool's own archive
+// format, can be restored; the others are listed and retained like any
+// other backup.
+const (
+	FormatArchive = "archive"
+	FormatSQL     = "sql"
+	FormatSQLGzip = "sql.gz"
+	FormatCustom  = "custom"
+)
+
+// extensions maps the formats to the file extensions imported files get.
+var extensions = map[string]string{
+	FormatArchive: ".tar.gz",
+	FormatSQL:     ".sql",
+	FormatSQLGzip: ".sql.gz",
+	FormatCustom:  ".dump",
+}
+
+// customMagic starts every pg_dump custom format (-Fc) file.
+const customMagic = "PGDMP"
+
+// fileDate matches a date in a file name, with an optional time:
+// 2024-01-31, 20240131, 2024-01-31_231500, 20240131T2315.
+var fileDate = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})(?:[T_-]?(\d{2}):?(\d{2})(?::?(\d{2}))?)?`)
+
+// Options configure Import.
+type Options struct {
+	// Project is the project to import into. It may be empty for archives
+	// of this tool, which name their project
+	Project string
+	// Move moves the file into the backup directory instead of copying it
+	Move bool
+}
+
+// file is what could be learned about a backup file.
+type file struct {
+	format  string
+	project string
+	runID   string
+	started time.Time
+	archive *backup.ArchiveManifest
+}
+
+// Import registers a backup file from outside, such as an archive of an
+// older installation or a manual pg_dump, in the catalog of cfg's backup
+// directory. The file is copied (or moved) to where l places the project's
+// backups and gets a manifest with best-effort metadata: the embedded
+// manifest of archives, else the date in the file name or its mtime.
+func Import(cfg *config.Config, l *layout.Layout, path string, opts Options) (*catalog.Entry, error) {
+	source, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := inspect(source)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.ToLower(opts.Project)
+	if project == "" {
+		project = f.project
+	}
+	if project == "" {
+		return nil, fmt.Errorf("%s doesn't name its project, use --project", path)
+	}
+	if !catalog.ValidName(project) {
+		return nil, fmt.Errorf("invalid project name %q", project)
+	}
+	if f.project != "" && f.project != project {
+		// The embedded run ID names the other project
+		f.runID = ""
+	}
+
+	baseDir := cfg.LocalBackupDir
+	runID, err := uniqueRunID(baseDir, project, f)
+	if err != nil {
+		return nil, err
+	}
+	date := f.started.Format("2006-01-02")
+	dir, name, err := l.Path(layout.Vars{
+		Project:   project,
+		Group:     cfg.ProjectGroup(project),
+		Namespace: cfg.ProjectNamespace(project),
+		RunID:     runID,
+		Date:      date,
+		Instance:  cfg.InstanceName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.format != FormatArchive {
+		name = strings.TrimSuffix(name, extensions[FormatArchive]) + extensions[f.format]
+	}
+	destDir := filepath.Join(baseDir, filepath.FromSlash(dir))
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	dest := filepath.Join(destDir, name)
+	if _, err := os.Stat(dest); err == nil {
+		return nil, fmt.Errorf("%s already exists", dest)
+	}
+	if opts.Move {
+		err = moveFile(source, dest)
+	} else {
+		err = copyFile(source, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeManifest(destDir, name, runID, project, source, f); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+	return catalog.Get(baseDir, project, runID)
+}
+
+// Scan adopts the backup files under the projects' directories that no
+// manifest refers to, in place: each gets a manifest next to it. Files in
+// hidden directories (such as .tmp) and files that can't be identified are
+// skipped. It returns the adopted backups.
+func Scan(baseDir string, projects []string) ([]*catalog.Entry, error) {
+	var adopted []*catalog.Entry
+	for _, project := range projects {
+		entries, err := catalog.List(baseDir, project)
+		if err != nil {
+			return adopted, err
+		}
+		known := make(map[string]bool)
+		for _, entry := range entries {
+			for _, path := range entry.Files {
+				known[path] = true
+			}
+		}
+
+		var candidates []string
+		projectDir := filepath.Join(baseDir, project)
+		err = filepath.WalkDir(projectDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == projectDir {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if d.IsDir() {
+				if path != projectDir && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() && !known[path] && candidate(path) {
+				candidates = append(candidates, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return adopted, fmt.Errorf("failed to scan %s: %w", projectDir, err)
+		}
+
+		for _, path := range candidates {
+			entry, err := adopt(baseDir, project, path)
+			if err != nil {
+				// Not a backup, or not one we understand
+				continue
+			}
+			adopted = append(adopted, entry)
+		}
+	}
+	return adopted, nil
+}
+
+// adopt registers a file under a project directory where it is.
+func adopt(baseDir, project, path string) (*catalog.Entry, error) {
+	f, err := inspect(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.project != "" && f.project != project {
+		f.runID = ""
+	}
+	runID, err := uniqueRunID(baseDir, project, f)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeManifest(filepath.Dir(path), filepath.Base(path), runID, project, path, f); err != nil {
+		return nil, err
+	}
+	return catalog.Get(baseDir, project, runID)
+}
+
+// candidate reports whether a file looks like a backup: it has one of the
+// extensions of the supported formats and isn't a file of this tool's own
+// backups, such as an archive whose manifest couldn't be read.
+func candidate(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, "manifest-") || strings.HasPrefix(name, "pin-") {
+		return false
+	}
+	if runID, ok := strings.CutPrefix(name, "backup-"); ok {
+		runID = strings.TrimSuffix(runID, extensions[FormatArchive])
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), "manifest-"+runID+".json")); err == nil {
+			return false
+		}
+	}
+	for _, ext := range []string{".tar.gz", ".sql", ".sql.gz", ".dump", ".backup"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// inspect identifies the format of a backup file and when it was taken.
+func inspect(path string) (*file, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	format, err := detectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{format: format, started: info.ModTime().Local()}
+	if t, ok := dateFromName(filepath.Base(path)); ok {
+		f.started = t
+	}
+	if format == FormatArchive {
+		// Version 1 archives have no embedded manifest
+		manifest, err := backup.ReadArchiveManifest(path)
+		if err == nil && manifest != nil {
+			f.archive = manifest
+			f.project = manifest.DatabaseID
+			f.runID = manifest.RunID
+			if t, err := time.Parse(time.RFC3339, manifest.StartedAt); err == nil {
+				f.started = t.Local()
+			}
+		}
+	}
+	return f, nil
+}
+
+// detectFormat tells the formats apart by their content, falling back to
+// the extension for plain SQL.
+func detectFormat(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	header := make([]byte, len(customMagic))
+	n, _ := io.ReadFull(fh, header)
+	if string(header[:n]) == customMagic {
+		return FormatCustom, nil
+	}
+	if n >= 2 && header[0] == 0x1f && header[1] == 0x8b {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		gzr, err := gzip.NewReader(fh)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		defer gzr.Close()
+		br := bufio.NewReader(gzr)
+		if isTar(br) {
+			return FormatArchive, nil
+		}
+		if strings.HasSuffix(path, ".tar.gz") {
+			return "", fmt.Errorf("%s is not a pg-backup-scheduler archive", path)
+		}
+		return FormatSQLGzip, nil
+	}
+	if strings.HasSuffix(path, ".sql") {
+		return FormatSQL, nil
+	}
+	return "", fmt.Errorf("unsupported backup file %s: expected a backup archive, SQL dump or pg_dump custom format file", path)
+}
+
+// isTar reports whether r is a tar stream holding a schema.sql, like this
+// tool's archives.
+func isTar(r io.Reader) bool {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return false
+		}
+		if header.Name == "schema.sql" {
+			return true
+		}
+	}
+}
+
+// dateFromName returns the date (and time) in a file name, in the local zone.
+func dateFromName(name string) (time.Time, bool) {
+	for _, m := range fileDate.FindAllStringSubmatch(name, -1) {
+		hour, minute, second := m[4], m[5], m[6]
+		if hour == "" {
+			hour, minute = "00", "00"
+		}
+		if second == "" {
+			second = "00"
+		}
+		value := m[1] + m[2] + m[3] + hour + minute + second
+		if t, err := time.ParseInLocation("20060102150405", value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// uniqueRunID returns the run ID of the imported backup: the embedded one,
+// unless a backup with it exists, else <project>-<date>-<time> like backups
+// taken by the scheduler, with a suffix if that is taken.
+func uniqueRunID(baseDir, project string, f *file) (string, error) {
+	entries, err := catalog.List(baseDir, project)
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		taken[entry.RunID] = true
+	}
+	if f.runID != "" && catalog.ValidName(f.runID) && !taken[f.runID] {
+		return f.runID, nil
+	}
+	runID := fmt.Sprintf("%s-%s-%s", project, f.started.Format("2006-01-02"), f.started.Format("150405"))
+	for i := 2; taken[runID]; i++ {
+		runID = fmt.Sprintf("%s-%s-%s-%d", project, f.started.Format("2006-01-02"), f.started.Format("150405"), i)
+	}
+	return runID, nil
+}
+
+// writeManifest writes the manifest of an imported file next to it.
+func writeManifest(dir, name, runID, project, source string, f *file) error {
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	sum, err := backup.FileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	manifest := &backup.BackupManifest{
+		RunID:      runID,
+		DatabaseID: project,
+		StartedAt:  f.started.Format(time.RFC3339),
+		FinishedAt: f.started.Format(time.RFC3339),
+		Status:     "success",
+		Files:      []backup.File{{Name: name, Size: info.Size(), SHA256: sum}},
+		Imported: &backup.ImportInfo{
+			Source:     source,
+			Format:     f.format,
+			ImportedAt: time.Now().Format(time.RFC3339),
+		},
+	}
+	if a := f.archive; a != nil {
+		manifest.PGVersion = a.PGVersion
+		manifest.DatabaseSizeBytes = a.DatabaseSizeBytes
+		manifest.DataDumpStyle = a.DumpOptions.DataDumpStyle
+		manifest.RolesDump = a.DumpOptions.RolesDump
+		manifest.Provider = a.DumpOptions.Provider
+		manifest.SharedSnapshot = a.DumpOptions.SharedSnapshot
+		manifest.Tables = a.Tables
+		manifest.RowCountMethod = a.RowCountMethod
+		manifest.ArchiveFormat = a.Format
+		manifest.Incremental = a.Incremental
+	}
+	return backup.SaveManifest(filepath.Join(dir, fmt.Sprintf("manifest-%s.json", runID)), manifest)
+}
+
+func copyFile(source, dest string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dest, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+	if err := durable.SyncFile(out); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+	return nil
+}
+
+// moveFile renames source to dest, copying it across file systems.
+func moveFile(source, dest string) error {
+	err := durable.Rename(source, dest)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(source, dest); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
@@ -0,0 +1,114 @@
+package layout
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Default is the layout of backups without LAYOUT_TEMPLATE:
+// <project>/<date>/backup-<run_id>.tar.gz.
+const Default = "{{.Project}}/{{.Date}}/backup-{{.RunID}}"
+
+// archiveExt is appended to rendered paths that don't end with it.
+const archiveExt = ".tar.gz"
+
+// Standard is the parsed Default layout.
+var Standard = mustParse(Default)
+
+// Vars are the values available to a layout template.
+type Vars struct {
+	Project string
+	// Group and Namespace are the project's group and namespace, empty for
+	// projects without one
+	Group     string
+	Namespace string
+	RunID     string
+	// Date is the backup date (YYYY-MM-DD), Year, Month and Day its parts
+	Date  string
+	Year  string
+	Month string
+	Day   string
+
+	// Instance is INSTANCE_NAME, empty if unset
+	Instance string
+}
+
+// Layout places a backup's archive relative to the backup directory and the
+// remote storage root. The manifest always sits next to the archive as
+// manifest-<run_id>.json, which is how the catalog finds backups.
+type Layout struct {
+	text string
+	tmpl *template.Template
+}
+
+// Parse compiles a layout template, or returns Standard for an empty one. The
+// template renders the archive path with or without ".tar.gz"; it must start
+// with the project ({{.Project}}/...) and put the run ID into the file name,
+// so backups of a project stay under its directory and never overwrite each
+// other.
+func Parse(text string) (*Layout, error) {
+	if strings.TrimSpace(text) == "" {
+		return Standard, nil
+	}
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout template: %w", err)
+	}
+	l := &Layout{text: text, tmpl: tmpl}
+	if _, _, err := l.Path(Vars{Project: "project", Group: "group", Namespace: "namespace", Instance: "instance", RunID: "project-2006-01-02-150405", Date: "2006-01-02"}); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func mustParse(text string) *Layout {
+	tmpl := template.Must(template.New("layout").Option("missingkey=error").Parse(text))
+	return &Layout{text: text, tmpl: tmpl}
+}
+
+// String returns the template text.
+func (l *Layout) String() string {
+	return l.text
+}
+
+// Path renders the location of a backup from vars, whose Year, Month and Day
+// are derived from Date: dir is the directory holding the archive and
+// manifest, archive the archive's file name. dir uses forward slashes and is
+// relative to the backup directory (or remote root).
+func (l *Layout) Path(vars Vars) (dir, archive string, err error) {
+	project, runID := vars.Project, vars.RunID
+	if parts := strings.Split(vars.Date, "-"); len(parts) == 3 {
+		vars.Year, vars.Month, vars.Day = parts[0], parts[1], parts[2]
+	}
+
+	var b strings.Builder
+	if err := l.tmpl.Execute(&b, vars); err != nil {
+		return "", "", fmt.Errorf("failed to render layout template: %w", err)
+	}
+	rendered := b.String()
+	if strings.ContainsAny(rendered, "\\\x00") || strings.HasPrefix(rendered, "/") {
+		return "", "", fmt.Errorf("layout %q renders an invalid path %q", l.text, rendered)
+	}
+	// Empty segments (e.g. {{.Group}} of a project without one) collapse
+	rendered = path.Clean(rendered)
+	for _, segment := range strings.Split(rendered, "/") {
+		if segment == ".." || segment == "." {
+			return "", "", fmt.Errorf("layout %q renders an invalid path %q", l.text, rendered)
+		}
+	}
+
+	dir, archive = path.Split(rendered)
+	dir = strings.TrimSuffix(dir, "/")
+	if first, _, _ := strings.Cut(dir, "/"); dir == "" || first != project {
+		return "", "", fmt.Errorf("layout %q must start with the project directory ({{.Project}}/...)", l.text)
+	}
+	if !strings.Contains(archive, runID) {
+		return "", "", fmt.Errorf("layout %q must contain the run ID ({{.RunID}}) in the file name", l.text)
+	}
+	if !strings.HasSuffix(archive, archiveExt) {
+		archive += archiveExt
+	}
+	return dir, archive, nil
+}
@@ -0,0 +1,77 @@
+package layout
+
+import (
+	"strings"
+	"testing"
+)
+
+var testVars = Vars{Project: "app", RunID: "app-2026-01-02-003000", Date: "2026-01-02", Namespace: "team-a", Instance: "eu1"}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		wantDir     string
+		wantArchive string
+		wantErr     string
+	}{
+		{name: "default", text: "", wantDir: "app/2026-01-02", wantArchive: "backup-app-2026-01-02-003000.tar.gz"},
+		{name: "date parts", text: "{{.Project}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.RunID}}", wantDir: "app/2026/01/02", wantArchive: "app-2026-01-02-003000.tar.gz"},
+		{name: "extension kept", text: "{{.Project}}/{{.RunID}}.tar.gz", wantDir: "app", wantArchive: "app-2026-01-02-003000.tar.gz"},
+		{name: "empty group collapses", text: "{{.Project}}/{{.Group}}/{{.Date}}/{{.RunID}}", wantDir: "app/2026-01-02", wantArchive: "app-2026-01-02-003000.tar.gz"},
+		{name: "namespace and instance", text: "{{.Project}}/{{.Namespace}}/{{.Instance}}-{{.RunID}}", wantDir: "app/team-a", wantArchive: "eu1-app-2026-01-02-003000.tar.gz"},
+		{name: "redundant segments", text: "{{.Project}}/./{{.Date}}//{{.RunID}}", wantDir: "app/2026-01-02", wantArchive: "app-2026-01-02-003000.tar.gz"},
+
+		{name: "syntax error", text: "{{.Project}/{{.RunID}}", wantErr: "invalid layout template"},
+		{name: "unknown field", text: "{{.Project}}/{{.Host}}/{{.RunID}}", wantErr: "failed to render layout template"},
+		{name: "no project prefix", text: "backups/{{.Project}}/{{.RunID}}", wantErr: "must start with the project directory"},
+		{name: "project not first", text: "{{.Date}}/{{.Project}}/{{.RunID}}", wantErr: "must start with the project directory"},
+		{name: "file directly in root", text: "{{.Project}}-{{.RunID}}", wantErr: "must start with the project directory"},
+		{name: "run ID in directory only", text: "{{.Project}}/{{.RunID}}/backup", wantErr: "must contain the run ID"},
+		{name: "no run ID", text: "{{.Project}}/{{.Date}}/backup", wantErr: "must contain the run ID"},
+		{name: "absolute", text: "/{{.Project}}/{{.RunID}}", wantErr: "renders an invalid path"},
+		{name: "parent directory", text: "../{{.Project}}/{{.RunID}}", wantErr: "renders an invalid path"},
+		{name: "escapes the project", text: "{{.Project}}/../{{.RunID}}", wantErr: "must start with the project directory"},
+		{name: "backslash", text: "{{.Project}}\\{{.RunID}}", wantErr: "renders an invalid path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Parse(tt.text)
+			if err == nil {
+				var dir, archive string
+				if dir, archive, err = l.Path(testVars); err == nil && tt.wantErr == "" {
+					if dir != tt.wantDir || archive != tt.wantArchive {
+						t.Fatalf("Path() = %q, %q, want %q, %q", dir, archive, tt.wantDir, tt.wantArchive)
+					}
+					return
+				}
+			}
+			if tt.wantErr == "" {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPathRejectsUnsafeValues(t *testing.T) {
+	tests := []struct {
+		name string
+		vars Vars
+	}{
+		{name: "parent project", vars: Vars{Project: "..", RunID: "x-2026-01-02-003000", Date: "2026-01-02"}},
+		{name: "current project", vars: Vars{Project: ".", RunID: "x-2026-01-02-003000", Date: "2026-01-02"}},
+		{name: "absolute project", vars: Vars{Project: "/etc", RunID: "x-2026-01-02-003000", Date: "2026-01-02"}},
+		{name: "traversing date", vars: Vars{Project: "app", RunID: "app-2026-01-02-003000", Date: "../.."}},
+		{name: "nul byte", vars: Vars{Project: "app\x00", RunID: "app-2026-01-02-003000", Date: "2026-01-02"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if dir, archive, err := Standard.Path(tt.vars); err == nil {
+				t.Fatalf("Path() = %q, %q, want an error", dir, archive)
+			}
+		})
+	}
+}
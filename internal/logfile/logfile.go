@@ -0,0 +1,115 @@
+// Package logfile writes logs to a file that is rotated by size: when a write
+// would grow it beyond the limit, it is renamed to <path>.1 (older files move
+// up to <path>.2, ...) and a new file is started. Only the newest rotated
+// files are kept.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Writer is a size-rotated log file, safe for concurrent use.
+type Writer struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens (appending to) or creates the log file at path. Files grow to
+// maxSize bytes (0 = never rotate) and maxBackups rotated files are kept.
+func Open(path string, maxSize int64, maxBackups int) (*Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	w := &Writer{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// Write writes p, rotating first if p doesn't fit. An entry larger than
+// maxSize is written to a file of its own.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files up by one, dropping the oldest, and starts
+// a new file. If that fails, the current file is reopened so later writes
+// still land somewhere.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	if err := w.shift(); err != nil {
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return w.open()
+}
+
+// shift moves the closed file out of the way.
+func (w *Writer) shift() error {
+	if w.maxBackups <= 0 {
+		return os.Remove(w.path)
+	}
+	_ = os.Remove(w.backupPath(w.maxBackups))
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(w.backupPath(i), w.backupPath(i+1))
+	}
+	return os.Rename(w.path, w.backupPath(1))
+}
+
+func (w *Writer) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// Sync flushes the file to disk.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Sync()
+}
+
+// Close closes the file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,124 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		writes     []string
+		want       map[string]string
+		wantGone   []string
+	}{
+		{
+			name:       "fits",
+			maxBackups: 2,
+			writes:     []string{"aaaa\n", "bbbb\n"},
+			want:       map[string]string{"app.log": "aaaa\nbbbb\n"},
+			wantGone:   []string{"app.log.1"},
+		},
+		{
+			name:       "rotated",
+			maxBackups: 2,
+			writes:     []string{"aaaa\n", "bbbb\n", "cccc\n"},
+			want:       map[string]string{"app.log": "cccc\n", "app.log.1": "aaaa\nbbbb\n"},
+		},
+		{
+			name:       "oldest dropped",
+			maxBackups: 2,
+			writes:     []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"},
+			want:       map[string]string{"app.log": "dddddddd\n", "app.log.1": "cccccccc\n", "app.log.2": "bbbbbbbb\n"},
+			wantGone:   []string{"app.log.3"},
+		},
+		{
+			name:       "no backups",
+			maxBackups: 0,
+			writes:     []string{"aaaaaaaa\n", "bbbbbbbb\n"},
+			want:       map[string]string{"app.log": "bbbbbbbb\n"},
+			wantGone:   []string{"app.log.1"},
+		},
+		{
+			name:       "entry larger than the limit",
+			maxBackups: 1,
+			writes:     []string{"aaaa\n", strings.Repeat("b", 20) + "\n", "cccc\n"},
+			want:       map[string]string{"app.log": "cccc\n", "app.log.1": strings.Repeat("b", 20) + "\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := Open(filepath.Join(dir, "app.log"), 10, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			for _, line := range tt.writes {
+				if _, err := w.Write([]byte(line)); err != nil {
+					t.Fatalf("Write(%q): %v", line, err)
+				}
+			}
+			for name, want := range tt.want {
+				if got := readFile(t, filepath.Join(dir, name)); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for _, name := range tt.wantGone {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s exists, want it gone", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateFailureKeepsWriting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	w, err := Open(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// A non-empty directory where the rotated file goes makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("aaaaaaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("bbbbbbbb\n")); err == nil || !strings.Contains(err.Error(), "failed to rotate log file") {
+		t.Fatalf("Write() = %v, want the rotation error", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatalf("Sync() after failed rotation: %v", err)
+	}
+
+	// Once the rotated file can be moved away, rotation resumes
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("cccccccc\n")); err != nil {
+		t.Fatalf("Write() after clearing the way: %v", err)
+	}
+	if got := readFile(t, path+".1"); got != "aaaaaaaa\n" {
+		t.Errorf("app.log.1 = %q, want the first entry", got)
+	}
+	if got := readFile(t, path); got != "cccccccc\n" {
+		t.Errorf("app.log = %q, want the last entry", got)
+	}
+}
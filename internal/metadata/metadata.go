@@ -2,90 +2,250 @@ package metadata
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
 )
 
 const (
 	latestRunFile = "latest.json"
 	runningFile   = "running.json"
+	schedulerFile = "scheduler.json"
+	retentionFile = "retention.json"
+	restoresDir   = "restores"
+	rehearsalsDir = "rehearsals"
 )
 
+// ErrCorrupted is returned when a metadata file can't be parsed, e.g. after a
+// crash left it truncated by a version without atomic writes. The file has
+// been moved aside to <name>.corrupt-<time> by then, so the next write
+// recreates it and later reads don't fail again.
+var ErrCorrupted = errors.New("corrupted metadata file")
+
 type ServiceStatus struct {
 	Running bool `json:"running"`
+	// Current is the backup in progress, if any; the one started first when
+	// several are
+	Current *RunProgress `json:"current,omitempty"`
+	// Backups are all backups in progress, in the order they started: a
+	// manual backup can run next to a job's
+	Backups []RunProgress `json:"backups,omitempty"`
+}
+
+// RunProgress describes the backup currently in progress. UpdatedAt moves when
+// bytes are written or the phase changes; HeartbeatAt moves periodically while
+// the backup runs, so a stale UpdatedAt with a fresh HeartbeatAt means the
+// dump is stuck rather than the service.
+type RunProgress struct {
+	RunID          string `json:"run_id,omitempty"`
+	Project        string `json:"project"`
+	Phase          string `json:"phase"`
+	BytesWritten   int64  `json:"bytes_written"`
+	StartedAt      string `json:"started_at"`
+	PhaseStartedAt string `json:"phase_started_at"`
+	UpdatedAt      string `json:"updated_at"`
+	HeartbeatAt    string `json:"heartbeat_at"`
+}
+
+type SchedulerState struct {
+	Paused   bool   `json:"paused"`
+	PausedAt string `json:"paused_at,omitempty"`
 }
 
 func ReadLastRun(baseDir string) (map[string]interface{}, error) {
-	filePath := filepath.Join(baseDir, "metadata", latestRunFile)
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
+	var result map[string]interface{}
+	if err := readJSON(filepath.Join(baseDir, "metadata", latestRunFile), &result); err != nil {
 		return nil, fmt.Errorf("failed to read last run: %w", err)
 	}
+	return result, nil
+}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse last run: %w", err)
+func WriteLastRun(baseDir string, data map[string]interface{}) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", latestRunFile), data); err != nil {
+		return fmt.Errorf("failed to write last run: %w", err)
 	}
+	return nil
+}
 
-	return result, nil
+func ReadServiceStatus(baseDir string) (*ServiceStatus, error) {
+	var status ServiceStatus
+	if err := readJSON(filepath.Join(baseDir, "metadata", runningFile), &status); err != nil {
+		return nil, fmt.Errorf("failed to read service status: %w", err)
+	}
+	return &status, nil
 }
 
-func WriteLastRun(baseDir string, data map[string]interface{}) error {
-	metadataDir := filepath.Join(baseDir, "metadata")
-	if err := os.MkdirAll(metadataDir, 0755); err != nil {
-		return fmt.Errorf("failed to create metadata directory: %w", err)
+func WriteServiceStatus(baseDir string, status *ServiceStatus) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", runningFile), status); err != nil {
+		return fmt.Errorf("failed to write service status: %w", err)
 	}
+	return nil
+}
 
-	filePath := filepath.Join(metadataDir, latestRunFile)
-	dataBytes, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal last run: %w", err)
+func ReadSchedulerState(baseDir string) (*SchedulerState, error) {
+	var state SchedulerState
+	if err := readJSON(filepath.Join(baseDir, "metadata", schedulerFile), &state); err != nil {
+		return nil, fmt.Errorf("failed to read scheduler state: %w", err)
 	}
+	return &state, nil
+}
 
-	if err := os.WriteFile(filePath, dataBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write last run: %w", err)
+func WriteSchedulerState(baseDir string, state *SchedulerState) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", schedulerFile), state); err != nil {
+		return fmt.Errorf("failed to write scheduler state: %w", err)
+	}
+	return nil
+}
+
+// ReadRetentionReport returns the report of the last retention run, or nil if
+// none has run yet.
+func ReadRetentionReport(baseDir string) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	if err := readJSON(filepath.Join(baseDir, "metadata", retentionFile), &result); err != nil {
+		return nil, fmt.Errorf("failed to read retention report: %w", err)
 	}
+	return result, nil
+}
 
+func WriteRetentionReport(baseDir string, report map[string]interface{}) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", retentionFile), report); err != nil {
+		return fmt.Errorf("failed to write retention report: %w", err)
+	}
 	return nil
 }
 
-func ReadServiceStatus(baseDir string) (*ServiceStatus, error) {
-	filePath := filepath.Join(baseDir, "metadata", runningFile)
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return &ServiceStatus{Running: false}, nil
-		}
-		return nil, fmt.Errorf("failed to read service status: %w", err)
+func ReadRestoreReport(baseDir, id string) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	if err := readJSON(filepath.Join(baseDir, "metadata", restoresDir, id+".json"), &result); err != nil {
+		return nil, fmt.Errorf("failed to read restore report: %w", err)
 	}
+	return result, nil
+}
 
-	var status ServiceStatus
-	if err := json.Unmarshal(data, &status); err != nil {
-		return nil, fmt.Errorf("failed to parse service status: %w", err)
+// RestoreLogPath is where the psql output of a restore is kept.
+func RestoreLogPath(baseDir, id string) string {
+	return filepath.Join(baseDir, "metadata", restoresDir, id+".log")
+}
+
+func WriteRestoreReport(baseDir, id string, report interface{}) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", restoresDir, id+".json"), report); err != nil {
+		return fmt.Errorf("failed to write restore report: %w", err)
 	}
+	return nil
+}
 
-	return &status, nil
+func ReadRehearsalReport(baseDir, id string) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	if err := readJSON(filepath.Join(baseDir, "metadata", rehearsalsDir, id+".json"), &result); err != nil {
+		return nil, fmt.Errorf("failed to read rehearsal report: %w", err)
+	}
+	return result, nil
 }
 
-func WriteServiceStatus(baseDir string, status *ServiceStatus) error {
-	metadataDir := filepath.Join(baseDir, "metadata")
-	if err := os.MkdirAll(metadataDir, 0755); err != nil {
-		return fmt.Errorf("failed to create metadata directory: %w", err)
+func WriteRehearsalReport(baseDir, id string, report interface{}) error {
+	if err := writeJSON(filepath.Join(baseDir, "metadata", rehearsalsDir, id+".json"), report); err != nil {
+		return fmt.Errorf("failed to write rehearsal report: %w", err)
 	}
+	return nil
+}
 
-	filePath := filepath.Join(metadataDir, runningFile)
-	dataBytes, err := json.MarshalIndent(status, "", "  ")
+// ListRehearsalReports returns the IDs of all stored rehearsal reports.
+func ListRehearsalReports(baseDir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(baseDir, "metadata", rehearsalsDir, "*.json"))
 	if err != nil {
-		return fmt.Errorf("failed to marshal service status: %w", err)
+		return nil, fmt.Errorf("failed to list rehearsal reports: %w", err)
 	}
+	ids := make([]string, 0, len(matches))
+	for _, match := range matches {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(match), ".json"))
+	}
+	return ids, nil
+}
 
-	if err := os.WriteFile(filePath, dataBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write service status: %w", err)
+// RemoveTempFiles deletes temporary files left behind by writes interrupted
+// by a crash. It must only be called while nothing writes metadata.
+func RemoveTempFiles(baseDir string) error {
+	for _, dir := range []string{
+		filepath.Join(baseDir, "metadata"),
+		filepath.Join(baseDir, "metadata", restoresDir),
+		filepath.Join(baseDir, "metadata", rehearsalsDir),
+	} {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
+// readJSON parses the file at path into v, leaving v untouched if the file
+// doesn't exist. Unparseable files are quarantined and reported as
+// ErrCorrupted.
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		quarantined := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102-150405"))
+		if renameErr := os.Rename(path, quarantined); renameErr != nil {
+			return fmt.Errorf("%w %s: %v (moving it aside failed: %v)", ErrCorrupted, filepath.Base(path), err, renameErr)
+		}
+		return fmt.Errorf("%w %s, moved to %s: %v", ErrCorrupted, filepath.Base(path), filepath.Base(quarantined), err)
+	}
 	return nil
 }
+
+// writeJSON replaces the file at path atomically: the JSON is written to a
+// temporary file in the same directory, synced and renamed over path, so
+// readers and crashes never see a partial file. Concurrent writers each use
+// their own temporary file; the last rename wins. With DURABLE_WRITES the
+// directory is synced as well, so the rename survives a crash.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return durable.SyncDir(dir)
+}
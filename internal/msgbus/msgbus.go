@@ -0,0 +1,96 @@
+// Package msgbus is a minimal client for the message buses backups can be
+// triggered through and report to: NATS (core subjects, no JetStream) and
+// Redis streams. It only covers what the service needs, publishing to and
+// consuming from one subject or stream per connection, so no client library
+// is pulled in.
+package msgbus
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// dialTimeout bounds connecting and the handshake.
+const dialTimeout = 10 * time.Second
+
+// Handler is called with the payload of each consumed message.
+type Handler func(data []byte)
+
+// Bus is a connection to a message bus. A Bus is not safe for concurrent
+// use: consume and publish on separate connections.
+type Bus interface {
+	// Publish sends data to subject, a NATS subject or a Redis stream.
+	Publish(ctx context.Context, subject string, data []byte) error
+	// Consume calls handle with every message sent to subject until ctx is
+	// done (returning nil) or the connection fails. On Redis, group is the
+	// consumer group whose position is kept across restarts; messages are
+	// acknowledged once handle returns. NATS has no position: messages sent
+	// while nobody is subscribed are lost.
+	Consume(ctx context.Context, subject, group string, handle Handler) error
+	Close() error
+}
+
+// Open connects to the bus at rawURL: nats://[user:pass@]host[:4222] (or
+// tls:// to require TLS) or redis://[[user]:pass@]host[:6379][/db] (rediss://
+// for TLS).
+func Open(ctx context.Context, rawURL string) (Bus, error) {
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	switch u.Scheme {
+	case "nats", "tls":
+		return dialNATS(ctx, u)
+	default:
+		return dialRedis(ctx, u)
+	}
+}
+
+// ValidateURL checks a bus URL without connecting.
+func ValidateURL(rawURL string) error {
+	_, err := parseURL(rawURL)
+	return err
+}
+
+func parseURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message bus URL: %w", err)
+	}
+	switch u.Scheme {
+	case "nats", "tls", "redis", "rediss":
+	default:
+		return nil, fmt.Errorf("unsupported message bus %q: use nats://, tls://, redis:// or rediss://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("message bus URL %q has no host", rawURL)
+	}
+	return u, nil
+}
+
+// hostPort is the address of u, with port as the default.
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// closeOnDone closes conn when ctx is done, unblocking reads, and returns a
+// function to stop watching.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,175 @@
+package msgbus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natsBus speaks the NATS client protocol: https://docs.nats.io/reference/reference-protocols/nats-protocol
+type natsBus struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+func dialNATS(ctx context.Context, u *url.URL) (*natsBus, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(u, "4222"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The server introduces itself first; TLS starts after its INFO
+	r := bufio.NewReader(conn)
+	line, err := readLine(r)
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: unexpected greeting %q: %v", line, err)
+	}
+	var info natsInfo
+	_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired || u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect := natsConnect{Name: "pg-backup-scheduler", Lang: "go", Version: "1", Protocol: 1}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	data, _ := json.Marshal(connect)
+	b := &natsBus{conn: conn, r: r}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", data); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	if err := b.awaitPong(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return b, nil
+}
+
+// awaitPong reads until the PONG answering our PING, answering the server's
+// pings in between. Errors (-ERR, e.g. authorization) are returned.
+func (b *natsBus) awaitPong() error {
+	for {
+		line, err := readLine(b.r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(b.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// Publish publishes data and waits for the server to have processed it, so
+// a failed publish is noticed. That also answers pings the server sent in
+// between, which an idle publisher can't: a connection unused for minutes
+// is dropped by the server and the next Publish fails.
+func (b *natsBus) Publish(ctx context.Context, subject string, data []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetDeadline(deadline)
+		defer b.conn.SetDeadline(time.Time{})
+	}
+	if _, err := fmt.Fprintf(b.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(data), data); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	if err := b.awaitPong(); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+func (b *natsBus) Consume(ctx context.Context, subject, _ string, handle Handler) error {
+	defer closeOnDone(ctx, b.conn)()
+	if _, err := fmt.Fprintf(b.conn, "SUB %s 1\r\n", subject); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	for {
+		line, err := readLine(b.r)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("NATS connection lost: %w", err)
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("invalid NATS message header %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(b.r, payload); err != nil {
+				return fmt.Errorf("NATS connection lost: %w", err)
+			}
+			handle(payload[:size])
+		case line == "PING":
+			if _, err := io.WriteString(b.conn, "PONG\r\n"); err != nil {
+				return fmt.Errorf("NATS connection lost: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (b *natsBus) Close() error {
+	return b.conn.Close()
+}
+
+// readLine reads a protocol line without its CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,158 @@
+package msgbus
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATS is the server end of a net.Pipe.
+type fakeNATS struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newFakeNATS(t *testing.T) (*natsBus, *fakeNATS) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	return &natsBus{conn: client, r: bufio.NewReader(client)},
+		&fakeNATS{t: t, conn: server, r: bufio.NewReader(server)}
+}
+
+// send writes protocol lines, or raw payloads, to the client.
+func (f *fakeNATS) send(data string) bool {
+	if _, err := io.WriteString(f.conn, data); err != nil {
+		f.t.Errorf("sending %q: %v", data, err)
+		return false
+	}
+	return true
+}
+
+// expect reads the next line from the client and checks it is want.
+func (f *fakeNATS) expect(want string) bool {
+	line, err := readLine(f.r)
+	if err != nil {
+		f.t.Errorf("reading %q: %v", want, err)
+		return false
+	}
+	if line != want {
+		f.t.Errorf("client sent %q, want %q", line, want)
+		return false
+	}
+	return true
+}
+
+func TestNATSAwaitPong(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  func(f *fakeNATS)
+		wantErr string
+	}{
+		{
+			name:   "pong",
+			server: func(f *fakeNATS) { f.send("PONG\r\n") },
+		},
+		{
+			name: "server ping answered first",
+			server: func(f *fakeNATS) {
+				_ = f.send("PING\r\n") && f.expect("PONG") && f.send("PONG\r\n")
+			},
+		},
+		{
+			name:   "other messages skipped",
+			server: func(f *fakeNATS) { f.send("+OK\r\nINFO {\"server_id\":\"x\"}\r\nPONG\r\n") },
+		},
+		{
+			name:    "authorization error",
+			server:  func(f *fakeNATS) { f.send("-ERR 'Authorization Violation'\r\n") },
+			wantErr: "server error: 'Authorization Violation'",
+		},
+		{
+			name: "error after ping",
+			server: func(f *fakeNATS) {
+				_ = f.send("PING\r\n") && f.expect("PONG") && f.send("-ERR 'Maximum Payload Violation'\r\n")
+			},
+			wantErr: "server error: 'Maximum Payload Violation'",
+		},
+		{
+			name:    "connection closed",
+			server:  func(f *fakeNATS) { f.conn.Close() },
+			wantErr: "EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newFakeNATS(t)
+			go tt.server(server)
+			err := client.awaitPong()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("awaitPong() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNATSPublishReportsServerError(t *testing.T) {
+	client, server := newFakeNATS(t)
+	go func() {
+		_ = server.expect("PUB backups.done 5") && server.expect("hello") && server.expect("PING") &&
+			server.send("-ERR 'Permissions Violation for Publish to \"backups.done\"'\r\n")
+	}()
+
+	err := client.Publish(context.Background(), "backups.done", []byte("hello"))
+	if err == nil || !strings.Contains(err.Error(), "failed to publish: server error: 'Permissions Violation") {
+		t.Fatalf("Publish() = %v, want the permissions error", err)
+	}
+}
+
+func TestNATSConsume(t *testing.T) {
+	client, server := newFakeNATS(t)
+	go func() {
+		_ = server.expect("SUB backups.requests 1") &&
+			server.send("MSG backups.requests 1 5\r\nfirst\r\n") &&
+			server.send("PING\r\n") && server.expect("PONG") &&
+			// With a reply subject, and a payload containing CRLF
+			server.send("MSG backups.requests 1 _INBOX.abc 8\r\nse\r\ncond\r\n") &&
+			server.send("-ERR 'Stale Connection'\r\n")
+	}()
+
+	var got []string
+	err := client.Consume(context.Background(), "backups.requests", "", func(data []byte) {
+		got = append(got, string(data))
+	})
+	if err == nil || !strings.Contains(err.Error(), "NATS server error: 'Stale Connection'") {
+		t.Fatalf("Consume() = %v, want the server error", err)
+	}
+	if want := []string{"first", "se\r\ncond"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("handled %q, want %q", got, want)
+	}
+}
+
+func TestNATSConsumeStopsWhenDone(t *testing.T) {
+	client, server := newFakeNATS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		server.expect("SUB backups.requests 1")
+		cancel()
+	}()
+
+	if err := client.Consume(ctx, "backups.requests", "", func([]byte) {}); err != nil {
+		t.Fatalf("Consume() = %v, want nil once ctx is done", err)
+	}
+}
@@ -0,0 +1,235 @@
+package msgbus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisBlock is how long XREADGROUP waits for new entries before asking
+// again.
+const redisBlock = 5 * time.Second
+
+// redisField is the stream entry field holding a message's payload.
+const redisField = "data"
+
+// redisBus speaks RESP, the Redis protocol, for the stream commands.
+type redisBus struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func dialRedis(ctx context.Context, u *url.URL) (*redisBus, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort(u, "6379"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	if u.Scheme == "rediss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	b := &redisBus{conn: conn, r: bufio.NewReader(conn)}
+	if u.User != nil {
+		// redis://:pass@host authenticates the default user
+		args := []string{"AUTH"}
+		if pass, ok := u.User.Password(); ok {
+			if u.User.Username() != "" {
+				args = append(args, u.User.Username())
+			}
+			args = append(args, pass)
+		} else {
+			args = append(args, u.User.Username())
+		}
+		if _, err := b.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to Redis: %w", err)
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := b.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select Redis database %s: %w", db, err)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return b, nil
+}
+
+func (b *redisBus) Publish(ctx context.Context, subject string, data []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		b.conn.SetDeadline(deadline)
+		defer b.conn.SetDeadline(time.Time{})
+	}
+	if _, err := b.do("XADD", subject, "*", redisField, string(data)); err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+	return nil
+}
+
+// Consume reads subject as a member of group, creating the group at the end
+// of the stream if it doesn't exist yet. Entries delivered before a restart
+// but not acknowledged are handled again first.
+func (b *redisBus) Consume(ctx context.Context, subject, group string, handle Handler) error {
+	defer closeOnDone(ctx, b.conn)()
+	if _, err := b.do("XGROUP", "CREATE", subject, group, "$", "MKSTREAM"); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group: %w", err)
+	}
+	consumer, _ := os.Hostname()
+	if consumer == "" {
+		consumer = group
+	}
+
+	// "0" lists our pending entries, ">" waits for new ones
+	id := "0"
+	for {
+		reply, err := b.do("XREADGROUP", "GROUP", group, consumer, "COUNT", "10",
+			"BLOCK", strconv.FormatInt(redisBlock.Milliseconds(), 10), "STREAMS", subject, id)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read stream: %w", err)
+		}
+		entries := streamEntries(reply)
+		if id == "0" && len(entries) == 0 {
+			id = ">"
+			continue
+		}
+		for _, entry := range entries {
+			handle([]byte(entry.fields[redisField]))
+			if _, err := b.do("XACK", subject, group, entry.id); err != nil {
+				return fmt.Errorf("failed to acknowledge %s: %w", entry.id, err)
+			}
+		}
+	}
+}
+
+func (b *redisBus) Close() error {
+	return b.conn.Close()
+}
+
+type streamEntry struct {
+	id     string
+	fields map[string]string
+}
+
+// streamEntries extracts the entries of an XREADGROUP reply for one stream:
+// [[stream, [[id, [field, value, ...]], ...]]], or nil on timeout.
+func streamEntries(reply interface{}) []streamEntry {
+	streams, _ := reply.([]interface{})
+	if len(streams) == 0 {
+		return nil
+	}
+	stream, _ := streams[0].([]interface{})
+	if len(stream) < 2 {
+		return nil
+	}
+	items, _ := stream[1].([]interface{})
+	entries := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		pair, _ := item.([]interface{})
+		if len(pair) < 2 {
+			continue
+		}
+		entry := streamEntry{fields: map[string]string{}}
+		entry.id, _ = pair[0].(string)
+		values, _ := pair[1].([]interface{})
+		for i := 0; i+1 < len(values); i += 2 {
+			key, _ := values[i].(string)
+			value, _ := values[i+1].(string)
+			entry.fields[key] = value
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// do sends a command and reads its reply.
+func (b *redisBus) do(args ...string) (interface{}, error) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(b.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return b.readReply()
+}
+
+// readReply reads one RESP reply: bulk strings become strings, arrays
+// []interface{}, null replies nil.
+func (b *redisBus) readReply() (interface{}, error) {
+	line, err := readLine(b.r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis reply %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(b.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis reply %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			// Errors inside arrays are values, not failures of the command
+			item, err := b.readReply()
+			var replyErr redisError
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected Redis reply %q", line)
+	}
+}
@@ -0,0 +1,213 @@
+package msgbus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    interface{}
+		wantErr string
+	}{
+		{name: "simple string", input: "+OK\r\n", want: "OK"},
+		{name: "error", input: "-BUSYGROUP Consumer Group name already exists\r\n", wantErr: "BUSYGROUP Consumer Group name already exists"},
+		{name: "integer", input: ":42\r\n", want: int64(42)},
+		{name: "bulk string", input: "$5\r\nhello\r\n", want: "hello"},
+		{name: "bulk string with CRLF", input: "$7\r\nhel\r\nlo\r\n", want: "hel\r\nlo"},
+		{name: "empty bulk string", input: "$0\r\n\r\n", want: ""},
+		{name: "null bulk string", input: "$-1\r\n", want: nil},
+		{name: "null array", input: "*-1\r\n", want: nil},
+		{name: "empty array", input: "*0\r\n", want: []interface{}{}},
+		{name: "nested array", input: "*2\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n", want: []interface{}{"a", []interface{}{int64(1), nil}}},
+		{name: "error inside array", input: "*2\r\n+OK\r\n-ERR no such key\r\n", want: []interface{}{"OK", nil}},
+		{name: "empty line", input: "\r\n", wantErr: "empty Redis reply"},
+		{name: "unknown type", input: "%2\r\n", wantErr: "unexpected Redis reply"},
+		{name: "invalid bulk size", input: "$x\r\n", wantErr: "invalid Redis reply"},
+		{name: "truncated bulk string", input: "$5\r\nhel", wantErr: "EOF"},
+		{name: "truncated array", input: "*2\r\n+OK\r\n", wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &redisBus{r: bufio.NewReader(strings.NewReader(tt.input))}
+			got, err := b.readReply()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readReply() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("readReply() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadReplyErrorType(t *testing.T) {
+	b := &redisBus{r: bufio.NewReader(strings.NewReader("-WRONGPASS invalid password\r\n"))}
+	_, err := b.readReply()
+	var replyErr redisError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("readReply() error = %#v, want a redisError", err)
+	}
+}
+
+func TestStreamEntries(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply interface{}
+		want  []streamEntry
+	}{
+		{name: "timeout", reply: nil, want: nil},
+		{name: "no streams", reply: []interface{}{}, want: nil},
+		{name: "no entries", reply: []interface{}{[]interface{}{"jobs", []interface{}{}}}, want: []streamEntry{}},
+		{
+			name: "entries",
+			reply: []interface{}{[]interface{}{"jobs", []interface{}{
+				[]interface{}{"1-0", []interface{}{"data", "first"}},
+				[]interface{}{"2-0", []interface{}{"data", "second", "source", "cron"}},
+			}}},
+			want: []streamEntry{
+				{id: "1-0", fields: map[string]string{"data": "first"}},
+				{id: "2-0", fields: map[string]string{"data": "second", "source": "cron"}},
+			},
+		},
+		{
+			// A pending entry that was deleted from the stream has no fields
+			name:  "deleted entry",
+			reply: []interface{}{[]interface{}{"jobs", []interface{}{[]interface{}{"1-0", nil}}}},
+			want:  []streamEntry{{id: "1-0", fields: map[string]string{}}},
+		},
+		{
+			name:  "odd field list",
+			reply: []interface{}{[]interface{}{"jobs", []interface{}{[]interface{}{"1-0", []interface{}{"data", "x", "dangling"}}}}},
+			want:  []streamEntry{{id: "1-0", fields: map[string]string{"data": "x"}}},
+		},
+		{
+			name:  "malformed entry",
+			reply: []interface{}{[]interface{}{"jobs", []interface{}{"1-0", []interface{}{"2-0", []interface{}{"data", "ok"}}}}},
+			want:  []streamEntry{{id: "2-0", fields: map[string]string{"data": "ok"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamEntries(tt.reply); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("streamEntries() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeRedis is the server end of a net.Pipe, answering commands from a
+// script. RESP commands are arrays of bulk strings, so readReply parses
+// them too.
+type fakeRedis struct {
+	t *testing.T
+	*redisBus
+}
+
+func newFakeRedis(t *testing.T) (*redisBus, *fakeRedis) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	return &redisBus{conn: client, r: bufio.NewReader(client)},
+		&fakeRedis{t: t, redisBus: &redisBus{conn: server, r: bufio.NewReader(server)}}
+}
+
+// expect reads the next command, checks it is want and answers reply.
+func (f *fakeRedis) expect(want []string, reply string) bool {
+	cmd, err := f.readReply()
+	if err != nil {
+		f.t.Errorf("reading command %v: %v", want, err)
+		return false
+	}
+	got := make([]string, 0, len(want))
+	for _, arg := range cmd.([]interface{}) {
+		got = append(got, arg.(string))
+	}
+	if !reflect.DeepEqual(got, want) {
+		f.t.Errorf("command = %q, want %q", got, want)
+		return false
+	}
+	if reply == "" {
+		return true
+	}
+	if _, err := f.conn.Write([]byte(reply)); err != nil {
+		f.t.Errorf("replying to %v: %v", want, err)
+		return false
+	}
+	return true
+}
+
+// bulk encodes s as a RESP bulk string.
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func TestRedisConsumeHandlesPendingEntriesBeforeNewOnes(t *testing.T) {
+	client, server := newFakeRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer, _ := os.Hostname()
+	if consumer == "" {
+		consumer = "scheduler"
+	}
+	read := func(id string) []string {
+		return []string{"XREADGROUP", "GROUP", "scheduler", consumer, "COUNT", "10", "BLOCK", "5000", "STREAMS", "jobs", id}
+	}
+	entry := func(id, data string) string {
+		return "*1\r\n*2\r\n" + bulk("jobs") + "*1\r\n*2\r\n" + bulk(id) + "*2\r\n" + bulk("data") + bulk(data)
+	}
+
+	go func() {
+		_ = server.expect([]string{"XGROUP", "CREATE", "jobs", "scheduler", "$", "MKSTREAM"}, "-BUSYGROUP Consumer Group name already exists\r\n") &&
+			// Delivered before a restart but never acknowledged
+			server.expect(read("0"), entry("1-0", "pending")) &&
+			server.expect([]string{"XACK", "jobs", "scheduler", "1-0"}, ":1\r\n") &&
+			server.expect(read("0"), "*1\r\n*2\r\n"+bulk("jobs")+"*0\r\n") &&
+			// Nothing pending any more: wait for new entries
+			server.expect(read(">"), entry("2-0", "new")) &&
+			server.expect([]string{"XACK", "jobs", "scheduler", "2-0"}, ":1\r\n") &&
+			server.expect(read(">"), "*-1\r\n") &&
+			server.expect(read(">"), "")
+		cancel()
+	}()
+
+	var got []string
+	err := client.Consume(ctx, "jobs", "scheduler", func(data []byte) {
+		got = append(got, string(data))
+	})
+	if err != nil {
+		t.Fatalf("Consume() = %v, want nil once ctx is done", err)
+	}
+	if want := []string{"pending", "new"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("handled %q, want %q", got, want)
+	}
+}
+
+func TestRedisConsumeFailsWhenGroupCannotBeCreated(t *testing.T) {
+	client, server := newFakeRedis(t)
+	go server.expect([]string{"XGROUP", "CREATE", "jobs", "scheduler", "$", "MKSTREAM"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+	err := client.Consume(context.Background(), "jobs", "scheduler", func([]byte) {})
+	if err == nil || !strings.Contains(err.Error(), "failed to create consumer group: WRONGTYPE") {
+		t.Fatalf("Consume() = %v, want the WRONGTYPE error", err)
+	}
+}
@@ -0,0 +1,173 @@
+// Package redact masks credentials in text before it is logged, written to a
+// manifest or returned by the API. It masks the password of connection URLs,
+// values of password, secret and token settings (PGPASSWORD=..., a DSN's
+// password=...), bearer tokens, and any secret registered with AddSecret,
+// which catches credentials echoed verbatim, e.g. by pgx or a container's
+// stderr.
+package redact
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Mask replaces every credential.
+const Mask = "[REDACTED]"
+
+// minSecretLen is the length below which registered secrets are ignored:
+// masking every occurrence of a short string would garble the rest of the
+// text, and such a password is no secret anyway.
+const minSecretLen = 6
+
+var (
+	// urlPassword matches the user and password of a URL up to the last "@"
+	// of its authority: "postgresql://user:pa@ss@host" masks "pa@ss".
+	urlPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s"']*:)[^\s"'/]*@`)
+	// keyValue matches settings like PGPASSWORD=..., password='...' (DSN) or
+	// ?sslpassword=... up to the end of the value.
+	keyValue = regexp.MustCompile(`(?i)(\b[a-z_]*(?:password|passwd|secret|token|api_?key|access_?key)\s*=\s*)('[^']*'|[^\s&,;"']+)`)
+	// bearer matches Authorization header values.
+	bearer = regexp.MustCompile(`(?i)(\bbearer\s+)[^\s"']+`)
+)
+
+var (
+	mu sync.RWMutex
+	// secrets are the registered secrets, longest first so a secret
+	// containing another is masked as a whole
+	secrets []string
+)
+
+// AddSecret registers a secret to be masked wherever it appears. Empty and
+// short secrets (under 6 characters) are ignored.
+func AddSecret(secret string) {
+	if len(secret) < minSecretLen {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// SecretName reports whether an environment variable named name holds a
+// credential by its name (..._PASSWORD, ..._SECRET_ACCESS_KEY, ..._TOKEN).
+func SecretName(name string) bool {
+	name = strings.ToUpper(name)
+	for _, part := range []string{"PASS", "SECRET", "TOKEN", "CREDENTIALS"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return strings.HasSuffix(name, "_KEY")
+}
+
+// String returns s with all credentials masked.
+func String(s string) string {
+	if s == "" {
+		return s
+	}
+	mu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	mu.RUnlock()
+	s = urlPassword.ReplaceAllString(s, "${1}"+Mask+"@")
+	s = keyValue.ReplaceAllString(s, "${1}"+Mask)
+	return bearer.ReplaceAllString(s, "${1}"+Mask)
+}
+
+// Fields returns fields with credentials masked in strings and errors. Errors
+// become string fields with the redacted message.
+func Fields(fields []zapcore.Field) []zapcore.Field {
+	var redacted []zapcore.Field
+	for i, field := range fields {
+		masked, changed := maskField(field)
+		if !changed {
+			continue
+		}
+		if redacted == nil {
+			redacted = append([]zapcore.Field(nil), fields...)
+		}
+		redacted[i] = masked
+	}
+	if redacted == nil {
+		return fields
+	}
+	return redacted
+}
+
+func maskField(field zapcore.Field) (zapcore.Field, bool) {
+	var value string
+	switch field.Type {
+	case zapcore.StringType:
+		value = field.String
+	case zapcore.ByteStringType:
+		value = string(field.Interface.([]byte))
+	case zapcore.ErrorType:
+		err, ok := field.Interface.(error)
+		if !ok || err == nil {
+			return field, false
+		}
+		return zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: String(err.Error())}, true
+	case zapcore.StringerType:
+		stringer, ok := field.Interface.(interface{ String() string })
+		if !ok {
+			return field, false
+		}
+		return zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: String(stringer.String())}, true
+	default:
+		return field, false
+	}
+	if masked := String(value); masked != value {
+		return zapcore.Field{Key: field.Key, Type: zapcore.StringType, String: masked}, true
+	}
+	return field, false
+}
+
+// Core wraps core so entry messages and fields are redacted before they are
+// written.
+func Core(core zapcore.Core) zapcore.Core {
+	return &redactingCore{core: core}
+}
+
+type redactingCore struct {
+	core zapcore.Core
+}
+
+func (c *redactingCore) Enabled(level zapcore.Level) bool {
+	return c.core.Enabled(level)
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{core: c.core.With(Fields(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+// Write checks the entry against the wrapped core again, so of a tee only
+// the cores enabled at its level write it.
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = String(entry.Message)
+	if checked := c.core.Check(entry, nil); checked != nil {
+		checked.Write(Fields(fields)...)
+	}
+	return nil
+}
+
+func (c *redactingCore) Sync() error {
+	return c.core.Sync()
+}
@@ -0,0 +1,41 @@
+package redact
+
+import "testing"
+
+func TestString(t *testing.T) {
+	AddSecret("correct-horse-battery")
+	AddSecret("short")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "URL password", in: "postgresql://app:s3cret@db:5432/app", want: "postgresql://app:[REDACTED]@db:5432/app"},
+		{name: "URL password with @", in: "postgresql://app:pa@ss@db/app", want: "postgresql://app:[REDACTED]@db/app"},
+		{name: "quoted URL", in: `failed to connect to "postgres://u:pw@h/db": refused`, want: `failed to connect to "postgres://u:[REDACTED]@h/db": refused`},
+		{name: "other scheme", in: "redis://:hunter22@cache:6379/0", want: "redis://:[REDACTED]@cache:6379/0"},
+		{name: "environment variable", in: "PGPASSWORD=hunter22 pg_dump", want: "PGPASSWORD=[REDACTED] pg_dump"},
+		{name: "quoted DSN password", in: "host=db password='my secret' dbname=app", want: "host=db password=[REDACTED] dbname=app"},
+		{name: "query parameter", in: "?sslpassword=abc&sslmode=require", want: "?sslpassword=[REDACTED]&sslmode=require"},
+		{name: "access key", in: "AWS_SECRET_ACCESS_KEY=abc123", want: "AWS_SECRET_ACCESS_KEY=[REDACTED]"},
+		{name: "api key", in: "api_key = abc123, region=eu", want: "api_key = [REDACTED], region=eu"},
+		{name: "token", in: "GET /status?token=abc123", want: "GET /status?token=[REDACTED]"},
+		{name: "bearer", in: "Authorization: Bearer abc.def.ghi", want: "Authorization: Bearer [REDACTED]"},
+		{name: "registered secret", in: "pg_dump: error: correct-horse-battery rejected", want: "pg_dump: error: [REDACTED] rejected"},
+
+		{name: "empty", in: "", want: ""},
+		{name: "no credentials", in: "backup of app completed in 3s", want: "backup of app completed in 3s"},
+		{name: "URL without password", in: "postgresql://app@db:5432/app", want: "postgresql://app@db:5432/app"},
+		{name: "URL with port", in: "https://example.com:8443/path?x=a@b", want: "https://example.com:8443/path?x=a@b"},
+		{name: "keyword without value", in: "password authentication failed for user app", want: "password authentication failed for user app"},
+		{name: "short secret ignored", in: "short names are fine", want: "short names are fine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := String(tt.in); got != tt.want {
+				t.Fatalf("String(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
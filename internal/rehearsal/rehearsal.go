@@ -0,0 +1,332 @@
+package rehearsal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/restore"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"go.uber.org/zap"
+)
+
+// rehearsalDatabase is the database backups are restored into.
+const rehearsalDatabase = "rehearsal"
+
+// startupTimeout bounds how long the throwaway server may take to accept
+// connections, so a broken image doesn't use up the whole rehearsal timeout.
+const startupTimeout = 5 * time.Minute
+
+// Report describes a restore rehearsal and is persisted while it runs.
+type Report struct {
+	ID         string `json:"id"`
+	Project    string `json:"project"`
+	RunID      string `json:"run_id,omitempty"`
+	Trigger    string `json:"trigger"`
+	Image      string `json:"image,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	// StartupMs is how long the throwaway server took to come up, RestoreMs
+	// how long the restore took: the recovery time to expect (RTO)
+	StartupMs int64          `json:"startup_ms"`
+	RestoreMs int64          `json:"restore_ms"`
+	Steps     []restore.Step `json:"steps"`
+	Checks    []Check        `json:"checks"`
+}
+
+// Check is one validation query run against the restored database.
+type Check struct {
+	Name   string `json:"name"`
+	Query  string `json:"query,omitempty"`
+	Status string `json:"status"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewReport creates the initial report of a rehearsal of a project.
+func NewReport(id, project, trigger string) *Report {
+	return &Report{
+		ID:        id,
+		Project:   project,
+		Trigger:   trigger,
+		Status:    "running",
+		StartedAt: time.Now().Format(time.RFC3339),
+		Steps:     []restore.Step{},
+		Checks:    []Check{},
+	}
+}
+
+// Fail finishes a report of a rehearsal that couldn't start.
+func (r *Report) Fail(err error) {
+	r.Status = "failed"
+	r.Error = redact.String(err.Error())
+	r.FinishedAt = time.Now().Format(time.RFC3339)
+}
+
+type Rehearser struct {
+	config   *config.Config
+	logger   *zap.Logger
+	restorer *restore.Restorer
+}
+
+func New(cfg *config.Config, logger *zap.Logger, restorer *restore.Restorer) *Rehearser {
+	return &Rehearser{
+		config:   cfg,
+		logger:   logger,
+		restorer: restorer,
+	}
+}
+
+// Run restores entry into a throwaway PostgreSQL container of the backup's
+// major version and runs the validation checks against it. The container is
+// removed afterwards. The report is updated in place and passed to onUpdate
+// after every step.
+func (r *Rehearser) Run(ctx context.Context, entry *catalog.Entry, report *Report, onUpdate func(*Report)) error {
+	ctx = docker.WithLabels(ctx, map[string]string{
+		docker.LabelTask:    "rehearsal",
+		docker.LabelProject: entry.Project,
+		docker.LabelRunID:   entry.RunID,
+	})
+	report.RunID = entry.RunID
+	r.logger.Info("Starting restore rehearsal",
+		zap.String("rehearsal_id", report.ID),
+		zap.String("project", entry.Project),
+		zap.String("run_id", entry.RunID))
+
+	started := time.Now()
+	err := r.run(ctx, entry, report, onUpdate)
+
+	report.Status = "success"
+	if err != nil {
+		report.Status = "failed"
+		report.Error = redact.String(err.Error())
+	}
+	finished := time.Now()
+	report.FinishedAt = finished.Format(time.RFC3339)
+	report.DurationMs = finished.Sub(started).Milliseconds()
+	onUpdate(report)
+
+	if err != nil {
+		r.logger.Error("Restore rehearsal failed", zap.String("rehearsal_id", report.ID), zap.Error(err))
+	} else {
+		r.logger.Info("Restore rehearsal passed",
+			zap.String("rehearsal_id", report.ID),
+			zap.Int64("restore_ms", report.RestoreMs))
+	}
+	return err
+}
+
+func (r *Rehearser) run(ctx context.Context, entry *catalog.Entry, report *Report, onUpdate func(*Report)) error {
+	manifest, err := readManifest(entry.ManifestPath)
+	if err != nil {
+		return err
+	}
+	if manifest.PGVersion == "" {
+		return fmt.Errorf("manifest of %s has no PostgreSQL version", entry.RunID)
+	}
+	image, err := backup.DumpImage(r.config, manifest.PGVersion)
+	if err != nil {
+		return err
+	}
+	report.Image = image
+	onUpdate(report)
+
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+	startCtx, cancel := context.WithTimeout(ctx, startupTimeout)
+	startupStarted := time.Now()
+	server, err := docker.StartService(startCtx, container.Config{
+		Image: image,
+		Env: []string{
+			"POSTGRES_PASSWORD=" + password,
+			"POSTGRES_DB=" + rehearsalDatabase,
+		},
+		// The entrypoint's temporary server during initdb only listens on
+		// the Unix socket, so checking TCP waits for the real one
+		Healthcheck: &container.HealthConfig{
+			Test:        []string{"CMD", "pg_isready", "--host=127.0.0.1", "--username=postgres"},
+			Interval:    time.Second,
+			Timeout:     5 * time.Second,
+			StartPeriod: startupTimeout,
+			Retries:     3,
+		},
+	}, container.HostConfig{})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to start rehearsal server: %w", err)
+	}
+	defer func() {
+		if err := server.Remove(); err != nil {
+			r.logger.Warn("Failed to remove rehearsal server", zap.String("container", server.ID), zap.Error(err))
+		}
+	}()
+	report.StartupMs = time.Since(startupStarted).Milliseconds()
+	onUpdate(report)
+
+	targetURL := (&url.URL{
+		Scheme: "postgresql",
+		User:   url.UserPassword("postgres", password),
+		Host:   net.JoinHostPort(server.IP, "5432"),
+		Path:   "/" + rehearsalDatabase,
+	}).String()
+	opts := restore.Options{TargetURL: targetURL, Image: image}
+	restoreReport, err := restore.NewReport(report.ID, entry, opts)
+	if err != nil {
+		return err
+	}
+	err = r.restorer.Restore(ctx, entry, opts, restoreReport, func(rr *restore.Report) {
+		report.Steps = rr.Steps
+		onUpdate(report)
+	})
+	report.RestoreMs = restoreReport.DurationMs
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	checks := 0
+	if len(manifest.Tables) > 0 {
+		checks++
+		if !r.checkTables(ctx, targetURL, image, manifest.Tables, report, onUpdate) {
+			failed++
+		}
+	}
+	for i, query := range r.queries(entry.Project) {
+		checks++
+		if !r.checkQuery(ctx, targetURL, image, fmt.Sprintf("query %d", i+1), query, report, onUpdate) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, checks)
+	}
+	return nil
+}
+
+// queries returns the project's REHEARSAL_QUERIES, separated by semicolons.
+func (r *Rehearser) queries(project string) []string {
+	var queries []string
+	for _, query := range strings.Split(r.config.ProjectOption(project, "REHEARSAL_QUERIES", ""), ";") {
+		if query = strings.TrimSpace(query); query != "" {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// checkTables verifies that every table recorded in the manifest exists in
+// the restored database.
+func (r *Rehearser) checkTables(ctx context.Context, connURL, image string, tables []backup.TableRowCount, report *Report, onUpdate func(*Report)) bool {
+	check := Check{Name: "tables"}
+	output, err := r.query(ctx, connURL, image, "SELECT schemaname || '.' || relname FROM pg_stat_user_tables")
+	if err != nil {
+		return r.record(report, onUpdate, check, err)
+	}
+
+	restored := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		restored[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, table := range tables {
+		if name := table.Schema + "." + table.Name; !restored[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	check.Result = fmt.Sprintf("%d of %d tables restored", len(tables)-len(missing), len(tables))
+	if len(missing) > 0 {
+		if len(missing) > 10 {
+			missing = append(missing[:10], "...")
+		}
+		return r.record(report, onUpdate, check, fmt.Errorf("missing tables: %s", strings.Join(missing, ", ")))
+	}
+	return r.record(report, onUpdate, check, nil)
+}
+
+// checkQuery runs a validation query. It passes if the query succeeds and
+// the first column of its first row is neither false, 0 nor empty.
+func (r *Rehearser) checkQuery(ctx context.Context, connURL, image, name, query string, report *Report, onUpdate func(*Report)) bool {
+	check := Check{Name: name, Query: query}
+	output, err := r.query(ctx, connURL, image, query)
+	if err != nil {
+		return r.record(report, onUpdate, check, err)
+	}
+	first, _, _ := strings.Cut(output, "\n")
+	first, _, _ = strings.Cut(first, "|")
+	check.Result = strings.TrimSpace(first)
+	switch check.Result {
+	case "", "f", "false", "0":
+		return r.record(report, onUpdate, check, fmt.Errorf("query returned %q", check.Result))
+	}
+	return r.record(report, onUpdate, check, nil)
+}
+
+func (r *Rehearser) record(report *Report, onUpdate func(*Report), check Check, err error) bool {
+	check.Status = "success"
+	if err != nil {
+		check.Status = "failed"
+		check.Error = redact.String(err.Error())
+	}
+	report.Checks = append(report.Checks, check)
+	onUpdate(report)
+	return err == nil
+}
+
+// query runs sql with psql in a helper container and returns its unaligned
+// output.
+func (r *Rehearser) query(ctx context.Context, connURL, image, sql string) (string, error) {
+	env, hostConfig, err := backup.ContainerConn(ctx, connURL)
+	if err != nil {
+		return "", err
+	}
+	cfg := container.Config{
+		Image: image,
+		Env:   env,
+		Cmd:   []string{"psql", "--no-psqlrc", "--tuples-only", "--no-align", "--set=ON_ERROR_STOP=1", "--command", sql},
+	}
+	stdout := docker.NewContainerOutput()
+	stderr := docker.NewContainerOutput()
+	if err := docker.RunOnceWithConfig(ctx, cfg, hostConfig, stdout, stderr); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func readManifest(path string) (*backup.BackupManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest backup.BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
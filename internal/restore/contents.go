@@ -0,0 +1,123 @@
+package restore
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Contents lists what a backup archive holds, read from the TOC comments of
+// its plain-format dumps.
+type Contents struct {
+	Schemas []string `json:"schemas"`
+	Tables  []Table  `json:"tables"`
+	// Objects counts schema objects by TOC type (TABLE, INDEX, FUNCTION, ...)
+	Objects map[string]int `json:"objects"`
+}
+
+type Table struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	// Rows is the number of rows in the table's data section
+	Rows int64 `json:"rows"`
+}
+
+// ReadContents lists the schemas and tables in the archive at archivePath and
+// counts the rows dumped for each table. The data file is streamed once, so
+// this takes about as long as decompressing the archive.
+func ReadContents(archivePath string) (*Contents, error) {
+	contents := &Contents{
+		Schemas: []string{},
+		Tables:  []Table{},
+		Objects: make(map[string]int),
+	}
+
+	schemaFile, err := OpenArchiveFile(archivePath, "schema.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer schemaFile.Close()
+
+	schemas := make(map[string]bool)
+	tables := make(map[string]int) // "schema.table" -> index in contents.Tables
+	err = scanLines(schemaFile, func(line string) {
+		sec, ok := parseTOCHeader(line)
+		if !ok {
+			return
+		}
+		contents.Objects[sec.typ]++
+		switch sec.typ {
+		case "SCHEMA":
+			schemas[sec.name] = true
+		case "TABLE":
+			schemas[sec.schema] = true
+			tables[sec.schema+"."+sec.name] = len(contents.Tables)
+			contents.Tables = append(contents.Tables, Table{Schema: sec.schema, Name: sec.name})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dataFile, err := OpenArchiveFile(archivePath, "data.sql")
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	// COPY sections hold one row per line up to "\."; INSERT-style dumps hold
+	// one statement per row
+	var current *Table
+	inCopy := false
+	err = scanLines(dataFile, func(line string) {
+		switch {
+		case inCopy:
+			if line == `\.` {
+				inCopy = false
+			} else if current != nil {
+				current.Rows++
+			}
+		case strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;"):
+			inCopy = true
+		case strings.HasPrefix(line, "INSERT INTO "):
+			if current != nil {
+				current.Rows++
+			}
+		default:
+			if sec, ok := parseTOCHeader(line); ok {
+				current = nil
+				if i, ok := tables[sec.schema+"."+sec.name]; ok && sec.typ == "TABLE DATA" {
+					current = &contents.Tables[i]
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for schema := range schemas {
+		contents.Schemas = append(contents.Schemas, schema)
+	}
+	sort.Strings(contents.Schemas)
+	return contents, nil
+}
+
+// scanLines calls fn for every line of r without its line ending. Lines may be
+// arbitrarily long (a single INSERT can hold a large value).
+func scanLines(r io.Reader, fn func(line string)) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			fn(strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
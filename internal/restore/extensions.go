@@ -0,0 +1,94 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"go.uber.org/zap"
+)
+
+// timescaleExtension must be restored at the version it was dumped with, and
+// its catalog only loads in restoring mode: timescaledb_pre_restore() stops
+// its background workers and turns restoring mode on for new sessions,
+// timescaledb_post_restore() turns it off again.
+const timescaleExtension = "timescaledb"
+
+// createExtensions creates a backup's extensions on the target in the order
+// they were created in the source, before schema.sql runs, and returns the
+// schemas of those it created. It runs as the connecting user rather than
+// the restore owner, who often may not create extensions. Extensions the
+// target server doesn't have fail the restore before anything is applied.
+// Extensions whose schema doesn't exist yet are left to schema.sql, which
+// creates the schema first.
+func (r *Restorer) createExtensions(ctx context.Context, connURL string, extensions []backup.Extension) (map[string]string, error) {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	var missing []string
+	for _, ext := range extensions {
+		var available bool
+		err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)", ext.Name).Scan(&available)
+		if err != nil {
+			return nil, err
+		}
+		if !available {
+			missing = append(missing, ext.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("extensions not available on the target server: %s", strings.Join(missing, ", "))
+	}
+
+	created := make(map[string]string, len(extensions))
+	for _, ext := range extensions {
+		var schemaExists bool
+		if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_namespace WHERE nspname = $1)", ext.Schema).Scan(&schemaExists); err != nil {
+			return nil, err
+		}
+		if !schemaExists {
+			r.logger.Debug("Leaving extension to the schema", zap.String("extension", ext.Name), zap.String("schema", ext.Schema))
+			continue
+		}
+		stmt := "CREATE EXTENSION IF NOT EXISTS " + pgx.Identifier{ext.Name}.Sanitize() + " WITH SCHEMA " + pgx.Identifier{ext.Schema}.Sanitize()
+		if ext.Name == timescaleExtension && ext.Version != "" {
+			stmt += " VERSION " + quoteLiteral(ext.Version)
+		}
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("failed to create extension %s: %w", ext.Name, err)
+		}
+		created[ext.Name] = ext.Schema
+	}
+	return created, nil
+}
+
+// timescaleHook calls timescaledb_pre_restore or timescaledb_post_restore
+// from the extension's schema.
+func (r *Restorer) timescaleHook(ctx context.Context, connURL, schema, hook string) error {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "SELECT "+pgx.Identifier{schema, hook}.Sanitize()+"()"); err != nil {
+		return fmt.Errorf("%s failed: %w", hook, err)
+	}
+	return nil
+}
+
+// quoteLiteral quotes s as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,238 @@
+package restore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Plain-format pg_dump output introduces every object with a TOC comment:
+//
+//	-- Name: orders; Type: TABLE; Schema: public; Owner: -
+//	-- Data for Name: orders; Type: TABLE DATA; Schema: public; Owner: -
+//
+// Partial restores split schema.sql and data.sql into these sections and keep
+// only the ones belonging to the requested tables or schemas. The preamble
+// before the first section (SET statements) is always kept.
+var tocHeader = regexp.MustCompile(`^-- (?:Data for )?Name: (.+?); Type: (.+?); Schema: (.+?);`)
+
+var ownedSequence = regexp.MustCompile(`^ALTER SEQUENCE (\S+) OWNED BY `)
+
+var simpleIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// objectFilter selects the objects of a partial restore.
+type objectFilter struct {
+	schemas map[string]bool
+	tables  map[string]bool // "schema.table"
+	// sequences owned by selected tables, collected from schema.sql and used
+	// to keep their SEQUENCE SET sections in data.sql
+	sequences map[string]bool
+}
+
+func newObjectFilter(schemas, tables []string) (*objectFilter, error) {
+	f := &objectFilter{
+		schemas:   make(map[string]bool),
+		tables:    make(map[string]bool),
+		sequences: make(map[string]bool),
+	}
+	for _, schema := range schemas {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			f.schemas[schema] = true
+		}
+	}
+	for _, table := range tables {
+		table = strings.TrimSpace(table)
+		if table == "" {
+			continue
+		}
+		if !strings.Contains(table, ".") {
+			table = "public." + table
+		}
+		if strings.Count(table, ".") != 1 {
+			return nil, fmt.Errorf("invalid table %q (expected schema.table)", table)
+		}
+		f.tables[table] = true
+	}
+	return f, nil
+}
+
+func (f *objectFilter) empty() bool {
+	return len(f.schemas) == 0 && len(f.tables) == 0
+}
+
+type tocSection struct {
+	name, typ, schema string
+}
+
+func parseTOCHeader(line string) (tocSection, bool) {
+	m := tocHeader.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return tocSection{}, false
+	}
+	return tocSection{name: m[1], typ: m[2], schema: m[3]}, true
+}
+
+// keepSchemaSection decides whether a schema.sql section is restored. body is
+// the section's SQL, needed for objects whose name doesn't reveal their table
+// (indexes, identity sequences).
+func (f *objectFilter) keepSchemaSection(sec tocSection, body string) bool {
+	if f.schemas[sec.schema] {
+		return true
+	}
+	if (sec.typ == "SCHEMA" && f.schemas[sec.name]) || (sec.typ == "COMMENT" && f.schemas[strings.TrimPrefix(sec.name, "SCHEMA ")]) {
+		return true
+	}
+
+	for table := range f.tables {
+		schema, name, _ := strings.Cut(table, ".")
+		if sec.schema != schema {
+			continue
+		}
+		// Tables, and objects named "<table> <object>" (constraints, defaults,
+		// triggers, policies) or "TABLE <table>"/"COLUMN <table>.<col>" (comments)
+		if sec.name == name || strings.HasPrefix(sec.name, name+" ") ||
+			sec.name == "TABLE "+name || strings.HasPrefix(sec.name, "COLUMN "+name+".") {
+			return true
+		}
+		qualified := quoteIdent(schema) + "." + quoteIdent(name)
+		if strings.Contains(body, " ON "+qualified+" ") || strings.Contains(body, " ON ONLY "+qualified+" ") ||
+			strings.Contains(body, "ALTER TABLE "+qualified+" ") || strings.Contains(body, "OWNED BY "+qualified+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// keepDataSection decides whether a data.sql section is restored.
+func (f *objectFilter) keepDataSection(sec tocSection) bool {
+	if f.schemas[sec.schema] {
+		return true
+	}
+	if sec.typ == "SEQUENCE SET" {
+		return f.sequences[quoteIdent(sec.schema)+"."+quoteIdent(sec.name)]
+	}
+	return f.tables[sec.schema+"."+sec.name]
+}
+
+// filterSchema returns the selected sections of schema.sql and records the
+// sequences owned by selected tables. Sequences are created before the
+// statement tying them to their table, so the whole file is read first.
+func (f *objectFilter) filterSchema(r io.Reader) (string, error) {
+	type section struct {
+		toc  tocSection
+		body strings.Builder
+	}
+	var preamble strings.Builder
+	var sections []*section
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if toc, ok := parseTOCHeader(line); ok {
+				sections = append(sections, &section{toc: toc})
+			}
+			if len(sections) > 0 {
+				sections[len(sections)-1].body.WriteString(line)
+			} else {
+				preamble.WriteString(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	keep := make([]bool, len(sections))
+	for i, sec := range sections {
+		keep[i] = f.keepSchemaSection(sec.toc, sec.body.String())
+		if keep[i] && strings.HasPrefix(sec.toc.typ, "SEQUENCE") {
+			f.recordSequences(sec.toc, sec.body.String())
+		}
+	}
+
+	for i, sec := range sections {
+		qualified := quoteIdent(sec.toc.schema) + "." + quoteIdent(sec.toc.name)
+		if keep[i] || (sec.toc.typ == "SEQUENCE" && f.sequences[qualified]) {
+			preamble.WriteString(sec.body.String())
+		}
+	}
+	return preamble.String(), nil
+}
+
+func (f *objectFilter) recordSequences(sec tocSection, body string) {
+	if sec.typ == "SEQUENCE" {
+		// Identity columns: the section is named after the sequence
+		f.sequences[quoteIdent(sec.schema)+"."+quoteIdent(sec.name)] = true
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if m := ownedSequence.FindStringSubmatch(line); m != nil {
+			f.sequences[m[1]] = true
+		}
+	}
+}
+
+// filterData streams the selected sections of data.sql. Sections are decided
+// by their header alone so table data is never buffered; COPY payloads are
+// passed through without looking for headers inside them. Closing the returned
+// reader stops the stream.
+func (f *objectFilter) filterData(r io.Reader) io.ReadCloser {
+	return filterSections(r, f.keepDataSection)
+}
+
+// filterSections streams the sections of a data file that keep selects, along
+// with the preamble.
+func filterSections(r io.Reader, keepSection func(tocSection) bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(r)
+		bw := bufio.NewWriter(pw)
+		keep, inCopy := true, false
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				switch {
+				case inCopy:
+					if strings.TrimRight(line, "\r\n") == `\.` {
+						inCopy = false
+					}
+				case strings.HasPrefix(line, "COPY ") && strings.HasSuffix(strings.TrimRight(line, "\r\n"), "FROM stdin;"):
+					inCopy = true
+				default:
+					if sec, ok := parseTOCHeader(line); ok {
+						keep = keepSection(sec)
+					}
+				}
+				if keep {
+					if _, werr := bw.WriteString(line); werr != nil {
+						pw.CloseWithError(werr)
+						return
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(bw.Flush())
+	}()
+	return pr
+}
+
+// quoteIdent quotes an identifier the way pg_dump does when it isn't a plain
+// lowercase name.
+func quoteIdent(name string) string {
+	if simpleIdentifier.MatchString(name) {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,193 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"go.uber.org/zap"
+)
+
+// validationOutputLimit caps how much of a validation file's output is kept
+// in its step.
+const validationOutputLimit = 4096
+
+// afterRestore runs the post-restore hooks enabled for project on the
+// restored database: ANALYZE, refreshing materialized views and the
+// validation files. Every validation file runs even if one fails.
+func (r *Restorer) afterRestore(ctx context.Context, p *progress, project, connURL, image string, opts Options, validation []string) error {
+	if enabled(opts.Analyze, r.config.ProjectOptionBool(project, "RESTORE_ANALYZE", r.config.RestoreAnalyze)) {
+		err := r.step(p, "analyze", func() error {
+			return r.exec(ctx, connURL, "ANALYZE")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if enabled(opts.RefreshMatviews, r.config.ProjectOptionBool(project, "RESTORE_REFRESH_MATVIEWS", r.config.RestoreRefreshMatviews)) {
+		err := r.step(p, "refresh_matviews", func() error {
+			return r.refreshMatviews(ctx, connURL)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var failed []string
+	for _, file := range validation {
+		step := "validate " + filepath.Base(file)
+		err := r.step(p, step, func() error {
+			output, err := r.validate(ctx, p, step, file, connURL, image)
+			// The running step is the last one
+			p.update(func(report *Report) {
+				report.Steps[len(report.Steps)-1].Output = output
+			})
+			return err
+		})
+		if err != nil {
+			failed = append(failed, filepath.Base(file))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("validation failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// enabled returns a restore's override of a hook, or the project's setting.
+func enabled(override *bool, setting bool) bool {
+	if override != nil {
+		return *override
+	}
+	return setting
+}
+
+// exec runs a statement on connURL.
+func (r *Restorer) exec(ctx context.Context, connURL, stmt string) error {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, stmt)
+	return err
+}
+
+// refreshMatviews refreshes every materialized view. A view reading from
+// another one fails until that is populated, so failed views are retried
+// until a pass makes no progress.
+func (r *Restorer) refreshMatviews(ctx context.Context, connURL string) error {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	rows, err := conn.Query(ctx, `SELECT format('%I.%I', schemaname, matviewname) FROM pg_matviews ORDER BY 1`)
+	if err != nil {
+		return err
+	}
+	views, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	pending := views
+	var lastErr error
+	for len(pending) > 0 {
+		var retry []string
+		for _, view := range pending {
+			if _, err := conn.Exec(ctx, "REFRESH MATERIALIZED VIEW "+view); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				retry = append(retry, view)
+				lastErr = fmt.Errorf("failed to refresh %s: %w", view, err)
+			}
+		}
+		if len(retry) == len(pending) {
+			return lastErr
+		}
+		pending = retry
+	}
+	r.logger.Info("Refreshed materialized views", zap.Int("views", len(views)))
+	return nil
+}
+
+// validationFiles expands the project's RESTORE_VALIDATION_SQL, a
+// comma-separated list of SQL files and globs, in order and each glob
+// sorted. A path or glob matching nothing is an error: a validation that
+// silently doesn't run would pass every restore.
+func (r *Restorer) validationFiles(project string) ([]string, error) {
+	var files []string
+	list := r.config.ProjectOption(project, "RESTORE_VALIDATION_SQL", r.config.RestoreValidationSQL)
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validation pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("validation SQL %q matches no files", pattern)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// validate runs a validation file with psql, stopping at the first error.
+// It fails if psql does or if a query returns false, so files can hold
+// plain assertions like SELECT count(*) > 0 FROM users. It returns the
+// file's output, cut to validationOutputLimit.
+func (r *Restorer) validate(ctx context.Context, p *progress, step, file, connURL, image string) (string, error) {
+	sql, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	env, hostConfig, err := backup.ContainerConn(ctx, connURL)
+	if err != nil {
+		return "", err
+	}
+	cfg := container.Config{
+		Image: image,
+		Env:   env,
+		Cmd:   []string{"psql", "--no-psqlrc", "--quiet", "--tuples-only", "--no-align", "--set=ON_ERROR_STOP=1"},
+	}
+	var stdout bytes.Buffer
+	err = docker.RunWithStdin(ctx, cfg, hostConfig, bytes.NewReader(sql), io.MultiWriter(&stdout, p.psqlOutput(step)), p.psqlOutput(step))
+
+	output := strings.TrimSpace(stdout.String())
+	if len(output) > validationOutputLimit {
+		output = output[:validationOutputLimit] + "..."
+	}
+	if err != nil {
+		return output, err
+	}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		first, _, _ := strings.Cut(line, "|")
+		switch strings.TrimSpace(first) {
+		case "f", "false":
+			return output, fmt.Errorf("a query returned false")
+		}
+	}
+	return output, nil
+}
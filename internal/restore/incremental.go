@@ -0,0 +1,77 @@
+package restore
+
+import (
+	"fmt"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+)
+
+// maxIncrementChain guards against manifests whose parents form a cycle.
+const maxIncrementChain = 10000
+
+// incrementChain is what restoring an incremental backup needs besides its
+// own schema and data: the full backup it is based on, whose data.sql holds
+// the incremental tables' rows up to the first watermark, and the increments
+// from the oldest to the one being restored.
+type incrementChain struct {
+	base       *catalog.Entry
+	increments []*catalog.Entry
+	// tables are the incremental tables, whose data comes from the chain
+	tables *objectFilter
+}
+
+// resolveIncrementChain follows an incremental backup's parents back to its
+// full base backup. It returns nil for backups that aren't incremental.
+func (r *Restorer) resolveIncrementChain(entry *catalog.Entry) (*incrementChain, error) {
+	incremental, err := backup.ReadIncremental(entry)
+	if err != nil {
+		return nil, err
+	}
+	if incremental == nil || incremental.Type != backup.ModeIncremental {
+		return nil, nil
+	}
+
+	names := make([]string, len(incremental.Tables))
+	for i, table := range incremental.Tables {
+		names[i] = table.Table
+	}
+	tables, err := newObjectFilter(nil, names)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := &incrementChain{increments: []*catalog.Entry{entry}, tables: tables}
+	current := entry
+	for parentRunID := incremental.ParentRunID; ; {
+		parent, err := catalog.Get(r.config.LocalBackupDir, entry.Project, parentRunID)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || parent.Status != "success" || parent.ArchivePath == "" {
+			return nil, fmt.Errorf("backup %s depends on %s, which is no longer available", current.RunID, parentRunID)
+		}
+		parentIncremental, err := backup.ReadIncremental(parent)
+		if err != nil {
+			return nil, err
+		}
+		if parentIncremental == nil {
+			return nil, fmt.Errorf("backup %s depends on %s, which wasn't taken in incremental mode", current.RunID, parentRunID)
+		}
+		if parentIncremental.Type == backup.ModeFull {
+			chain.base = parent
+			break
+		}
+		// Increments are applied from the oldest
+		chain.increments = append([]*catalog.Entry{parent}, chain.increments...)
+		if len(chain.increments) > maxIncrementChain {
+			return nil, fmt.Errorf("increment chain of %s is longer than %d backups", entry.RunID, maxIncrementChain)
+		}
+		current, parentRunID = parent, parentIncremental.ParentRunID
+	}
+
+	if chain.base.RunID != incremental.BaseRunID {
+		return nil, fmt.Errorf("backup %s is based on %s, but its chain leads to %s", entry.RunID, incremental.BaseRunID, chain.base.RunID)
+	}
+	return chain, nil
+}
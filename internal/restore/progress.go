@@ -0,0 +1,164 @@
+package restore
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+)
+
+// progressSaveInterval throttles how often byte counts are written to the
+// report; step changes are written immediately.
+const progressSaveInterval = 5 * time.Second
+
+// Progress is how far a running restore got. Bytes count the SQL read from
+// the archives, including what a partial restore filters out, so BytesTotal
+// is reached at the end either way.
+type Progress struct {
+	Step         string `json:"step"`
+	BytesApplied int64  `json:"bytes_applied"`
+	// BytesTotal is the size of all SQL files the restore applies; 0 if an
+	// archive doesn't record the sizes (format 1)
+	BytesTotal int64   `json:"bytes_total,omitempty"`
+	Percent    float64 `json:"percent,omitempty"`
+	// RowsApplied counts the rows loaded by COPY so far, as reported by psql
+	RowsApplied int64 `json:"rows_applied"`
+	// EstimatedRemainingMs extrapolates the throughput so far to the bytes
+	// left
+	EstimatedRemainingMs int64  `json:"estimated_remaining_ms,omitempty"`
+	UpdatedAt            string `json:"updated_at"`
+}
+
+// progress serializes changes to a running restore's report, which the
+// goroutines feeding psql update while the restore waits for it.
+type progress struct {
+	mu       sync.Mutex
+	report   *Report
+	onUpdate func(*Report)
+	// output receives psql's output, if set
+	output io.Writer
+
+	applyStarted time.Time
+	lastSave     time.Time
+}
+
+func newProgress(report *Report, onUpdate func(*Report), output io.Writer) *progress {
+	return &progress{report: report, onUpdate: onUpdate, output: output}
+}
+
+// update applies change to the report and saves it.
+func (p *progress) update(change func(*Report)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	change(p.report)
+	p.save(time.Now())
+}
+
+// save refreshes the report's estimate and passes it on; p.mu must be held.
+func (p *progress) save(now time.Time) {
+	p.lastSave = now
+	if current := p.report.Progress; current != nil {
+		current.UpdatedAt = now.Format(time.RFC3339)
+		if current.BytesTotal > 0 && current.BytesApplied > 0 {
+			done := min(1, float64(current.BytesApplied)/float64(current.BytesTotal))
+			current.Percent = math.Round(done*1000) / 10
+			elapsed := now.Sub(p.applyStarted)
+			current.EstimatedRemainingMs = int64(float64(elapsed.Milliseconds()) * (1 - done) / done)
+		}
+	}
+	p.onUpdate(p.report)
+}
+
+// start begins counting, with total the size of the SQL files to apply.
+func (p *progress) start(total int64) {
+	p.update(func(report *Report) {
+		report.Progress = &Progress{BytesTotal: total}
+	})
+}
+
+// add counts bytes read and rows loaded, saving at most every
+// progressSaveInterval.
+func (p *progress) add(bytes, rows int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.report.Progress
+	if current == nil {
+		return
+	}
+	now := time.Now()
+	if p.applyStarted.IsZero() {
+		p.applyStarted = now
+	}
+	current.BytesApplied += bytes
+	current.RowsApplied += rows
+	if now.Sub(p.lastSave) >= progressSaveInterval {
+		p.save(now)
+	}
+}
+
+// reader counts what is read from r as applied.
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, p: p}
+}
+
+type countingReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.p.add(int64(n), 0)
+	}
+	return n, err
+}
+
+// psqlOutput returns the writer for psql's output in step: lines go to the
+// restore's output prefixed with the step, and COPY command tags are counted
+// as rows.
+func (p *progress) psqlOutput(step string) io.Writer {
+	return &outputWriter{p: p, step: step}
+}
+
+type outputWriter struct {
+	p       *progress
+	step    string
+	partial string
+}
+
+func (w *outputWriter) Write(b []byte) (int, error) {
+	lines := strings.Split(w.partial+string(b), "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		line = strings.TrimRight(line, "\r")
+		if count, ok := strings.CutPrefix(line, "COPY "); ok {
+			if rows, err := strconv.ParseInt(count, 10, 64); err == nil {
+				w.p.add(0, rows)
+			}
+		}
+		if w.p.output != nil {
+			fmt.Fprintf(w.p.output, "[%s] %s\n", w.step, line)
+		}
+	}
+	return len(b), nil
+}
+
+// fileSizes returns the sizes of the SQL files in an archive from its
+// embedded manifest, nil for archives without one.
+func fileSizes(archivePath string) (map[string]int64, error) {
+	manifest, err := backup.ReadArchiveManifest(archivePath)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(manifest.Files))
+	for _, file := range manifest.Files {
+		sizes[file.Name] = file.Size
+	}
+	return sizes, nil
+}
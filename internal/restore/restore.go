@@ -0,0 +1,620 @@
+package restore
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"go.uber.org/zap"
+)
+
+const dbConnectionTimeout = 30 * time.Second
+
+// Options controls where and how a backup is restored.
+type Options struct {
+	// TargetURL is the server (and default database) to restore into
+	TargetURL string `json:"target_url"`
+	// RenameDB restores into this database on the target server instead of the
+	// one in TargetURL, creating it if it doesn't exist
+	RenameDB string `json:"rename_db,omitempty"`
+	// Owner makes this role the owner of all restored objects
+	Owner string `json:"owner,omitempty"`
+	// SkipRoles skips applying roles.sql (cluster-wide roles)
+	SkipRoles bool `json:"skip_roles,omitempty"`
+	// Tables ("schema.table", schema defaults to public) and Schemas restrict
+	// the restore to those objects. Roles are skipped for partial restores.
+	Tables  []string `json:"tables,omitempty"`
+	Schemas []string `json:"schemas,omitempty"`
+	// Image runs psql from this image instead of one matching the target
+	// server's version, which then isn't queried by the scheduler itself
+	Image string `json:"-"`
+	// SkipVerify skips reading the archives in full before anything is
+	// applied. Each file's checksum is still checked as it is applied.
+	SkipVerify bool `json:"skip_verify,omitempty"`
+	// Analyze and RefreshMatviews override the project's RESTORE_ANALYZE and
+	// RESTORE_REFRESH_MATVIEWS for this restore
+	Analyze         *bool `json:"analyze,omitempty"`
+	RefreshMatviews *bool `json:"refresh_matviews,omitempty"`
+	// SkipValidation skips the project's RESTORE_VALIDATION_SQL files
+	SkipValidation bool `json:"skip_validation,omitempty"`
+	// Output receives psql's output, each line prefixed with the step
+	Output io.Writer `json:"-"`
+}
+
+// Report describes a restore and is persisted while it runs.
+type Report struct {
+	ID             string   `json:"id"`
+	Project        string   `json:"project"`
+	RunID          string   `json:"run_id"`
+	TargetHost     string   `json:"target_host"`
+	TargetDatabase string   `json:"target_database"`
+	Owner          string   `json:"owner,omitempty"`
+	Tables         []string `json:"tables,omitempty"`
+	Schemas        []string `json:"schemas,omitempty"`
+	Status         string   `json:"status"`
+	Error          string   `json:"error,omitempty"`
+	StartedAt      string   `json:"started_at"`
+	FinishedAt     string   `json:"finished_at,omitempty"`
+	DurationMs     int64    `json:"duration_ms"`
+	Steps          []Step   `json:"steps"`
+
+	// Progress counts the SQL applied so far, from the first file on
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+type Step struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+
+	// Output is what a validation file printed
+	Output string `json:"output,omitempty"`
+}
+
+type Restorer struct {
+	config *config.Config
+	logger *zap.Logger
+}
+
+func New(cfg *config.Config, logger *zap.Logger) *Restorer {
+	return &Restorer{
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// NewReport validates options and creates the initial report for restoring entry.
+func NewReport(id string, entry *catalog.Entry, opts Options) (*Report, error) {
+	if opts.TargetURL == "" {
+		return nil, fmt.Errorf("target URL is required")
+	}
+	target, err := database.ParseConnString(opts.TargetURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL: %w", err)
+	}
+	if entry.ArchivePath == "" && entry.ImportFormat != "" {
+		return nil, fmt.Errorf("backup %s was imported from a %s file, only backup archives can be restored", entry.RunID, entry.ImportFormat)
+	}
+	if entry.ArchivePath == "" {
+		return nil, fmt.Errorf("backup %s has no archive", entry.RunID)
+	}
+	if _, err := newObjectFilter(opts.Schemas, opts.Tables); err != nil {
+		return nil, err
+	}
+
+	dbName := target.Database
+	if opts.RenameDB != "" {
+		dbName = opts.RenameDB
+	}
+	if dbName == "" {
+		dbName = "postgres"
+	}
+
+	return &Report{
+		ID:             id,
+		Project:        entry.Project,
+		RunID:          entry.RunID,
+		TargetHost:     database.Address(target.Host, int(target.Port)),
+		TargetDatabase: dbName,
+		Owner:          opts.Owner,
+		Tables:         opts.Tables,
+		Schemas:        opts.Schemas,
+		Status:         "running",
+		StartedAt:      time.Now().Format(time.RFC3339),
+		Steps:          []Step{},
+	}, nil
+}
+
+// Restore applies roles, schema and data from entry's archive to the target.
+// For incremental backups, the data of the incremental tables is layered from
+// the base backup and every increment up to entry. Afterwards the project's
+// post-restore hooks run: ANALYZE, refreshing materialized views and the
+// validation files.
+// The report is updated in place and passed to onUpdate after every step and
+// every few seconds while SQL is applied, from other goroutines as well (but
+// never concurrently).
+func (r *Restorer) Restore(ctx context.Context, entry *catalog.Entry, opts Options, report *Report, onUpdate func(*Report)) error {
+	ctx = docker.WithLabels(ctx, map[string]string{
+		docker.LabelTask:      "restore",
+		docker.LabelProject:   entry.Project,
+		docker.LabelRunID:     entry.RunID,
+		docker.LabelRestoreID: report.ID,
+	})
+	started := time.Now()
+	p := newProgress(report, onUpdate, opts.Output)
+	err := r.restore(ctx, entry, opts, p)
+
+	p.update(func(report *Report) {
+		report.Status = "success"
+		if err != nil {
+			report.Status = "failed"
+			report.Error = redact.String(err.Error())
+		}
+		finished := time.Now()
+		report.FinishedAt = finished.Format(time.RFC3339)
+		report.DurationMs = finished.Sub(started).Milliseconds()
+	})
+
+	if err != nil {
+		r.logger.Error("Restore failed", zap.String("restore_id", report.ID), zap.Error(err))
+	} else {
+		r.logger.Info("Restore completed",
+			zap.String("restore_id", report.ID),
+			zap.String("database", report.TargetDatabase),
+			zap.Int64("duration_ms", report.DurationMs))
+	}
+	return err
+}
+
+func (r *Restorer) restore(ctx context.Context, entry *catalog.Entry, opts Options, p *progress) (err error) {
+	// Incremental backups only hold the rows added since their parent, so the
+	// whole chain has to be on disk before anything is applied
+	chain, err := r.resolveIncrementChain(entry)
+	if err != nil {
+		return err
+	}
+	var validation []string
+	if !opts.SkipValidation {
+		if validation, err = r.validationFiles(entry.Project); err != nil {
+			return err
+		}
+	}
+
+	// A damaged archive is found before the target is touched, rather than
+	// halfway through the data
+	if !opts.SkipVerify {
+		entries := []*catalog.Entry{entry}
+		if chain != nil {
+			entries = append(append(entries, chain.base), chain.increments...)
+		}
+		err := r.step(p, "verify", func() error {
+			for _, e := range entries {
+				if err := verifyEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	opts.TargetURL = database.NormalizeConnString(opts.TargetURL)
+	restoreURL := opts.TargetURL
+	if opts.RenameDB != "" {
+		err := r.step(p, "create_database", func() error {
+			return r.ensureDatabase(ctx, opts.TargetURL, opts.RenameDB, opts.Owner)
+		})
+		if err != nil {
+			return err
+		}
+		restoreURL, err = database.WithDatabase(opts.TargetURL, opts.RenameDB)
+		if err != nil {
+			return err
+		}
+	}
+
+	image := opts.Image
+	if image == "" {
+		pgVersion, err := backup.DetectServerVersion(ctx, restoreURL)
+		if err != nil {
+			return fmt.Errorf("failed to connect to target database: %w", err)
+		}
+		if image, err = backup.DumpImage(r.config, pgVersion); err != nil {
+			return err
+		}
+	}
+
+	// Deferred before the TimescaleDB hooks so that it runs after restoring
+	// mode has ended, on the complete database
+	defer func() {
+		if err == nil {
+			err = r.afterRestore(ctx, p, entry.Project, restoreURL, image, opts, validation)
+		}
+	}()
+
+	filter, err := newObjectFilter(opts.Schemas, opts.Tables)
+	if err != nil {
+		return err
+	}
+
+	applyRoles := !opts.SkipRoles && filter.empty()
+	total, err := totalBytes(entry, chain, applyRoles)
+	if err != nil {
+		return err
+	}
+	p.start(total)
+
+	// Roles are cluster-wide and usually partly exist already, so errors such as
+	// "role already exists" don't abort the restore
+	if applyRoles {
+		err := r.step(p, "roles", func() error {
+			return r.applyFile(ctx, p, "roles", entry.ArchivePath, "roles.sql", opts.TargetURL, image, "", false, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Extensions are created in their original order before the schema needs
+	// them; archives of format 1 don't record them
+	manifest, err := backup.ReadArchiveManifest(entry.ArchivePath)
+	if err != nil {
+		return err
+	}
+	var extensions map[string]string
+	if manifest != nil && len(manifest.Extensions) > 0 {
+		err := r.step(p, "extensions", func() (err error) {
+			extensions, err = r.createExtensions(ctx, restoreURL, manifest.Extensions)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if schema, ok := extensions[timescaleExtension]; ok {
+		err := r.step(p, "timescaledb_pre_restore", func() error {
+			return r.timescaleHook(ctx, restoreURL, schema, "timescaledb_pre_restore")
+		})
+		if err != nil {
+			return err
+		}
+		// Restoring mode must end even if the restore fails or is cancelled
+		defer func() {
+			postErr := r.step(p, "timescaledb_post_restore", func() error {
+				return r.timescaleHook(context.WithoutCancel(ctx), restoreURL, schema, "timescaledb_post_restore")
+			})
+			if err == nil {
+				err = postErr
+			}
+		}()
+	}
+
+	var schemaFilter, dataFilter func(io.Reader) (io.Reader, error)
+	if !filter.empty() {
+		// schema.sql is filtered first: it records the sequences owned by the
+		// selected tables, whose values are set in data.sql
+		schemaFilter = func(in io.Reader) (io.Reader, error) {
+			sql, err := filter.filterSchema(in)
+			if err != nil {
+				return nil, err
+			}
+			return strings.NewReader(sql), nil
+		}
+		dataFilter = func(in io.Reader) (io.Reader, error) {
+			return filter.filterData(in), nil
+		}
+	}
+
+	err = r.step(p, "schema", func() error {
+		return r.applyFile(ctx, p, "schema", entry.ArchivePath, "schema.sql", restoreURL, image, opts.Owner, true, schemaFilter)
+	})
+	if err != nil {
+		return err
+	}
+	err = r.step(p, "data", func() error {
+		return r.applyFile(ctx, p, "data", entry.ArchivePath, "data.sql", restoreURL, image, opts.Owner, true, dataFilter)
+	})
+	if err != nil || chain == nil {
+		return err
+	}
+
+	// The incremental tables' rows up to the first watermark come from the
+	// base backup, the rest from each increment in order
+	baseFilter := func(in io.Reader) (io.Reader, error) {
+		return filterSections(in, func(sec tocSection) bool {
+			return chain.tables.keepDataSection(sec) && (filter.empty() || filter.keepDataSection(sec))
+		}), nil
+	}
+	err = r.step(p, "base_data", func() error {
+		return r.applyFile(ctx, p, "base_data", chain.base.ArchivePath, "data.sql", restoreURL, image, opts.Owner, true, baseFilter)
+	})
+	if err != nil {
+		return err
+	}
+	for _, increment := range chain.increments {
+		step := "increment " + increment.RunID
+		err := r.step(p, step, func() error {
+			return r.applyFile(ctx, p, step, increment.ArchivePath, backup.IncrementFile, restoreURL, image, opts.Owner, true, dataFilter)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Restorer) step(p *progress, name string, fn func() error) error {
+	var index int
+	p.update(func(report *Report) {
+		report.Steps = append(report.Steps, Step{Name: name, Status: "running"})
+		index = len(report.Steps) - 1
+		if report.Progress != nil {
+			report.Progress.Step = name
+		}
+	})
+
+	r.logger.Info("Restore step started", zap.String("restore_id", p.report.ID), zap.String("step", name))
+	started := time.Now()
+	err := fn()
+	p.update(func(report *Report) {
+		step := &report.Steps[index]
+		step.DurationMs = time.Since(started).Milliseconds()
+		step.Status = "success"
+		if err != nil {
+			step.Status = "failed"
+			step.Error = redact.String(err.Error())
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("%s step failed: %w", name, err)
+	}
+	return nil
+}
+
+// totalBytes is the size of the SQL files a restore of entry applies, or 0
+// if an archive doesn't record it.
+func totalBytes(entry *catalog.Entry, chain *incrementChain, roles bool) (int64, error) {
+	type file struct{ archivePath, name string }
+	files := []file{{entry.ArchivePath, "schema.sql"}, {entry.ArchivePath, "data.sql"}}
+	if roles {
+		files = append(files, file{entry.ArchivePath, "roles.sql"})
+	}
+	if chain != nil {
+		files = append(files, file{chain.base.ArchivePath, "data.sql"})
+		for _, increment := range chain.increments {
+			files = append(files, file{increment.ArchivePath, backup.IncrementFile})
+		}
+	}
+
+	var total int64
+	sizes := map[string]map[string]int64{}
+	for _, f := range files {
+		if _, ok := sizes[f.archivePath]; !ok {
+			archiveSizes, err := fileSizes(f.archivePath)
+			if err != nil {
+				return 0, err
+			}
+			sizes[f.archivePath] = archiveSizes
+		}
+		size, ok := sizes[f.archivePath][f.name]
+		if !ok {
+			return 0, nil
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// ensureDatabase creates database name on the target server if it is missing.
+func (r *Restorer) ensureDatabase(ctx context.Context, targetURL, name, owner string) error {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, targetURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		r.logger.Info("Restoring into existing database", zap.String("database", name))
+		return nil
+	}
+
+	stmt := "CREATE DATABASE " + pgx.Identifier{name}.Sanitize()
+	if owner != "" {
+		stmt += " OWNER " + pgx.Identifier{owner}.Sanitize()
+	}
+	if _, err := conn.Exec(ctx, stmt); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+	r.logger.Info("Created database for restore", zap.String("database", name))
+	return nil
+}
+
+// applyFile streams one SQL file from the archive into psql running in a
+// container. strict runs the file in a single transaction that stops on the
+// first error, so a failed step leaves nothing half-applied. filter, if set,
+// selects the parts of the file to apply. What is read and psql's output are
+// counted in p as step.
+func (r *Restorer) applyFile(ctx context.Context, p *progress, step, archivePath, name, connURL, image, owner string, strict bool, filter func(io.Reader) (io.Reader, error)) error {
+	sql, err := OpenArchiveFile(archivePath, name)
+	if err != nil {
+		return err
+	}
+	defer sql.Close()
+
+	input := p.reader(sql)
+	if filter != nil {
+		if input, err = filter(input); err != nil {
+			return fmt.Errorf("failed to filter %s: %w", name, err)
+		}
+		if closer, ok := input.(io.Closer); ok {
+			// Stops a streaming filter if psql exits before reading everything
+			defer closer.Close()
+		}
+	}
+	if owner != "" {
+		// Objects created after SET ROLE are owned by that role
+		input = io.MultiReader(strings.NewReader("SET ROLE "+pgx.Identifier{owner}.Sanitize()+";\n"), input)
+	}
+
+	env, hostConfig, err := backup.ContainerConn(ctx, connURL)
+	if err != nil {
+		return err
+	}
+
+	// Not --quiet: the COPY command tags count the rows
+	cmd := []string{"psql", "--no-psqlrc"}
+	if strict {
+		cmd = append(cmd, "--set=ON_ERROR_STOP=1", "--single-transaction")
+	}
+
+	cfg := container.Config{
+		Image: image,
+		Env:   env,
+		Cmd:   cmd,
+	}
+	return docker.RunWithStdin(ctx, cfg, hostConfig, input, p.psqlOutput(step), p.psqlOutput(step))
+}
+
+// ErrNotInArchive is returned by OpenArchiveFile for files the archive
+// doesn't hold.
+var ErrNotInArchive = errors.New("file not found in archive")
+
+// ErrBackupCorrupted marks archives that don't match their checksums or
+// can't be decompressed.
+var ErrBackupCorrupted = errors.New("backup corrupted")
+
+// verifyEntry reads a backup's archive in full and checks it against the
+// archive checksum in its manifest and the file checksums embedded in it.
+func verifyEntry(entry *catalog.Entry) error {
+	data, err := os.ReadFile(entry.ManifestPath)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest of %s: %w", entry.RunID, err)
+	}
+	var manifest backup.BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest of %s: %w", entry.RunID, err)
+	}
+	var sum string
+	for _, file := range manifest.Files {
+		if file.Name == filepath.Base(entry.ArchivePath) {
+			sum = file.SHA256
+		}
+	}
+
+	if _, err := backup.VerifyArchiveChecksum(entry.ArchivePath, sum); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("archive of %s is missing: %w", entry.RunID, err)
+		}
+		return fmt.Errorf("%w: %s: %v", ErrBackupCorrupted, entry.RunID, err)
+	}
+	return nil
+}
+
+// OpenArchiveFile returns a reader for a single file inside a backup archive,
+// reassembling split archives. Only the archive up to the end of the file is
+// decompressed. For version 2 archives the file's checksum is checked as it
+// is read: instead of the final io.EOF, a mismatch returns an error wrapping
+// ErrBackupCorrupted, as do decompression errors.
+func OpenArchiveFile(archivePath, name string) (io.ReadCloser, error) {
+	file, err := backup.OpenArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	tr := tar.NewReader(gzr)
+	expected := map[string]backup.File{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: failed to read archive: %v", ErrBackupCorrupted, err)
+		}
+		if header.Name == backup.ArchiveManifestName {
+			var manifest backup.ArchiveManifest
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%w: failed to parse %s: %v", ErrBackupCorrupted, backup.ArchiveManifestName, err)
+			}
+			for _, f := range manifest.Files {
+				expected[f.Name] = f
+			}
+			continue
+		}
+		if header.Name == name {
+			return &archiveFile{Reader: &checkedReader{r: tr, name: name, want: expected[name], hash: sha256.New()}, file: file}, nil
+		}
+	}
+
+	file.Close()
+	return nil, fmt.Errorf("%s: %w", name, ErrNotInArchive)
+}
+
+// checkedReader hashes a file as it is read and checks it at the end.
+type checkedReader struct {
+	r    io.Reader
+	name string
+	want backup.File
+	hash hash.Hash
+	size int64
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.size += int64(n)
+	switch {
+	case err == io.EOF && c.want.SHA256 != "" && (c.size != c.want.Size || hex.EncodeToString(c.hash.Sum(nil)) != c.want.SHA256):
+		return n, fmt.Errorf("%w: %s checksum mismatch", ErrBackupCorrupted, c.name)
+	case err != nil && err != io.EOF:
+		return n, fmt.Errorf("%w: failed to read %s: %v", ErrBackupCorrupted, c.name, err)
+	}
+	return n, err
+}
+
+type archiveFile struct {
+	io.Reader
+	file io.Closer
+}
+
+func (a *archiveFile) Close() error {
+	return a.file.Close()
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// advisoryLock holds a session-level advisory lock on the source database on
+// its own connection, so maintenance jobs taking the same lock don't run
+// while the dumps do. The server releases the lock when the connection ends,
+// so a crashed scheduler can't leave it behind.
+type advisoryLock struct {
+	conn *pgx.Conn
+	// arg and expr are the lock's key as a query argument and the SQL
+	// expression turning it into pg_advisory_lock's bigint
+	arg  interface{}
+	expr string
+}
+
+// advisoryLockKey returns how a lock setting is passed to pg_advisory_lock:
+// an integer is the key itself, anything else a name hashed with hashtext,
+// which applications can lock the same way.
+func advisoryLockKey(lock string) (arg interface{}, expr string) {
+	if key, err := strconv.ParseInt(lock, 10, 64); err == nil {
+		return key, "$1::bigint"
+	}
+	return lock, "hashtext($1)"
+}
+
+// acquireAdvisoryLock connects to connURL and takes lock, waiting up to
+// timeout for another session to release it (0 tries once).
+func acquireAdvisoryLock(ctx context.Context, connURL, lock string, timeout time.Duration) (*advisoryLock, error) {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return nil, err
+	}
+	// The connection sits idle while the dumps run; don't let a server-side
+	// idle timeout end it and the lock with it (the setting is new in 14)
+	_, _ = conn.Exec(ctx, "SET idle_session_timeout = 0")
+
+	l := &advisoryLock{conn: conn}
+	l.arg, l.expr = advisoryLockKey(lock)
+
+	if timeout <= 0 {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock("+l.expr+")", l.arg).Scan(&locked); err != nil {
+			conn.Close(context.Background())
+			return nil, fmt.Errorf("failed to take advisory lock %q: %w", lock, err)
+		}
+		if !locked {
+			conn.Close(context.Background())
+			return nil, withFailure(FailureLockHeld, fmt.Errorf("advisory lock %q is held by another session", lock))
+		}
+		return l, nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := conn.Exec(waitCtx, "SELECT pg_advisory_lock("+l.expr+")", l.arg); err != nil {
+		conn.Close(context.Background())
+		if ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+			return nil, withFailure(FailureLockHeld, fmt.Errorf("advisory lock %q is still held by another session after %s", lock, timeout))
+		}
+		return nil, fmt.Errorf("failed to take advisory lock %q: %w", lock, err)
+	}
+	return l, nil
+}
+
+// pid is the backend process of the lock's connection.
+func (l *advisoryLock) pid() uint32 {
+	return l.conn.PgConn().PID()
+}
+
+// Release unlocks and closes the connection. It is safe to call more than
+// once and on a nil lock.
+func (l *advisoryLock) Release() {
+	if l == nil || l.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Closing the connection releases the lock anyway; unlocking first
+	// frees it right away even if the close is slow
+	_, _ = l.conn.Exec(ctx, "SELECT pg_advisory_unlock("+l.expr+")", l.arg)
+	_ = l.conn.Close(ctx)
+	l.conn = nil
+}
+
+// advisoryLockName returns the lock a project's backups take, or "" for none.
+func (br *BackupRunner) advisoryLockName(project string) string {
+	lock := strings.TrimSpace(br.config.ProjectOption(project, "ADVISORY_LOCK", br.config.AdvisoryLock))
+	if strings.EqualFold(lock, "none") {
+		return ""
+	}
+	return lock
+}
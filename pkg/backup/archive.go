@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ArchiveFormat is the version of the archive layout. Version 2 archives
+// start with ArchiveManifestName; version 1 archives only hold the SQL files.
+const ArchiveFormat = 2
+
+// ArchiveManifestName is the first entry of a version 2 archive.
+const ArchiveManifestName = "manifest.json"
+
+// ArchiveManifest describes an archive from the inside, so a copy separated
+// from its manifest file still says what it holds. It is written before the
+// archive exists and so can't contain the archive's own checksum or anything
+// decided afterwards (finish time, signature, storage results); the manifest
+// file next to the archive has those.
+type ArchiveManifest struct {
+	Format            int             `json:"format"`
+	RunID             string          `json:"run_id"`
+	DatabaseID        string          `json:"database_identifier"`
+	StartedAt         string          `json:"started_at"`
+	PGVersion         string          `json:"pg_version,omitempty"`
+	DatabaseSizeBytes *int64          `json:"database_size_bytes,omitempty"`
+	DumpOptions       DumpOptions     `json:"dump_options"`
+	Files             []File          `json:"files"`
+	Warnings          []string        `json:"warnings,omitempty"`
+	Tables            []TableRowCount `json:"tables,omitempty"`
+	RowCountMethod    string          `json:"row_count_method,omitempty"`
+	SkippedMetrics    []SkippedMetric `json:"skipped_metrics,omitempty"`
+	Incremental       *Incremental    `json:"incremental,omitempty"`
+	// LargeObjects is the number of large objects in the database
+	LargeObjects *int64 `json:"large_objects,omitempty"`
+	// Extensions are the installed extensions, in creation order
+	Extensions []Extension `json:"extensions,omitempty"`
+	// Environment is the scheduler, hosts and pg_dump build that took the
+	// dumps, as in the backup manifest
+	Environment *Environment `json:"environment,omitempty"`
+}
+
+// DumpOptions records how the dumps in an archive were taken.
+type DumpOptions struct {
+	Image          string   `json:"image"`
+	DataDumpStyle  string   `json:"data_dump_style"`
+	DataArgs       []string `json:"data_args,omitempty"`
+	RolesDump      string   `json:"roles_dump"`
+	Provider       string   `json:"provider,omitempty"`
+	SharedSnapshot bool     `json:"shared_snapshot"`
+	// ExtraArgs are the DUMP_ARGS flags; Env the names of the DUMP_ENV
+	// variables (values may be secrets)
+	ExtraArgs []string `json:"extra_args,omitempty"`
+	Env       []string `json:"env,omitempty"`
+	// LargeObjects is the LARGE_OBJECTS mode
+	LargeObjects string `json:"large_objects,omitempty"`
+}
+
+// writeArchiveManifest checksums the files going into the archive and writes
+// the archive manifest to path.
+func writeArchiveManifest(path string, manifest *ArchiveManifest, files []string) error {
+	manifest.Format = ArchiveFormat
+	manifest.Files = make([]File, 0, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		sum, err := FileSHA256(file)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", filepath.Base(file), err)
+		}
+		manifest.Files = append(manifest.Files, File{Name: filepath.Base(file), Size: info.Size(), SHA256: sum})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadArchiveManifest returns the manifest embedded in an archive, or nil for
+// version 1 archives, which don't have one.
+func ReadArchiveManifest(archivePath string) (*ArchiveManifest, error) {
+	file, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return readArchiveManifest(tar.NewReader(gzr))
+}
+
+// readArchiveManifest reads the first entry of an archive if it is the
+// manifest.
+func readArchiveManifest(tr *tar.Reader) (*ArchiveManifest, error) {
+	header, err := tr.Next()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if header.Name != ArchiveManifestName {
+		return nil, nil
+	}
+	var manifest ArchiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ArchiveManifestName, err)
+	}
+	return &manifest, nil
+}
+
+// VerifyArchive checks every file in a version 2 archive against the
+// checksums of its embedded manifest, that none is missing or extra, and the
+// gzip stream's checksum. It returns the manifest, nil for version 1
+// archives, which can't be checked.
+func VerifyArchive(archivePath string) (*ArchiveManifest, error) {
+	return VerifyArchiveChecksum(archivePath, "")
+}
+
+// VerifyArchiveChecksum is VerifyArchive that also compares the SHA-256 of
+// the archive itself (reassembled, if split) with sum, if set, in the same
+// pass. This catches damage to version 1 archives too.
+func VerifyArchiveChecksum(archivePath, sum string) (*ArchiveManifest, error) {
+	file, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	manifest, err := verifyArchive(io.TeeReader(file, hash))
+	if err != nil || sum == "" {
+		return manifest, err
+	}
+	// Version 1 archives aren't read to the end
+	if _, err := io.Copy(hash, file); err != nil {
+		return manifest, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != sum {
+		return manifest, fmt.Errorf("archive checksum mismatch")
+	}
+	return manifest, nil
+}
+
+func verifyArchive(file io.Reader) (*ArchiveManifest, error) {
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gzr)
+	manifest, err := readArchiveManifest(tr)
+	if err != nil || manifest == nil {
+		return manifest, err
+	}
+
+	expected := make(map[string]File, len(manifest.Files))
+	for _, f := range manifest.Files {
+		expected[f.Name] = f
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read archive: %w", err)
+		}
+		want, ok := expected[header.Name]
+		if !ok {
+			return manifest, fmt.Errorf("%s is not listed in %s", header.Name, ArchiveManifestName)
+		}
+		delete(expected, header.Name)
+		hash := sha256.New()
+		size, err := io.Copy(hash, tr)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		if size != want.Size || hex.EncodeToString(hash.Sum(nil)) != want.SHA256 {
+			return manifest, fmt.Errorf("%s checksum mismatch", header.Name)
+		}
+	}
+	for name := range expected {
+		return manifest, fmt.Errorf("%s is missing from the archive", name)
+	}
+	// The tar end marker isn't the end of the gzip stream: reading on checks
+	// the CRC-32 and length in its trailer, which a truncated archive lacks
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return manifest, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return manifest, nil
+}
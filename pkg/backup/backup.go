@@ -0,0 +1,1167 @@
+// Package backup dumps one database into an archive (roles, schema and data
+// from pg_dump/pg_dumpall in a helper container) and writes its manifest.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/layout"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"go.uber.org/zap"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	dbConnectionTimeout = 30 * time.Second
+)
+
+type BackupRunner struct {
+	config     *config.Config
+	logger     *zap.Logger
+	signingKey ed25519.PrivateKey
+	layout     *layout.Layout
+
+	// pgDumpVersions caches `pg_dump --version` by dump image ID
+	pgDumpVersions sync.Map
+}
+
+func New(cfg *config.Config, logger *zap.Logger) *BackupRunner {
+	return &BackupRunner{
+		config: cfg,
+		logger: logger,
+		layout: layout.Standard,
+	}
+}
+
+type BackupManifest struct {
+	RunID             string   `json:"run_id"`
+	DatabaseID        string   `json:"database_identifier"`
+	StartedAt         string   `json:"started_at"`
+	FinishedAt        string   `json:"finished_at"`
+	DurationMs        int64    `json:"duration_ms"`
+	Status            string   `json:"status"`
+	Files             []File   `json:"files"`
+	Error             string   `json:"error,omitempty"`
+	PGVersion         string   `json:"pg_version,omitempty"`
+	DatabaseSizeBytes *int64   `json:"database_size_bytes,omitempty"`
+	DataDumpStyle     string   `json:"data_dump_style,omitempty"`
+	RolesDump         string   `json:"roles_dump,omitempty"`
+	Provider          string   `json:"provider,omitempty"`
+	Warnings          []string `json:"warnings,omitempty"`
+	// SharedSnapshot is set when schema and data were dumped from one exported snapshot
+	SharedSnapshot bool `json:"shared_snapshot"`
+	// Tables holds per-table row counts taken before the dump; RowCountMethod
+	// is "estimate" (pg_stat_user_tables) or "exact" (count(*))
+	Tables         []TableRowCount `json:"tables,omitempty"`
+	RowCountMethod string          `json:"row_count_method,omitempty"`
+	// SkippedMetrics lists metrics that couldn't be collected and why
+	SkippedMetrics []SkippedMetric `json:"skipped_metrics,omitempty"`
+	// ThrottledMs is how long the backup was paused because the database was busy
+	ThrottledMs int64 `json:"throttled_ms,omitempty"`
+	// Tags are the labels the backup was triggered with (WithTags)
+	Tags []string `json:"tags,omitempty"`
+	// ArchiveFormat is the archive layout version (unset for version 1)
+	ArchiveFormat int `json:"archive_format,omitempty"`
+	// Incremental is set for backups taken with BACKUP_MODE=incremental
+	Incremental *Incremental `json:"incremental,omitempty"`
+	// Signature is set for successful backups when SIGNING_KEY_FILE is configured
+	Signature *Signature `json:"signature,omitempty"`
+	// Storage records where copies of the backup were stored
+	Storage []StorageResult `json:"storage,omitempty"`
+	// Imported is set for backups adopted from outside (see package importer)
+	Imported *ImportInfo `json:"imported,omitempty"`
+	// Stats are the sizes and speeds of a successful backup
+	Stats *Stats `json:"stats,omitempty"`
+	// Failure classifies the error of a failed backup (see ClassifyFailure)
+	// and FailedPhase names the phase it failed in
+	Failure     string `json:"failure,omitempty"`
+	FailedPhase string `json:"failed_phase,omitempty"`
+	// Parts are the pieces of an archive split by ARCHIVE_SPLIT_SIZE, in
+	// order; Files[0] still describes the whole archive, which only exists
+	// as its parts (see OpenArchive)
+	Parts []File `json:"parts,omitempty"`
+	// LargeObjects is the LARGE_OBJECTS mode of the data dump and
+	// LargeObjectCount the number of large objects in the database
+	LargeObjects     string `json:"large_objects,omitempty"`
+	LargeObjectCount *int64 `json:"large_object_count,omitempty"`
+	// Extensions are the extensions installed in the database, in creation
+	// order; restores create them before the schema
+	Extensions []Extension `json:"extensions,omitempty"`
+	// SchemaDrift compares the schema with the previous successful backup's
+	// (SCHEMA_DRIFT); unset if there was none to compare with
+	SchemaDrift *SchemaDrift `json:"schema_drift,omitempty"`
+	// Verification is the result of reading the archive back after writing
+	// it (ARCHIVE_VERIFY)
+	Verification *Verification `json:"verification,omitempty"`
+	// Environment records the scheduler, hosts and pg_dump build behind the
+	// backup; failed backups only get the scheduler and its host
+	Environment *Environment `json:"environment,omitempty"`
+	// PhaseMs is how long each phase took in milliseconds, by phase name
+	// (connect, roles, schema, data, increment, archive, verify, upload).
+	// Failed backups have the phases up to the one that failed
+	PhaseMs map[string]int64 `json:"phase_ms,omitempty"`
+	// Instance is the INSTANCE_NAME of the scheduler that took the backup
+	Instance string `json:"instance,omitempty"`
+}
+
+// Verification records whether an archive was read back in full after it was
+// written: Status is "passed", "failed" or "skipped".
+type Verification struct {
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ImportInfo records where an imported backup came from. Its metadata is
+// best-effort: whatever could be read from the file, its name and mtime.
+type ImportInfo struct {
+	// Source is the path the file was imported from
+	Source string `json:"source"`
+	// Format is archive (this tool's own format), sql, sql.gz or custom
+	// (pg_dump -Fc); only archives can be restored
+	Format     string `json:"format"`
+	ImportedAt string `json:"imported_at"`
+}
+
+type StorageResult struct {
+	Target     string `json:"target"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	UploadedAt string `json:"uploaded_at,omitempty"`
+	// DurationMs and MBPerSec describe the archive upload
+	DurationMs int64   `json:"duration_ms,omitempty"`
+	MBPerSec   float64 `json:"mb_per_s,omitempty"`
+}
+
+type TableRowCount struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	// Estimate marks estimated counts in an exact count, for tables the
+	// backup user can't read
+	Estimate bool `json:"estimate,omitempty"`
+}
+
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// SetSigningKey makes CreateBackup sign the manifests of successful backups.
+func (br *BackupRunner) SetSigningKey(key ed25519.PrivateKey) {
+	br.signingKey = key
+}
+
+// SetLayout names archives after l instead of the default layout.
+func (br *BackupRunner) SetLayout(l *layout.Layout) {
+	br.layout = l
+}
+
+// CreateBackup dumps db into an archive and manifest in outputDir. progress,
+// if not nil, is told about each phase and the bytes written so far.
+func (br *BackupRunner) CreateBackup(ctx context.Context, db *database.Database, outputDir, backupDate string, progress ProgressFunc) (*BackupManifest, error) {
+	if progress == nil {
+		progress = func(string, int64) {}
+	}
+	timer := newPhaseTimer(br.now)
+	manifest, err := br.createBackup(ctx, db, outputDir, backupDate, progress, timer)
+	if manifest != nil && manifest.PhaseMs == nil {
+		manifest.PhaseMs = timer.result()
+	}
+	return manifest, err
+}
+
+func (br *BackupRunner) createBackup(ctx context.Context, db *database.Database, outputDir, backupDate string, progress ProgressFunc, timer *phaseTimer) (*BackupManifest, error) {
+	startedAt := br.now()
+	timer.start(PhaseConnect)
+	runID := fmt.Sprintf("%s-%s-%s", db.Identifier, backupDate, startedAt.Format("150405"))
+	if br.config.InstanceName != "" {
+		// Appended, so run IDs still start with <project>-<date>
+		runID += "-" + br.config.InstanceName
+	}
+	ctx = docker.WithLabels(ctx, map[string]string{
+		docker.LabelTask:    "backup",
+		docker.LabelProject: db.Identifier,
+		docker.LabelRunID:   runID,
+	})
+
+	br.logger.Info("Starting backup", zap.String("database", db.Identifier))
+
+	connURL, err := br.backupURL(db)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+	if connURL != db.ConnectionURL {
+		br.logger.Debug("Using direct URL for backup", zap.String("database", db.Identifier))
+		direct := *db
+		direct.ConnectionURL = connURL
+		db = &direct
+	}
+
+	// Detect PostgreSQL version
+	pgVersion, err := br.serverVersion(ctx, db)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, err)
+	}
+
+	image, err := br.dumpImage(pgVersion)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+
+	dataStyle := strings.ToLower(br.config.ProjectOption(db.Identifier, "DATA_DUMP_STYLE", br.config.DataDumpStyle))
+	if dataStyle == "" {
+		dataStyle = "copy"
+	}
+	dataOptions, err := dataDumpOptions(dataStyle)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+
+	// Extra environment for every dump container and extra pg_dump flags,
+	// for edge cases like a server-side statement_timeout
+	extraEnv, err := ParseDumpEnv(br.config.ProjectOption(db.Identifier, "DUMP_ENV", br.config.DumpEnv))
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+	extraArgs, err := ParseDumpArgs(br.config.ProjectOption(db.Identifier, "DUMP_ARGS", br.config.DumpArgs))
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+	ctx = withDumpEnv(ctx, extraEnv)
+
+	largeObjects := strings.ToLower(br.config.ProjectOption(db.Identifier, "LARGE_OBJECTS", br.config.LargeObjects))
+	if largeObjects == "" {
+		largeObjects = LargeObjectsAuto
+	}
+	largeObjectFlags, err := largeObjectOptions(largeObjects, extraArgs)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+	dataOptions = append(dataOptions, largeObjectFlags...)
+
+	rolesMode := strings.ToLower(br.config.ProjectOption(db.Identifier, "ROLES_DUMP", br.config.RolesDump))
+	if rolesMode == "" {
+		rolesMode = rolesDumpAll
+	}
+	if rolesMode != rolesDumpAll && rolesMode != rolesDumpOwners && rolesMode != rolesDumpSkip {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, fmt.Errorf("invalid roles dump mode %q (expected all, owners or skip)", rolesMode)))
+	}
+	rolesOptional := br.config.ProjectOptionBool(db.Identifier, "ROLES_DUMP_OPTIONAL", br.config.RolesDumpOptional)
+
+	mode, incrementalTables, err := br.incrementalTables(db.Identifier)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, withFailure(FailureConfig, err))
+	}
+	var parent *incrementalParent
+	if mode == ModeIncremental {
+		var reason string
+		if parent, reason = br.findIncrementalParent(db.Identifier, incrementalTables); parent == nil {
+			br.logger.Info("Taking a full backup in incremental mode", zap.String("database", db.Identifier), zap.String("reason", reason))
+		}
+	}
+
+	profile, err := br.resolveProvider(ctx, db)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, err)
+	}
+	br.logger.Debug("Using provider profile", zap.String("database", db.Identifier), zap.String("provider", profile.name))
+
+	// Wait for the source to quiet down before anything touches it; the dumps
+	// pause whenever it gets busy again
+	throttler, err := br.startThrottle(ctx, db, db.ConnectionURL)
+	if err != nil {
+		br.logger.Warn("Failed to start load checks, backing up without throttling", zap.String("database", db.Identifier), zap.Error(err))
+	}
+	if throttler != nil {
+		defer throttler.Close()
+		ctx = withThrottle(ctx, throttler)
+		if err := throttler.wait(ctx); err != nil {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, fmt.Errorf("waiting for the database to quiet down: %w", err))
+		}
+	}
+
+	// Hold ADVISORY_LOCK from here until the dumps are done, so maintenance
+	// jobs taking the same lock wait for them
+	var lock *advisoryLock
+	if lockName := br.advisoryLockName(db.Identifier); lockName != "" {
+		lockTimeout := br.config.ProjectOptionDuration(db.Identifier, "ADVISORY_LOCK_TIMEOUT", br.config.AdvisoryLockTimeout)
+		br.logger.Debug("Taking advisory lock", zap.String("database", db.Identifier), zap.String("lock", lockName))
+		lock, err = acquireAdvisoryLock(ctx, db.ConnectionURL, lockName, lockTimeout)
+		if err != nil {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, err)
+		}
+		defer lock.Release()
+		throttler.ignore(lock.pid())
+	}
+
+	// Collect metrics
+	exactRowCounts := br.config.ProjectOptionBool(db.Identifier, "EXACT_ROW_COUNTS", br.config.ExactRowCounts)
+	metrics := br.collectMetrics(ctx, db.ConnectionURL, exactRowCounts)
+	for _, skipped := range metrics.Skipped {
+		br.logger.Warn("Skipped metric", zap.String("database", db.Identifier), zap.String("metric", skipped.Metric), zap.String("reason", skipped.Reason))
+	}
+
+	// Create temp directory for dumps
+	tempDir := filepath.Join(outputDir, runID)
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	var files []string
+	var warnings []string
+
+	// pg_dump drops large objects without a word once DUMP_ARGS selects
+	// schemas or tables
+	if largeObjects == LargeObjectsAuto && metrics.LargeObjects != nil && *metrics.LargeObjects > 0 && !largeObjectsDumped(extraArgs) {
+		br.logger.Warn("Large objects are left out of the dump", zap.String("database", db.Identifier), zap.Int64("large_objects", *metrics.LargeObjects))
+		warnings = append(warnings, fmt.Sprintf("the database has %d large objects, which pg_dump leaves out when DUMP_ARGS selects schemas or tables; set LARGE_OBJECTS=include to dump them", *metrics.LargeObjects))
+	}
+
+	// Schema and data are dumped by separate pg_dump runs; a shared snapshot
+	// makes them describe the same point in time. Incremental mode always
+	// needs one: watermarks and increments must match the dumps exactly
+	var snapshotOptions []string
+	var snapshot *exportedSnapshot
+	if mode == ModeIncremental || br.config.ProjectOptionBool(db.Identifier, "SHARED_SNAPSHOT", br.config.SharedSnapshot) {
+		snapshot, err = exportSnapshot(ctx, db.ConnectionURL)
+		if err != nil && mode == ModeIncremental {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, fmt.Errorf("incremental mode needs an exported snapshot: %w", err))
+		}
+		if err != nil {
+			br.logger.Warn("Failed to export snapshot, dumping without a shared snapshot", zap.String("database", db.Identifier), zap.Error(err))
+			warnings = append(warnings, fmt.Sprintf("shared snapshot unavailable, schema and data were dumped independently: %v", err))
+		} else {
+			defer snapshot.Close()
+			throttler.ignore(snapshot.conn.PgConn().PID())
+			snapshotOptions = []string{"--snapshot=" + snapshot.ID}
+			br.logger.Debug("Exported snapshot for dumps", zap.String("database", db.Identifier), zap.String("snapshot", snapshot.ID))
+		}
+	}
+
+	// A full backup in incremental mode records where the next increment
+	// starts; an incremental one leaves the tables' data to increment.sql
+	var incremental *Incremental
+	if mode == ModeIncremental && parent == nil {
+		marks, err := snapshot.watermarks(ctx, incrementalTables)
+		if err != nil {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSetup, err)
+		}
+		incremental = &Incremental{Type: ModeFull, Tables: marks}
+	} else if mode == ModeIncremental {
+		baseRunID := parent.incremental.BaseRunID
+		if parent.incremental.Type == ModeFull {
+			baseRunID = parent.runID
+		}
+		incremental = &Incremental{Type: ModeIncremental, BaseRunID: baseRunID, ParentRunID: parent.runID}
+		dataOptions = append(dataOptions, excludeTableDataOptions(incrementalTables)...)
+	}
+
+	// 1. Dump roles
+	dumpStarted := br.now()
+	timer.start(PhaseRoles)
+	rolesFile := filepath.Join(tempDir, "roles.sql")
+	progress(PhaseRoles, 0)
+	rolesStatus, err := br.dumpRolesWithMode(ctx, db.ConnectionURL, rolesFile, image, rolesMode, profile)
+	if err != nil {
+		if !rolesOptional {
+			br.logger.Error("Roles dump failed", zap.String("database", db.Identifier), zap.Error(err))
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseRoles, fmt.Errorf("roles dump failed: %w", err))
+		}
+		br.logger.Warn("Roles dump failed, continuing without roles", zap.String("database", db.Identifier), zap.Error(err))
+		warnings = append(warnings, fmt.Sprintf("roles dump failed: %v", err))
+		rolesStatus = "failed"
+		if err := writeRolesPlaceholder(rolesFile, "roles dump failed, see manifest warnings"); err != nil {
+			return nil, err
+		}
+	}
+	files = append(files, rolesFile)
+	if info, err := os.Stat(rolesFile); err == nil {
+		progress(PhaseRoles, info.Size())
+	}
+
+	// 2. Dump schema
+	timer.start(PhaseSchema)
+	schemaFile := filepath.Join(tempDir, "schema.sql")
+	schemaArgs := append(append(append([]string{}, snapshotOptions...), profile.dumpArgs...), extraArgs...)
+	if err := br.dumpSchema(ctx, db.ConnectionURL, schemaFile, image, schemaArgs, progress); err != nil {
+		br.logger.Error("Schema dump failed", zap.String("database", db.Identifier), zap.Error(err))
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseSchema, fmt.Errorf("schema dump failed: %w", err))
+	}
+	files = append(files, schemaFile)
+
+	var drift *SchemaDrift
+	if br.config.ProjectOptionBool(db.Identifier, "SCHEMA_DRIFT", br.config.SchemaDrift) {
+		drift = br.schemaDrift(db.Identifier, schemaFile)
+	}
+
+	// 3. Dump data
+	timer.start(PhaseData)
+	dataFile := filepath.Join(tempDir, "data.sql")
+	dataArgs := append(append(append(append([]string{}, dataOptions...), snapshotOptions...), profile.dumpArgs...), extraArgs...)
+	if err := br.dumpData(ctx, db.ConnectionURL, dataFile, image, dataArgs, progress); err != nil {
+		br.logger.Error("Data dump failed", zap.String("database", db.Identifier), zap.Error(err))
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseData, fmt.Errorf("data dump failed: %w", err))
+	}
+	files = append(files, dataFile)
+
+	// 4. Copy the new rows of incremental tables
+	if incremental != nil && incremental.Type == ModeIncremental {
+		timer.start(PhaseIncrement)
+		incrementFile := filepath.Join(tempDir, IncrementFile)
+		marks, err := br.dumpIncrement(ctx, snapshot, incrementFile, incrementalTables, parent.incremental, progress)
+		if err != nil {
+			br.logger.Error("Increment dump failed", zap.String("database", db.Identifier), zap.Error(err))
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseIncrement, fmt.Errorf("increment dump failed: %w", err))
+		}
+		incremental.Tables = marks
+		files = append(files, incrementFile)
+	}
+
+	dumpDuration := br.now().Sub(dumpStarted)
+	timer.stop()
+	// The dumps are done, let jobs waiting for the advisory lock in
+	lock.Release()
+	var dumpBytes int64
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			dumpBytes += info.Size()
+		}
+	}
+
+	throttledFor, gaveUp := throttler.stats()
+	if gaveUp {
+		warnings = append(warnings, fmt.Sprintf("database stayed busy, the backup continued without throttling after waiting %s", throttledFor.Round(time.Second)))
+	}
+
+	environment := br.environment(ctx, image)
+
+	// Describe the archive from the inside; the manifest is its first entry
+	timer.start(PhaseArchive)
+	archiveManifestFile := filepath.Join(tempDir, ArchiveManifestName)
+	err = writeArchiveManifest(archiveManifestFile, &ArchiveManifest{
+		RunID:             runID,
+		DatabaseID:        db.Identifier,
+		StartedAt:         startedAt.Format(time.RFC3339),
+		PGVersion:         metrics.PGVersion,
+		DatabaseSizeBytes: metrics.DatabaseSizeBytes,
+		DumpOptions: DumpOptions{
+			Image:          image,
+			DataDumpStyle:  dataStyle,
+			DataArgs:       dataOptions,
+			RolesDump:      rolesStatus,
+			Provider:       profile.name,
+			SharedSnapshot: len(snapshotOptions) > 0,
+			ExtraArgs:      extraArgs,
+			Env:            envNames(extraEnv),
+			LargeObjects:   largeObjects,
+		},
+		Warnings:       warnings,
+		Tables:         metrics.Tables,
+		RowCountMethod: metrics.RowCountMethod,
+		SkippedMetrics: metrics.Skipped,
+		Incremental:    incremental,
+		LargeObjects:   metrics.LargeObjects,
+		Extensions:     metrics.Extensions,
+		Environment:    environment,
+	}, files)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, fmt.Errorf("failed to write archive manifest: %w", err))
+	}
+	files = append([]string{archiveManifestFile}, files...)
+
+	// Create archive, named by the layout
+	_, archiveName, err := br.layout.Path(layout.Vars{
+		Project:   db.Identifier,
+		Group:     br.config.ProjectGroup(db.Identifier),
+		Namespace: br.config.ProjectNamespace(db.Identifier),
+		RunID:     runID,
+		Date:      backupDate,
+		Instance:  br.config.InstanceName,
+	})
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, withFailure(FailureConfig, err))
+	}
+	archivePath := filepath.Join(outputDir, archiveName)
+	archiveStarted := br.now()
+	compressionLevel := br.config.ProjectOptionInt(db.Identifier, "COMPRESSION_LEVEL", br.config.CompressionLevel)
+	if compressionLevel == 0 {
+		// A Config built in code
+		compressionLevel = gzip.DefaultCompression
+	} else if compressionLevel < gzip.BestSpeed || compressionLevel > gzip.BestCompression {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, withFailure(FailureConfig, fmt.Errorf("COMPRESSION_LEVEL must be between 1 and 9, got %d", compressionLevel)))
+	}
+	archiveHash, err := br.createArchive(files, archivePath, tempDir, compressionLevel, progress)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, fmt.Errorf("archive creation failed: %w", err))
+	}
+
+	archiveDuration := br.now().Sub(archiveStarted)
+
+	timer.stop()
+	verification, err := br.verifyArchive(archivePath)
+	if verification.Status != "skipped" {
+		timer.ms[PhaseVerify] = verification.DurationMs
+	}
+	if err != nil {
+		manifest, _ := br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, fmt.Errorf("archive verification failed: %w", err))
+		manifest.Verification = verification
+		return manifest, nil
+	}
+
+	finishedAt := br.now()
+	durationMs := finishedAt.Sub(startedAt).Milliseconds()
+
+	archiveInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, fmt.Errorf("failed to stat archive: %w", err))
+	}
+
+	var parts []File
+	timer.start(PhaseArchive)
+	if partSize := br.config.ProjectArchiveSplitBytes(db.Identifier); partSize > 0 && archiveInfo.Size() > partSize {
+		if partSize < config.MinArchiveSplitBytes {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, withFailure(FailureConfig, fmt.Errorf("ARCHIVE_SPLIT_SIZE must be at least 1MB, got %d bytes", partSize)))
+		}
+		parts, err = splitArchive(archivePath, partSize)
+		if err != nil {
+			return br.createFailedManifest(runID, db.Identifier, startedAt, PhaseArchive, fmt.Errorf("archive splitting failed: %w", err))
+		}
+		br.logger.Info("Split archive", zap.String("database", db.Identifier), zap.Int("parts", len(parts)), zap.Int64("part_size", partSize))
+	}
+
+	manifest := &BackupManifest{
+		RunID:         runID,
+		DatabaseID:    db.Identifier,
+		StartedAt:     startedAt.Format(time.RFC3339),
+		FinishedAt:    finishedAt.Format(time.RFC3339),
+		DurationMs:    durationMs,
+		Status:        "success",
+		ArchiveFormat: ArchiveFormat,
+		Files: []File{{
+			Name:   filepath.Base(archivePath),
+			Size:   archiveInfo.Size(),
+			SHA256: archiveHash,
+		}},
+		PGVersion:         metrics.PGVersion,
+		DatabaseSizeBytes: metrics.DatabaseSizeBytes,
+		DataDumpStyle:     dataStyle,
+		RolesDump:         rolesStatus,
+		Provider:          profile.name,
+		Warnings:          warnings,
+		SharedSnapshot:    len(snapshotOptions) > 0,
+		Tables:            metrics.Tables,
+		RowCountMethod:    metrics.RowCountMethod,
+		SkippedMetrics:    metrics.Skipped,
+		ThrottledMs:       throttledFor.Milliseconds(),
+		Stats:             newStats(dumpBytes, archiveInfo.Size(), dumpDuration, archiveDuration),
+		Tags:              tagsFrom(ctx),
+		Incremental:       incremental,
+		Parts:             parts,
+		LargeObjects:      largeObjects,
+		LargeObjectCount:  metrics.LargeObjects,
+		Extensions:        metrics.Extensions,
+		SchemaDrift:       drift,
+		Verification:      verification,
+		Environment:       environment,
+		PhaseMs:           timer.result(),
+		Instance:          br.config.InstanceName,
+	}
+
+	if br.signingKey != nil {
+		br.signManifest(manifest)
+	}
+
+	// Save manifest
+	manifestPath := filepath.Join(outputDir, fmt.Sprintf("manifest-%s.json", runID))
+	if err := br.saveManifest(manifestPath, manifest); err != nil {
+		br.logger.Warn("Failed to save manifest", zap.Error(err))
+	}
+
+	// Cleanup temp directory
+	if err := os.RemoveAll(tempDir); err != nil {
+		br.logger.Warn("Failed to cleanup temp directory", zap.Error(err))
+	}
+
+	br.logger.Info("Backup completed",
+		zap.String("database", db.Identifier),
+		zap.Int64("duration_ms", durationMs),
+		zap.Int64("size_bytes", archiveInfo.Size()),
+		zap.Float64("compression_ratio", manifest.Stats.CompressionRatio),
+		zap.Float64("dump_mb_per_s", manifest.Stats.DumpMBPerSec))
+
+	return manifest, nil
+}
+
+type Metrics struct {
+	PGVersion         string
+	DatabaseSizeBytes *int64
+	Tables            []TableRowCount
+	RowCountMethod    string
+	// LargeObjects is the number of large objects in the database
+	LargeObjects *int64
+	// Extensions are the installed extensions, in creation order
+	Extensions []Extension
+	// Skipped lists the metrics that couldn't be collected
+	Skipped []SkippedMetric
+}
+
+// SkippedMetric is a manifest metric that wasn't collected, usually because
+// the backup user lacks a privilege. Metric "all" means the metrics
+// connection failed.
+type SkippedMetric struct {
+	Metric string `json:"metric"`
+	Reason string `json:"reason"`
+}
+
+func (m *Metrics) skip(metric, reason string) {
+	m.Skipped = append(m.Skipped, SkippedMetric{Metric: metric, Reason: reason})
+}
+
+// collectMetrics reads the server version, database size and table row
+// counts. Restricted users often can't read all of them, so privileges are
+// checked first and metrics that can't be collected are recorded as skipped
+// instead of failing the backup.
+func (br *BackupRunner) collectMetrics(ctx context.Context, connURL string, exactRowCounts bool) *Metrics {
+	metrics := &Metrics{}
+
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		metrics.skip("all", fmt.Sprintf("failed to connect: %v", err))
+		return metrics
+	}
+	defer conn.Close(context.Background())
+
+	// Get PostgreSQL version
+	var version string
+	if err := conn.QueryRow(ctx, "SELECT version()").Scan(&version); err != nil {
+		metrics.skip("pg_version", err.Error())
+	} else {
+		re := regexp.MustCompile(`PostgreSQL (\d+(?:\.\d+)?)`)
+		matches := re.FindStringSubmatch(version)
+		if len(matches) >= 2 {
+			metrics.PGVersion = matches[1]
+		}
+	}
+
+	// pg_largeobject_metadata is readable by everyone, unlike pg_largeobject
+	var largeObjects int64
+	if err := conn.QueryRow(ctx, "SELECT count(*) FROM pg_catalog.pg_largeobject_metadata").Scan(&largeObjects); err != nil {
+		metrics.skip("large_objects", err.Error())
+	} else {
+		metrics.LargeObjects = &largeObjects
+	}
+
+	if extensions, err := listExtensions(ctx, conn); err != nil {
+		metrics.skip("extensions", err.Error())
+	} else {
+		metrics.Extensions = extensions
+	}
+
+	// pg_database_size needs CONNECT on the database or pg_read_all_stats
+	// (PostgreSQL 10+); the statistics views can be revoked by providers
+	var canSize, canStats bool
+	err = conn.QueryRow(ctx, `
+		SELECT has_database_privilege(current_database(), 'CONNECT')
+		       OR EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'pg_read_all_stats' AND pg_has_role(oid, 'USAGE')),
+		       has_table_privilege('pg_catalog.pg_stat_user_tables', 'SELECT')`).Scan(&canSize, &canStats)
+	if err != nil {
+		metrics.skip("database_size", fmt.Sprintf("failed to check privileges: %v", err))
+		metrics.skip("table_row_counts", fmt.Sprintf("failed to check privileges: %v", err))
+		return metrics
+	}
+
+	// Get database size
+	var sizeBytes int64
+	if !canSize {
+		metrics.skip("database_size", "no CONNECT privilege on the database or pg_read_all_stats membership")
+	} else if err := conn.QueryRow(ctx, "SELECT pg_database_size(current_database())").Scan(&sizeBytes); err != nil {
+		metrics.skip("database_size", err.Error())
+	} else {
+		metrics.DatabaseSizeBytes = &sizeBytes
+	}
+
+	// Get per-table row counts
+	if !canStats {
+		metrics.skip("table_row_counts", "no SELECT privilege on pg_stat_user_tables")
+		return metrics
+	}
+	tables, unreadable, err := tableRowCounts(ctx, conn, exactRowCounts)
+	if err != nil {
+		metrics.skip("table_row_counts", err.Error())
+		return metrics
+	}
+	metrics.Tables = tables
+	metrics.RowCountMethod = "estimate"
+	if exactRowCounts {
+		metrics.RowCountMethod = "exact"
+	}
+	if len(unreadable) > 0 {
+		listed := unreadable
+		if len(listed) > maxListedObjects {
+			listed = listed[:maxListedObjects]
+		}
+		reason := fmt.Sprintf("no SELECT privilege on %d tables, estimates recorded instead: %s", len(unreadable), strings.Join(listed, ", "))
+		if len(unreadable) > len(listed) {
+			reason += ", ..."
+		}
+		metrics.skip("exact_row_counts", reason)
+	}
+	return metrics
+}
+
+// tableRowCounts lists user tables with their live row estimate, or with an
+// exact count(*) per table when exact is set. Exact counts scan every table
+// and can take a long time on large databases. Tables the user can't read
+// keep their estimate, are marked as such and returned as unreadable.
+func tableRowCounts(ctx context.Context, conn *pgx.Conn, exact bool) (tables []TableRowCount, unreadable []string, err error) {
+	rows, err := conn.Query(ctx, `
+		SELECT schemaname, relname, n_live_tup,
+		       has_schema_privilege(schemaname, 'USAGE') AND has_table_privilege(relid, 'SELECT')
+		FROM pg_stat_user_tables ORDER BY schemaname, relname`)
+	if err != nil {
+		return nil, nil, err
+	}
+	var readable []bool
+	tables, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (TableRowCount, error) {
+		var t TableRowCount
+		var canRead bool
+		err := row.Scan(&t.Schema, &t.Name, &t.Rows, &canRead)
+		readable = append(readable, canRead)
+		return t, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if exact {
+		for i := range tables {
+			if !readable[i] {
+				tables[i].Estimate = true
+				unreadable = append(unreadable, tables[i].Schema+"."+tables[i].Name)
+				continue
+			}
+			query := "SELECT count(*) FROM " + pgx.Identifier{tables[i].Schema, tables[i].Name}.Sanitize()
+			if err := conn.QueryRow(ctx, query).Scan(&tables[i].Rows); err != nil {
+				return nil, nil, fmt.Errorf("failed to count rows of %s.%s: %w", tables[i].Schema, tables[i].Name, err)
+			}
+		}
+	}
+	return tables, unreadable, nil
+}
+
+func (br *BackupRunner) dumpRoles(ctx context.Context, connURL, outputFile string, image string, extraArgs []string, keep func(string) bool) error {
+	parsed, err := parseConnectionURL(connURL)
+	if err != nil {
+		return err
+	}
+
+	// Ensure output directory exists
+	outputDir := filepath.Dir(outputFile)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	host, port, hostConfig, err := containerEndpoint(ctx, parsed.host, parsed.port)
+	if err != nil {
+		return err
+	}
+
+	// Run pg_dumpall and capture stdout (no file redirect, no bind mount needed)
+	cmd := append([]string{"pg_dumpall", "--roles-only"}, extraArgs...)
+	env := []string{
+		fmt.Sprintf("PGHOST=%s", host),
+		fmt.Sprintf("PGPORT=%d", port),
+		fmt.Sprintf("PGUSER=%s", parsed.user),
+		fmt.Sprintf("PGPASSWORD=%s", parsed.password),
+	}
+	env = append(env, dumpEnv(ctx)...)
+
+	cfg := container.Config{
+		Image: image,
+		Env:   env,
+		Cmd:   cmd,
+	}
+
+	stdout := docker.NewContainerOutput()
+	stderr := docker.NewContainerOutput()
+
+	if err = docker.RunOnceWithConfig(ctx, cfg, hostConfig, stdout, stderr); err != nil {
+		stderrStr := stderr.String()
+		if stderrStr != "" {
+			br.logger.Error("Docker command stderr", zap.String("output", stderrStr))
+		}
+		return err
+	}
+
+	// Write captured stdout to file
+	stdoutData := stdout.Bytes()
+	if keep != nil {
+		stdoutData = filterRoles(stdoutData, keep)
+	}
+	if err := os.WriteFile(outputFile, stdoutData, 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	return nil
+}
+
+func (br *BackupRunner) dumpSchema(ctx context.Context, connURL, outputFile string, image string, extraOptions []string, progress ProgressFunc) error {
+	options := []string{
+		"--schema-only",
+		"--no-owner",
+		"--no-acl",
+		"--no-privileges",
+	}
+	return br.runPgDump(ctx, connURL, outputFile, image, append(options, extraOptions...), PhaseSchema, progress)
+}
+
+func (br *BackupRunner) dumpData(ctx context.Context, connURL, outputFile string, image string, styleOptions []string, progress ProgressFunc) error {
+	options := []string{
+		"--data-only",
+		"--use-set-session-authorization",
+		"--no-owner",
+		"--no-acl",
+	}
+	return br.runPgDump(ctx, connURL, outputFile, image, append(options, styleOptions...), PhaseData, progress)
+}
+
+// dataDumpOptions maps a DATA_DUMP_STYLE to pg_dump flags. COPY is the fastest
+// and most compact; INSERT styles trade speed for cross-version portability.
+func dataDumpOptions(style string) ([]string, error) {
+	switch style {
+	case "copy":
+		return nil, nil
+	case "inserts":
+		return []string{"--inserts"}, nil
+	case "column-inserts":
+		return []string{"--column-inserts"}, nil
+	default:
+		return nil, fmt.Errorf("invalid data dump style %q (expected copy, inserts or column-inserts)", style)
+	}
+}
+
+// runPgDump streams pg_dump's output into outputFile while it runs, reporting
+// the bytes written under phase.
+func (br *BackupRunner) runPgDump(ctx context.Context, connURL, outputFile string, image string, options []string, phase string, progress ProgressFunc) error {
+	// Ensure output directory exists
+	outputDir := filepath.Dir(outputFile)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	if err := br.streamPgDump(ctx, connURL, newProgressWriter(throttled(ctx, file), phase, progress), image, options); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
+
+// streamPgDump runs pg_dump with options against connURL in a container of
+// image and streams its output to w.
+func (br *BackupRunner) streamPgDump(ctx context.Context, connURL string, w io.Writer, image string, options []string) error {
+	parsed, err := parseConnectionURL(connURL)
+	if err != nil {
+		return err
+	}
+
+	host, port, hostConfig, err := containerEndpoint(ctx, parsed.host, parsed.port)
+	if err != nil {
+		return err
+	}
+
+	pgDumpArgs := []string{"pg_dump",
+		fmt.Sprintf("--host=%s", host),
+		fmt.Sprintf("--port=%d", port),
+		fmt.Sprintf("--username=%s", parsed.user),
+		fmt.Sprintf("--dbname=%s", parsed.database),
+		"--no-password",
+	}
+	pgDumpArgs = append(pgDumpArgs, options...)
+
+	// Run pg_dump and stream stdout to w (no file redirect, no bind mount needed)
+	cmd := pgDumpArgs
+	env := []string{
+		fmt.Sprintf("PGPASSWORD=%s", parsed.password),
+	}
+	env = append(env, dumpEnv(ctx)...)
+
+	cfg := container.Config{
+		Image: image,
+		Env:   env,
+		Cmd:   cmd,
+	}
+
+	stderr := docker.NewContainerOutput()
+	if err := docker.RunStreaming(ctx, cfg, hostConfig, w, stderr); err != nil {
+		if stderrStr := stderr.String(); stderrStr != "" {
+			br.logger.Error("Docker command stderr", zap.String("output", stderrStr))
+		}
+		return err
+	}
+	return nil
+}
+
+// ContainerConn returns libpq environment variables (PGHOST, PGPORT, PGUSER,
+// PGPASSWORD, PGDATABASE) for reaching connURL from a helper container, and
+// the host config the container must run with.
+func ContainerConn(ctx context.Context, connURL string) ([]string, container.HostConfig, error) {
+	parsed, err := parseConnectionURL(connURL)
+	if err != nil {
+		return nil, container.HostConfig{}, err
+	}
+
+	host, port, hostConfig, err := containerEndpoint(ctx, parsed.host, parsed.port)
+	if err != nil {
+		return nil, container.HostConfig{}, err
+	}
+
+	return []string{
+		fmt.Sprintf("PGHOST=%s", host),
+		fmt.Sprintf("PGPORT=%d", port),
+		fmt.Sprintf("PGUSER=%s", parsed.user),
+		fmt.Sprintf("PGPASSWORD=%s", parsed.password),
+		fmt.Sprintf("PGDATABASE=%s", parsed.database),
+	}, hostConfig, nil
+}
+
+type connParams struct {
+	host     string
+	port     int
+	user     string
+	password string
+	database string
+}
+
+// parseConnectionURL extracts the connection parameters passed to helper
+// containers from a connection URL, key/value DSN or service reference (see
+// database.ParseConnString).
+func parseConnectionURL(connURL string) (*connParams, error) {
+	config, err := database.ParseConnString(connURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dbName := config.Database
+	if dbName == "" {
+		dbName = "postgres"
+	}
+
+	return &connParams{
+		host:     config.Host,
+		port:     int(config.Port),
+		user:     config.User,
+		password: config.Password,
+		database: dbName,
+	}, nil
+}
+
+// createArchive writes files into a tar.gz at archivePath, compressed with
+// gzip level, and returns the archive's hex-encoded SHA-256.
+func (br *BackupRunner) createArchive(files []string, archivePath, baseDir string, level int, progress ProgressFunc) (string, error) {
+	// Create tar.gz archive
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	gzw, err := gzip.NewWriterLevel(newProgressWriter(io.MultiWriter(file, hash), PhaseArchive, progress), level)
+	if err != nil {
+		return "", fmt.Errorf("invalid compression level: %w", err)
+	}
+	defer gzw.Close()
+
+	tw := tar.NewWriter(gzw)
+	defer tw.Close()
+
+	for _, filePath := range files {
+		relPath, err := filepath.Rel(baseDir, filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to get relative path: %w", err)
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to stat file %s: %w", filePath, err)
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to create tar header: %w", err)
+		}
+		// Tar entries always use forward slashes, also on Windows
+		header.Name = filepath.ToSlash(relPath)
+
+		if err := tw.WriteHeader(header); err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if _, err := io.Copy(tw, f); err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to write file to archive: %w", err)
+		}
+
+		f.Close()
+	}
+
+	// Flush the tar and gzip trailers before taking the hash
+	if err := tw.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := durable.SyncFile(file); err != nil {
+		return "", fmt.Errorf("failed to sync archive: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyArchive reads a new archive back in full, walking the tar and
+// checking the gzip checksum and the embedded manifest's file checksums, so a
+// truncated or partially flushed archive fails the backup. With
+// ARCHIVE_VERIFY=false it is skipped.
+func (br *BackupRunner) verifyArchive(archivePath string) (*Verification, error) {
+	if !br.config.ArchiveVerify {
+		return &Verification{Status: "skipped"}, nil
+	}
+	started := br.now()
+	_, err := VerifyArchive(archivePath)
+	verification := &Verification{Status: "passed", DurationMs: br.now().Sub(started).Milliseconds()}
+	if err != nil {
+		verification.Status = "failed"
+		verification.Error = err.Error()
+	}
+	return verification, err
+}
+
+// signManifest signs manifest, chaining it to the project's last successful
+// backup. A missing or unreadable predecessor starts a new chain.
+func (br *BackupRunner) signManifest(manifest *BackupManifest) {
+	var previousRunID string
+	var previous *Signature
+	last, err := catalog.LastSuccessful(br.config.LocalBackupDir, manifest.DatabaseID)
+	if err == nil && last != nil {
+		previousRunID = last.RunID
+		previous, err = readSignature(last.ManifestPath)
+	}
+	if err != nil {
+		br.logger.Warn("Failed to read previous manifest, starting a new signature chain", zap.String("database", manifest.DatabaseID), zap.Error(err))
+		manifest.Warnings = append(manifest.Warnings, redact.String(fmt.Sprintf("signature chain restarted: %v", err)))
+		previous = nil
+	}
+
+	if err := SignManifest(manifest, br.signingKey, previousRunID, previous); err != nil {
+		br.logger.Warn("Failed to sign manifest", zap.String("database", manifest.DatabaseID), zap.Error(err))
+		manifest.Warnings = append(manifest.Warnings, redact.String(fmt.Sprintf("manifest not signed: %v", err)))
+		manifest.Signature = nil
+	}
+}
+
+// readSignature returns the signature of a manifest file, or nil if unsigned.
+func readSignature(path string) (*Signature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Signature *Signature `json:"signature"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return manifest.Signature, nil
+}
+
+func (br *BackupRunner) saveManifest(path string, manifest *BackupManifest) error {
+	return SaveManifest(path, manifest)
+}
+
+// SaveManifest writes a manifest as indented JSON, e.g. after storage results
+// have been added to it. The file is replaced atomically (durable.WriteFile).
+func SaveManifest(path string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+
+	if err := durable.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// createFailedManifest describes a backup that failed in phase, classifying
+// err (see ClassifyFailure).
+func (br *BackupRunner) createFailedManifest(runID, dbID string, startedAt time.Time, phase string, err error) (*BackupManifest, error) {
+	finishedAt := br.now()
+	return &BackupManifest{
+		RunID:       runID,
+		DatabaseID:  dbID,
+		StartedAt:   startedAt.Format(time.RFC3339),
+		FinishedAt:  finishedAt.Format(time.RFC3339),
+		DurationMs:  finishedAt.Sub(startedAt).Milliseconds(),
+		Status:      "failed",
+		Error:       redact.String(err.Error()),
+		Failure:     ClassifyFailure(err),
+		FailedPhase: phase,
+		Environment: hostEnvironment(),
+		Instance:    br.config.InstanceName,
+	}, nil
+}
+
+func (br *BackupRunner) now() time.Time {
+	return time.Now()
+}
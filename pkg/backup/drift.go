@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// SchemaDrift summarizes how the schema of a backup differs from the one of
+// the backup before it. Tables are "schema.table", columns
+// "schema.table.column" and indexes "schema.index"; columns are only listed
+// for tables in both backups.
+type SchemaDrift struct {
+	// BaseRunID is the backup the schema was compared with
+	BaseRunID      string   `json:"base_run_id"`
+	AddedTables    []string `json:"added_tables,omitempty"`
+	RemovedTables  []string `json:"removed_tables,omitempty"`
+	AddedColumns   []string `json:"added_columns,omitempty"`
+	RemovedColumns []string `json:"removed_columns,omitempty"`
+	// ChangedColumns changed type, default or constraints
+	ChangedColumns []string `json:"changed_columns,omitempty"`
+	AddedIndexes   []string `json:"added_indexes,omitempty"`
+	RemovedIndexes []string `json:"removed_indexes,omitempty"`
+}
+
+// Changed reports whether the schema changed.
+func (d *SchemaDrift) Changed() bool {
+	return len(d.AddedTables)+len(d.RemovedTables)+len(d.AddedColumns)+len(d.RemovedColumns)+
+		len(d.ChangedColumns)+len(d.AddedIndexes)+len(d.RemovedIndexes) > 0
+}
+
+// schemaTOCHeader matches the TOC comment pg_dump puts before every object
+// of a plain-format dump: "-- Name: orders; Type: TABLE; Schema: public; ..."
+var schemaTOCHeader = regexp.MustCompile(`^-- Name: (.+?); Type: (.+?); Schema: (.+?);`)
+
+// schemaObjects are the tables, columns and indexes of a schema.sql.
+type schemaObjects struct {
+	tables  map[string]bool
+	columns map[string]string // "schema.table.column" -> definition
+	indexes map[string]bool
+}
+
+// readSchemaObjects collects the tables with their columns and the indexes
+// of a plain-format schema dump.
+func readSchemaObjects(r io.Reader) (*schemaObjects, error) {
+	objects := &schemaObjects{tables: map[string]bool{}, columns: map[string]string{}, indexes: map[string]bool{}}
+	var table string // the table whose CREATE TABLE is being read
+	inColumns := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := schemaTOCHeader.FindStringSubmatch(line); m != nil {
+			table, inColumns = "", false
+			switch m[2] {
+			case "TABLE":
+				table = m[3] + "." + m[1]
+				objects.tables[table] = true
+			case "INDEX":
+				objects.indexes[m[3]+"."+m[1]] = true
+			}
+			continue
+		}
+		switch {
+		case table == "":
+		case strings.HasPrefix(line, "CREATE ") && strings.HasSuffix(line, "("):
+			inColumns = true
+		case inColumns && strings.HasPrefix(line, ")"):
+			table, inColumns = "", false
+		case inColumns && strings.HasPrefix(line, "    "):
+			name, definition := splitColumn(strings.TrimSpace(line))
+			if name != "" && name != "CONSTRAINT" {
+				objects.columns[table+"."+name] = definition
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// splitColumn splits a column line of CREATE TABLE into the column name,
+// unquoted, and its definition without the trailing comma.
+func splitColumn(line string) (name, definition string) {
+	line = strings.TrimSuffix(line, ",")
+	if strings.HasPrefix(line, `"`) {
+		// Quoted names may contain spaces and doubled quotes
+		for i := 1; i < len(line); i++ {
+			if line[i] != '"' {
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '"' {
+				i++
+				continue
+			}
+			return strings.ReplaceAll(line[1:i], `""`, `"`), strings.TrimSpace(line[i+1:])
+		}
+		return "", ""
+	}
+	name, definition, _ = strings.Cut(line, " ")
+	return name, definition
+}
+
+// diffSchemas compares the schema objects of two backups.
+func diffSchemas(baseRunID string, previous, current *schemaObjects) *SchemaDrift {
+	drift := &SchemaDrift{BaseRunID: baseRunID}
+	drift.AddedTables, drift.RemovedTables = diffKeys(previous.tables, current.tables)
+	drift.AddedIndexes, drift.RemovedIndexes = diffKeys(previous.indexes, current.indexes)
+	for column, definition := range current.columns {
+		table := column[:strings.LastIndex(column, ".")]
+		if !previous.tables[table] {
+			continue
+		}
+		if before, ok := previous.columns[column]; !ok {
+			drift.AddedColumns = append(drift.AddedColumns, column)
+		} else if before != definition {
+			drift.ChangedColumns = append(drift.ChangedColumns, column)
+		}
+	}
+	for column := range previous.columns {
+		table := column[:strings.LastIndex(column, ".")]
+		if _, ok := current.columns[column]; !ok && current.tables[table] {
+			drift.RemovedColumns = append(drift.RemovedColumns, column)
+		}
+	}
+	sort.Strings(drift.AddedColumns)
+	sort.Strings(drift.RemovedColumns)
+	sort.Strings(drift.ChangedColumns)
+	return drift
+}
+
+// diffKeys returns the sorted keys only in current (added) and only in
+// previous (removed).
+func diffKeys(previous, current map[string]bool) (added, removed []string) {
+	for key := range current {
+		if !previous[key] {
+			added = append(added, key)
+		}
+	}
+	for key := range previous {
+		if !current[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// schemaDrift compares a new backup's schema.sql with the one of the
+// project's last successful backup. It returns nil when there is nothing to
+// compare with; failures are logged and never fail the backup.
+func (br *BackupRunner) schemaDrift(project, schemaFile string) *SchemaDrift {
+	last, err := catalog.LastSuccessful(br.config.LocalBackupDir, project)
+	if err != nil || last == nil || last.ArchivePath == "" {
+		return nil
+	}
+
+	previous, err := readArchiveSchema(last.ArchivePath)
+	if err != nil {
+		br.logger.Warn("Failed to read the previous schema, skipping drift detection", zap.String("database", project), zap.String("base_run_id", last.RunID), zap.Error(err))
+		return nil
+	}
+	file, err := os.Open(schemaFile)
+	if err != nil {
+		br.logger.Warn("Failed to read the schema, skipping drift detection", zap.String("database", project), zap.Error(err))
+		return nil
+	}
+	defer file.Close()
+	current, err := readSchemaObjects(file)
+	if err != nil {
+		br.logger.Warn("Failed to read the schema, skipping drift detection", zap.String("database", project), zap.Error(err))
+		return nil
+	}
+
+	drift := diffSchemas(last.RunID, previous, current)
+	if drift.Changed() {
+		br.logger.Info("Schema changed since the last backup",
+			zap.String("database", project),
+			zap.String("base_run_id", last.RunID),
+			zap.Int("added_tables", len(drift.AddedTables)),
+			zap.Int("removed_tables", len(drift.RemovedTables)),
+			zap.Int("added_columns", len(drift.AddedColumns)),
+			zap.Int("removed_columns", len(drift.RemovedColumns)),
+			zap.Int("changed_columns", len(drift.ChangedColumns)),
+			zap.Int("added_indexes", len(drift.AddedIndexes)),
+			zap.Int("removed_indexes", len(drift.RemovedIndexes)))
+	}
+	return drift
+}
+
+// readArchiveSchema reads the schema objects of a backup archive's
+// schema.sql, which comes before the data, so little is decompressed.
+func readArchiveSchema(archivePath string) (*schemaObjects, error) {
+	file, err := OpenArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("schema.sql not found in archive")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Name == "schema.sql" {
+			return readSchemaObjects(tr)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"go.uber.org/zap"
+)
+
+// Dump streams a plain SQL dump of db to w, schema and data in one script
+// without ownership or privileges, ready to pipe into psql. It isn't a
+// backup: no roles, snapshot, archive or manifest. The dump image, direct
+// URL, DUMP_ENV, DUMP_ARGS, DATA_DUMP_STYLE and LARGE_OBJECTS apply as they
+// do to backups.
+func (br *BackupRunner) Dump(ctx context.Context, db *database.Database, w io.Writer) error {
+	ctx = docker.WithLabels(ctx, map[string]string{
+		docker.LabelTask:    "dump",
+		docker.LabelProject: db.Identifier,
+	})
+
+	connURL, err := br.backupURL(db)
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+
+	direct := *db
+	direct.ConnectionURL = connURL
+	pgVersion, err := br.serverVersion(ctx, &direct)
+	if err != nil {
+		return err
+	}
+	image, err := br.dumpImage(pgVersion)
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+
+	dataStyle := strings.ToLower(br.config.ProjectOption(db.Identifier, "DATA_DUMP_STYLE", br.config.DataDumpStyle))
+	if dataStyle == "" {
+		dataStyle = "copy"
+	}
+	dataOptions, err := dataDumpOptions(dataStyle)
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+	extraEnv, err := ParseDumpEnv(br.config.ProjectOption(db.Identifier, "DUMP_ENV", br.config.DumpEnv))
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+	extraArgs, err := ParseDumpArgs(br.config.ProjectOption(db.Identifier, "DUMP_ARGS", br.config.DumpArgs))
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+	ctx = withDumpEnv(ctx, extraEnv)
+	largeObjects := strings.ToLower(br.config.ProjectOption(db.Identifier, "LARGE_OBJECTS", br.config.LargeObjects))
+	if largeObjects == "" {
+		largeObjects = LargeObjectsAuto
+	}
+	largeObjectFlags, err := largeObjectOptions(largeObjects, extraArgs)
+	if err != nil {
+		return withFailure(FailureConfig, err)
+	}
+
+	options := append([]string{"--no-owner", "--no-acl"}, dataOptions...)
+	options = append(options, largeObjectFlags...)
+	options = append(options, extraArgs...)
+	br.logger.Info("Streaming dump", zap.String("database", db.Identifier), zap.String("image", image))
+	return br.streamPgDump(ctx, connURL, w, image, options)
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/buildinfo"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"go.uber.org/zap"
+)
+
+// Environment records the tools and hosts that produced a backup, so that a
+// restore failing years later can be traced to the exact pg_dump build.
+// Facts that couldn't be read are left out.
+type Environment struct {
+	SchedulerVersion  string `json:"scheduler_version"`
+	SchedulerRevision string `json:"scheduler_revision,omitempty"`
+	GoVersion         string `json:"go_version"`
+	// Hostname, OS and Arch describe the host the scheduler runs on
+	Hostname string `json:"hostname,omitempty"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	// DumpImage is the image reference the dumps ran with; DumpImageID and
+	// DumpImageDigest (repo@sha256:..., unset for images built locally)
+	// identify the image content behind it
+	DumpImage       string `json:"dump_image,omitempty"`
+	DumpImageID     string `json:"dump_image_id,omitempty"`
+	DumpImageDigest string `json:"dump_image_digest,omitempty"`
+	// PgDumpVersion is the output of `pg_dump --version` in the dump image
+	PgDumpVersion string `json:"pg_dump_version,omitempty"`
+	// Docker describes the daemon that ran the dump containers
+	Docker *DockerEnvironment `json:"docker,omitempty"`
+}
+
+// DockerEnvironment is the version and platform of a Docker daemon.
+type DockerEnvironment struct {
+	Version       string `json:"version"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	KernelVersion string `json:"kernel_version,omitempty"`
+}
+
+// hostEnvironment describes the scheduler build and its host.
+func hostEnvironment() *Environment {
+	hostname, _ := os.Hostname()
+	return &Environment{
+		SchedulerVersion:  buildinfo.Version(),
+		SchedulerRevision: buildinfo.Revision(),
+		GoVersion:         runtime.Version(),
+		Hostname:          hostname,
+		OS:                runtime.GOOS,
+		Arch:              runtime.GOARCH,
+	}
+}
+
+// environment describes the scheduler, its host, the Docker daemon and the
+// dump image. It never fails a backup: what can't be read is logged and
+// left out.
+func (br *BackupRunner) environment(ctx context.Context, image string) *Environment {
+	env := hostEnvironment()
+	env.DumpImage = image
+
+	if server, err := docker.Server(ctx); err != nil {
+		br.logger.Debug("Failed to read Docker version for the manifest", zap.Error(err))
+	} else {
+		env.Docker = &DockerEnvironment{Version: server.Version, OS: server.OS, Arch: server.Arch, KernelVersion: server.KernelVersion}
+	}
+
+	id, digest, err := docker.ImageIdentity(ctx, image)
+	if err != nil {
+		br.logger.Debug("Failed to inspect dump image for the manifest", zap.String("image", image), zap.Error(err))
+		return env
+	}
+	env.DumpImageID, env.DumpImageDigest = id, digest
+	if env.PgDumpVersion, err = br.pgDumpVersion(ctx, image, id); err != nil {
+		br.logger.Debug("Failed to read pg_dump version for the manifest", zap.String("image", image), zap.Error(err))
+	}
+	return env
+}
+
+// pgDumpVersion runs `pg_dump --version` in image. Results are cached by
+// image ID, so it runs once per image rather than once per backup.
+func (br *BackupRunner) pgDumpVersion(ctx context.Context, image, imageID string) (string, error) {
+	if version, ok := br.pgDumpVersions.Load(imageID); ok {
+		return version.(string), nil
+	}
+	cfg := container.Config{
+		Image: image,
+		Cmd:   []string{"pg_dump", "--version"},
+	}
+	stdout, stderr := docker.NewContainerOutput(), docker.NewContainerOutput()
+	if err := docker.RunOnceWithConfig(ctx, cfg, container.HostConfig{NetworkMode: "none"}, stdout, stderr); err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return "", fmt.Errorf("%w: %s", err, out)
+		}
+		return "", err
+	}
+	version := strings.TrimSpace(stdout.String())
+	br.pgDumpVersions.Store(imageID, version)
+	return version, nil
+}
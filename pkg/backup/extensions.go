@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Extension is an extension installed in a backed up database.
+type Extension struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Schema  string `json:"schema"`
+}
+
+// listExtensions lists the installed extensions in creation order, which
+// puts the extensions others require before them. pg_extension is readable
+// by everyone.
+func listExtensions(ctx context.Context, conn *pgx.Conn) ([]Extension, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT e.extname, e.extversion, n.nspname
+		FROM pg_catalog.pg_extension e
+		JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+		ORDER BY e.oid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var extensions []Extension
+	for rows.Next() {
+		var ext Extension
+		if err := rows.Scan(&ext.Name, &ext.Version, &ext.Schema); err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions, rows.Err()
+}
+
+// HasExtension reports whether extensions includes name.
+func HasExtension(extensions []Extension, name string) bool {
+	for _, ext := range extensions {
+		if ext.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+)
+
+// Failure causes recorded in manifests and run results, so alerts can be
+// routed by what went wrong rather than by parsing error messages.
+const (
+	FailureConnection = "connection_failed"
+	FailureAuth       = "auth_failed"
+	FailureDump       = "dump_error"
+	FailureDiskFull   = "disk_full"
+	FailureDocker     = "docker_error"
+	FailureUpload     = "upload_failed"
+	FailureTimeout    = "timeout"
+	// FailureConfig is an invalid setting only found at backup time
+	FailureConfig = "config_error"
+	// FailureQuota is a backup that didn't fit its project's or namespace's
+	// quota
+	FailureQuota = "quota_exceeded"
+	// FailureLockHeld is a backup that gave up waiting for its
+	// ADVISORY_LOCK because another session held it
+	FailureLockHeld = "lock_held"
+)
+
+// PhaseSetup is the failed phase of backups that failed before dumping:
+// settings, provider detection, waiting for the load to drop, the snapshot.
+const PhaseSetup = "setup"
+
+// Messages of libpq (pg_dump, pg_dumpall) and the OS that identify a failure
+// cause when all that's left of it is a container's stderr.
+var (
+	diskFullMessages   = []string{"no space left on device", "disk full"}
+	authMessages       = []string{"password authentication failed", "no pg_hba.conf entry", "no password supplied"}
+	connectionMessages = []string{
+		"could not connect to server",
+		"connection refused",
+		"could not translate host name",
+		"no route to host",
+		"network is unreachable",
+		"timeout expired",
+		"server closed the connection unexpectedly",
+		"connection to server at",
+		"connection to server on socket",
+	}
+)
+
+// failureError forces the failure cause of an error.
+type failureError struct {
+	failure string
+	err     error
+}
+
+func (e *failureError) Error() string { return e.err.Error() }
+
+func (e *failureError) Unwrap() error { return e.err }
+
+// withFailure marks err as failure, overriding ClassifyFailure.
+func withFailure(failure string, err error) error {
+	return &failureError{failure: failure, err: err}
+}
+
+// ClassifyFailure returns the failure cause of a backup error: one of the
+// Failure constants. Errors nothing specific is known about are dump errors.
+func ClassifyFailure(err error) string {
+	var forced *failureError
+	if errors.As(err, &forced) {
+		return forced.failure
+	}
+	if errors.Is(err, syscall.ENOSPC) || containsAny(err.Error(), diskFullMessages) {
+		return FailureDiskFull
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "28") {
+		return FailureAuth
+	}
+	var exitErr *docker.ExitError
+	if errors.As(err, &exitErr) {
+		// pg_dump's stderr; check authentication first, libpq prefixes those
+		// with "connection to server at ... failed"
+		switch {
+		case containsAny(exitErr.Output, authMessages):
+			return FailureAuth
+		case containsAny(exitErr.Output, connectionMessages):
+			return FailureConnection
+		}
+		return FailureDump
+	}
+
+	// Before timeouts: a connect timeout is a connection failure
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return FailureConnection
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+	var daemonErr *docker.DaemonError
+	if errors.As(err, &daemonErr) {
+		return FailureDocker
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return FailureConnection
+	}
+	return FailureDump
+}
+
+// containsAny reports whether s contains one of substrs, ignoring case.
+func containsAny(s string, substrs []string) bool {
+	s = strings.ToLower(s)
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
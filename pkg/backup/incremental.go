@@ -0,0 +1,359 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// Backup modes (BACKUP_MODE). Backups in incremental mode are either "full"
+// or "incremental", recorded in the manifest's incremental section.
+const (
+	ModeFull        = "full"
+	ModeIncremental = "incremental"
+)
+
+// IncrementFile holds the rows added to incremental tables since the parent
+// backup, in the format of data.sql.
+const IncrementFile = "increment.sql"
+
+// IncrementalTable is a table backed up incrementally by a column whose values
+// only grow, such as a serial ID or an insert timestamp.
+type IncrementalTable struct {
+	Schema string
+	Name   string
+	Column string
+}
+
+// String returns the table as "schema.table".
+func (t IncrementalTable) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// Incremental describes a backup taken in incremental mode. A full backup
+// records the watermarks its increments start from; an incremental backup
+// holds the rows between its parent's watermarks and its own. BaseRunID is the
+// full backup the chain starts with.
+type Incremental struct {
+	Type        string      `json:"type"`
+	BaseRunID   string      `json:"base_run_id,omitempty"`
+	ParentRunID string      `json:"parent_run_id,omitempty"`
+	Tables      []Watermark `json:"tables"`
+}
+
+// Watermark is the range of an incremental table's column covered by a
+// backup: From (exclusive, unset for full backups) to To (inclusive, unset
+// while the table is empty). Values are in the column's text form. Rows is
+// the number of rows in an increment.
+type Watermark struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Rows   int64  `json:"rows,omitempty"`
+}
+
+// ParseIncrementalTables parses INCREMENTAL_TABLES: comma-separated
+// "schema.table:column" entries, the schema defaulting to public.
+func ParseIncrementalTables(spec string) ([]IncrementalTable, error) {
+	var tables []IncrementalTable
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		table, column, ok := strings.Cut(entry, ":")
+		if !ok || strings.TrimSpace(column) == "" {
+			return nil, fmt.Errorf("invalid incremental table %q (expected schema.table:column)", entry)
+		}
+		schema, name, ok := strings.Cut(strings.TrimSpace(table), ".")
+		if !ok {
+			schema, name = "public", schema
+		}
+		if schema == "" || name == "" || strings.Contains(name, ".") {
+			return nil, fmt.Errorf("invalid incremental table %q (expected schema.table:column)", entry)
+		}
+		tables = append(tables, IncrementalTable{Schema: schema, Name: name, Column: strings.TrimSpace(column)})
+	}
+	return tables, nil
+}
+
+// incrementalParent is the backup an incremental backup continues from.
+type incrementalParent struct {
+	runID       string
+	incremental *Incremental
+}
+
+// incrementalTables returns the project's backup mode and, in incremental
+// mode, its incremental tables.
+func (br *BackupRunner) incrementalTables(project string) (string, []IncrementalTable, error) {
+	mode := strings.ToLower(br.config.ProjectOption(project, "BACKUP_MODE", br.config.BackupMode))
+	switch mode {
+	case "", ModeFull:
+		return ModeFull, nil, nil
+	case ModeIncremental:
+	default:
+		return "", nil, fmt.Errorf("invalid backup mode %q (expected full or incremental)", mode)
+	}
+	tables, err := ParseIncrementalTables(br.config.ProjectOption(project, "INCREMENTAL_TABLES", br.config.IncrementalTables))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(tables) == 0 {
+		return "", nil, fmt.Errorf("incremental mode needs INCREMENTAL_TABLES (schema.table:column)")
+	}
+	return ModeIncremental, tables, nil
+}
+
+// findIncrementalParent returns the project's newest successful backup if an
+// incremental backup can continue from it: it was taken in incremental mode
+// for the same tables and columns, its chain back to the full backup is
+// complete, and the full backup policy doesn't ask for a new full backup.
+// Otherwise the next backup has to be full.
+func (br *BackupRunner) findIncrementalParent(project string, tables []IncrementalTable) (*incrementalParent, string) {
+	entries, err := catalog.List(br.config.LocalBackupDir, project)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to find the last backup: %v", err)
+	}
+	var last *catalog.Entry
+	for i := len(entries) - 1; i >= 0 && last == nil; i-- {
+		if entries[i].Status == "success" {
+			last = entries[i]
+		}
+	}
+	if last == nil {
+		return nil, "no previous backup"
+	}
+	incremental, err := readIncremental(last.ManifestPath)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if incremental == nil {
+		return nil, fmt.Sprintf("last backup %s wasn't taken in incremental mode", last.RunID)
+	}
+	if len(incremental.Tables) != len(tables) {
+		return nil, "incremental tables changed"
+	}
+	for i, table := range tables {
+		if incremental.Tables[i].Table != table.String() || incremental.Tables[i].Column != table.Column {
+			return nil, "incremental tables changed"
+		}
+	}
+
+	ancestors, missing := catalog.Ancestors(entries, last)
+	if missing != "" {
+		return nil, fmt.Sprintf("backup %s of the incremental chain is missing", missing)
+	}
+	base := last
+	if len(ancestors) > 0 {
+		base = ancestors[len(ancestors)-1]
+	}
+	if after := br.config.ProjectOptionInt(project, "FULL_BACKUP_AFTER", br.config.FullBackupAfter); after > 0 && len(ancestors) >= after {
+		// The chain's incremental backups are last and every ancestor but the full one
+		return nil, fmt.Sprintf("%d incremental backups since the last full backup (FULL_BACKUP_AFTER)", after)
+	}
+	days, err := parseWeekdays(br.config.ProjectOption(project, "FULL_BACKUP_DAYS", br.config.FullBackupDays))
+	if err != nil {
+		br.logger.Warn("Ignoring FULL_BACKUP_DAYS", zap.String("database", project), zap.Error(err))
+	}
+	now := br.now()
+	if days[now.Weekday()] && base.Date != now.Format("2006-01-02") {
+		return nil, fmt.Sprintf("full backup day %s (FULL_BACKUP_DAYS)", now.Weekday())
+	}
+	return &incrementalParent{runID: last.RunID, incremental: incremental}, ""
+}
+
+// parseWeekdays parses a comma-separated list of day names ("Sun", "Sat,Sun")
+// into flags indexed by time.Weekday.
+func parseWeekdays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if name == strings.ToLower(d.String()[:3]) || name == strings.ToLower(d.String()) {
+				days[d], found = true, true
+			}
+		}
+		if !found {
+			return [7]bool{}, fmt.Errorf("unknown day %q", name)
+		}
+	}
+	return days, nil
+}
+
+// readIncremental returns the incremental section of a manifest file, or nil.
+func readIncremental(path string) (*Incremental, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Incremental *Incremental `json:"incremental"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return manifest.Incremental, nil
+}
+
+// ReadIncremental returns the incremental section of a catalog entry's
+// manifest, or nil for backups not taken in incremental mode.
+func ReadIncremental(entry *catalog.Entry) (*Incremental, error) {
+	return readIncremental(entry.ManifestPath)
+}
+
+// excludeTableDataOptions makes pg_dump leave out the data of the
+// incremental tables, which increment.sql carries instead.
+func excludeTableDataOptions(tables []IncrementalTable) []string {
+	options := make([]string, len(tables))
+	for i, table := range tables {
+		// Quoted pattern parts match the name literally
+		options[i] = fmt.Sprintf("--exclude-table-data=%s.%s", quotePattern(table.Schema), quotePattern(table.Name))
+	}
+	return options
+}
+
+func quotePattern(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// watermarks reads the current maximum of each incremental table's column
+// inside the snapshot, so they match what the dumps see exactly.
+func (s *exportedSnapshot) watermarks(ctx context.Context, tables []IncrementalTable) ([]Watermark, error) {
+	marks := make([]Watermark, len(tables))
+	for i, table := range tables {
+		var max *string
+		query := fmt.Sprintf("SELECT max(%s)::text FROM %s", pgx.Identifier{table.Column}.Sanitize(), pgx.Identifier{table.Schema, table.Name}.Sanitize())
+		if err := s.tx.QueryRow(ctx, query).Scan(&max); err != nil {
+			return nil, fmt.Errorf("failed to read watermark of %s.%s: %w", table, table.Column, err)
+		}
+		marks[i] = Watermark{Table: table.String(), Column: table.Column}
+		if max != nil {
+			marks[i].To = *max
+		}
+	}
+	return marks, nil
+}
+
+// writeIncrement writes the rows of each incremental table above the
+// parent's watermark to w, as COPY sections with pg_dump's TOC comments, so
+// increments are restored and filtered like data.sql. It returns the new
+// watermarks; a table without new rows keeps the parent's.
+func (s *exportedSnapshot) writeIncrement(ctx context.Context, w io.Writer, tables []IncrementalTable, parent *Incremental) ([]Watermark, error) {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--\n-- Incremental data\n--\n\nSET client_encoding = 'UTF8';\nSET standard_conforming_strings = on;\n\n")
+
+	marks := make([]Watermark, len(tables))
+	for i, table := range tables {
+		qualified := pgx.Identifier{table.Schema, table.Name}.Sanitize()
+		column := pgx.Identifier{table.Column}.Sanitize()
+		from := parent.Tables[i].To
+		marks[i] = Watermark{Table: table.String(), Column: table.Column, From: from, To: from}
+
+		var columnType string
+		err := s.tx.QueryRow(ctx, "SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attname = $2 AND NOT attisdropped",
+			qualified, table.Column).Scan(&columnType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up column %s of %s: %w", table.Column, table, err)
+		}
+
+		// Comparing in SQL keeps the column's ordering (numbers, timestamps)
+		where := "TRUE"
+		if from != "" {
+			where = fmt.Sprintf("%s > %s::%s", column, quoteLiteral(from), columnType)
+		}
+		var to *string
+		if err := s.tx.QueryRow(ctx, fmt.Sprintf("SELECT max(%s)::text FROM %s WHERE %s", column, qualified, where)).Scan(&to); err != nil {
+			return nil, fmt.Errorf("failed to read watermark of %s.%s: %w", table, table.Column, err)
+		}
+		if to == nil {
+			continue
+		}
+		marks[i].To = *to
+
+		columns, err := s.copyColumns(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		columnList := strings.Join(columns, ", ")
+		where += fmt.Sprintf(" AND %s <= %s::%s", column, quoteLiteral(*to), columnType)
+
+		fmt.Fprintf(bw, "--\n-- Data for Name: %s; Type: TABLE DATA; Schema: %s; Owner: -\n--\n\n", table.Name, table.Schema)
+		fmt.Fprintf(bw, "COPY %s (%s) FROM stdin;\n", qualified, columnList)
+		if err := bw.Flush(); err != nil {
+			return nil, err
+		}
+		tag, err := s.tx.Conn().PgConn().CopyTo(ctx, w,
+			fmt.Sprintf("COPY (SELECT %s FROM %s WHERE %s ORDER BY %s) TO STDOUT", columnList, qualified, where, column))
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy increment of %s: %w", table, err)
+		}
+		marks[i].Rows = tag.RowsAffected()
+		fmt.Fprintf(bw, "\\.\n\n")
+	}
+	return marks, bw.Flush()
+}
+
+// dumpIncrement writes increment.sql to outputFile and returns the new
+// watermarks.
+func (br *BackupRunner) dumpIncrement(ctx context.Context, snapshot *exportedSnapshot, outputFile string, tables []IncrementalTable, parent *Incremental, progress ProgressFunc) ([]Watermark, error) {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+
+	progress(PhaseIncrement, 0)
+	marks, err := snapshot.writeIncrement(ctx, newProgressWriter(throttled(ctx, file), PhaseIncrement, progress), tables, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", IncrementFile, err)
+	}
+	return marks, nil
+}
+
+// copyColumns lists the columns pg_dump would dump for a table: generated
+// columns (PostgreSQL 12+) are computed on restore instead.
+func (s *exportedSnapshot) copyColumns(ctx context.Context, table IncrementalTable) ([]string, error) {
+	var versionNum int
+	if err := s.tx.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return nil, fmt.Errorf("failed to read server version: %w", err)
+	}
+	query := "SELECT attname FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped"
+	if versionNum >= 120000 {
+		query += " AND attgenerated = ''"
+	}
+	rows, err := s.tx.Query(ctx, query+" ORDER BY attnum", pgx.Identifier{table.Schema, table.Name}.Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", table, err)
+	}
+	columns, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (string, error) {
+		var name string
+		err := row.Scan(&name)
+		return pgx.Identifier{name}.Sanitize(), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// quoteLiteral quotes a string as SQL literal (standard_conforming_strings on).
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
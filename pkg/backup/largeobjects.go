@@ -0,0 +1,54 @@
+package backup
+
+import "fmt"
+
+// Large object modes (LARGE_OBJECTS): whether the data dump includes large
+// objects (pg_largeobject, lo_import/lo_export).
+const (
+	// LargeObjectsAuto leaves it to pg_dump, which includes them unless
+	// DUMP_ARGS selects schemas or tables
+	LargeObjectsAuto    = "auto"
+	LargeObjectsInclude = "include"
+	LargeObjectsExclude = "exclude"
+)
+
+// pg_dump flags selecting large objects. 16 renamed --blobs/--no-blobs to
+// --large-objects/--no-large-objects but still accepts the old names, which
+// every supported pg_dump understands.
+var (
+	includeLargeObjectArgs = []string{"-b", "--blobs", "--large-objects"}
+	excludeLargeObjectArgs = []string{"-B", "--no-blobs", "--no-large-objects"}
+	selectObjectArgs       = []string{"-n", "--schema", "-t", "--table"}
+)
+
+// largeObjectOptions returns the data dump flags of a LARGE_OBJECTS mode.
+// An explicit mode conflicts with large object flags in DUMP_ARGS.
+func largeObjectOptions(mode string, extraArgs []string) ([]string, error) {
+	var options []string
+	switch mode {
+	case LargeObjectsAuto:
+		return nil, nil
+	case LargeObjectsInclude:
+		options = []string{"--blobs"}
+	case LargeObjectsExclude:
+		options = []string{"--no-blobs"}
+	default:
+		return nil, fmt.Errorf("invalid large objects mode %q (expected auto, include or exclude)", mode)
+	}
+	if arg := findFlag(extraArgs, append(append([]string{}, includeLargeObjectArgs...), excludeLargeObjectArgs...)...); arg != "" {
+		return nil, fmt.Errorf("DUMP_ARGS can't set %s together with LARGE_OBJECTS=%s", arg, mode)
+	}
+	return options, nil
+}
+
+// largeObjectsDumped reports whether a data dump run with args includes
+// large objects.
+func largeObjectsDumped(args []string) bool {
+	switch {
+	case findFlag(args, includeLargeObjectArgs...) != "":
+		return true
+	case findFlag(args, excludeLargeObjectArgs...) != "", findFlag(args, selectObjectArgs...) != "":
+		return false
+	}
+	return true
+}
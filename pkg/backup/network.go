@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+)
+
+// hostGateway is the name helper containers use for the machine running the
+// scheduler when they aren't on its network.
+const hostGateway = "host.docker.internal"
+
+// containerEndpoint returns the host and port a helper container connects to
+// for a database at host:port, and the host config that makes it reachable.
+//
+// A host starting with a slash is a Unix socket directory, as in libpq. It is
+// bind-mounted into the container at the same path and no network is needed.
+// The Docker daemon resolves the path on its host, so a scheduler running in a
+// container must see the socket directory at the same path as the host does.
+//
+// With host networking the container shares the host's network and only
+// loopback addresses on Docker Desktop need rewriting. With bridge networking
+// loopback addresses point at the container itself, so a database published
+// by another container is reached on that container's network, and anything
+// else on the host through host-gateway.
+func containerEndpoint(ctx context.Context, host string, port int) (string, int, container.HostConfig, error) {
+	if isUnixSocket(host) {
+		return host, port, container.HostConfig{
+			NetworkMode: container.NetworkMode("none"),
+			Binds:       []string{host + ":" + host},
+		}, nil
+	}
+	if docker.HostNetwork() {
+		return containerHost(host), port, container.HostConfig{NetworkMode: container.NetworkMode("host")}, nil
+	}
+
+	hostConfig := container.HostConfig{
+		ExtraHosts: []string{hostGateway + ":host-gateway"},
+	}
+	if !isLoopback(host) {
+		return host, port, hostConfig, nil
+	}
+
+	network, ip, containerPort, found, err := docker.PublishedPort(ctx, port)
+	if err != nil {
+		return "", 0, container.HostConfig{}, err
+	}
+	if found {
+		hostConfig.NetworkMode = container.NetworkMode(network)
+		return ip, containerPort, hostConfig, nil
+	}
+	return hostGateway, port, hostConfig, nil
+}
+
+// containerHost returns the address a helper container on the host network
+// uses to reach host. Docker Desktop (macOS and Windows) runs containers in a
+// VM, so loopback addresses there point at the VM rather than the machine
+// running the scheduler; host.docker.internal is Docker Desktop's name for
+// that machine.
+func containerHost(host string) string {
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		return host
+	}
+	if isLoopback(host) {
+		return hostGateway
+	}
+	return host
+}
+
+// isLoopback reports whether host is localhost or a loopback address
+// (127.0.0.0/8 or ::1, without brackets).
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isUnixSocket reports whether host names a Unix socket directory.
+func isUnixSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
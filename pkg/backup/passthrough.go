@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envName is a valid environment variable name.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnv are the libpq variables the dump containers get from the
+// connection URL; DUMP_ENV can't override them.
+var reservedEnv = map[string]bool{
+	"PGHOST":        true,
+	"PGHOSTADDR":    true,
+	"PGPORT":        true,
+	"PGUSER":        true,
+	"PGPASSWORD":    true,
+	"PGPASSFILE":    true,
+	"PGDATABASE":    true,
+	"PGSERVICE":     true,
+	"PGSERVICEFILE": true,
+}
+
+// reservedArgs are pg_dump flags the backup sets itself: where to connect,
+// what to dump and the output format the archive relies on. Long flags also
+// match in --flag=value form, short ones with an attached value (-Fc).
+var reservedArgs = []string{
+	"-h", "--host", "-p", "--port", "-U", "--username", "-d", "--dbname",
+	"-f", "--file", "-F", "--format", "-a", "--data-only", "-s", "--schema-only",
+	"--snapshot",
+}
+
+// ParseDumpEnv parses DUMP_ENV: semicolon-separated NAME=value pairs added
+// to the environment of every dump container, e.g.
+// "PGOPTIONS=-c statement_timeout=0;PGAPPNAME=backup".
+func ParseDumpEnv(value string) ([]string, error) {
+	var env []string
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, val, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !envName.MatchString(name) {
+			return nil, fmt.Errorf("invalid DUMP_ENV entry %q (expected NAME=value)", strings.TrimSpace(pair))
+		}
+		if reservedEnv[strings.ToUpper(name)] {
+			return nil, fmt.Errorf("DUMP_ENV can't set %s, it comes from the connection URL", name)
+		}
+		env = append(env, name+"="+val)
+	}
+	return env, nil
+}
+
+// ParseDumpArgs parses DUMP_ARGS: whitespace-separated flags appended to
+// both pg_dump runs, e.g. "--lock-wait-timeout=30s --no-comments". Values
+// must be attached (--flag=value), and flags the backup sets itself are
+// rejected.
+func ParseDumpArgs(value string) ([]string, error) {
+	args := strings.Fields(value)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("invalid DUMP_ARGS entry %q (expected flags, use --flag=value)", arg)
+		}
+		for _, flag := range reservedArgs {
+			if matchesFlag(arg, flag) {
+				return nil, fmt.Errorf("DUMP_ARGS can't set %s, the backup sets it itself", flag)
+			}
+		}
+	}
+	return args, nil
+}
+
+// matchesFlag reports whether arg is flag, with or without an attached value.
+func matchesFlag(arg, flag string) bool {
+	long := strings.HasPrefix(flag, "--")
+	return arg == flag || (long && strings.HasPrefix(arg, flag+"=")) || (!long && !strings.HasPrefix(arg, "--") && strings.HasPrefix(arg, flag))
+}
+
+// findFlag returns the first of args matching one of flags, or "".
+func findFlag(args []string, flags ...string) string {
+	for _, arg := range args {
+		for _, flag := range flags {
+			if matchesFlag(arg, flag) {
+				return arg
+			}
+		}
+	}
+	return ""
+}
+
+// envNames returns the sorted variable names of env, for the manifest (the
+// values may be secrets).
+func envNames(env []string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	names := make([]string, len(env))
+	for i, pair := range env {
+		names[i], _, _ = strings.Cut(pair, "=")
+	}
+	sort.Strings(names)
+	return names
+}
+
+type dumpEnvKey struct{}
+
+// withDumpEnv adds env to every dump container started under ctx.
+func withDumpEnv(ctx context.Context, env []string) context.Context {
+	if len(env) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, dumpEnvKey{}, env)
+}
+
+// dumpEnv returns the extra environment of dump containers from ctx.
+func dumpEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(dumpEnvKey{}).([]string)
+	return env
+}
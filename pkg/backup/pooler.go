@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+)
+
+// transactionPoolerPort is the port Supabase (Supavisor) and many PgBouncer
+// setups use for transaction pooling.
+const transactionPoolerPort = "6543"
+
+// transactionPoolerReason explains why connURL looks like it goes through a
+// connection pooler in transaction mode, or returns "" if it doesn't. pg_dump
+// needs one session for its whole run (snapshot, SET commands, server-side
+// state), which transaction pooling doesn't provide.
+func transactionPoolerReason(connURL string) string {
+	config, err := database.ParseConnString(connURL)
+	if err != nil {
+		return ""
+	}
+	// Parameters unknown to libpq end up as runtime parameters
+	if strings.EqualFold(config.RuntimeParams["pgbouncer"], "true") {
+		return "it has pgbouncer=true"
+	}
+	if strconv.Itoa(int(config.Port)) == transactionPoolerPort {
+		return fmt.Sprintf("it uses port %s, the usual transaction pooler port", transactionPoolerPort)
+	}
+	return ""
+}
+
+// backupURL returns the URL a backup of db connects with. A DIRECT_URL project
+// option bypasses the pooler; otherwise URLs that look like a transaction-mode
+// pooler are rejected up front instead of failing halfway through a dump.
+func (br *BackupRunner) backupURL(db *database.Database) (string, error) {
+	if direct := br.config.ProjectOption(db.Identifier, "DIRECT_URL", ""); direct != "" {
+		return database.NormalizeConnString(direct), nil
+	}
+	if !br.config.ProjectOptionBool(db.Identifier, "POOLER_CHECK", br.config.PoolerCheck) {
+		return db.ConnectionURL, nil
+	}
+	if reason := transactionPoolerReason(db.ConnectionURL); reason != "" {
+		project := strings.ToUpper(db.Identifier)
+		return "", fmt.Errorf("connection URL looks like a transaction-mode connection pooler (%s), which breaks pg_dump: "+
+			"set BACKUP_%s_DIRECT_URL to a direct or session-mode URL, or BACKUP_%s_POOLER_CHECK=false if this is wrong",
+			reason, project, project)
+	}
+	return db.ConnectionURL, nil
+}
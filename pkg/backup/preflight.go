@@ -0,0 +1,342 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+)
+
+// Preflight check statuses, from best to worst.
+const (
+	CheckOK      = "ok"
+	CheckSkipped = "skipped"
+	CheckWarning = "warning"
+	CheckFailed  = "failed"
+)
+
+// maxListedObjects caps the unreadable tables named in a privileges check.
+const maxListedObjects = 10
+
+// PreflightReport is the result of checking that a project can be backed up.
+// Status is the worst status of its checks.
+type PreflightReport struct {
+	Project   string           `json:"project"`
+	Status    string           `json:"status"`
+	PGVersion string           `json:"pg_version,omitempty"`
+	Image     string           `json:"image,omitempty"`
+	Provider  string           `json:"provider,omitempty"`
+	Checks    []PreflightCheck `json:"checks"`
+}
+
+// PreflightCheck is one step of a preflight check. Hint suggests a fix for
+// warnings and failures.
+type PreflightCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func (r *PreflightReport) add(name, status, message, hint string) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Status: status, Message: message, Hint: hint})
+	if checkRank(status) > checkRank(r.Status) {
+		r.Status = status
+	}
+}
+
+// skip records checks that weren't run because an earlier one failed.
+func (r *PreflightReport) skip(reason string, names ...string) {
+	for _, name := range names {
+		r.add(name, CheckSkipped, "not checked, "+reason, "")
+	}
+}
+
+func checkRank(status string) int {
+	switch status {
+	case CheckWarning:
+		return 1
+	case CheckFailed:
+		return 2
+	}
+	return 0
+}
+
+// Preflight checks what a backup of db needs without dumping anything: the
+// Docker daemon, the connection and credentials, read privileges on every
+// table, the roles dump, the dump image's version and the advisory lock. Checks that depend on a
+// failed one are reported as skipped.
+func (br *BackupRunner) Preflight(ctx context.Context, db *database.Database) *PreflightReport {
+	report := &PreflightReport{Project: db.Identifier, Status: CheckOK, Checks: []PreflightCheck{}}
+
+	if err := docker.CheckDocker(ctx); err != nil {
+		report.add("docker", CheckFailed, err.Error(), "mount the Docker socket into the container")
+	} else {
+		report.add("docker", CheckOK, "Docker daemon is reachable", "")
+	}
+
+	connURL, err := br.backupURL(db)
+	if err != nil {
+		report.add("connection_url", CheckFailed, err.Error(), "")
+		report.skip("the connection URL is unusable", "connect", "version", "privileges", "roles")
+		return report
+	}
+	if connURL != db.ConnectionURL {
+		direct := *db
+		direct.ConnectionURL = connURL
+		db = &direct
+	}
+	parsed, err := parseConnectionURL(connURL)
+	if err == nil {
+		// Dumps run in helper containers, which may reach the server differently
+		_, _, err = ContainerConn(ctx, connURL)
+	}
+	if err != nil {
+		report.add("connection_url", CheckFailed, err.Error(), "")
+		report.skip("the connection URL is unusable", "connect", "version", "privileges", "roles")
+		return report
+	}
+	report.add("connection_url", CheckOK, fmt.Sprintf("connecting to %s, database %s as %s", database.Address(parsed.host, parsed.port), parsed.database, parsed.user), "")
+
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		report.add("connect", CheckFailed, err.Error(), connectHint(err))
+		report.skip("the connection failed", "version", "privileges", "roles")
+		return report
+	}
+	defer conn.Close(context.Background())
+	report.add("connect", CheckOK, "connected and authenticated", "")
+
+	var versionNum int
+	var superuser bool
+	err = conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int, rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&versionNum, &superuser)
+	if err != nil {
+		report.add("version", CheckFailed, fmt.Sprintf("failed to read server version: %v", err), "")
+		report.skip("the server version is unknown", "privileges", "roles")
+		return report
+	}
+	br.checkVersion(report, versionNum)
+	br.checkPrivileges(ctx, report, conn, versionNum, superuser)
+
+	profile, err := br.resolveProvider(ctx, db)
+	if err != nil {
+		report.add("roles", CheckFailed, err.Error(), "")
+	} else {
+		report.Provider = profile.name
+		br.checkRoles(report, db, profile, superuser)
+	}
+
+	if br.config.ProjectOptionBool(db.Identifier, "SHARED_SNAPSHOT", br.config.SharedSnapshot) {
+		snapshot, err := exportSnapshot(ctx, connURL)
+		if err != nil {
+			report.add("snapshot", CheckWarning, err.Error(), "schema and data will be dumped without a shared snapshot")
+		} else {
+			snapshot.Close()
+			report.add("snapshot", CheckOK, "snapshots can be exported", "")
+		}
+	}
+
+	if lockName := br.advisoryLockName(db.Identifier); lockName != "" {
+		lock, err := acquireAdvisoryLock(ctx, connURL, lockName, 0)
+		switch {
+		case err == nil:
+			lock.Release()
+			report.add("advisory_lock", CheckOK, fmt.Sprintf("advisory lock %q is free", lockName), "")
+		case ClassifyFailure(err) == FailureLockHeld:
+			timeout := br.config.ProjectOptionDuration(db.Identifier, "ADVISORY_LOCK_TIMEOUT", br.config.AdvisoryLockTimeout)
+			report.add("advisory_lock", CheckWarning, err.Error(), fmt.Sprintf("a backup now would wait up to %s (ADVISORY_LOCK_TIMEOUT) for it", timeout))
+		default:
+			report.add("advisory_lock", CheckFailed, err.Error(), "")
+		}
+	}
+
+	dumpEnvValue := br.config.ProjectOption(db.Identifier, "DUMP_ENV", br.config.DumpEnv)
+	dumpArgsValue := br.config.ProjectOption(db.Identifier, "DUMP_ARGS", br.config.DumpArgs)
+	largeObjects := strings.ToLower(br.config.ProjectOption(db.Identifier, "LARGE_OBJECTS", br.config.LargeObjects))
+	if largeObjects == "" {
+		largeObjects = LargeObjectsAuto
+	}
+	if dumpEnvValue != "" || dumpArgsValue != "" || largeObjects != LargeObjectsAuto {
+		env, err := ParseDumpEnv(dumpEnvValue)
+		if err == nil {
+			var args []string
+			if args, err = ParseDumpArgs(dumpArgsValue); err == nil {
+				if _, err = largeObjectOptions(largeObjects, args); err == nil {
+					report.add("dump_options", CheckOK, fmt.Sprintf("dumps run with env %v and flags %v, large objects %s", envNames(env), args, largeObjects), "")
+				}
+			}
+		}
+		if err != nil {
+			report.add("dump_options", CheckFailed, err.Error(), "fix DUMP_ENV, DUMP_ARGS or LARGE_OBJECTS (or the project's override)")
+		}
+	}
+	return report
+}
+
+// connectHint explains common connection failures.
+func connectHint(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "28P01", "28000":
+			return "check the user name and password in the connection URL"
+		case "3D000":
+			return "the database in the connection URL doesn't exist"
+		case "53300":
+			return "the server has no free connection slots"
+		}
+	}
+	var netErr *net.OpError
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return "the server can't be reached; check the host, port and firewall"
+	}
+	return ""
+}
+
+// checkVersion resolves the dump image for the server's major version and
+// makes sure its pg_dump isn't older than the server, which pg_dump refuses.
+func (br *BackupRunner) checkVersion(report *PreflightReport, versionNum int) {
+	major := versionNum / 10000
+	report.PGVersion = formatServerVersion(versionNum)
+	image, err := br.dumpImage(report.PGVersion)
+	if err != nil {
+		report.add("version", CheckFailed, err.Error(), "")
+		return
+	}
+	report.Image = image
+
+	if imageMajor, ok := imageMajorVersion(image); ok && imageMajor < major {
+		report.add("version", CheckFailed,
+			fmt.Sprintf("dump image %s is PostgreSQL %d, older than the server (%d)", image, imageMajor, major),
+			fmt.Sprintf("set PGDUMP_IMAGE_%d or PGDUMP_IMAGE to an image of version %d or later", major, major))
+		return
+	}
+	report.add("version", CheckOK, fmt.Sprintf("server is PostgreSQL %s, dumping with %s", report.PGVersion, image), "")
+}
+
+// imageMajorVersion reads the major version from an image tag like "17" or
+// "16.4-alpine". Images without a numeric tag report false.
+func imageMajorVersion(image string) (int, bool) {
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		image = image[:idx]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	idx := strings.LastIndex(name, ":")
+	if idx < 0 {
+		return 0, false
+	}
+	tag := name[idx+1:]
+	end := strings.IndexFunc(tag, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(tag)
+	}
+	major, err := strconv.Atoi(tag[:end])
+	return major, err == nil
+}
+
+// checkPrivileges makes sure pg_dump can read every table and sequence:
+// superusers and members of pg_read_all_data (PostgreSQL 14+) can, other
+// users need USAGE on each schema and SELECT on each relation.
+func (br *BackupRunner) checkPrivileges(ctx context.Context, report *PreflightReport, conn *pgx.Conn, versionNum int, superuser bool) {
+	if superuser {
+		report.add("privileges", CheckOK, "connected as a superuser", "")
+		return
+	}
+	if versionNum >= 140000 {
+		var readAll bool
+		if err := conn.QueryRow(ctx, "SELECT pg_has_role(current_user, 'pg_read_all_data', 'USAGE')").Scan(&readAll); err != nil {
+			report.add("privileges", CheckFailed, fmt.Sprintf("failed to check role membership: %v", err), "")
+			return
+		}
+		if readAll {
+			report.add("privileges", CheckOK, "member of pg_read_all_data", "")
+			return
+		}
+	}
+
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname, c.relname FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'm', 'S')
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg_toast%'
+		  AND NOT (has_schema_privilege(n.oid, 'USAGE') AND has_table_privilege(c.oid, 'SELECT'))
+		ORDER BY 1, 2`)
+	if err != nil {
+		report.add("privileges", CheckFailed, fmt.Sprintf("failed to check table privileges: %v", err), "")
+		return
+	}
+	unreadable, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (string, error) {
+		var schema, name string
+		err := row.Scan(&schema, &name)
+		return schema + "." + name, err
+	})
+	if err != nil {
+		report.add("privileges", CheckFailed, fmt.Sprintf("failed to check table privileges: %v", err), "")
+		return
+	}
+
+	if len(unreadable) == 0 {
+		report.add("privileges", CheckOK, "SELECT granted on all tables and sequences", "")
+		return
+	}
+	listed := unreadable
+	if len(listed) > maxListedObjects {
+		listed = listed[:maxListedObjects]
+	}
+	message := fmt.Sprintf("no read access to %d tables or sequences: %s", len(unreadable), strings.Join(listed, ", "))
+	if len(unreadable) > len(listed) {
+		message += ", ..."
+	}
+	hint := "GRANT USAGE on the schemas and SELECT on the tables and sequences"
+	if versionNum >= 140000 {
+		hint = "GRANT pg_read_all_data TO the backup user, or " + hint
+	}
+	report.add("privileges", CheckFailed, message, hint)
+}
+
+// checkRoles reports whether the roles dump will work. pg_dumpall reads role
+// passwords from pg_authid, which only superusers can, unless the provider
+// profile passes --no-role-passwords.
+func (br *BackupRunner) checkRoles(report *PreflightReport, db *database.Database, profile *providerProfile, superuser bool) {
+	mode := strings.ToLower(br.config.ProjectOption(db.Identifier, "ROLES_DUMP", br.config.RolesDump))
+	if mode == "" {
+		mode = rolesDumpAll
+	}
+	if mode != rolesDumpAll && mode != rolesDumpOwners && mode != rolesDumpSkip {
+		report.add("roles", CheckFailed, fmt.Sprintf("invalid roles dump mode %q (expected all, owners or skip)", mode), "")
+		return
+	}
+	if mode == rolesDumpSkip {
+		report.add("roles", CheckSkipped, "roles dump disabled (ROLES_DUMP=skip)", "")
+		return
+	}
+
+	noPasswords := false
+	for _, arg := range profile.rolesDumpArgs {
+		if arg == "--no-role-passwords" {
+			noPasswords = true
+		}
+	}
+	if superuser || noPasswords {
+		report.add("roles", CheckOK, fmt.Sprintf("roles can be dumped (mode %s, provider %s)", mode, profile.name), "")
+		return
+	}
+
+	status := CheckFailed
+	if br.config.ProjectOptionBool(db.Identifier, "ROLES_DUMP_OPTIONAL", br.config.RolesDumpOptional) {
+		status = CheckWarning
+	}
+	project := strings.ToUpper(db.Identifier)
+	report.add("roles", status, "pg_dumpall needs superuser to read role passwords",
+		fmt.Sprintf("set BACKUP_%s_PROVIDER to a managed provider profile, BACKUP_%s_ROLES_DUMP=skip or BACKUP_%s_ROLES_DUMP_OPTIONAL=true", project, project, project))
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"io"
+	"time"
+)
+
+// Backup phases reported to a ProgressFunc.
+const (
+	PhaseRoles  = "roles"
+	PhaseSchema = "schema"
+	PhaseData   = "data"
+	// PhaseIncrement copies the new rows of incremental tables
+	PhaseIncrement = "increment"
+	PhaseArchive   = "archive"
+	PhaseUpload    = "upload"
+)
+
+// Phases that are only timed (see BackupManifest.PhaseMs), not reported to a
+// ProgressFunc.
+const (
+	// PhaseConnect is everything before the first dump: connecting,
+	// detecting the version, collecting metrics and exporting the snapshot
+	PhaseConnect = "connect"
+	PhaseVerify  = "verify"
+)
+
+// phaseTimer adds up how long the phases of a backup take. Starting a phase
+// ends the current one; a phase started again keeps adding up.
+type phaseTimer struct {
+	now     func() time.Time
+	ms      map[string]int64
+	phase   string
+	started time.Time
+}
+
+func newPhaseTimer(now func() time.Time) *phaseTimer {
+	return &phaseTimer{now: now, ms: make(map[string]int64)}
+}
+
+func (t *phaseTimer) start(phase string) {
+	t.stop()
+	t.phase = phase
+	t.started = t.now()
+}
+
+func (t *phaseTimer) stop() {
+	if t.phase == "" {
+		return
+	}
+	t.ms[t.phase] += t.now().Sub(t.started).Milliseconds()
+	t.phase = ""
+}
+
+// result ends the current phase and returns the timings so far.
+func (t *phaseTimer) result() map[string]int64 {
+	t.stop()
+	return t.ms
+}
+
+// ProgressFunc receives the phase a backup is in and the bytes written in that
+// phase so far. It is called for every chunk written, so it must be cheap.
+type ProgressFunc func(phase string, bytesWritten int64)
+
+// progressWriter counts the bytes written to w and reports them.
+type progressWriter struct {
+	w       io.Writer
+	phase   string
+	written int64
+	report  ProgressFunc
+}
+
+func newProgressWriter(w io.Writer, phase string, report ProgressFunc) *progressWriter {
+	report(phase, 0)
+	return &progressWriter{w: w, phase: phase, report: report}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.report(p.phase, p.written)
+	return n, err
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"go.uber.org/zap"
+)
+
+// providerProfile adjusts dumps for managed Postgres quirks. Managed services
+// don't grant superuser, so pg_authid (role passwords) is unreadable and the
+// cluster contains provider-owned roles that can't be recreated elsewhere.
+type providerProfile struct {
+	name                 string
+	rolesDumpArgs        []string
+	reservedRoles        []string
+	reservedRolePrefixes []string
+	// dumpArgs are added to both pg_dump runs
+	dumpArgs []string
+}
+
+var providerProfiles = map[string]*providerProfile{
+	"generic": {name: "generic"},
+	"rds": {
+		name:                 "rds",
+		rolesDumpArgs:        []string{"--no-role-passwords"},
+		reservedRoles:        []string{"rdsadmin", "rdsrepladmin", "rdstopmgr"},
+		reservedRolePrefixes: []string{"rds_"},
+	},
+	"aurora": {
+		name:                 "aurora",
+		rolesDumpArgs:        []string{"--no-role-passwords"},
+		reservedRoles:        []string{"rdsadmin", "rdsrepladmin", "rdstopmgr"},
+		reservedRolePrefixes: []string{"rds_", "aurora_"},
+	},
+	"cloudsql": {
+		name:                 "cloudsql",
+		rolesDumpArgs:        []string{"--no-role-passwords"},
+		reservedRolePrefixes: []string{"cloudsql"},
+	},
+	"supabase": {
+		name:          "supabase",
+		rolesDumpArgs: []string{"--no-role-passwords"},
+		reservedRoles: []string{
+			"anon", "authenticated", "authenticator", "dashboard_user", "pgbouncer",
+			"service_role", "pgsodium_keyholder", "pgsodium_keyiduser", "pgsodium_keymaker",
+		},
+		reservedRolePrefixes: []string{"supabase_"},
+	},
+	// TimescaleDB keeps chunks of hypertables in tablespaces of their own and
+	// names them with mixed case, which the flags Timescale recommends for
+	// plain dumps take care of. Restores run its pre/post restore hooks
+	"timescale": {
+		name:          "timescale",
+		rolesDumpArgs: []string{"--no-role-passwords"},
+		dumpArgs:      []string{"--no-tablespaces", "--quote-all-identifiers"},
+	},
+}
+
+func (p *providerProfile) reservedRole(name string) bool {
+	for _, role := range p.reservedRoles {
+		if name == role {
+			return true
+		}
+	}
+	for _, prefix := range p.reservedRolePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveProvider returns the profile configured for a project via PROVIDER,
+// detecting it from the host name and provider-specific roles when set to auto.
+func (br *BackupRunner) resolveProvider(ctx context.Context, db *database.Database) (*providerProfile, error) {
+	name := strings.ToLower(br.config.ProjectOption(db.Identifier, "PROVIDER", br.config.Provider))
+	if name == "" || name == "auto" {
+		detected, err := br.detectProvider(ctx, db.ConnectionURL)
+		if err != nil {
+			br.logger.Warn("Failed to detect provider, using generic profile", zap.String("database", db.Identifier), zap.Error(err))
+			detected = "generic"
+		}
+		name = detected
+	}
+
+	profile, ok := providerProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q (expected auto, generic, rds, aurora, cloudsql, supabase or timescale)", name)
+	}
+	return profile, nil
+}
+
+func (br *BackupRunner) detectProvider(ctx context.Context, connURL string) (string, error) {
+	parsed, err := parseConnectionURL(connURL)
+	if err != nil {
+		return "", err
+	}
+
+	host := strings.ToLower(parsed.host)
+	switch {
+	case strings.HasSuffix(host, ".rds.amazonaws.com") && strings.Contains(host, ".cluster-"):
+		return "aurora", nil
+	case strings.HasSuffix(host, ".rds.amazonaws.com"):
+		return "rds", nil
+	case strings.HasSuffix(host, ".supabase.co"), strings.HasSuffix(host, ".supabase.com"):
+		return "supabase", nil
+	case strings.HasSuffix(host, ".tsdb.cloud.timescale.com"):
+		return "timescale", nil
+	}
+
+	// Hosts behind proxies or private IPs: look for provider-owned objects
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(context.Background())
+
+	var aurora, rds, cloudsql, supabase, timescale bool
+	err = conn.QueryRow(ctx, `
+		SELECT
+			EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'aurora_version'),
+			EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'rds_superuser'),
+			EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'cloudsqlsuperuser'),
+			EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'supabase_admin'),
+			EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'tsdbadmin')`).Scan(&aurora, &rds, &cloudsql, &supabase, &timescale)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case aurora:
+		return "aurora", nil
+	case rds:
+		return "rds", nil
+	case cloudsql:
+		return "cloudsql", nil
+	case supabase:
+		return "supabase", nil
+	case timescale:
+		return "timescale", nil
+	}
+	return "generic", nil
+}
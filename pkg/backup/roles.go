@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	rolesDumpAll    = "all"
+	rolesDumpOwners = "owners"
+	rolesDumpSkip   = "skip"
+)
+
+// dumpRolesWithMode writes roles.sql according to the ROLES_DUMP mode and
+// returns the mode that was applied ("skipped" when no dump ran).
+// Roles reserved by the provider profile are always filtered out.
+func (br *BackupRunner) dumpRolesWithMode(ctx context.Context, connURL, outputFile, image, mode string, profile *providerProfile) (string, error) {
+	keep := func(name string) bool {
+		return !profile.reservedRole(name)
+	}
+
+	switch mode {
+	case rolesDumpSkip:
+		if err := writeRolesPlaceholder(outputFile, "roles dump skipped (ROLES_DUMP=skip)"); err != nil {
+			return "", err
+		}
+		return "skipped", nil
+	case rolesDumpOwners:
+		owners, err := br.objectOwners(ctx, connURL)
+		if err != nil {
+			return "", fmt.Errorf("failed to list object owners: %w", err)
+		}
+		ownerKeep := func(name string) bool {
+			return owners[name] && keep(name)
+		}
+		return rolesDumpOwners, br.dumpRoles(ctx, connURL, outputFile, image, profile.rolesDumpArgs, ownerKeep)
+	default:
+		if len(profile.reservedRoles) == 0 && len(profile.reservedRolePrefixes) == 0 {
+			keep = nil
+		}
+		return rolesDumpAll, br.dumpRoles(ctx, connURL, outputFile, image, profile.rolesDumpArgs, keep)
+	}
+}
+
+// objectOwners returns the roles owning the target database or any object in it.
+func (br *BackupRunner) objectOwners(ctx context.Context, connURL string) (map[string]bool, error) {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	rows, err := conn.Query(ctx, `
+		SELECT DISTINCT pg_get_userbyid(owner) FROM (
+			SELECT datdba AS owner FROM pg_database WHERE datname = current_database()
+			UNION SELECT nspowner FROM pg_namespace
+			UNION SELECT relowner FROM pg_class
+			UNION SELECT proowner FROM pg_proc
+			UNION SELECT typowner FROM pg_type
+		) owners`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		owners[name] = true
+	}
+	return owners, rows.Err()
+}
+
+// filterRoles drops role statements from a pg_dumpall --roles-only dump for
+// roles rejected by keep. Role memberships are kept only if both sides are kept
+// (or the granted role is a predefined pg_* role); everything else passes through.
+func filterRoles(dump []byte, keep func(string) bool) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(dump))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !keepRoleLine(line, keep) {
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+func keepRoleLine(line string, keep func(string) bool) bool {
+	for _, prefix := range []string{"CREATE ROLE ", "ALTER ROLE ", "COMMENT ON ROLE "} {
+		if strings.HasPrefix(line, prefix) {
+			name, _ := parseIdentifier(line[len(prefix):])
+			return keep(name)
+		}
+	}
+
+	if strings.HasPrefix(line, "GRANT ") {
+		granted, rest := parseIdentifier(line[len("GRANT "):])
+		if !strings.HasPrefix(rest, " TO ") {
+			return true
+		}
+		member, _ := parseIdentifier(rest[len(" TO "):])
+		return keep(member) && (keep(granted) || strings.HasPrefix(granted, "pg_"))
+	}
+
+	return true
+}
+
+// parseIdentifier reads a possibly double-quoted SQL identifier and returns it
+// unquoted along with the remainder of the string.
+func parseIdentifier(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		end := strings.IndexAny(s, " ;")
+		if end < 0 {
+			return s, ""
+		}
+		return s[:end], s[end:]
+	}
+
+	var name strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			name.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			name.WriteByte('"')
+			i++
+			continue
+		}
+		return name.String(), s[i+1:]
+	}
+	return name.String(), ""
+}
+
+// writeRolesPlaceholder keeps roles.sql present in the archive when no roles
+// were dumped, so restores can always apply the three files in order.
+func writeRolesPlaceholder(outputFile, reason string) error {
+	if err := os.WriteFile(outputFile, []byte("-- "+reason+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// exportedSnapshot keeps a transaction open so that its snapshot can be
+// imported by several pg_dump runs (--snapshot), making them all see the
+// database at the same point in time. Close releases it once the dumps are done.
+type exportedSnapshot struct {
+	conn *pgx.Conn
+	tx   pgx.Tx
+	ID   string
+}
+
+// exportSnapshot starts a read-only repeatable-read transaction on connURL and
+// exports its snapshot. Snapshots can only be imported into the same database.
+func exportSnapshot(ctx context.Context, connURL string) (*exportedSnapshot, error) {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection sits idle in its transaction while the dumps run; don't let
+	// a server-side idle timeout end it (the setting doesn't exist before 9.6)
+	_, _ = conn.Exec(ctx, "SET idle_in_transaction_session_timeout = 0")
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to start snapshot transaction: %w", err)
+	}
+
+	var id string
+	if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&id); err != nil {
+		_ = tx.Rollback(context.Background())
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to export snapshot: %w", err)
+	}
+
+	return &exportedSnapshot{conn: conn, tx: tx, ID: id}, nil
+}
+
+func (s *exportedSnapshot) Close() {
+	_ = s.tx.Rollback(context.Background())
+	_ = s.conn.Close(context.Background())
+}
@@ -0,0 +1,177 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+)
+
+// PartName is the name of part i of a split archive: <archive>.part000, ...
+func PartName(archiveName string, i int) string {
+	return fmt.Sprintf("%s.part%03d", archiveName, i)
+}
+
+// splitArchive splits the archive at archivePath into parts of at most
+// partSize bytes next to it and removes the archive. The parts are returned
+// in order with their sizes and checksums.
+func splitArchive(archivePath string, partSize int64) ([]File, error) {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	var parts []File
+	for i := 0; ; i++ {
+		name := PartName(filepath.Base(archivePath), i)
+		part, err := writePart(filepath.Join(filepath.Dir(archivePath), name), io.LimitReader(archive, partSize))
+		if err != nil {
+			return nil, err
+		}
+		if part.Size == 0 && i > 0 {
+			// The archive ended exactly at a part boundary
+			_ = os.Remove(filepath.Join(filepath.Dir(archivePath), name))
+			break
+		}
+		parts = append(parts, part)
+		if part.Size < partSize {
+			break
+		}
+	}
+
+	archive.Close()
+	if err := os.Remove(archivePath); err != nil {
+		return nil, fmt.Errorf("failed to remove split archive: %w", err)
+	}
+	if err := durable.SyncDir(filepath.Dir(archivePath)); err != nil {
+		return nil, fmt.Errorf("failed to sync archive parts: %w", err)
+	}
+	return parts, nil
+}
+
+func writePart(path string, r io.Reader) (File, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to create archive part: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to write archive part: %w", err)
+	}
+	if err := durable.SyncFile(file); err != nil {
+		return File{}, fmt.Errorf("failed to sync archive part: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return File{}, fmt.Errorf("failed to write archive part: %w", err)
+	}
+	return File{Name: filepath.Base(path), Size: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// ArchiveParts returns the paths of the parts of a split archive in order,
+// or nil if archivePath wasn't split.
+func ArchiveParts(archivePath string) ([]string, error) {
+	var parts []string
+	for i := 0; ; i++ {
+		part := filepath.Join(filepath.Dir(archivePath), PartName(filepath.Base(archivePath), i))
+		if _, err := os.Stat(part); errors.Is(err, os.ErrNotExist) {
+			return parts, nil
+		} else if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+}
+
+// OpenArchive opens an archive for reading. A split archive that is not on
+// disk as a whole is read from its parts, so readers don't need to know
+// whether it was split.
+func OpenArchive(archivePath string) (io.ReadCloser, error) {
+	file, err := os.Open(archivePath)
+	if !errors.Is(err, os.ErrNotExist) {
+		return file, err
+	}
+	parts, partsErr := ArchiveParts(archivePath)
+	if partsErr != nil || len(parts) == 0 {
+		return nil, err
+	}
+	return &partsReader{parts: parts}, nil
+}
+
+// partsReader reads the parts of a split archive one after another, keeping
+// only one of them open.
+type partsReader struct {
+	parts   []string
+	current *os.File
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			file, err := os.Open(r.parts[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.parts = file, r.parts[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// ArchiveSHA256 is FileSHA256 for archives, which may be split.
+func ArchiveSHA256(archivePath string) (string, error) {
+	file, err := OpenArchive(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ArchiveFiles returns the names of the files holding a backup's archive on
+// disk: its parts if it was split, else the archive itself.
+func (m *BackupManifest) ArchiveFiles() []string {
+	if len(m.Parts) > 0 {
+		names := make([]string, 0, len(m.Parts))
+		for _, part := range m.Parts {
+			names = append(names, part.Name)
+		}
+		return names
+	}
+	if len(m.Files) == 0 {
+		return nil
+	}
+	return []string{m.Files[0].Name}
+}
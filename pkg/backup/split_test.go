@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitArchiveRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		partSize  int64
+		wantParts int
+	}{
+		{name: "empty", size: 0, partSize: 10, wantParts: 1},
+		{name: "smaller than a part", size: 7, partSize: 10, wantParts: 1},
+		{name: "exactly one part", size: 10, partSize: 10, wantParts: 1},
+		{name: "exactly two parts", size: 20, partSize: 10, wantParts: 2},
+		{name: "short last part", size: 25, partSize: 10, wantParts: 3},
+		{name: "one-byte parts", size: 5, partSize: 1, wantParts: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, "backup-app.tar.gz")
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			if err := os.WriteFile(archivePath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			parts, err := splitArchive(archivePath, tt.partSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != tt.wantParts {
+				t.Fatalf("split into %d parts, want %d", len(parts), tt.wantParts)
+			}
+			if _, err := os.Stat(archivePath); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("archive still on disk after splitting: %v", err)
+			}
+			paths, err := ArchiveParts(archivePath)
+			if err != nil || len(paths) != tt.wantParts {
+				t.Fatalf("ArchiveParts() = %v, %v, want %d parts", paths, err, tt.wantParts)
+			}
+
+			file, err := OpenArchive(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			// One byte at a time crosses every part boundary separately
+			got, err := io.ReadAll(iotest.OneByteReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes back, want the %d written", len(got), len(data))
+			}
+
+			sum := sha256.Sum256(data)
+			if got, err := ArchiveSHA256(archivePath); err != nil || got != hex.EncodeToString(sum[:]) {
+				t.Fatalf("ArchiveSHA256() = %s, %v, want the checksum of the original", got, err)
+			}
+		})
+	}
+}
+
+func TestPartsReader(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first, empty, last := write("a", "hello "), write("b", ""), write("c", "world")
+
+	tests := []struct {
+		name    string
+		parts   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "no parts", parts: nil, want: ""},
+		{name: "one part", parts: []string{first}, want: "hello "},
+		{name: "in the given order", parts: []string{last, first}, want: "worldhello "},
+		{name: "empty part skipped", parts: []string{first, empty, last}, want: "hello world"},
+		{name: "missing part", parts: []string{first, filepath.Join(dir, "missing")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &partsReader{parts: tt.parts}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if tt.wantErr {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("ReadAll() error = %v, want a missing part", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("ReadAll() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenArchiveWithoutArchiveOrParts(t *testing.T) {
+	if _, err := OpenArchive(filepath.Join(t.TempDir(), "backup-app.tar.gz")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenArchive() error = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"math"
+	"time"
+)
+
+// Stats records how big a backup is before and after compression and how
+// fast it was taken, to diagnose slow backups and forecast disk usage. The
+// dump covers all pg_dump runs (roles to increment), throttling included.
+type Stats struct {
+	// DumpBytes is the uncompressed size of the dumps, ArchiveBytes the
+	// size of the archive
+	DumpBytes    int64 `json:"dump_bytes"`
+	ArchiveBytes int64 `json:"archive_bytes"`
+	// CompressionRatio is DumpBytes / ArchiveBytes
+	CompressionRatio float64 `json:"compression_ratio"`
+	DumpMs           int64   `json:"dump_ms"`
+	DumpMBPerSec     float64 `json:"dump_mb_per_s"`
+	ArchiveMs        int64   `json:"archive_ms"`
+}
+
+func newStats(dumpBytes, archiveBytes int64, dump, archive time.Duration) *Stats {
+	stats := &Stats{
+		DumpBytes:    dumpBytes,
+		ArchiveBytes: archiveBytes,
+		DumpMs:       dump.Milliseconds(),
+		DumpMBPerSec: MBPerSec(dumpBytes, dump),
+		ArchiveMs:    archive.Milliseconds(),
+	}
+	if archiveBytes > 0 {
+		stats.CompressionRatio = round2(float64(dumpBytes) / float64(archiveBytes))
+	}
+	return stats
+}
+
+// MBPerSec returns the throughput of transferring n bytes in d, in megabytes
+// (10^6 bytes) per second, rounded to two decimals.
+func MBPerSec(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return round2(float64(n) / 1e6 / d.Seconds())
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
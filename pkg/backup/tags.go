@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Limits on the tags of one backup, so manifests stay small.
+const (
+	maxTags      = 16
+	maxTagLength = 64
+)
+
+type tagsKey struct{}
+
+// WithTags returns a context whose backups are tagged with tags, e.g.
+// "pre-upgrade-v5" for a manual backup before an upgrade. The tags are
+// recorded in the manifest.
+func WithTags(ctx context.Context, tags []string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+func tagsFrom(ctx context.Context) []string {
+	tags, _ := ctx.Value(tagsKey{}).([]string)
+	return tags
+}
+
+// NormalizeTags trims tags and drops duplicates. Tags are free-form, but
+// must not be empty, contain control characters or commas (tag lists are
+// comma-separated in queries), or exceed the length limits.
+func NormalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "":
+			return nil, fmt.Errorf("tags must not be empty")
+		case len(tag) > maxTagLength:
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		case strings.ContainsRune(tag, ',') || strings.IndexFunc(tag, unicode.IsControl) >= 0:
+			return nil, fmt.Errorf("tag %q must not contain commas or control characters", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
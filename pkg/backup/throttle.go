@@ -0,0 +1,259 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"go.uber.org/zap"
+)
+
+// throttle pauses a backup while the source database is busy: before the
+// first dump it waits for the load to drop below the limits, and during the
+// dumps it blocks their output, which stalls pg_dump (and the COPY of an
+// increment) until the load drops again. Load is sampled on its own
+// connection every interval.
+type throttle struct {
+	conn      *pgx.Conn
+	project   string
+	maxActive int
+	maxLag    time.Duration
+	interval  time.Duration
+	maxWait   time.Duration
+	logger    *zap.Logger
+
+	mu sync.Mutex
+	// ignored holds the backend PIDs of the backup's own connections
+	ignored []int32
+	// resume is open while paused and closed when the dump may continue
+	resume   chan struct{}
+	pausedAt time.Time
+	waited   time.Duration
+	gaveUp   bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startThrottle connects to connURL and takes the first load sample. It
+// returns nil when no throttle limit is configured for db.
+func (br *BackupRunner) startThrottle(ctx context.Context, db *database.Database, connURL string) (*throttle, error) {
+	maxActive := br.config.ProjectOptionInt(db.Identifier, "THROTTLE_MAX_ACTIVE", br.config.ThrottleMaxActive)
+	maxLag := br.config.ProjectOptionDuration(db.Identifier, "THROTTLE_MAX_LAG", br.config.ThrottleMaxLag)
+	if maxActive <= 0 && maxLag <= 0 {
+		return nil, nil
+	}
+	interval := br.config.ProjectOptionDuration(db.Identifier, "THROTTLE_INTERVAL", br.config.ThrottleInterval)
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect for load checks: %w", err)
+	}
+
+	t := &throttle{
+		conn:      conn,
+		project:   db.Identifier,
+		maxActive: maxActive,
+		maxLag:    maxLag,
+		interval:  interval,
+		maxWait:   br.config.ProjectOptionDuration(db.Identifier, "THROTTLE_MAX_WAIT", br.config.ThrottleMaxWait),
+		logger:    br.logger,
+		done:      make(chan struct{}),
+	}
+	pollCtx, stop := context.WithCancel(context.Background())
+	t.cancel = stop
+	t.check(ctx)
+	go t.poll(pollCtx)
+	return t, nil
+}
+
+// ignore excludes a connection of the backup itself from the active count.
+func (t *throttle) ignore(pid uint32) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ignored = append(t.ignored, int32(pid))
+}
+
+func (t *throttle) poll(ctx context.Context) {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.check(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// check samples the load and pauses or resumes. It reports false once the
+// throttle has given up after waiting maxWait in total.
+func (t *throttle) check(ctx context.Context) bool {
+	reason, err := t.busy(ctx)
+	if err != nil {
+		// A failing load check mustn't hold up the backup
+		if ctx.Err() == nil {
+			t.logger.Warn("Load check failed, not throttling", zap.String("database", t.project), zap.Error(err))
+		}
+		reason = ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case reason != "" && t.resume == nil:
+		t.logger.Info("Database is busy, pausing backup", zap.String("database", t.project), zap.String("reason", reason))
+		t.resume = make(chan struct{})
+		t.pausedAt = time.Now()
+	case reason == "" && t.resume != nil:
+		t.logger.Info("Database quieted down, resuming backup", zap.String("database", t.project),
+			zap.Duration("paused", time.Since(t.pausedAt).Round(time.Second)))
+		t.unpause()
+	}
+	if t.resume != nil && t.maxWait > 0 && t.waited+time.Since(t.pausedAt) >= t.maxWait {
+		t.logger.Warn("Database still busy, continuing backup without throttling", zap.String("database", t.project),
+			zap.String("reason", reason), zap.Duration("max_wait", t.maxWait))
+		t.unpause()
+		t.gaveUp = true
+		return false
+	}
+	return true
+}
+
+// unpause releases waiting dumps. t.mu must be held.
+func (t *throttle) unpause() {
+	t.waited += time.Since(t.pausedAt)
+	close(t.resume)
+	t.resume = nil
+}
+
+// busy samples the load and describes the exceeded limit, or returns "".
+func (t *throttle) busy(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	ignored := append([]int32(nil), t.ignored...)
+	t.mu.Unlock()
+
+	// pg_dump and pg_dumpall set their application_name; replication lag is
+	// the replay lag of the slowest standby, or on a standby its own
+	lagQuery := "0::float8"
+	if t.maxLag > 0 {
+		lagQuery = `CASE WHEN pg_is_in_recovery() THEN
+			CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0) END
+		ELSE coalesce((SELECT extract(epoch FROM max(replay_lag)) FROM pg_stat_replication), 0) END::float8`
+	}
+	var active int
+	var lagSeconds float64
+	err := t.conn.QueryRow(ctx, `
+		SELECT (SELECT count(*) FROM pg_stat_activity
+			WHERE state = 'active' AND pid <> pg_backend_pid() AND pid <> ALL($1::int[])
+			  AND coalesce(application_name, '') NOT IN ('pg_dump', 'pg_dumpall'))::int,
+		`+lagQuery, ignored).Scan(&active, &lagSeconds)
+	if err != nil {
+		return "", err
+	}
+
+	lag := time.Duration(lagSeconds * float64(time.Second))
+	if t.maxActive > 0 && active > t.maxActive {
+		return fmt.Sprintf("%d active connections (limit %d)", active, t.maxActive), nil
+	}
+	if t.maxLag > 0 && lag > t.maxLag {
+		return fmt.Sprintf("replication lag %s (limit %s)", lag.Round(time.Second), t.maxLag), nil
+	}
+	return "", nil
+}
+
+// wait blocks while the backup is paused.
+func (t *throttle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	resume := t.resume
+	t.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the load checks and releases paused dumps.
+func (t *throttle) Close() {
+	if t == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+	_ = t.conn.Close(context.Background())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resume != nil {
+		t.unpause()
+	}
+}
+
+// stats returns how long the backup was paused and whether the throttle gave
+// up after maxWait.
+func (t *throttle) stats() (waited time.Duration, gaveUp bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	waited = t.waited
+	if t.resume != nil {
+		waited += time.Since(t.pausedAt)
+	}
+	return waited, t.gaveUp
+}
+
+// throttledWriter holds back writes while the throttle is paused.
+type throttledWriter struct {
+	ctx context.Context
+	t   *throttle
+	w   io.Writer
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	if err := w.t.wait(w.ctx); err != nil {
+		return 0, err
+	}
+	return w.w.Write(b)
+}
+
+type throttleKey struct{}
+
+// withThrottle makes the dumps run under ctx pause with t.
+func withThrottle(ctx context.Context, t *throttle) context.Context {
+	return context.WithValue(ctx, throttleKey{}, t)
+}
+
+// throttled wraps w so writes wait while the throttle in ctx is paused.
+func throttled(ctx context.Context, w io.Writer) io.Writer {
+	t, _ := ctx.Value(throttleKey{}).(*throttle)
+	if t == nil {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, t: t, w: w}
+}
@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+)
+
+// ValidateProject checks the backup settings of a project (its own or the
+// global ones) without connecting to anything: what CreateBackup would
+// otherwise only reject at backup time.
+func (br *BackupRunner) ValidateProject(db *database.Database) []error {
+	project := db.Identifier
+	var problems []error
+	add := func(err error) {
+		problems = append(problems, fmt.Errorf("project %s: %w", project, err))
+	}
+
+	dataStyle := strings.ToLower(br.config.ProjectOption(project, "DATA_DUMP_STYLE", br.config.DataDumpStyle))
+	if dataStyle != "" {
+		if _, err := dataDumpOptions(dataStyle); err != nil {
+			add(err)
+		}
+	}
+	switch rolesMode := strings.ToLower(br.config.ProjectOption(project, "ROLES_DUMP", br.config.RolesDump)); rolesMode {
+	case "", rolesDumpAll, rolesDumpOwners, rolesDumpSkip:
+	default:
+		add(fmt.Errorf("invalid roles dump mode %q (expected all, owners or skip)", rolesMode))
+	}
+	if provider := strings.ToLower(br.config.ProjectOption(project, "PROVIDER", br.config.Provider)); provider != "" && provider != "auto" {
+		if _, ok := providerProfiles[provider]; !ok {
+			add(fmt.Errorf("unknown provider %q (expected auto, generic, rds, aurora, cloudsql, supabase or timescale)", provider))
+		}
+	}
+	if _, _, err := br.incrementalTables(project); err != nil {
+		add(err)
+	}
+	if _, err := parseWeekdays(br.config.ProjectOption(project, "FULL_BACKUP_DAYS", br.config.FullBackupDays)); err != nil {
+		add(fmt.Errorf("invalid FULL_BACKUP_DAYS: %w", err))
+	}
+	if _, err := ParseDumpEnv(br.config.ProjectOption(project, "DUMP_ENV", br.config.DumpEnv)); err != nil {
+		add(err)
+	}
+	if args, err := ParseDumpArgs(br.config.ProjectOption(project, "DUMP_ARGS", br.config.DumpArgs)); err != nil {
+		add(err)
+	} else if largeObjects := strings.ToLower(br.config.ProjectOption(project, "LARGE_OBJECTS", br.config.LargeObjects)); largeObjects != "" {
+		if _, err := largeObjectOptions(largeObjects, args); err != nil {
+			add(err)
+		}
+	}
+	if direct := br.config.ProjectOption(project, "DIRECT_URL", ""); direct != "" {
+		if _, err := database.ParseConnString(direct); err != nil {
+			add(fmt.Errorf("invalid DIRECT_URL: %w", err))
+		}
+	} else if _, err := br.backupURL(db); err != nil {
+		add(err)
+	}
+	return problems
+}
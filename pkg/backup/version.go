@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"go.uber.org/zap"
+)
+
+// defaultMajor is the dump image major used when the server version can't be
+// detected and no images are configured: the newest release, as pg_dump can
+// dump older servers but refuses newer ones.
+const defaultMajor = 18
+
+// DetectVersion returns the major version of the server at connURL, e.g. "17".
+func DetectVersion(ctx context.Context, connURL string) (string, error) {
+	version, err := DetectServerVersion(ctx, connURL)
+	if err != nil {
+		return "", err
+	}
+	major, _, _ := strings.Cut(version, ".")
+	return major, nil
+}
+
+// DetectServerVersion returns the major and minor version of the server at
+// connURL, e.g. "17.4", or "9.6.24" before PostgreSQL 10.
+func DetectServerVersion(ctx context.Context, connURL string) (string, error) {
+	connCtx, cancel := context.WithTimeout(ctx, dbConnectionTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(connCtx, connURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(context.Background())
+
+	// server_version_num is 170004 for 17.4, unlike version() the same on
+	// every build and platform
+	var versionNum int
+	if err := conn.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&versionNum); err != nil {
+		return "", fmt.Errorf("failed to read server version: %w", err)
+	}
+	return formatServerVersion(versionNum), nil
+}
+
+// formatServerVersion turns a server_version_num into a version string.
+// Before PostgreSQL 10 the major took two parts, 90624 being 9.6.24.
+func formatServerVersion(versionNum int) string {
+	if versionNum < 100000 {
+		return fmt.Sprintf("%d.%d.%d", versionNum/10000, versionNum/100%100, versionNum%100)
+	}
+	return fmt.Sprintf("%d.%d", versionNum/10000, versionNum%10000)
+}
+
+// serverVersion detects the version of db's server for picking the dump
+// image. Connection and authentication failures fail the backup, as the
+// dumps wouldn't get further. Other detection failures fail it with
+// VERSION_MATCH=strict and fall back to the newest available major
+// otherwise.
+func (br *BackupRunner) serverVersion(ctx context.Context, db *database.Database) (string, error) {
+	version, err := DetectServerVersion(ctx, db.ConnectionURL)
+	if err == nil {
+		br.logger.Debug("Detected PostgreSQL version", zap.String("database", db.Identifier), zap.String("version", version))
+		return version, nil
+	}
+	if failure := ClassifyFailure(err); failure == FailureConnection || failure == FailureAuth {
+		return "", fmt.Errorf("failed to connect: %w", err)
+	}
+	if br.config.VersionMatch == config.VersionMatchStrict {
+		return "", fmt.Errorf("failed to detect PostgreSQL version (VERSION_MATCH=strict): %w", err)
+	}
+	fallback := strconv.Itoa(FallbackMajor(br.config))
+	br.logger.Warn("Failed to detect PostgreSQL version, dumping with the newest available image",
+		zap.String("database", db.Identifier),
+		zap.String("major", fallback),
+		zap.Error(err))
+	return fallback, nil
+}
+
+// FallbackMajor is the major dumped with when the server version is unknown:
+// the newest of DUMP_IMAGE_MAJORS and the PGDUMP_IMAGE_<MAJOR> overrides, or
+// defaultMajor without either.
+func FallbackMajor(cfg *config.Config) int {
+	majors := availableMajors(cfg)
+	if len(majors) == 0 {
+		return defaultMajor
+	}
+	return majors[len(majors)-1]
+}
+
+// availableMajors lists the majors of DUMP_IMAGE_MAJORS and the
+// PGDUMP_IMAGE_<MAJOR> overrides, ascending.
+func availableMajors(cfg *config.Config) []int {
+	majors := slices.Clone(cfg.DumpImageMajors)
+	for key := range cfg.PgDumpImages {
+		if major, err := strconv.Atoi(key); err == nil && !slices.Contains(majors, major) {
+			majors = append(majors, major)
+		}
+	}
+	slices.Sort(majors)
+	return majors
+}
+
+// resolveImageMajor picks the dump image major for a server major. Without
+// DUMP_IMAGE_MAJORS every major is available. With it, the server's own major
+// is used if listed (or overridden by PGDUMP_IMAGE_<MAJOR>); otherwise
+// VERSION_MATCH=fallback takes the closest newer one, which can still dump
+// the server, and strict matching fails.
+func resolveImageMajor(cfg *config.Config, major int) (int, error) {
+	if len(cfg.DumpImageMajors) == 0 {
+		return major, nil
+	}
+	available := availableMajors(cfg)
+	for _, candidate := range available {
+		if candidate == major || candidate > major && cfg.VersionMatch != config.VersionMatchStrict {
+			return candidate, nil
+		}
+	}
+
+	listed := make([]string, len(available))
+	for i, candidate := range available {
+		listed[i] = strconv.Itoa(candidate)
+	}
+	reason := "pg_dump can't dump newer servers"
+	if cfg.VersionMatch == config.VersionMatchStrict {
+		reason = "VERSION_MATCH=strict requires the same major"
+	}
+	return 0, fmt.Errorf("no dump image for PostgreSQL %d: images are available for %s and %s; add %d to DUMP_IMAGE_MAJORS or set PGDUMP_IMAGE_%d",
+		major, strings.Join(listed, ", "), reason, major, major)
+}
+
+func (br *BackupRunner) dumpImage(pgVersion string) (string, error) {
+	return DumpImage(br.config, pgVersion)
+}
+
+// DumpImage resolves the Docker image used for dumps (and restores) of a
+// server version, "17" or "17.4". The image major comes from resolveImageMajor. A
+// PGDUMP_IMAGE_<MAJOR> override wins; otherwise PGDUMP_IMAGE is used as-is
+// when it already carries a tag or digest, or as a repository tagged with the
+// major (or with the server's major and minor for PGDUMP_IMAGE_TAG=minor).
+func DumpImage(cfg *config.Config, pgVersion string) (string, error) {
+	majorPart, minorPart, _ := strings.Cut(pgVersion, ".")
+	major, err := strconv.Atoi(majorPart)
+	if err != nil {
+		return "", fmt.Errorf("invalid PostgreSQL version %q", pgVersion)
+	}
+	imageMajor, err := resolveImageMajor(cfg, major)
+	if err != nil {
+		return "", err
+	}
+
+	image, ok := cfg.PgDumpImages[strconv.Itoa(imageMajor)]
+	if !ok {
+		repo := cfg.PgDumpImage
+		if repo == "" {
+			repo = "postgres"
+		}
+		image = repo
+		if !docker.HasTagOrDigest(repo) {
+			tag := strconv.Itoa(imageMajor)
+			if cfg.PgDumpImageTag == config.ImageTagMinor && imageMajor == major && minorPart != "" {
+				tag = pgVersion
+			}
+			image = fmt.Sprintf("%s:%s", repo, tag)
+		}
+	}
+
+	if cfg.RequireImageDigest && docker.ImageDigest(image) == "" {
+		return "", fmt.Errorf("dump image %s is not pinned to a digest (REQUIRE_IMAGE_DIGEST is enabled)", image)
+	}
+
+	return image, nil
+}
@@ -0,0 +1,22 @@
+package backup
+
+import "testing"
+
+func TestFormatServerVersion(t *testing.T) {
+	tests := []struct {
+		versionNum int
+		want       string
+	}{
+		{versionNum: 170004, want: "17.4"},
+		{versionNum: 180000, want: "18.0"},
+		{versionNum: 100023, want: "10.23"},
+		{versionNum: 90624, want: "9.6.24"},
+		{versionNum: 90500, want: "9.5.0"},
+		{versionNum: 80423, want: "8.4.23"},
+	}
+	for _, tt := range tests {
+		if got := formatServerVersion(tt.versionNum); got != tt.want {
+			t.Errorf("formatServerVersion(%d) = %q, want %q", tt.versionNum, got, tt.want)
+		}
+	}
+}
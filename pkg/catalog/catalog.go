@@ -0,0 +1,378 @@
+// Package catalog lists the backups in a backup directory. The manifests on
+// disk are the only index.
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes one backup run found on disk, built from its manifest.
+type Entry struct {
+	Project    string `json:"project"`
+	Date       string `json:"date"`
+	RunID      string `json:"run_id"`
+	Status     string `json:"status"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	DurationMs int64  `json:"duration_ms"`
+	SizeBytes  int64  `json:"size_bytes"`
+	Error      string `json:"error,omitempty"`
+	// BackupType is "full" or "incremental" for backups taken in incremental
+	// mode. Incremental backups depend on ParentRunID and, through it, on the
+	// full backup BaseRunID
+	BackupType   string `json:"backup_type,omitempty"`
+	BaseRunID    string `json:"base_run_id,omitempty"`
+	ParentRunID  string `json:"parent_run_id,omitempty"`
+	Dir          string `json:"-"`
+	ManifestPath string `json:"-"`
+	ArchivePath  string `json:"-"`
+
+	// Tags are the labels the backup was triggered with
+	Tags []string `json:"tags,omitempty"`
+	// Pin is set for backups pinned via the API, see Pinned
+	Pin *Pin `json:"pin,omitempty"`
+	// ImportFormat is set for backups adopted by `cli import` or
+	// IMPORT_SCAN: archive, sql, sql.gz or custom
+	ImportFormat string `json:"import_format,omitempty"`
+	// Files are the paths of all files of the backup, including ones in
+	// foreign formats that have no ArchivePath. Parts of a split archive are
+	// listed in order
+	Files []string `json:"-"`
+	// Stats are the sizes and speeds recorded for the backup; nil for
+	// backups taken before they were recorded
+	Stats *Stats `json:"stats,omitempty"`
+	// LogPath is the backup's run log (RUN_LOGS), if it has one
+	LogPath string `json:"-"`
+	// StoredIn are the storage targets ("local" and remote ones) a copy of
+	// the backup was stored to successfully
+	StoredIn []string `json:"-"`
+	// PhaseMs is how long each phase of the backup took in milliseconds
+	PhaseMs map[string]int64 `json:"phase_ms,omitempty"`
+	// Instance is the INSTANCE_NAME of the scheduler that took the backup
+	Instance string `json:"instance,omitempty"`
+}
+
+// Stats are the sizes and speeds of a backup (the manifest's stats and
+// storage results).
+type Stats struct {
+	DumpBytes        int64   `json:"dump_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	DumpMs           int64   `json:"dump_ms"`
+	DumpMBPerSec     float64 `json:"dump_mb_per_s"`
+	// UploadMBPerSec is the archive upload throughput per remote target
+	UploadMBPerSec map[string]float64 `json:"upload_mb_per_s,omitempty"`
+}
+
+// dateLayout is the format of backup dates.
+const dateLayout = "2006-01-02"
+
+// manifestFields is the subset of backup.BackupManifest the catalog needs
+type manifestFields struct {
+	RunID      string `json:"run_id"`
+	Status     string `json:"status"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error"`
+	Files      []struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+	Parts []struct {
+		Name string `json:"name"`
+	} `json:"parts"`
+	Incremental *struct {
+		Type        string `json:"type"`
+		BaseRunID   string `json:"base_run_id"`
+		ParentRunID string `json:"parent_run_id"`
+	} `json:"incremental"`
+	Tags     []string `json:"tags"`
+	Imported *struct {
+		Format string `json:"format"`
+	} `json:"imported"`
+	Stats   *Stats           `json:"stats"`
+	PhaseMs map[string]int64 `json:"phase_ms"`
+	Storage []struct {
+		Target   string  `json:"target"`
+		Status   string  `json:"status"`
+		MBPerSec float64 `json:"mb_per_s"`
+	} `json:"storage"`
+	Instance string `json:"instance"`
+}
+
+// ValidName reports whether a project name or run ID from user input is safe
+// to use as a path component.
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// List returns all backups of a project ordered from oldest to newest. The
+// project directory is searched recursively, so any layout (LAYOUT_TEMPLATE)
+// that keeps manifests under it is found.
+func List(baseDir, project string) ([]*Entry, error) {
+	projectDir := filepath.Join(baseDir, project)
+	if _, err := os.Stat(projectDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read project directory: %w", err)
+	}
+
+	var entries []*Entry
+	err := filepath.WalkDir(projectDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read backup directory %s: %w", path, err)
+		}
+		name := d.Name()
+		if d.IsDir() || !strings.HasPrefix(name, "manifest-") || !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+		entry, err := readEntry(project, filepath.Dir(path), name)
+		if err != nil {
+			// A single unreadable manifest shouldn't hide every other backup
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].startTime().Before(entries[j].startTime())
+	})
+	return entries, nil
+}
+
+// Get returns the backup with the given run ID, or nil if it doesn't exist.
+func Get(baseDir, project, runID string) (*Entry, error) {
+	entries, err := List(baseDir, project)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.RunID == runID {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// LastSuccessful returns the newest successful backup of a project, or nil.
+func LastSuccessful(baseDir, project string) (*Entry, error) {
+	entries, err := List(baseDir, project)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Status == "success" {
+			return entries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func readEntry(project, dir, manifestName string) (*Entry, error) {
+	manifestPath := filepath.Join(dir, manifestName)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest manifestFields
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Project:      project,
+		Date:         backupDate(project, manifest.RunID, dir, manifest.StartedAt),
+		RunID:        manifest.RunID,
+		Status:       manifest.Status,
+		StartedAt:    localTimestamp(manifest.StartedAt),
+		FinishedAt:   localTimestamp(manifest.FinishedAt),
+		DurationMs:   manifest.DurationMs,
+		Error:        manifest.Error,
+		Tags:         manifest.Tags,
+		Dir:          dir,
+		ManifestPath: manifestPath,
+		PhaseMs:      manifest.PhaseMs,
+		Instance:     manifest.Instance,
+	}
+	if manifest.Incremental != nil {
+		entry.BackupType = manifest.Incremental.Type
+		entry.BaseRunID = manifest.Incremental.BaseRunID
+		entry.ParentRunID = manifest.Incremental.ParentRunID
+	}
+	if manifest.Imported != nil {
+		entry.ImportFormat = manifest.Imported.Format
+	}
+	if manifest.Stats != nil {
+		entry.Stats = manifest.Stats
+		for _, stored := range manifest.Storage {
+			if stored.MBPerSec > 0 {
+				if entry.Stats.UploadMBPerSec == nil {
+					entry.Stats.UploadMBPerSec = make(map[string]float64)
+				}
+				entry.Stats.UploadMBPerSec[stored.Target] = stored.MBPerSec
+			}
+		}
+	}
+	for _, stored := range manifest.Storage {
+		if stored.Status == "success" {
+			entry.StoredIn = append(entry.StoredIn, stored.Target)
+		}
+	}
+	entry.Pin = readPin(dir, manifest.RunID)
+	for _, file := range manifest.Files {
+		entry.SizeBytes += file.Size
+		entry.Files = append(entry.Files, filepath.Join(dir, file.Name))
+		if strings.HasSuffix(file.Name, ".tar.gz") {
+			entry.ArchivePath = filepath.Join(dir, file.Name)
+		}
+	}
+	// A split archive is only on disk as its parts
+	for _, part := range manifest.Parts {
+		entry.Files = append(entry.Files, filepath.Join(dir, part.Name))
+	}
+	if logPath := filepath.Join(dir, RunLogName(manifest.RunID)); fileExists(logPath) {
+		entry.LogPath = logPath
+		entry.Files = append(entry.Files, logPath)
+	}
+	return entry, nil
+}
+
+// RunLogName is the name of a backup's run log next to its manifest.
+func RunLogName(runID string) string {
+	return fmt.Sprintf("log-%s.log", runID)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// backupDate returns the date a backup belongs to: the one in its run ID
+// (<project>-<date>-<time>), which the default layout names its directory
+// after, else the directory name if it is a date, else the start date.
+func backupDate(project, runID, dir, startedAt string) string {
+	if rest, ok := strings.CutPrefix(runID, project+"-"); ok && len(rest) >= len(dateLayout) {
+		if _, err := time.Parse(dateLayout, rest[:len(dateLayout)]); err == nil {
+			return rest[:len(dateLayout)]
+		}
+	}
+	if _, err := time.Parse(dateLayout, filepath.Base(dir)); err == nil {
+		return filepath.Base(dir)
+	}
+	if t, err := time.Parse(time.RFC3339, startedAt); err == nil {
+		return t.Local().Format(dateLayout)
+	}
+	return ""
+}
+
+// localTimestamp rewrites an RFC 3339 timestamp in the local zone
+// (TIMESTAMP_TZ), so manifests written under another zone are reported
+// consistently. Other values are returned unchanged.
+func localTimestamp(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func (e *Entry) startTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, e.StartedAt)
+	return t
+}
+
+// Ancestors returns the backups entry depends on, from its parent back to the
+// full backup, looked up in entries (as returned by List). missing is the run
+// ID of the first ancestor that isn't among them, if any.
+func Ancestors(entries []*Entry, entry *Entry) (ancestors []*Entry, missing string) {
+	byRunID := make(map[string]*Entry, len(entries))
+	for _, e := range entries {
+		byRunID[e.RunID] = e
+	}
+	for parentRunID := entry.ParentRunID; parentRunID != ""; {
+		parent := byRunID[parentRunID]
+		if parent == nil || len(ancestors) == len(entries) {
+			// The length check stops manifests whose parents form a cycle
+			return ancestors, parentRunID
+		}
+		ancestors = append(ancestors, parent)
+		parentRunID = parent.ParentRunID
+	}
+	return ancestors, ""
+}
+
+// HasTags reports whether the backup carries all of tags.
+func (e *Entry) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(e.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Restorable reports whether the backup can be restored from its local copy:
+// it succeeded, or is partial (stored locally but an upload to a remote
+// failed), and its files are on disk. An archive that fails verification
+// makes the backup failed, so a restorable one has been read back.
+func (e *Entry) Restorable() bool {
+	if e.Status != "success" && e.Status != "partial" || len(e.Files) == 0 {
+		return false
+	}
+	// A split archive is only on disk as its parts
+	split := false
+	for _, file := range e.Files {
+		if e.ArchivePath != "" && strings.HasPrefix(file, e.ArchivePath+".part") {
+			split = true
+		}
+	}
+	for _, file := range e.Files {
+		if split && file == e.ArchivePath {
+			continue
+		}
+		if !fileExists(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// FinishedTime parses FinishedAt, returning the zero time if it is unset.
+func (e *Entry) FinishedTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, e.FinishedAt)
+	return t
+}
+
+// Projects returns the names of all projects with a backup directory in
+// baseDir, sorted. Service directories (metadata, .tmp) are skipped.
+func Projects(baseDir string) ([]string, error) {
+	dirs, err := os.ReadDir(baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var projects []string
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == "metadata" || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		projects = append(projects, dir.Name())
+	}
+	return projects, nil
+}
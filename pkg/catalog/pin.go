@@ -0,0 +1,78 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+)
+
+// Pin exempts a backup from retention, e.g. a snapshot taken before a
+// migration that has to be kept for a year. It is stored next to the
+// manifest as pin-<run_id>.json, so signed manifests stay untouched.
+type Pin struct {
+	PinnedAt string `json:"pinned_at"`
+	// Until is when the pin expires (RFC 3339); empty pins hold forever
+	Until  string `json:"until,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Active reports whether the pin still holds at now.
+func (p *Pin) Active(now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	if p.Until == "" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, p.Until)
+	return err != nil || now.Before(until)
+}
+
+// Pinned reports whether retention must keep the backup at now.
+func (e *Entry) Pinned(now time.Time) bool {
+	return e.Pin.Active(now)
+}
+
+func pinPath(dir, runID string) string {
+	return filepath.Join(dir, fmt.Sprintf("pin-%s.json", runID))
+}
+
+func readPin(dir, runID string) *Pin {
+	data, err := os.ReadFile(pinPath(dir, runID))
+	if err != nil {
+		return nil
+	}
+	var pin Pin
+	if err := json.Unmarshal(data, &pin); err != nil {
+		// An unreadable pin file still pins: keeping a backup too long is
+		// better than deleting one that was meant to be kept
+		return &Pin{}
+	}
+	return &pin
+}
+
+// SetPin pins entry, replacing an existing pin.
+func SetPin(entry *Entry, pin *Pin) error {
+	data, err := json.MarshalIndent(pin, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pin: %w", err)
+	}
+	if err := durable.WriteFile(pinPath(entry.Dir, entry.RunID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write pin: %w", err)
+	}
+	entry.Pin = pin
+	return nil
+}
+
+// RemovePin unpins entry. Removing a missing pin is not an error.
+func RemovePin(entry *Entry) error {
+	if err := os.Remove(pinPath(entry.Dir, entry.RunID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove pin: %w", err)
+	}
+	entry.Pin = nil
+	return nil
+}
@@ -0,0 +1,1108 @@
+// Package config loads the service configuration from the environment. A
+// Config from Load can be adjusted in code before it is passed to
+// service.New.
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/logfile"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Config struct {
+	// Backup Configuration
+	RetentionDays int
+	// RetentionCron runs retention as its own scheduled job; when empty it
+	// runs at the end of every backup job
+	RetentionCron string
+	// RetentionMaxBytes caps the size of all projects' backups together;
+	// BACKUP_<PROJECT>_RETENTION_MAX_BYTES caps one project. 0 disables
+	RetentionMaxBytes int64
+	// KeepLastSuccess makes retention keep each project's newest successful
+	// backup even when it is older than the retention period
+	KeepLastSuccess bool
+
+	// Scheduling
+	BackupCron string
+	TZ         string
+	Catchup    bool
+
+	// TimestampTZ is the zone of run IDs, date directories, manifests and
+	// API timestamps; empty means TZ
+	TimestampTZ string
+
+	// ScheduleJitter delays each scheduled run by a random amount up to this duration
+	ScheduleJitter time.Duration
+	// BlackoutWindows defers scheduled runs, e.g. "Mon-Fri 08:00-20:00; Sun 00:00-04:00"
+	BlackoutWindows string
+
+	// Timeouts (0 disables): BackupTimeout bounds one project's dump,
+	// RunTimeout a whole backup job across all projects
+	BackupTimeout time.Duration
+	RunTimeout    time.Duration
+	// ShutdownGracePeriod is how long a shutdown waits for running backups
+	// and API requests before cancelling them
+	ShutdownGracePeriod time.Duration
+
+	// Storage: LayoutTemplate places backups under LocalBackupDir and on
+	// remotes (empty means <project>/<date>/backup-<run_id>.tar.gz).
+	// ImportScan adopts unregistered backup files found under LocalBackupDir
+	// at startup
+	LocalBackupDir string
+	LayoutTemplate string
+	ImportScan     bool
+
+	// Dumps are written to temp directories under StagingDir
+	// (LocalBackupDir/.tmp if empty) and moved into place when done. Temp
+	// directories untouched for TempMaxAge are left over from crashed runs
+	// and removed at startup and every TempCleanupInterval (0 disables the
+	// periodic cleanup)
+	StagingDir          string
+	TempMaxAge          time.Duration
+	TempCleanupInterval time.Duration
+
+	// ArchiveSplitBytes splits archives larger than this into parts for
+	// stores with object-size limits; 0 keeps single archives
+	ArchiveSplitBytes int64
+	// CompressionLevel is the archives' gzip level, from 1 (fastest) to 9
+	// (smallest)
+	CompressionLevel int
+	// ArchiveVerify reads every archive back after writing it
+	ArchiveVerify bool
+	// DurableWrites fsyncs archives, manifests and metadata files and their
+	// directories, so a host crash can't undo a finished backup
+	DurableWrites bool
+
+	// Remote storage (rclone)
+	RcloneRemote string
+	RcloneBinary string
+	RcloneFlags  string
+	RcloneVerify bool
+	// ShareURLTTL is how long URLs from POST .../share stay valid at most
+	ShareURLTTL time.Duration
+
+	// SigningKeyFile is a PEM Ed25519 private key used to sign manifests
+	SigningKeyFile string
+
+	// Dump image
+	PgDumpImage        string
+	PgDumpImages       map[string]string // per-major overrides from PGDUMP_IMAGE_<MAJOR> or IMAGE_MAP_<MAJOR>
+	RequireImageDigest bool
+	ImagePullPolicy    string
+
+	// RegistryAuthFile is a Docker config.json with credentials for private
+	// registries; empty reads the Docker CLI's own file if there is one
+	RegistryAuthFile string
+
+	// NetworkMode is how helper containers reach databases: auto, host or bridge
+	NetworkMode string
+
+	// Logging
+	LogLevel  string
+	LogFormat string
+
+	// LogFile also writes logs to this file, rotated at LogMaxSizeBytes
+	// keeping LogMaxBackups rotated files
+	LogFile         string
+	LogMaxSizeBytes int64
+	LogMaxBackups   int
+	// RunLogs keeps the log of each backup next to its archive
+	RunLogs bool
+
+	// Service
+	ServicePort int
+
+	// APITokens maps API bearer tokens to their role (read, operator or
+	// admin). The API is unauthenticated when empty
+	APITokens map[string]string
+
+	// API rate limiting per client (token or IP): requests per second and
+	// burst; 0 disables. APIMaxConcurrentRuns caps backups triggered through
+	// the API that run at the same time (0 = no cap)
+	APIRateLimit         float64
+	APIRateBurst         int
+	APIMaxConcurrentRuns int
+
+	// API server timeouts (0 = none). Streaming responses (dumps, archive
+	// files, logs, exports) are exempt from APIWriteTimeout
+	APIReadTimeout  time.Duration
+	APIWriteTimeout time.Duration
+	APIIdleTimeout  time.Duration
+	// APIMaxHeaderBytes and APIMaxBodyBytes limit the size of request
+	// headers and bodies (0 = Go's default of 1MB for headers, no limit for
+	// bodies)
+	APIMaxHeaderBytes int64
+	APIMaxBodyBytes   int64
+
+	// Message bus (nats:// or redis:// URL; empty disables): backup requests
+	// are consumed from MessageBusSubject, completion events published to
+	// MessageBusEventsSubject. MessageBusGroup is the Redis consumer group,
+	// the hostname if empty
+	MessageBusURL           string
+	MessageBusSubject       string
+	MessageBusEventsSubject string
+	MessageBusGroup         string
+
+	// EventsURL receives lifecycle events (run started, backup succeeded or
+	// failed, upload completed, retention pruned): an http(s) webhook, or a
+	// nats:// or redis:// URL publishing to EventsSubject. Empty disables
+	EventsURL     string
+	EventsSubject string
+
+	// PushgatewayURL is a Prometheus Pushgateway the metrics are pushed to
+	// after every backup, grouped under job PushgatewayJob. Empty disables
+	PushgatewayURL string
+	PushgatewayJob string
+
+	// InstanceName identifies this scheduler (environment, cluster) when
+	// several share a bucket or monitoring: it is appended to run IDs,
+	// recorded in manifests, prefixed to remote keys and added to metrics.
+	// Lowercase letters, digits, "-" and "_"; empty leaves all of them as
+	// they were
+	InstanceName string
+
+	// Dump options
+	DataDumpStyle     string
+	RolesDump         string
+	RolesDumpOptional bool
+	Provider          string
+	// DumpEnv (NAME=value;...) is added to the environment of the dump
+	// containers, DumpArgs (whitespace-separated flags) to both pg_dump runs
+	DumpEnv  string
+	DumpArgs string
+
+	// ExactRowCounts records per-table row counts with count(*) instead of
+	// pg_stat_user_tables estimates
+	ExactRowCounts bool
+
+	// PoolerCheck rejects connection URLs that look like a transaction-mode
+	// pooler (PgBouncer, Supavisor) unless a DIRECT_URL is configured
+	PoolerCheck bool
+
+	// SharedSnapshot dumps schema and data from one exported snapshot
+	SharedSnapshot bool
+
+	// LargeObjects is auto (pg_dump's default), include or exclude
+	LargeObjects string
+
+	// SchemaDrift compares each backup's schema with the previous one's;
+	// changes are POSTed to SchemaDriftURL if set
+	SchemaDrift    bool
+	SchemaDriftURL string
+
+	// BackupMode is full or incremental. In incremental mode the tables in
+	// IncrementalTables ("schema.table:column,...") only get the rows added
+	// since the previous backup
+	BackupMode        string
+	IncrementalTables string
+	// FullBackupDays ("Sun", "Sat,Sun") and FullBackupAfter (a number of
+	// incremental backups, 0 = unlimited) force the next backup in
+	// incremental mode to be full
+	FullBackupDays  string
+	FullBackupAfter int
+
+	// Load-based throttling: dumps wait and pause while the source has more
+	// than ThrottleMaxActive active connections or a replication lag above
+	// ThrottleMaxLag (0 disables each), checked every ThrottleInterval. After
+	// ThrottleMaxWait of waiting in total the dump continues regardless
+	ThrottleMaxActive int
+	ThrottleMaxLag    time.Duration
+	ThrottleInterval  time.Duration
+	ThrottleMaxWait   time.Duration
+
+	// AdvisoryLock is an advisory lock taken on the source database while
+	// the dumps run: a bigint key, or a name locked as hashtext(name); empty
+	// or "none" takes none. AdvisoryLockTimeout is how long to wait for it
+	// (0 tries once) before the backup fails
+	AdvisoryLock        string
+	AdvisoryLockTimeout time.Duration
+
+	// Restore rehearsals: RehearsalCron restores each project's latest backup
+	// into a throwaway container (empty disables), bounded by RehearsalTimeout.
+	// A summary of the previous month is POSTed to RehearsalReportURL on
+	// RehearsalReportCron
+	RehearsalCron       string
+	RehearsalTimeout    time.Duration
+	RehearsalReportURL  string
+	RehearsalReportCron string
+
+	// Digest reports: on DigestCron, a summary of all projects over the past
+	// DigestPeriod is POSTed to DigestURL (JSON with a Markdown "text") and
+	// emailed as HTML to DigestEmailTo (comma-separated addresses) through
+	// the SMTP server
+	DigestCron    string
+	DigestPeriod  time.Duration
+	DigestURL     string
+	DigestEmailTo string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPUsername  string
+	SMTPPassword  string
+	SMTPFrom      string
+
+	// Post-restore hooks: RestoreAnalyze runs ANALYZE on the restored
+	// database, RestoreRefreshMatviews refreshes its materialized views, and
+	// RestoreValidationSQL lists SQL files (comma-separated paths or globs)
+	// run against it, failing the restore if one fails
+	RestoreAnalyze         bool
+	RestoreRefreshMatviews bool
+	RestoreValidationSQL   string
+
+	// RPOTarget is how old a project's latest successful backup may get
+	// before its recovery point objective counts as breached; 0 sets none
+	RPOTarget time.Duration
+
+	// Databases (parsed from env)
+	Databases map[string]string
+
+	// Per-project overrides (BACKUP_<PROJECT>_<OPTION>), keyed by project then option
+	ProjectOptions map[string]map[string]string
+
+	// Group settings (GROUP_<NAME>_<OPTION>), keyed by lowercased group then
+	// option. Projects join a group with BACKUP_<PROJECT>_GROUP
+	GroupOptions map[string]map[string]string
+
+	// Namespace settings (NAMESPACE_<NAME>_<OPTION>), keyed by lowercased
+	// namespace then option. Projects join a namespace with
+	// BACKUP_<PROJECT>_NAMESPACE
+	NamespaceOptions map[string]map[string]string
+	// APITokenNamespaces maps the tokens of NAMESPACE_<NAME>_API_TOKENS (also
+	// in APITokens) to their namespace; they only reach its projects
+	APITokenNamespaces map[string]string
+
+	// QuotaPolicy is what happens to a backup that would exceed a project's
+	// or namespace's quota unless its QUOTA_POLICY says otherwise: QuotaReject
+	// or QuotaPrune
+	QuotaPolicy string
+
+	// DumpImageMajors are the PostgreSQL majors dump images are available
+	// for (DUMP_IMAGE_MAJORS), ascending; empty allows any major
+	DumpImageMajors []int
+	// VersionMatch decides what a backup does when the server version can't
+	// be detected: VersionMatchFallback or VersionMatchStrict
+	VersionMatch string
+	// PgDumpImageTag is what PGDUMP_IMAGE repositories are tagged with:
+	// ImageTagMajor ("17") or ImageTagMinor ("17.4")
+	PgDumpImageTag string
+}
+
+// projectOptionNames lists the options that can be overridden per project via
+// BACKUP_<PROJECT>_<OPTION>. Keys matching these are never treated as databases.
+var projectOptionNames = []string{
+	"DATA_DUMP_STYLE",
+	"ROLES_DUMP",
+	"ROLES_DUMP_OPTIONAL",
+	"PROVIDER",
+	"RCLONE_REMOTE",
+	"EXACT_ROW_COUNTS",
+	"BACKUP_TIMEOUT",
+	"DIRECT_URL",
+	"POOLER_CHECK",
+	"SHARED_SNAPSHOT",
+	"BACKUP_MODE",
+	"INCREMENTAL_TABLES",
+	"FULL_BACKUP_DAYS",
+	"FULL_BACKUP_AFTER",
+	"THROTTLE_MAX_ACTIVE",
+	"THROTTLE_MAX_LAG",
+	"THROTTLE_INTERVAL",
+	"THROTTLE_MAX_WAIT",
+	"ADVISORY_LOCK",
+	"ADVISORY_LOCK_TIMEOUT",
+	"GROUP",
+	"RETENTION_MAX_BYTES",
+	"RETENTION_KEEP_LAST_SUCCESS",
+	"REHEARSAL",
+	"REHEARSAL_QUERIES",
+	"RESTORE_ANALYZE",
+	"RESTORE_REFRESH_MATVIEWS",
+	"RESTORE_VALIDATION_SQL",
+	"RPO_TARGET",
+	"DUMP_ENV",
+	"DUMP_ARGS",
+	"ARCHIVE_SPLIT_SIZE",
+	"COMPRESSION_LEVEL",
+	"LARGE_OBJECTS",
+	"SCHEMA_DRIFT",
+	"NAMESPACE",
+	"QUOTA_BYTES",
+	"QUOTA_BACKUPS",
+	"QUOTA_POLICY",
+}
+
+// groupOptionNames lists the settings of a project group (GROUP_<NAME>_<OPTION>).
+var groupOptionNames = []string{
+	"CRON",
+	"RETENTION_DAYS",
+}
+
+// namespaceOptionNames lists the settings of a namespace
+// (NAMESPACE_<NAME>_<OPTION>).
+var namespaceOptionNames = []string{
+	"RETENTION_DAYS",
+	"RETENTION_MAX_BYTES",
+	"RCLONE_REMOTE",
+	"API_TOKENS",
+	"QUOTA_BYTES",
+	"QUOTA_BACKUPS",
+	"QUOTA_POLICY",
+}
+
+func Load() (*Config, error) {
+	localBackupDir := getEnvString("LOCAL_BACKUP_DIR", "./backups")
+
+	cfg := &Config{
+		RetentionDays:        getEnvInt("RETENTION_DAYS", 30),
+		RetentionCron:        getEnvString("RETENTION_CRON", ""),
+		RetentionMaxBytes:    getEnvBytes("RETENTION_MAX_BYTES", 0),
+		KeepLastSuccess:      getEnvBool("RETENTION_KEEP_LAST_SUCCESS", true),
+		BackupCron:           getEnvString("BACKUP_CRON", "30 0 * * *"),
+		TZ:                   getEnvString("TZ", "Europe/Berlin"),
+		TimestampTZ:          getEnvString("TIMESTAMP_TZ", ""),
+		Catchup:              getEnvBool("CATCHUP", false),
+		ScheduleJitter:       getEnvDuration("SCHEDULE_JITTER", 0),
+		BlackoutWindows:      getEnvString("BLACKOUT_WINDOWS", ""),
+		BackupTimeout:        getEnvDuration("BACKUP_TIMEOUT", 0),
+		RunTimeout:           getEnvDuration("RUN_TIMEOUT", 0),
+		ShutdownGracePeriod:  getEnvDuration("SHUTDOWN_GRACE_PERIOD", 5*time.Minute),
+		LocalBackupDir:       localBackupDir,
+		LayoutTemplate:       getEnvString("LAYOUT_TEMPLATE", ""),
+		ImportScan:           getEnvBool("IMPORT_SCAN", false),
+		TempMaxAge:           getEnvDuration("TEMP_MAX_AGE", 24*time.Hour),
+		TempCleanupInterval:  getEnvDuration("TEMP_CLEANUP_INTERVAL", time.Hour),
+		ArchiveSplitBytes:    getEnvBytes("ARCHIVE_SPLIT_SIZE", 0),
+		CompressionLevel:     getEnvInt("COMPRESSION_LEVEL", 6),
+		ArchiveVerify:        getEnvBool("ARCHIVE_VERIFY", true),
+		DurableWrites:        getEnvBool("DURABLE_WRITES", false),
+		RcloneRemote:         getEnvString("RCLONE_REMOTE", ""),
+		RcloneBinary:         getEnvString("RCLONE_BINARY", "rclone"),
+		RcloneFlags:          getEnvString("RCLONE_FLAGS", ""),
+		RcloneVerify:         getEnvBool("RCLONE_VERIFY", true),
+		ShareURLTTL:          getEnvDuration("SHARE_URL_TTL", time.Hour),
+		SigningKeyFile:       getEnvString("SIGNING_KEY_FILE", ""),
+		PgDumpImage:          getEnvString("PGDUMP_IMAGE", "postgres"),
+		RequireImageDigest:   getEnvBool("REQUIRE_IMAGE_DIGEST", false),
+		ImagePullPolicy:      getEnvString("IMAGE_PULL_POLICY", "ifnotpresent"),
+		RegistryAuthFile:     getEnvString("REGISTRY_AUTH_FILE", ""),
+		NetworkMode:          getEnvString("NETWORK_MODE", "auto"),
+		DataDumpStyle:        getEnvString("DATA_DUMP_STYLE", "copy"),
+		RolesDump:            getEnvString("ROLES_DUMP", "all"),
+		RolesDumpOptional:    getEnvBool("ROLES_DUMP_OPTIONAL", false),
+		Provider:             getEnvString("PROVIDER", "auto"),
+		DumpEnv:              getEnvString("DUMP_ENV", ""),
+		DumpArgs:             getEnvString("DUMP_ARGS", ""),
+		ExactRowCounts:       getEnvBool("EXACT_ROW_COUNTS", false),
+		PoolerCheck:          getEnvBool("POOLER_CHECK", true),
+		SharedSnapshot:       getEnvBool("SHARED_SNAPSHOT", true),
+		LargeObjects:         getEnvString("LARGE_OBJECTS", "auto"),
+		SchemaDrift:          getEnvBool("SCHEMA_DRIFT", true),
+		SchemaDriftURL:       getEnvString("SCHEMA_DRIFT_URL", ""),
+		BackupMode:           getEnvString("BACKUP_MODE", "full"),
+		IncrementalTables:    getEnvString("INCREMENTAL_TABLES", ""),
+		FullBackupDays:       getEnvString("FULL_BACKUP_DAYS", ""),
+		FullBackupAfter:      getEnvInt("FULL_BACKUP_AFTER", 0),
+		ThrottleMaxActive:    getEnvInt("THROTTLE_MAX_ACTIVE", 0),
+		ThrottleMaxLag:       getEnvDuration("THROTTLE_MAX_LAG", 0),
+		ThrottleInterval:     getEnvDuration("THROTTLE_INTERVAL", 15*time.Second),
+		ThrottleMaxWait:      getEnvDuration("THROTTLE_MAX_WAIT", time.Hour),
+		RehearsalCron:        getEnvString("REHEARSAL_CRON", ""),
+		RehearsalTimeout:     getEnvDuration("REHEARSAL_TIMEOUT", 2*time.Hour),
+		RehearsalReportURL:   getEnvString("REHEARSAL_REPORT_URL", ""),
+		RehearsalReportCron:  getEnvString("REHEARSAL_REPORT_CRON", "0 8 1 * *"),
+		DigestCron:           getEnvString("DIGEST_CRON", ""),
+		DigestPeriod:         getEnvDuration("DIGEST_PERIOD", 24*time.Hour),
+		DigestURL:            getEnvString("DIGEST_URL", ""),
+		DigestEmailTo:        getEnvString("DIGEST_EMAIL_TO", ""),
+		SMTPHost:             getEnvString("SMTP_HOST", ""),
+		SMTPPort:             getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:         getEnvString("SMTP_USERNAME", ""),
+		SMTPPassword:         getEnvString("SMTP_PASSWORD", ""),
+		SMTPFrom:             getEnvString("SMTP_FROM", ""),
+		LogLevel:             getEnvString("LOG_LEVEL", "INFO"),
+		LogFormat:            getEnvString("LOG_FORMAT", "json"),
+		LogFile:              getEnvString("LOG_FILE", ""),
+		LogMaxSizeBytes:      getEnvBytes("LOG_MAX_SIZE", 100*1000*1000),
+		LogMaxBackups:        getEnvInt("LOG_MAX_BACKUPS", 5),
+		RunLogs:              getEnvBool("RUN_LOGS", true),
+		ServicePort:          getEnvInt("SERVICE_PORT", 8080),
+		APIRateLimit:         getEnvFloat("API_RATE_LIMIT", 5),
+		APIRateBurst:         getEnvInt("API_RATE_BURST", 20),
+		MessageBusURL:        getEnvString("MESSAGE_BUS_URL", ""),
+		MessageBusSubject:    getEnvString("MESSAGE_BUS_SUBJECT", "pg-backup.requests"),
+		MessageBusGroup:      getEnvString("MESSAGE_BUS_GROUP", ""),
+		APIMaxConcurrentRuns: getEnvInt("API_MAX_CONCURRENT_RUNS", 1),
+		APIReadTimeout:       getEnvDuration("API_READ_TIMEOUT", 10*time.Second),
+		APIWriteTimeout:      getEnvDuration("API_WRITE_TIMEOUT", 10*time.Second),
+		APIIdleTimeout:       getEnvDuration("API_IDLE_TIMEOUT", 60*time.Second),
+		APIMaxHeaderBytes:    getEnvBytes("API_MAX_HEADER_SIZE", 64*1000),
+		APIMaxBodyBytes:      getEnvBytes("API_MAX_BODY_SIZE", 1000*1000),
+		QuotaPolicy:          strings.ToLower(getEnvString("QUOTA_POLICY", QuotaReject)),
+		VersionMatch:         strings.ToLower(getEnvString("VERSION_MATCH", VersionMatchFallback)),
+		PgDumpImageTag:       strings.ToLower(getEnvString("PGDUMP_IMAGE_TAG", ImageTagMajor)),
+	}
+
+	// Parse per-major dump image overrides
+	images, err := getDumpImageConfigs()
+	if err != nil {
+		return nil, err
+	}
+	cfg.PgDumpImages = images
+	majors, err := parseMajors(getEnvString("DUMP_IMAGE_MAJORS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DUMP_IMAGE_MAJORS: %w", err)
+	}
+	cfg.DumpImageMajors = majors
+
+	// Parse database configurations
+	cfg.Databases = getDatabaseConfigs()
+	cfg.ProjectOptions = getProjectOptions()
+	cfg.GroupOptions = getNamedOptions("GROUP_", groupOptionNames)
+	cfg.NamespaceOptions = getNamedOptions("NAMESPACE_", namespaceOptionNames)
+
+	apiTokens, err := getAPITokens(getEnvString("API_TOKENS", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.APITokens = apiTokens
+	if err := cfg.addNamespaceTokens(); err != nil {
+		return nil, err
+	}
+	cfg.MessageBusEventsSubject = getEnvString("MESSAGE_BUS_EVENTS_SUBJECT", "pg-backup.events")
+	cfg.EventsURL = getEnvString("EVENTS_URL", "")
+	cfg.EventsSubject = getEnvString("EVENTS_SUBJECT", "pg-backup.lifecycle")
+	cfg.PushgatewayURL = strings.TrimRight(getEnvString("PUSHGATEWAY_URL", ""), "/")
+	cfg.PushgatewayJob = getEnvString("PUSHGATEWAY_JOB", "pg_backup_scheduler")
+	cfg.AdvisoryLock = getEnvString("ADVISORY_LOCK", "")
+	cfg.AdvisoryLockTimeout = getEnvDuration("ADVISORY_LOCK_TIMEOUT", 10*time.Minute)
+	cfg.InstanceName = strings.ToLower(getEnvString("INSTANCE_NAME", ""))
+	cfg.StagingDir = getEnvString("STAGING_DIR", "")
+	cfg.RestoreAnalyze = getEnvBool("RESTORE_ANALYZE", false)
+	cfg.RestoreRefreshMatviews = getEnvBool("RESTORE_REFRESH_MATVIEWS", false)
+	cfg.RestoreValidationSQL = getEnvString("RESTORE_VALIDATION_SQL", "")
+	cfg.RPOTarget = getEnvDuration("RPO_TARGET", 0)
+	if cfg.InstanceName != "" && !instanceName.MatchString(cfg.InstanceName) {
+		return nil, fmt.Errorf("invalid INSTANCE_NAME %q: use letters, digits, \"-\" and \"_\", starting with a letter or digit", cfg.InstanceName)
+	}
+
+	// Resolve absolute path for backup directory. Forward slashes are accepted
+	// on Windows too, and a path without a drive letter such as /backups
+	// resolves against the current drive
+	localBackupDir, err = filepath.Abs(filepath.FromSlash(cfg.LocalBackupDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve LOCAL_BACKUP_DIR: %w", err)
+	}
+	cfg.LocalBackupDir = localBackupDir
+	if cfg.StagingDir != "" {
+		stagingDir, err := filepath.Abs(filepath.FromSlash(cfg.StagingDir))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve STAGING_DIR: %w", err)
+		}
+		cfg.StagingDir = stagingDir
+	}
+
+	return cfg, nil
+}
+
+func getEnvString(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBytes(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if bytesValue, err := ParseBytes(value); err == nil {
+			return bytesValue
+		}
+	}
+	return defaultValue
+}
+
+// byteUnits are the suffixes ParseBytes accepts, longest first.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseBytes parses a size like "500000", "50GB" (powers of 1000), "50GiB"
+// or "50G" (powers of 1024).
+func ParseBytes(value string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(upper, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// API roles, from least to most privileged
+const (
+	RoleRead     = "read"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// RoleRank orders API roles so that each one includes the ones below it;
+// unknown roles rank 0.
+func RoleRank(role string) int {
+	switch role {
+	case RoleRead:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// getAPITokens parses API_TOKENS, a comma-separated list of role:token pairs
+// such as "read:abc,admin:def".
+func getAPITokens(value string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, token, ok := strings.Cut(entry, ":")
+		role = strings.ToLower(strings.TrimSpace(role))
+		token = strings.TrimSpace(token)
+		if !ok || token == "" {
+			return nil, fmt.Errorf("invalid API_TOKENS entry (expected role:token)")
+		}
+		if RoleRank(role) == 0 {
+			return nil, fmt.Errorf("invalid API token role %q (expected read, operator or admin)", role)
+		}
+		tokens[token] = role
+	}
+	return tokens, nil
+}
+
+// getDumpImageConfigs reads per-major dump images from PGDUMP_IMAGE_<MAJOR>
+// and its alias IMAGE_MAP_<MAJOR>. Setting both for one major to different
+// images is an error rather than a silent pick.
+func getDumpImageConfigs() (map[string]string, error) {
+	images := make(map[string]string)
+	sources := make(map[string]string)
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		if value == "" {
+			continue
+		}
+		var major string
+		switch {
+		case strings.HasPrefix(key, "PGDUMP_IMAGE_"):
+			major = strings.TrimPrefix(key, "PGDUMP_IMAGE_")
+		case strings.HasPrefix(key, "IMAGE_MAP_"):
+			major = strings.TrimPrefix(key, "IMAGE_MAP_")
+		default:
+			continue
+		}
+		// Only numeric suffixes are major versions (PGDUMP_IMAGE_17=...)
+		if _, err := strconv.Atoi(major); err != nil {
+			continue
+		}
+		if existing, ok := images[major]; ok && existing != value {
+			return nil, fmt.Errorf("%s and %s set different images for PostgreSQL %s", sources[major], key, major)
+		}
+		images[major] = value
+		sources[major] = key
+	}
+	return images, nil
+}
+
+// parseMajors parses a comma-separated list of major versions ("15,16,17")
+// into ascending order.
+func parseMajors(value string) ([]int, error) {
+	var majors []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		major, err := strconv.Atoi(field)
+		if err != nil || major < 1 {
+			return nil, fmt.Errorf("%q is not a major version", field)
+		}
+		if !slices.Contains(majors, major) {
+			majors = append(majors, major)
+		}
+	}
+	slices.Sort(majors)
+	return majors, nil
+}
+
+func getDatabaseConfigs() map[string]string {
+	configs := make(map[string]string)
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		if !strings.HasPrefix(strings.ToUpper(key), "BACKUP_") {
+			continue
+		}
+		// Extract project name (everything after BACKUP_)
+		projectName := key[7:] // Remove "BACKUP_" prefix
+		if _, _, ok := splitProjectOption(projectName); ok {
+			continue
+		}
+		// Only treat as a database if the value is a connection string
+		if projectName != "" && isConnString(strings.TrimSpace(value)) {
+			projectNameLower := strings.ToLower(projectName)
+			configs[projectNameLower] = strings.TrimSpace(value)
+		}
+	}
+	return configs
+}
+
+// dsnKeyword matches a libpq key/value DSN naming a server, database or
+// service ("host=db dbname=app", "service=prod").
+// instanceName matches valid INSTANCE_NAME values, which end up in file
+// names and remote keys.
+var instanceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+var dsnKeyword = regexp.MustCompile(`(^|\s)(host|hostaddr|dbname|service)\s*=`)
+
+// isConnString reports whether value is a connection URL or key/value DSN.
+func isConnString(value string) bool {
+	if strings.HasPrefix(value, "postgresql://") || strings.HasPrefix(value, "postgres://") {
+		return true
+	}
+	return dsnKeyword.MatchString(value)
+}
+
+// splitProjectOption splits "<PROJECT>_<OPTION>" (the part after BACKUP_) into
+// the lowercased project name and the option name. The longest matching option
+// wins so that options sharing a suffix stay unambiguous.
+func splitProjectOption(name string) (string, string, bool) {
+	upper := strings.ToUpper(name)
+	var project, option string
+	for _, opt := range projectOptionNames {
+		suffix := "_" + opt
+		if len(upper) > len(suffix) && strings.HasSuffix(upper, suffix) && len(opt) > len(option) {
+			project = strings.ToLower(name[:len(name)-len(suffix)])
+			option = opt
+		}
+	}
+	return project, option, option != ""
+}
+
+func getProjectOptions() map[string]map[string]string {
+	options := make(map[string]map[string]string)
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		if !strings.HasPrefix(strings.ToUpper(key), "BACKUP_") || value == "" {
+			continue
+		}
+		project, option, ok := splitProjectOption(key[7:])
+		if !ok {
+			continue
+		}
+		if options[project] == nil {
+			options[project] = make(map[string]string)
+		}
+		options[project][option] = value
+	}
+	return options
+}
+
+// getNamedOptions collects the <PREFIX><NAME>_<OPTION> settings of groups
+// (GROUP_) or namespaces (NAMESPACE_), keyed by lowercased name then option.
+func getNamedOptions(prefix string, optionNames []string) map[string]map[string]string {
+	options := make(map[string]map[string]string)
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.ToUpper(parts[0]), strings.TrimSpace(parts[1])
+		if !strings.HasPrefix(key, prefix) || value == "" {
+			continue
+		}
+		name := key[len(prefix):]
+		for _, opt := range optionNames {
+			suffix := "_" + opt
+			if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+				owner := strings.ToLower(name[:len(name)-len(suffix)])
+				if options[owner] == nil {
+					options[owner] = make(map[string]string)
+				}
+				options[owner][opt] = value
+			}
+		}
+	}
+	return options
+}
+
+// addNamespaceTokens adds the tokens of every NAMESPACE_<NAME>_API_TOKENS
+// to APITokens, recording their namespace in APITokenNamespaces.
+func (c *Config) addNamespaceTokens() error {
+	c.APITokenNamespaces = make(map[string]string)
+	for _, namespace := range slices.Sorted(maps.Keys(c.NamespaceOptions)) {
+		tokens, err := getAPITokens(c.NamespaceOptions[namespace]["API_TOKENS"])
+		if err != nil {
+			return fmt.Errorf("NAMESPACE_%s_API_TOKENS: %w", strings.ToUpper(namespace), err)
+		}
+		for token, role := range tokens {
+			if _, ok := c.APITokens[token]; ok {
+				return fmt.Errorf("NAMESPACE_%s_API_TOKENS: a token is also configured elsewhere", strings.ToUpper(namespace))
+			}
+			c.APITokens[token] = role
+			c.APITokenNamespaces[token] = namespace
+		}
+	}
+	return nil
+}
+
+// ProjectOption returns the BACKUP_<PROJECT>_<OPTION> override for a project,
+// or defaultValue (usually the global setting) if none is set.
+func (c *Config) ProjectOption(project, option, defaultValue string) string {
+	if value, ok := c.ProjectOptions[project][option]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// ProjectOptionBool is ProjectOption for boolean settings. Unparseable values
+// fall back to defaultValue.
+func (c *Config) ProjectOptionBool(project, option string, defaultValue bool) bool {
+	if value, ok := c.ProjectOptions[project][option]; ok {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// ProjectOptionInt is ProjectOption for integers. Unparseable values fall
+// back to defaultValue.
+func (c *Config) ProjectOptionInt(project, option string, defaultValue int) int {
+	if value, ok := c.ProjectOptions[project][option]; ok {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return intValue
+		}
+	}
+	return defaultValue
+}
+
+// ProjectOptionDuration is ProjectOption for durations. Unparseable values
+// fall back to defaultValue.
+func (c *Config) ProjectOptionDuration(project, option string, defaultValue time.Duration) time.Duration {
+	if value, ok := c.ProjectOptions[project][option]; ok {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
+
+// ApplyTimestampZone makes TimestampTZ (or TZ) the process's local time zone,
+// so every timestamp and date derived from time.Now() uses it, rather than
+// the zone of the host (often UTC in containers) while schedules follow TZ.
+// An invalid zone leaves the local zone unchanged.
+func (c *Config) ApplyTimestampZone() (*time.Location, error) {
+	name := c.TimestampTZ
+	if name == "" {
+		name = c.TZ
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local, fmt.Errorf("invalid timestamp time zone %q: %w", name, err)
+	}
+	time.Local = loc
+	return loc, nil
+}
+
+// ProjectGroup returns the lowercased group of a project, or "" if it isn't
+// in one.
+func (c *Config) ProjectGroup(project string) string {
+	return strings.ToLower(strings.TrimSpace(c.ProjectOption(project, "GROUP", "")))
+}
+
+// GroupOption returns the GROUP_<NAME>_<OPTION> setting of a group, or
+// defaultValue if none is set.
+func (c *Config) GroupOption(group, option, defaultValue string) string {
+	if value, ok := c.GroupOptions[group][option]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// ProjectNamespace returns the lowercased namespace of a project, or "" if
+// it isn't in one.
+func (c *Config) ProjectNamespace(project string) string {
+	return strings.ToLower(strings.TrimSpace(c.ProjectOption(project, "NAMESPACE", "")))
+}
+
+// NamespaceOption returns the NAMESPACE_<NAME>_<OPTION> setting of a
+// namespace, or defaultValue if none is set.
+func (c *Config) NamespaceOption(namespace, option, defaultValue string) string {
+	if value, ok := c.NamespaceOptions[namespace][option]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// NamespaceRetentionMaxBytes returns the NAMESPACE_<NAME>_RETENTION_MAX_BYTES
+// cap on the backups of a namespace's projects together, or 0 if it has none.
+func (c *Config) NamespaceRetentionMaxBytes(namespace string) int64 {
+	if value, ok := c.NamespaceOptions[namespace]["RETENTION_MAX_BYTES"]; ok {
+		if bytesValue, err := ParseBytes(value); err == nil {
+			return bytesValue
+		}
+	}
+	return 0
+}
+
+// NamespaceRetentionDays returns the retention of a namespace's projects:
+// its RETENTION_DAYS, or RETENTION_DAYS. Unparseable values fall back to the
+// global setting.
+func (c *Config) NamespaceRetentionDays(namespace string) int {
+	if value, ok := c.NamespaceOptions[namespace]["RETENTION_DAYS"]; ok {
+		if days, err := strconv.Atoi(value); err == nil {
+			return days
+		}
+	}
+	return c.RetentionDays
+}
+
+// ProjectRetentionDays returns the retention of a project: its group's
+// RETENTION_DAYS, else its namespace's, else RETENTION_DAYS. Unparseable
+// values fall back to the next one.
+func (c *Config) ProjectRetentionDays(project string) int {
+	if value, ok := c.GroupOptions[c.ProjectGroup(project)]["RETENTION_DAYS"]; ok {
+		if days, err := strconv.Atoi(value); err == nil {
+			return days
+		}
+	}
+	return c.NamespaceRetentionDays(c.ProjectNamespace(project))
+}
+
+// ProjectKeepLastSuccess reports whether age-based retention keeps
+// the newest successful backup of a project (RETENTION_KEEP_LAST_SUCCESS,
+// per project BACKUP_<PROJECT>_RETENTION_KEEP_LAST_SUCCESS).
+func (c *Config) ProjectKeepLastSuccess(project string) bool {
+	return c.ProjectOptionBool(project, "RETENTION_KEEP_LAST_SUCCESS", c.KeepLastSuccess)
+}
+
+// ProjectRetentionMaxBytes returns the BACKUP_<PROJECT>_RETENTION_MAX_BYTES
+// cap of a project, or 0 if it has none. RETENTION_MAX_BYTES is a cap on all
+// projects together, not a default for this one.
+func (c *Config) ProjectRetentionMaxBytes(project string) int64 {
+	if value, ok := c.ProjectOptions[project]["RETENTION_MAX_BYTES"]; ok {
+		if bytesValue, err := ParseBytes(value); err == nil {
+			return bytesValue
+		}
+	}
+	return 0
+}
+
+// Quota policies: what happens to a backup that would exceed a quota.
+const (
+	// QuotaReject fails the backup
+	QuotaReject = "reject"
+	// QuotaPrune deletes the oldest backups to make room for it
+	QuotaPrune = "prune"
+)
+
+const (
+	// VersionMatchFallback dumps with the newest available image when the
+	// server version can't be detected
+	VersionMatchFallback = "fallback"
+	// VersionMatchStrict fails the backup instead
+	VersionMatchStrict = "strict"
+)
+
+const (
+	// ImageTagMajor tags dump images with the server's major version
+	ImageTagMajor = "major"
+	// ImageTagMinor tags them with its major and minor version
+	ImageTagMinor = "minor"
+)
+
+// Quota limits the backups a project or namespace keeps. Zero limits are
+// unset.
+type Quota struct {
+	MaxBytes   int64
+	MaxBackups int
+	Policy     string
+}
+
+// Enabled reports whether the quota sets any limit.
+func (q Quota) Enabled() bool {
+	return q.MaxBytes > 0 || q.MaxBackups > 0
+}
+
+// ProjectQuota returns the quota of a project's own backups
+// (BACKUP_<PROJECT>_QUOTA_BYTES, _QUOTA_BACKUPS and _QUOTA_POLICY).
+func (c *Config) ProjectQuota(project string) Quota {
+	return c.quota(c.ProjectOptions[project])
+}
+
+// NamespaceQuota returns the quota of the backups of a namespace's projects
+// together (NAMESPACE_<NAME>_QUOTA_BYTES, _QUOTA_BACKUPS and _QUOTA_POLICY).
+func (c *Config) NamespaceQuota(namespace string) Quota {
+	return c.quota(c.NamespaceOptions[namespace])
+}
+
+// quota reads the QUOTA_* options. Unparseable limits are unset; the policy
+// defaults to QUOTA_POLICY.
+func (c *Config) quota(options map[string]string) Quota {
+	quota := Quota{Policy: strings.ToLower(options["QUOTA_POLICY"])}
+	if quota.Policy == "" {
+		quota.Policy = c.QuotaPolicy
+	}
+	if value, ok := options["QUOTA_BYTES"]; ok {
+		if bytesValue, err := ParseBytes(value); err == nil {
+			quota.MaxBytes = bytesValue
+		}
+	}
+	if value, ok := options["QUOTA_BACKUPS"]; ok {
+		if count, err := strconv.Atoi(value); err == nil {
+			quota.MaxBackups = count
+		}
+	}
+	return quota
+}
+
+// MinArchiveSplitBytes is the smallest part size archives are split into.
+const MinArchiveSplitBytes = 1000 * 1000
+
+// ProjectArchiveSplitBytes returns the part size archives of a project are
+// split into (ARCHIVE_SPLIT_SIZE, per project
+// BACKUP_<PROJECT>_ARCHIVE_SPLIT_SIZE), or 0 to keep them whole.
+func (c *Config) ProjectArchiveSplitBytes(project string) int64 {
+	if value, ok := c.ProjectOptions[project]["ARCHIVE_SPLIT_SIZE"]; ok {
+		if bytesValue, err := ParseBytes(value); err == nil {
+			return bytesValue
+		}
+	}
+	return c.ArchiveSplitBytes
+}
+
+func NewLogger(cfg *Config) (*zap.Logger, error) {
+	var level zapcore.Level
+	switch strings.ToUpper(cfg.LogLevel) {
+	case "DEBUG":
+		level = zapcore.DebugLevel
+	case "INFO":
+		level = zapcore.InfoLevel
+	case "WARN":
+		level = zapcore.WarnLevel
+	case "ERROR":
+		level = zapcore.ErrorLevel
+	default:
+		level = zapcore.InfoLevel
+	}
+
+	config := zapConfig(cfg)
+	config.Level = zap.NewAtomicLevelAt(level)
+	var fileCore zapcore.Core
+	if cfg.LogFile != "" {
+		file, err := logfile.Open(cfg.LogFile, cfg.LogMaxSizeBytes, cfg.LogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		fileCore = zapcore.NewCore(NewLogEncoder(cfg), file, config.Level)
+	}
+	// Credentials are masked in every destination (see package redact)
+	return config.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		if fileCore != nil {
+			core = zapcore.NewTee(core, fileCore)
+		}
+		return redact.Core(core)
+	}))
+}
+
+// zapConfig is the logger configuration of LOG_FORMAT.
+func zapConfig(cfg *Config) zap.Config {
+	config := zap.NewProductionConfig()
+	if cfg.LogFormat == "text" {
+		config = zap.NewDevelopmentConfig()
+	}
+	config.EncoderConfig.TimeKey = "timestamp"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return config
+}
+
+// NewLogEncoder returns an encoder writing entries like the logger does, for
+// logs written to other destinations.
+func NewLogEncoder(cfg *Config) zapcore.Encoder {
+	config := zapConfig(cfg)
+	if config.Encoding == "console" {
+		return zapcore.NewConsoleEncoder(config.EncoderConfig)
+	}
+	return zapcore.NewJSONEncoder(config.EncoderConfig)
+}
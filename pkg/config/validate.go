@@ -0,0 +1,289 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of typed settings.
+const (
+	kindInt      = "integer"
+	kindBool     = "boolean"
+	kindFloat    = "number"
+	kindDuration = "duration"
+	kindBytes    = "size"
+)
+
+// settingKinds are the typed settings, globally and as project or group
+// options of the same name. Load and the ProjectOption* lookups fall back to
+// the default for values that don't parse; CheckEnv and Validate report them.
+var settingKinds = map[string]string{
+	"RETENTION_DAYS":              kindInt,
+	"FULL_BACKUP_AFTER":           kindInt,
+	"THROTTLE_MAX_ACTIVE":         kindInt,
+	"SERVICE_PORT":                kindInt,
+	"API_RATE_BURST":              kindInt,
+	"API_MAX_CONCURRENT_RUNS":     kindInt,
+	"SMTP_PORT":                   kindInt,
+	"LOG_MAX_BACKUPS":             kindInt,
+	"RETENTION_KEEP_LAST_SUCCESS": kindBool,
+	"CATCHUP":                     kindBool,
+	"IMPORT_SCAN":                 kindBool,
+	"RCLONE_VERIFY":               kindBool,
+	"ARCHIVE_VERIFY":              kindBool,
+	"DURABLE_WRITES":              kindBool,
+	"REQUIRE_IMAGE_DIGEST":        kindBool,
+	"ROLES_DUMP_OPTIONAL":         kindBool,
+	"EXACT_ROW_COUNTS":            kindBool,
+	"POOLER_CHECK":                kindBool,
+	"SHARED_SNAPSHOT":             kindBool,
+	"REHEARSAL":                   kindBool,
+	"RUN_LOGS":                    kindBool,
+	"SCHEMA_DRIFT":                kindBool,
+	"RESTORE_ANALYZE":             kindBool,
+	"RESTORE_REFRESH_MATVIEWS":    kindBool,
+	"API_RATE_LIMIT":              kindFloat,
+	"SCHEDULE_JITTER":             kindDuration,
+	"BACKUP_TIMEOUT":              kindDuration,
+	"RUN_TIMEOUT":                 kindDuration,
+	"SHUTDOWN_GRACE_PERIOD":       kindDuration,
+	"THROTTLE_MAX_LAG":            kindDuration,
+	"THROTTLE_INTERVAL":           kindDuration,
+	"THROTTLE_MAX_WAIT":           kindDuration,
+	"ADVISORY_LOCK_TIMEOUT":       kindDuration,
+	"REHEARSAL_TIMEOUT":           kindDuration,
+	"RPO_TARGET":                  kindDuration,
+	"DIGEST_PERIOD":               kindDuration,
+	"SHARE_URL_TTL":               kindDuration,
+	"TEMP_MAX_AGE":                kindDuration,
+	"TEMP_CLEANUP_INTERVAL":       kindDuration,
+	"API_READ_TIMEOUT":            kindDuration,
+	"API_WRITE_TIMEOUT":           kindDuration,
+	"API_IDLE_TIMEOUT":            kindDuration,
+	"RETENTION_MAX_BYTES":         kindBytes,
+	"ARCHIVE_SPLIT_SIZE":          kindBytes,
+	"COMPRESSION_LEVEL":           kindInt,
+	"LOG_MAX_SIZE":                kindBytes,
+	"API_MAX_HEADER_SIZE":         kindBytes,
+	"API_MAX_BODY_SIZE":           kindBytes,
+}
+
+// parseKind reports whether value is a valid setting of kind.
+func parseKind(kind, value string) bool {
+	var err error
+	switch kind {
+	case kindInt:
+		_, err = strconv.Atoi(value)
+	case kindBool:
+		_, err = strconv.ParseBool(value)
+	case kindFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case kindDuration:
+		_, err = time.ParseDuration(value)
+	case kindBytes:
+		_, err = ParseBytes(value)
+	}
+	return err == nil
+}
+
+// CheckEnv reports typed environment variables whose values don't parse,
+// which Load silently replaces with their defaults.
+func CheckEnv() []error {
+	var problems []error
+	for _, key := range slices.Sorted(maps.Keys(settingKinds)) {
+		value := os.Getenv(key)
+		if value != "" && !parseKind(settingKinds[key], value) {
+			problems = append(problems, fmt.Errorf("%s: invalid %s %q", key, settingKinds[key], value))
+		}
+	}
+	return problems
+}
+
+// Validate checks the values of a configuration that don't depend on other
+// packages: ranges, enumerations, time zones, and the types of project and
+// group options. service.ValidateConfig checks the rest.
+func (c *Config) Validate() []error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Databases) == 0 {
+		add("no databases configured (set BACKUP_<PROJECT>=postgresql://...)")
+	}
+	if c.RetentionDays < 0 {
+		add("RETENTION_DAYS: must not be negative, got %d", c.RetentionDays)
+	}
+	if c.ServicePort < 1 || c.ServicePort > 65535 {
+		add("SERVICE_PORT: must be between 1 and 65535, got %d", c.ServicePort)
+	}
+	if c.APIRateLimit < 0 || c.APIRateBurst < 0 || c.APIMaxConcurrentRuns < 0 {
+		add("API_RATE_LIMIT, API_RATE_BURST and API_MAX_CONCURRENT_RUNS must not be negative")
+	}
+	if c.APIRateLimit > 0 && c.APIRateBurst < 1 {
+		add("API_RATE_BURST: must be at least 1 when API_RATE_LIMIT is set")
+	}
+	durations := map[string]time.Duration{
+		"SCHEDULE_JITTER":       c.ScheduleJitter,
+		"BACKUP_TIMEOUT":        c.BackupTimeout,
+		"RUN_TIMEOUT":           c.RunTimeout,
+		"SHUTDOWN_GRACE_PERIOD": c.ShutdownGracePeriod,
+		"THROTTLE_MAX_LAG":      c.ThrottleMaxLag,
+		"THROTTLE_MAX_WAIT":     c.ThrottleMaxWait,
+		"REHEARSAL_TIMEOUT":     c.RehearsalTimeout,
+		"TEMP_CLEANUP_INTERVAL": c.TempCleanupInterval,
+		"ADVISORY_LOCK_TIMEOUT": c.AdvisoryLockTimeout,
+		"RPO_TARGET":            c.RPOTarget,
+		"API_READ_TIMEOUT":      c.APIReadTimeout,
+		"API_WRITE_TIMEOUT":     c.APIWriteTimeout,
+		"API_IDLE_TIMEOUT":      c.APIIdleTimeout,
+	}
+	for _, key := range slices.Sorted(maps.Keys(durations)) {
+		if durations[key] < 0 {
+			add("%s: must not be negative, got %s", key, durations[key])
+		}
+	}
+	if c.ArchiveSplitBytes > 0 && c.ArchiveSplitBytes < MinArchiveSplitBytes {
+		add("ARCHIVE_SPLIT_SIZE: must be at least 1MB, got %d bytes", c.ArchiveSplitBytes)
+	}
+	if c.CompressionLevel < 1 || c.CompressionLevel > 9 {
+		add("COMPRESSION_LEVEL: must be between 1 and 9, got %d", c.CompressionLevel)
+	}
+	if err := checkPatterns(c.RestoreValidationSQL); err != nil {
+		add("RESTORE_VALIDATION_SQL: %v", err)
+	}
+	if c.TempMaxAge <= 0 {
+		add("TEMP_MAX_AGE: must be positive, got %s", c.TempMaxAge)
+	}
+	if c.StagingDir != "" {
+		// Temp cleanup removes everything in the staging directory, and
+		// backup listings would pick up staged dumps
+		if rel, err := filepath.Rel(c.StagingDir, c.LocalBackupDir); err == nil && !strings.HasPrefix(rel, "..") {
+			add("STAGING_DIR: must not be LOCAL_BACKUP_DIR or contain it, got %q", c.StagingDir)
+		} else if rel, err := filepath.Rel(c.LocalBackupDir, c.StagingDir); err == nil && !strings.HasPrefix(rel, "..") && !strings.HasPrefix(rel, ".") {
+			add("STAGING_DIR: must be outside LOCAL_BACKUP_DIR or a hidden directory in it, got %q", c.StagingDir)
+		}
+	}
+	if c.DigestPeriod <= 0 {
+		add("DIGEST_PERIOD: must be positive, got %s", c.DigestPeriod)
+	}
+	if c.ShareURLTTL < time.Second {
+		add("SHARE_URL_TTL: must be at least 1s, got %s", c.ShareURLTTL)
+	}
+	if (c.ThrottleMaxActive > 0 || c.ThrottleMaxLag > 0) && c.ThrottleInterval <= 0 {
+		add("THROTTLE_INTERVAL: must be positive when throttling is enabled, got %s", c.ThrottleInterval)
+	}
+
+	if _, err := time.LoadLocation(c.TZ); err != nil {
+		add("TZ: unknown time zone %q", c.TZ)
+	}
+	if c.TimestampTZ != "" {
+		if _, err := time.LoadLocation(c.TimestampTZ); err != nil {
+			add("TIMESTAMP_TZ: unknown time zone %q", c.TimestampTZ)
+		}
+	}
+	switch strings.ToUpper(c.LogLevel) {
+	case "", "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		add("LOG_LEVEL: expected DEBUG, INFO, WARN or ERROR, got %q", c.LogLevel)
+	}
+	if c.QuotaPolicy != QuotaReject && c.QuotaPolicy != QuotaPrune {
+		add("QUOTA_POLICY: expected reject or prune, got %q", c.QuotaPolicy)
+	}
+	if c.VersionMatch != VersionMatchFallback && c.VersionMatch != VersionMatchStrict {
+		add("VERSION_MATCH: expected fallback or strict, got %q", c.VersionMatch)
+	}
+	if c.PgDumpImageTag != ImageTagMajor && c.PgDumpImageTag != ImageTagMinor {
+		add("PGDUMP_IMAGE_TAG: expected major or minor, got %q", c.PgDumpImageTag)
+	}
+	switch c.LogFormat {
+	case "", "json", "text":
+	default:
+		add("LOG_FORMAT: expected json or text, got %q", c.LogFormat)
+	}
+
+	for _, project := range slices.Sorted(maps.Keys(c.ProjectOptions)) {
+		options := c.ProjectOptions[project]
+		for _, option := range slices.Sorted(maps.Keys(options)) {
+			if kind, ok := settingKinds[option]; ok && !parseKind(kind, options[option]) {
+				add("BACKUP_%s_%s: invalid %s %q", strings.ToUpper(project), option, kind, options[option])
+				continue
+			}
+			if option == "ARCHIVE_SPLIT_SIZE" {
+				if size := c.ProjectArchiveSplitBytes(project); size > 0 && size < MinArchiveSplitBytes {
+					add("BACKUP_%s_ARCHIVE_SPLIT_SIZE: must be at least 1MB, got %d bytes", strings.ToUpper(project), size)
+				}
+			}
+			if option == "COMPRESSION_LEVEL" {
+				if level := c.ProjectOptionInt(project, option, c.CompressionLevel); level < 1 || level > 9 {
+					add("BACKUP_%s_COMPRESSION_LEVEL: must be between 1 and 9, got %d", strings.ToUpper(project), level)
+				}
+			}
+			if option == "RESTORE_VALIDATION_SQL" {
+				if err := checkPatterns(options[option]); err != nil {
+					add("BACKUP_%s_RESTORE_VALIDATION_SQL: %v", strings.ToUpper(project), err)
+				}
+			}
+		}
+		problems = append(problems, validateQuota("BACKUP_"+strings.ToUpper(project), options)...)
+	}
+	for _, group := range slices.Sorted(maps.Keys(c.GroupOptions)) {
+		if value, ok := c.GroupOptions[group]["RETENTION_DAYS"]; ok {
+			if days, err := strconv.Atoi(value); err != nil || days < 0 {
+				add("GROUP_%s_RETENTION_DAYS: invalid number of days %q", strings.ToUpper(group), value)
+			}
+		}
+	}
+	for _, namespace := range slices.Sorted(maps.Keys(c.NamespaceOptions)) {
+		options := c.NamespaceOptions[namespace]
+		if value, ok := options["RETENTION_DAYS"]; ok {
+			if days, err := strconv.Atoi(value); err != nil || days < 0 {
+				add("NAMESPACE_%s_RETENTION_DAYS: invalid number of days %q", strings.ToUpper(namespace), value)
+			}
+		}
+		if value, ok := options["RETENTION_MAX_BYTES"]; ok && !parseKind(kindBytes, value) {
+			add("NAMESPACE_%s_RETENTION_MAX_BYTES: invalid %s %q", strings.ToUpper(namespace), kindBytes, value)
+		}
+		problems = append(problems, validateQuota("NAMESPACE_"+strings.ToUpper(namespace), options)...)
+	}
+	return problems
+}
+
+// checkPatterns checks the syntax of a comma-separated list of file paths
+// and globs.
+func checkPatterns(list string) error {
+	for _, pattern := range strings.Split(list, ",") {
+		if _, err := filepath.Match(strings.TrimSpace(pattern), ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", strings.TrimSpace(pattern))
+		}
+	}
+	return nil
+}
+
+// validateQuota checks the QUOTA_* options of a project or namespace, whose
+// settings start with prefix.
+func validateQuota(prefix string, options map[string]string) []error {
+	var problems []error
+	if value, ok := options["QUOTA_BYTES"]; ok {
+		if size, err := ParseBytes(value); err != nil || size < 0 {
+			problems = append(problems, fmt.Errorf("%s_QUOTA_BYTES: invalid %s %q", prefix, kindBytes, value))
+		}
+	}
+	if value, ok := options["QUOTA_BACKUPS"]; ok {
+		if count, err := strconv.Atoi(value); err != nil || count < 0 {
+			problems = append(problems, fmt.Errorf("%s_QUOTA_BACKUPS: invalid number of backups %q", prefix, value))
+		}
+	}
+	if value, ok := options["QUOTA_POLICY"]; ok {
+		if policy := strings.ToLower(value); policy != QuotaReject && policy != QuotaPrune {
+			problems = append(problems, fmt.Errorf("%s_QUOTA_POLICY: expected reject or prune, got %q", prefix, value))
+		}
+	}
+	return problems
+}
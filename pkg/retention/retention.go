@@ -0,0 +1,120 @@
+// Package retention deletes expired backups from a backup directory, by age
+// (CleanupOldBackups) and by size caps (PruneToSize).
+package retention
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+)
+
+// CleanupOldBackups deletes the backups of a project dated before
+// retentionDays ago and returns how many dates it deleted. Pinned backups, and
+// backups that a kept or pinned incremental backup depends on (its parents
+// back to the full backup), are kept as well, and with keepLastSuccess the
+// newest restorable backup (and its parents, see catalog.Entry.Restorable),
+// so a project whose backups or uploads keep failing isn't left without any. Backups are found through their manifests,
+// whatever the layout; dated directories without any (leftovers of the
+// default layout) are deleted as a whole.
+func CleanupOldBackups(baseDir, databaseID string, retentionDays int, keepLastSuccess bool) (int, error) {
+	dbDir := filepath.Join(baseDir, databaseID)
+	if _, err := os.Stat(dbDir); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	cutoffDate := time.Now().AddDate(0, 0, -retentionDays)
+	cutoffDateStr := cutoffDate.Format("2006-01-02")
+
+	backups, err := catalog.List(baseDir, databaseID)
+	if err != nil {
+		return 0, err
+	}
+	keep := keptDates(backups, cutoffDateStr, keepLastSuccess)
+
+	deleted := make(map[string]bool)
+	for _, backup := range backups {
+		if backup.Date == "" || backup.Date >= cutoffDateStr || keep[backup.Date] {
+			continue
+		}
+		if err := removeBackup(baseDir, backup); err != nil {
+			return len(deleted), err
+		}
+		deleted[backup.Date] = true
+	}
+
+	entries, err := os.ReadDir(dbDir)
+	if err != nil {
+		return len(deleted), fmt.Errorf("failed to read database directory: %w", err)
+	}
+	for _, entry := range entries {
+		dirDate := entry.Name()
+		if _, err := time.Parse("2006-01-02", dirDate); err != nil || !entry.IsDir() {
+			continue
+		}
+		if dirDate < cutoffDateStr && !keep[dirDate] {
+			dirPath := filepath.Join(dbDir, dirDate)
+			if err := os.RemoveAll(dirPath); err != nil {
+				return len(deleted), fmt.Errorf("failed to delete directory %s: %w", dirPath, err)
+			}
+			deleted[dirDate] = true
+		}
+	}
+
+	return len(deleted), nil
+}
+
+// keptDates returns the dates of backups older than cutoff that newer
+// incremental backups depend on, those of pinned backups and their parents,
+// and with keepLastSuccess those of the newest restorable backup and its
+// parents.
+func keptDates(backups []*catalog.Entry, cutoff string, keepLastSuccess bool) map[string]bool {
+	now := time.Now()
+	dates := make(map[string]bool)
+	for _, backup := range backups {
+		pinned := backup.Pinned(now)
+		if pinned {
+			dates[backup.Date] = true
+		}
+		if (backup.Date < cutoff && !pinned) || backup.ParentRunID == "" {
+			continue
+		}
+		ancestors, _ := catalog.Ancestors(backups, backup)
+		for _, ancestor := range ancestors {
+			dates[ancestor.Date] = true
+		}
+	}
+	if keepLastSuccess {
+		for i := len(backups) - 1; i >= 0; i-- {
+			if !backups[i].Restorable() {
+				continue
+			}
+			dates[backups[i].Date] = true
+			ancestors, _ := catalog.Ancestors(backups, backups[i])
+			for _, ancestor := range ancestors {
+				dates[ancestor.Date] = true
+			}
+			break
+		}
+	}
+	return dates
+}
+
+// CleanupAllDatabases runs CleanupOldBackups for each project with the
+// retention retentionDays and keepLastSuccess return for it, and counts the
+// deleted dates.
+func CleanupAllDatabases(baseDir string, databaseIDs []string, retentionDays func(databaseID string) int, keepLastSuccess func(databaseID string) bool) (map[string]int, error) {
+	results := make(map[string]int)
+	for _, dbID := range databaseIDs {
+		count, err := CleanupOldBackups(baseDir, dbID, retentionDays(dbID), keepLastSuccess(dbID))
+		if err != nil {
+			return results, err
+		}
+		if count > 0 {
+			results[dbID] = count
+		}
+	}
+	return results, nil
+}
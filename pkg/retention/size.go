@@ -0,0 +1,215 @@
+package retention
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+)
+
+// PrunedBackup is a backup deleted to get under a size cap or quota.
+type PrunedBackup struct {
+	Project   string `json:"project"`
+	RunID     string `json:"run_id"`
+	Date      string `json:"date"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// PruneToSize deletes the oldest backups of the projects until their total
+// size is at most maxBytes. Each project's last restorable backup
+// (catalog.Entry.Restorable), pinned backups and the backups they depend on
+// are never deleted; an incremental
+// backup's parents are only deleted together with it. total is the size left
+// afterwards, which stays above maxBytes when only protected backups remain.
+func PruneToSize(baseDir string, projects []string, maxBytes int64) (pruned []PrunedBackup, total int64, err error) {
+	pruned, total, _, err = pruneOldest(baseDir, projects, func(total int64, _ int) bool {
+		return total > maxBytes
+	})
+	return pruned, total, err
+}
+
+// PruneToQuota deletes the oldest backups of the projects, protected like
+// PruneToSize, until one more backup fits their quota: fewer than maxBackups
+// backups taking less than maxBytes. Zero limits are unset. total and count
+// are the size and number of backups left afterwards.
+func PruneToQuota(baseDir string, projects []string, maxBytes int64, maxBackups int) (pruned []PrunedBackup, total int64, count int, err error) {
+	return pruneOldest(baseDir, projects, func(total int64, count int) bool {
+		return OverQuota(total, count, maxBytes, maxBackups)
+	})
+}
+
+// OverQuota reports whether total bytes in count backups leave no room for
+// another backup under maxBytes and maxBackups. Zero limits are unset.
+func OverQuota(total int64, count int, maxBytes int64, maxBackups int) bool {
+	return maxBytes > 0 && total >= maxBytes || maxBackups > 0 && count >= maxBackups
+}
+
+// Usage returns the size and number of the backups of the projects, as
+// PruneToSize and PruneToQuota count them.
+func Usage(baseDir string, projects []string) (total int64, count int, err error) {
+	for _, project := range projects {
+		entries, err := catalog.List(baseDir, project)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			total += entrySize(entry)
+		}
+		count += len(entries)
+	}
+	return total, count, nil
+}
+
+// pruneOldest deletes the oldest unprotected backups of the projects while
+// over reports the size and number of those left as too many.
+func pruneOldest(baseDir string, projects []string, over func(total int64, count int) bool) (pruned []PrunedBackup, total int64, count int, err error) {
+	var candidates []*catalog.Entry
+	byProject := make(map[string][]*catalog.Entry, len(projects))
+	protected := make(map[*catalog.Entry]bool)
+	sizes := make(map[*catalog.Entry]int64)
+	now := time.Now()
+	for _, project := range projects {
+		entries, err := catalog.List(baseDir, project)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		byProject[project] = entries
+		protect := func(entry *catalog.Entry) {
+			protected[entry] = true
+			ancestors, _ := catalog.Ancestors(entries, entry)
+			for _, ancestor := range ancestors {
+				protected[ancestor] = true
+			}
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Restorable() {
+				protect(entries[i])
+				break
+			}
+		}
+		for _, entry := range entries {
+			if entry.Pinned(now) {
+				protect(entry)
+			}
+		}
+		for _, entry := range entries {
+			sizes[entry] = entrySize(entry)
+			total += sizes[entry]
+		}
+		count += len(entries)
+		candidates = append(candidates, entries...)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return startedAt(candidates[i]).Before(startedAt(candidates[j]))
+	})
+
+	removed := make(map[*catalog.Entry]bool)
+	for _, candidate := range candidates {
+		if !over(total, count) {
+			break
+		}
+		if removed[candidate] || protected[candidate] {
+			continue
+		}
+		group := append([]*catalog.Entry{candidate}, dependents(byProject[candidate.Project], candidate)...)
+		if anyOf(group, protected) {
+			continue
+		}
+		for _, entry := range group {
+			if removed[entry] {
+				continue
+			}
+			if err := removeBackup(baseDir, entry); err != nil {
+				return pruned, total, count, err
+			}
+			removed[entry] = true
+			total -= sizes[entry]
+			count--
+			pruned = append(pruned, PrunedBackup{
+				Project:   entry.Project,
+				RunID:     entry.RunID,
+				Date:      entry.Date,
+				SizeBytes: sizes[entry],
+			})
+		}
+	}
+	return pruned, total, count, nil
+}
+
+// dependents returns the incremental backups in entries built on entry.
+func dependents(entries []*catalog.Entry, entry *catalog.Entry) []*catalog.Entry {
+	var result []*catalog.Entry
+	for _, e := range entries {
+		ancestors, _ := catalog.Ancestors(entries, e)
+		for _, ancestor := range ancestors {
+			if ancestor == entry {
+				result = append(result, e)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func anyOf(entries []*catalog.Entry, set map[*catalog.Entry]bool) bool {
+	for _, entry := range entries {
+		if set[entry] {
+			return true
+		}
+	}
+	return false
+}
+
+func startedAt(entry *catalog.Entry) time.Time {
+	t, _ := time.Parse(time.RFC3339, entry.StartedAt)
+	return t
+}
+
+// entrySize is the size of a backup's files on disk, manifest included.
+func entrySize(entry *catalog.Entry) int64 {
+	size := entry.SizeBytes
+	if info, err := os.Stat(entry.ManifestPath); err == nil {
+		size += info.Size()
+	}
+	return size
+}
+
+// removeBackup deletes the archive and manifest of a backup (and an expired
+// pin), then the directories above it that are left empty, up to the project
+// directory.
+func removeBackup(baseDir string, entry *catalog.Entry) error {
+	archivePath := entry.ArchivePath
+	if archivePath == "" {
+		archivePath = filepath.Join(entry.Dir, fmt.Sprintf("backup-%s.tar.gz", entry.RunID))
+	}
+	// Files also covers imported backups in foreign formats
+	paths := append([]string{archivePath, entry.ManifestPath}, entry.Files...)
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %w", path, err)
+		}
+		// State of an S3 upload that never finished
+		if err := storage.RemoveUploadState(path); err != nil {
+			return err
+		}
+	}
+	if entry.Pin != nil {
+		if err := catalog.RemovePin(entry); err != nil {
+			return err
+		}
+	}
+	projectDir := filepath.Join(baseDir, entry.Project)
+	for dir := entry.Dir; dir != projectDir && strings.HasPrefix(dir, projectDir); dir = filepath.Dir(dir) {
+		// Fails for directories that aren't empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
+	"go.uber.org/zap"
+)
+
+// Exit codes of --once.
+const (
+	exitSuccess = 0
+	// exitFailed: no backup of the run succeeded
+	exitFailed = 1
+	// exitPartial: some backups or uploads failed
+	exitPartial = 2
+	// exitSetup: the run couldn't start (configuration, Docker, unknown
+	// project)
+	exitSetup = 3
+)
+
+// onceShutdownTimeout bounds the delivery of events still queued when a
+// --once run ends.
+const onceShutdownTimeout = time.Minute
+
+// runOnce runs a single backup job of projects (all if none) without the
+// scheduler and the API, prints the run report as JSON to stdout and returns
+// the exit code. Logs go to stderr as usual. SIGINT and SIGTERM cancel the
+// running backup.
+func runOnce(cfg *config.Config, projects []string) int {
+	logger, err := config.NewLogger(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		return exitSetup
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backupService, err := service.NewOneShot(ctx, cfg, logger)
+	if err != nil {
+		logger.Error("Failed to initialize backup service", zap.Error(err))
+		return exitSetup
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), onceShutdownTimeout)
+		defer cancel()
+		if err := backupService.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to deliver remaining events", zap.Error(err))
+		}
+	}()
+
+	runCtx := service.WithTrigger(ctx, service.TriggerOnce)
+	var result map[string]interface{}
+	if len(projects) == 0 {
+		result, err = backupService.RunBackupJob(runCtx)
+	} else {
+		result, err = backupService.RunBackupProjects(runCtx, projects)
+	}
+	if err != nil {
+		logger.Error("Backup run failed to start", zap.Error(err))
+		return exitSetup
+	}
+
+	report, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		logger.Error("Failed to encode run report", zap.Error(err))
+		return exitFailed
+	}
+	fmt.Println(string(report))
+	return onceExitCode(result)
+}
+
+// onceExitCode maps the status of a run report to the exit code.
+func onceExitCode(result map[string]interface{}) int {
+	switch result["status"] {
+	case "success":
+		return exitSuccess
+	case "partial":
+		return exitPartial
+	}
+	return exitFailed
+}
@@ -0,0 +1,145 @@
+// Package server runs the backup service. cmd/backup is a thin wrapper around
+// Main; custom builds use it to compile in their own storage backends:
+//
+//	package main
+//
+//	import (
+//		_ "example.com/backups/objstore" // calls storage.Register("objstore", ...)
+//
+//		"github.com/mxschmitt/pg-backup-scheduler/pkg/server"
+//	)
+//
+//	func main() {
+//		server.Main()
+//	}
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/api"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/systemd"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/service"
+	"go.uber.org/zap"
+)
+
+// Main loads the configuration from the environment, starts the scheduler
+// and the HTTP API, and blocks until SIGINT or SIGTERM. With
+// --validate-config it only checks the configuration, listing every problem
+// and exiting non-zero if there are any. With --once [project...] it runs a
+// single backup job and exits with its status (see runOnce).
+func Main() {
+	once := len(os.Args) > 1 && os.Args[1] == "--once"
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		if once {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+			os.Exit(exitSetup)
+		}
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "--validate-config" {
+		os.Exit(validateConfig(cfg))
+	}
+	if once {
+		os.Exit(runOnce(cfg, os.Args[2:]))
+	}
+
+	// Initialize logger
+	logger, err := config.NewLogger(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+	defer logger.Sync()
+
+	logger.Info("Starting PostgreSQL Backup Service")
+
+	// Start the API server first so the probes answer while the service
+	// starts; everything else gets 503 until SetService
+	apiServer := api.New(cfg, nil, logger)
+	if err := apiServer.Listen(); err != nil {
+		logger.Fatal("API server failed", zap.Error(err))
+	}
+	go func() {
+		if err := apiServer.Start(); err != nil {
+			logger.Fatal("API server failed", zap.Error(err))
+		}
+	}()
+
+	// Initialize service
+	ctx := context.Background()
+	backupService, err := service.New(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize backup service", zap.Error(err))
+	}
+	apiServer.SetService(backupService)
+
+	// Tell systemd (Type=notify) that we're up, and keep its watchdog fed
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		logger.Warn("Failed to notify systemd", zap.Error(err))
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		ping := func() {
+			if _, err := systemd.Notify("WATCHDOG=1"); err != nil {
+				logger.Warn("Failed to send watchdog ping", zap.Error(err))
+			}
+		}
+		if err := backupService.StartWatchdog(interval/2, ping); err != nil {
+			logger.Fatal("Failed to start watchdog", zap.Error(err))
+		}
+		logger.Info("systemd watchdog enabled", zap.Duration("interval", interval))
+	}
+
+	logger.Info("Service started successfully")
+
+	// Wait for interrupt signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	logger.Info("Shutting down gracefully...", zap.Duration("grace_period", cfg.ShutdownGracePeriod))
+	_, _ = systemd.Notify("STOPPING=1")
+	// API requests and backups drain at the same time, each for at most
+	// SHUTDOWN_GRACE_PERIOD (0: until they are done)
+	apiDone := make(chan struct{})
+	go func() {
+		defer close(apiDone)
+		drainCtx := ctx
+		if cfg.ShutdownGracePeriod > 0 {
+			var cancel context.CancelFunc
+			drainCtx, cancel = context.WithTimeout(ctx, cfg.ShutdownGracePeriod)
+			defer cancel()
+		}
+		if err := apiServer.Shutdown(drainCtx); err != nil {
+			logger.Warn("API requests still running after the grace period were closed", zap.Error(err))
+		}
+	}()
+	if err := backupService.Shutdown(ctx); err != nil {
+		logger.Error("Error shutting down service", zap.Error(err))
+	}
+	<-apiDone
+}
+
+// validateConfig prints the problems of cfg to stderr and returns the exit
+// code for --validate-config.
+func validateConfig(cfg *config.Config) int {
+	problems := append(config.CheckEnv(), service.ValidateConfig(context.Background(), cfg)...)
+	if len(problems) == 0 {
+		fmt.Printf("Configuration OK (%d projects)\n", len(cfg.Databases))
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Found %d configuration problems:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  - %v\n", problem)
+	}
+	return 1
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// blackoutWindow is a recurring time range during which scheduled backups
+// must not start, e.g. "Mon-Fri 08:00-20:00". Ranges may cross midnight.
+type blackoutWindow struct {
+	days  [7]bool // indexed by time.Weekday
+	start int     // minutes since midnight
+	end   int
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseBlackoutWindows parses BLACKOUT_WINDOWS: semicolon-separated windows of
+// an optional day list ("Mon-Fri", "Sat,Sun") followed by "HH:MM-HH:MM".
+func parseBlackoutWindows(value string) ([]blackoutWindow, error) {
+	var windows []blackoutWindow
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		window, err := parseBlackoutWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blackout window %q: %w", spec, err)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseBlackoutWindow(spec string) (blackoutWindow, error) {
+	var window blackoutWindow
+	fields := strings.Fields(spec)
+
+	var timeRange string
+	switch len(fields) {
+	case 1:
+		timeRange = fields[0]
+		for i := range window.days {
+			window.days[i] = true
+		}
+	case 2:
+		if err := parseDays(fields[0], &window.days); err != nil {
+			return window, err
+		}
+		timeRange = fields[1]
+	default:
+		return window, fmt.Errorf("expected [days] HH:MM-HH:MM")
+	}
+
+	startStr, endStr, ok := strings.Cut(timeRange, "-")
+	if !ok {
+		return window, fmt.Errorf("expected time range HH:MM-HH:MM")
+	}
+	var err error
+	if window.start, err = parseClock(startStr); err != nil {
+		return window, err
+	}
+	if window.end, err = parseClock(endStr); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("empty time range")
+	}
+	return window, nil
+}
+
+func parseDays(spec string, days *[7]bool) error {
+	for _, part := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(strings.ToLower(part), "-")
+		first, ok := weekdayNames[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdayNames[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// endAfter returns the end of the window occurrence containing t, if any.
+func (w blackoutWindow) endAfter(t time.Time) (time.Time, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	weekday := t.Weekday()
+
+	if w.start < w.end {
+		if w.days[weekday] && minute >= w.start && minute < w.end {
+			return midnight.Add(time.Duration(w.end) * time.Minute), true
+		}
+		return time.Time{}, false
+	}
+
+	// Window crosses midnight: the occurrence starts on the listed day
+	if w.days[weekday] && minute >= w.start {
+		return midnight.AddDate(0, 0, 1).Add(time.Duration(w.end) * time.Minute), true
+	}
+	if w.days[(weekday+6)%7] && minute < w.end {
+		return midnight.Add(time.Duration(w.end) * time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+// deferPastBlackouts moves t to the first moment outside all blackout windows.
+func deferPastBlackouts(t time.Time, windows []blackoutWindow) time.Time {
+	// Bounded so overlapping windows covering the whole week can't loop forever
+	for i := 0; i < 100; i++ {
+		moved := false
+		for _, w := range windows {
+			if end, ok := w.endAfter(t); ok {
+				t = end
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
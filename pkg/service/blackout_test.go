@@ -0,0 +1,101 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func weekdays(days ...time.Weekday) [7]bool {
+	var set [7]bool
+	for _, d := range days {
+		set[d] = true
+	}
+	return set
+}
+
+var everyDay = weekdays(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+
+func TestParseBlackoutWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []blackoutWindow
+		wantErr string
+	}{
+		{name: "empty", value: "", want: nil},
+		{name: "only separators", value: " ; ;", want: nil},
+		{name: "every day", value: "08:00-20:00", want: []blackoutWindow{{days: everyDay, start: 480, end: 1200}}},
+		{name: "day range", value: "Mon-Fri 08:00-20:00", want: []blackoutWindow{{days: weekdays(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), start: 480, end: 1200}}},
+		{name: "day list", value: "sat,SUN 00:00-06:30", want: []blackoutWindow{{days: weekdays(time.Saturday, time.Sunday), start: 0, end: 390}}},
+		{name: "range wrapping the week", value: "Fri-Mon 22:00-02:00", want: []blackoutWindow{{days: weekdays(time.Friday, time.Saturday, time.Sunday, time.Monday), start: 1320, end: 120}}},
+		{name: "single day", value: "Wed 12:00-13:00", want: []blackoutWindow{{days: weekdays(time.Wednesday), start: 720, end: 780}}},
+		{
+			name:  "several windows",
+			value: "Mon-Fri 08:00-20:00; Sat 10:00-12:00;",
+			want: []blackoutWindow{
+				{days: weekdays(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday), start: 480, end: 1200},
+				{days: weekdays(time.Saturday), start: 600, end: 720},
+			},
+		},
+
+		{name: "unknown day", value: "Mon-Fry 08:00-20:00", wantErr: `unknown day "fry"`},
+		{name: "full day name", value: "Monday 08:00-20:00", wantErr: `unknown day "monday"`},
+		{name: "days only", value: "Mon-Fri", wantErr: `invalid time "Mon"`},
+		{name: "missing end", value: "08:00", wantErr: "expected time range"},
+		{name: "invalid time", value: "08:00-25:00", wantErr: `invalid time "25:00"`},
+		{name: "seconds", value: "08:00:00-20:00:00", wantErr: "invalid time"},
+		{name: "empty range", value: "08:00-08:00", wantErr: "empty time range"},
+		{name: "too many fields", value: "Mon Fri 08:00-20:00", wantErr: "expected [days] HH:MM-HH:MM"},
+		{name: "one bad window", value: "08:00-20:00; 20:00", wantErr: `invalid blackout window "20:00"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBlackoutWindows(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseBlackoutWindows(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseBlackoutWindows(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeferPastBlackouts(t *testing.T) {
+	windows, err := parseBlackoutWindows("Mon-Fri 08:00-20:00; Fri 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2026-01-05 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{name: "outside", t: at(5, 7, 59), want: at(5, 7, 59)},
+		{name: "inside", t: at(5, 8, 0), want: at(5, 20, 0)},
+		{name: "end is outside", t: at(5, 20, 0), want: at(5, 20, 0)},
+		{name: "weekend", t: at(10, 12, 0), want: at(10, 12, 0)},
+		{name: "across midnight", t: at(9, 23, 0), want: at(10, 2, 0)},
+		{name: "after midnight", t: at(10, 1, 0), want: at(10, 2, 0)},
+		{name: "not the day after", t: at(11, 1, 0), want: at(11, 1, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deferPastBlackouts(tt.t, windows); !got.Equal(tt.want) {
+				t.Fatalf("deferPastBlackouts(%s) = %s, want %s", tt.t, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/msgbus"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"go.uber.org/zap"
+)
+
+const (
+	// busRetryInterval is how long the consumer waits before reconnecting
+	busRetryInterval = 10 * time.Second
+	// busPublishTimeout bounds publishing one event
+	busPublishTimeout = 10 * time.Second
+)
+
+// busRequest is a backup request consumed from MESSAGE_BUS_SUBJECT: a
+// project or a group, with optional tags. ID is echoed in the completion
+// event so senders can match it to their request.
+type busRequest struct {
+	ID      string   `json:"id"`
+	Project string   `json:"project"`
+	Group   string   `json:"group"`
+	Tags    []string `json:"tags"`
+}
+
+// busPublisher publishes to MESSAGE_BUS_URL on a connection of its own,
+// reconnecting when publishing fails.
+type busPublisher struct {
+	url string
+	mu  sync.Mutex
+	bus msgbus.Bus
+}
+
+// publish sends body as JSON to subject, retrying once on a new connection:
+// an idle connection may have been dropped by the server.
+func (p *busPublisher) publish(subject string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), busPublishTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if p.bus == nil {
+			if p.bus, err = msgbus.Open(ctx, p.url); err != nil {
+				return err
+			}
+		}
+		if err = p.bus.Publish(ctx, subject, data); err == nil {
+			return nil
+		}
+		p.bus.Close()
+		p.bus = nil
+		if attempt > 0 || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// consumeBus consumes backup requests from MESSAGE_BUS_SUBJECT until
+// Shutdown, reconnecting after connection failures.
+func (s *Service) consumeBus() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.stopCh
+		cancel()
+	}()
+
+	group := s.config.MessageBusGroup
+	if group == "" {
+		group, _ = os.Hostname()
+	}
+	for ctx.Err() == nil {
+		bus, err := msgbus.Open(ctx, s.config.MessageBusURL)
+		if err == nil {
+			s.logger.Info("Consuming backup requests from the message bus", zap.String("subject", s.config.MessageBusSubject))
+			err = bus.Consume(ctx, s.config.MessageBusSubject, group, func(data []byte) {
+				s.handleBusRequest(ctx, data)
+			})
+			bus.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("Message bus unavailable, reconnecting", zap.Duration("retry_in", busRetryInterval), zap.Error(err))
+		select {
+		case <-ctx.Done():
+		case <-time.After(busRetryInterval):
+		}
+	}
+}
+
+// handleBusRequest starts the backup a message asks for. Requests for
+// projects or groups not configured here are ignored: several instances may
+// listen on the same subject, each backing up its own projects. Requests
+// that can't start are answered with a "rejected" event right away.
+func (s *Service) handleBusRequest(ctx context.Context, data []byte) {
+	var req busRequest
+	if err := json.Unmarshal(data, &req); err != nil || (req.Project == "") == (req.Group == "") {
+		s.logger.Warn("Ignoring invalid backup request from the message bus", zap.ByteString("message", data))
+		s.publishBusEvent(req, map[string]interface{}{"status": "rejected", "error": "invalid request: expected JSON with either project or group"})
+		return
+	}
+	req.Project, req.Group = strings.ToLower(req.Project), strings.ToLower(req.Group)
+	if req.Project != "" && s.GetDatabase(req.Project) == nil || req.Group != "" && len(s.groupDatabases(req.Group)) == 0 {
+		s.logger.Debug("Ignoring backup request for a project or group not configured here", zap.String("project", req.Project), zap.String("group", req.Group))
+		return
+	}
+
+	tags, err := backup.NormalizeTags(req.Tags)
+	if err == nil {
+		if req.Group != "" {
+			err = s.CheckGroupRunnable(ctx, req.Group)
+		} else {
+			err = s.CheckRunnable(ctx, req.Project)
+		}
+	}
+	if err != nil {
+		s.logger.Warn("Rejected backup request from the message bus", zap.String("project", req.Project), zap.String("group", req.Group), zap.Error(err))
+		s.publishBusEvent(req, map[string]interface{}{"status": "rejected", "error": redact.String(err.Error())})
+		return
+	}
+
+	s.logger.Info("Backup requested through the message bus", zap.String("project", req.Project), zap.String("group", req.Group), zap.String("request_id", req.ID))
+	go func() {
+		runCtx := WithTrigger(backup.WithTags(context.Background(), tags), TriggerBus)
+		var result map[string]interface{}
+		var err error
+		if req.Group != "" {
+			result, err = s.RunBackupGroup(runCtx, req.Group)
+		} else {
+			result, err = s.RunBackupForProject(runCtx, req.Project)
+		}
+		event := map[string]interface{}{"status": "failed"}
+		if err != nil {
+			event["error"] = redact.String(err.Error())
+		} else {
+			event["status"] = result["status"]
+			event["result"] = result
+		}
+		s.publishBusEvent(req, event)
+	}()
+}
+
+// publishBusEvent publishes the completion event of a backup request to
+// MESSAGE_BUS_EVENTS_SUBJECT. A failed publish is only logged.
+func (s *Service) publishBusEvent(req busRequest, event map[string]interface{}) {
+	if s.busPublisher == nil {
+		return
+	}
+	event["type"] = "backup_completed"
+	event["request_id"] = req.ID
+	event["timestamp"] = time.Now().Format(time.RFC3339)
+	if req.Group != "" {
+		event["group"] = req.Group
+	} else {
+		event["project"] = req.Project
+	}
+	if err := s.busPublisher.publish(s.config.MessageBusEventsSubject, event); err != nil {
+		s.logger.Warn("Failed to publish backup event", zap.String("request_id", req.ID), zap.Error(err))
+	}
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"go.uber.org/zap"
+)
+
+// Digest summarizes all projects over a period, for the scheduled digest
+// reports (DIGEST_CRON) and GET /digest.
+type Digest struct {
+	Instance    string `json:"instance,omitempty"`
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+	// Succeeded and Failed count the backups started in the period
+	Succeeded     int             `json:"succeeded"`
+	Failed        int             `json:"failed"`
+	StoredBytes   int64           `json:"stored_bytes"`
+	StoredBackups int             `json:"stored_backups"`
+	Projects      []DigestProject `json:"projects"`
+}
+
+// DigestProject is a project's part of a digest.
+type DigestProject struct {
+	Project string `json:"project"`
+	// LastSuccessAt is the finish time of the latest successful backup,
+	// whether or not it is in the period
+	LastSuccessAt           string `json:"last_success_at,omitempty"`
+	SecondsSinceLastSuccess *int64 `json:"seconds_since_last_success,omitempty"`
+	Succeeded               int    `json:"succeeded"`
+	Failed                  int    `json:"failed"`
+	// LastError is the error of the period's latest failed backup
+	LastError     string `json:"last_error,omitempty"`
+	StoredBytes   int64  `json:"stored_bytes"`
+	StoredBackups int    `json:"stored_backups"`
+	// LatestFullBytes is the archive size of the latest successful full
+	// backup. GrowthBytes and GrowthPercent compare it with the latest one
+	// before the period, if there is one
+	LatestFullBytes int64      `json:"latest_full_bytes,omitempty"`
+	GrowthBytes     *int64     `json:"growth_bytes,omitempty"`
+	GrowthPercent   *float64   `json:"growth_percent,omitempty"`
+	RPO             *RPOStatus `json:"rpo,omitempty"`
+}
+
+// Digest summarizes the configured projects over the period before end.
+func (s *Service) Digest(period time.Duration, end time.Time) (*Digest, error) {
+	start := end.Add(-period)
+	digest := &Digest{
+		Instance:    s.config.InstanceName,
+		PeriodStart: start.Format(time.RFC3339),
+		PeriodEnd:   end.Format(time.RFC3339),
+		Projects:    []DigestProject{},
+	}
+
+	for _, db := range s.GetDatabases() {
+		backups, err := s.ListBackups(db.Identifier, nil)
+		if err != nil {
+			return nil, err
+		}
+		project := DigestProject{Project: db.Identifier, StoredBackups: len(backups)}
+
+		var before, latest int64
+		var lastFailed string
+		for _, entry := range backups {
+			project.StoredBytes += entry.SizeBytes
+			started := entryStarted(entry)
+			if entry.Status == "success" && entry.BackupType != "incremental" {
+				latest = entry.SizeBytes
+				if started.Before(start) {
+					before = entry.SizeBytes
+				}
+			}
+			if started.Before(start) || started.After(end) {
+				continue
+			}
+			switch entry.Status {
+			case "success":
+				project.Succeeded++
+			case "failed":
+				project.Failed++
+				if entry.StartedAt >= lastFailed {
+					lastFailed = entry.StartedAt
+					project.LastError = redact.String(entry.Error)
+				}
+			}
+		}
+		project.LatestFullBytes = latest
+		if before > 0 && latest > 0 {
+			growth := latest - before
+			percent := math.Round(float64(growth)/float64(before)*1000) / 10
+			project.GrowthBytes = &growth
+			project.GrowthPercent = &percent
+		}
+
+		last, err := s.LastSuccessfulBackup(db.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			project.LastSuccessAt = last.FinishedAt
+			if finished := last.FinishedTime(); !finished.IsZero() {
+				since := int64(end.Sub(finished).Seconds())
+				project.SecondsSinceLastSuccess = &since
+			}
+		}
+		if project.RPO, err = s.ProjectRPO(db.Identifier); err != nil {
+			return nil, err
+		}
+
+		digest.Succeeded += project.Succeeded
+		digest.Failed += project.Failed
+		digest.StoredBytes += project.StoredBytes
+		digest.StoredBackups += project.StoredBackups
+		digest.Projects = append(digest.Projects, project)
+	}
+	sort.Slice(digest.Projects, func(i, j int) bool {
+		return digest.Projects[i].Project < digest.Projects[j].Project
+	})
+	return digest, nil
+}
+
+// Title is the digest's one-line summary, used as the email subject.
+func (d *Digest) Title() string {
+	title := "Backup digest"
+	if d.Instance != "" {
+		title += " (" + d.Instance + ")"
+	}
+	title += fmt.Sprintf(": %d projects, %d backups", len(d.Projects), d.Succeeded+d.Failed)
+	if d.Failed > 0 {
+		title += fmt.Sprintf(", %d failed", d.Failed)
+	}
+	return title
+}
+
+// Markdown renders the digest as a Markdown table for chat webhooks.
+func (d *Digest) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s**\n\n", d.Title())
+	fmt.Fprintf(&b, "%s to %s: %d succeeded, %d failed, %s stored in %d backups\n\n",
+		d.PeriodStart, d.PeriodEnd, d.Succeeded, d.Failed, formatBytes(d.StoredBytes), d.StoredBackups)
+	b.WriteString("| Project | Last success | Succeeded | Failed | Stored | Growth | RPO |\n")
+	b.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, p := range d.Projects {
+		fmt.Fprintf(&b, "| %s | %s | %d | %d | %s | %s | %s |\n",
+			p.Project, p.lastSuccess(), p.Succeeded, p.Failed, formatBytes(p.StoredBytes), p.growth(), p.rpo())
+	}
+	var failures []string
+	for _, p := range d.Projects {
+		if p.LastError != "" {
+			failures = append(failures, fmt.Sprintf("- **%s**: %s", p.Project, strings.ReplaceAll(p.LastError, "\n", " ")))
+		}
+	}
+	if len(failures) > 0 {
+		b.WriteString("\nFailures:\n" + strings.Join(failures, "\n") + "\n")
+	}
+	return b.String()
+}
+
+var digestHTML = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif">
+<h2>{{.Title}}</h2>
+<p>{{.PeriodStart}} to {{.PeriodEnd}}: {{.Succeeded}} succeeded, {{.Failed}} failed, {{.StoredSize}} stored in {{.StoredBackups}} backups</p>
+<table cellpadding="6" style="border-collapse: collapse" border="1">
+<tr><th>Project</th><th>Last success</th><th>Succeeded</th><th>Failed</th><th>Stored</th><th>Growth</th><th>RPO</th></tr>
+{{range .Rows}}<tr{{if .Alert}} style="background: #fde2e2"{{end}}><td>{{.Project}}</td><td>{{.LastSuccess}}</td><td>{{.Succeeded}}</td><td>{{.Failed}}</td><td>{{.Stored}}</td><td>{{.Growth}}</td><td>{{.RPO}}</td></tr>
+{{end}}</table>
+{{if .Failures}}<h3>Failures</h3>
+<ul>{{range .Failures}}<li><b>{{.Project}}</b>: {{.LastError}}</li>{{end}}</ul>{{end}}
+</body></html>
+`))
+
+// HTML renders the digest as an HTML email body. Projects with failures or a
+// breached RPO target are highlighted.
+func (d *Digest) HTML() (string, error) {
+	type row struct {
+		Project, LastSuccess, Stored, Growth, RPO string
+		Succeeded, Failed                         int
+		Alert                                     bool
+	}
+	data := struct {
+		*Digest
+		Title      string
+		StoredSize string
+		Rows       []row
+		Failures   []DigestProject
+	}{Digest: d, Title: d.Title(), StoredSize: formatBytes(d.StoredBytes)}
+	for _, p := range d.Projects {
+		data.Rows = append(data.Rows, row{
+			Project:     p.Project,
+			LastSuccess: p.lastSuccess(),
+			Stored:      formatBytes(p.StoredBytes),
+			Growth:      p.growth(),
+			RPO:         p.rpo(),
+			Succeeded:   p.Succeeded,
+			Failed:      p.Failed,
+			Alert:       p.Failed > 0 || p.RPO != nil && !p.RPO.Compliant,
+		})
+		if p.LastError != "" {
+			data.Failures = append(data.Failures, p)
+		}
+	}
+	var b bytes.Buffer
+	if err := digestHTML.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (p DigestProject) lastSuccess() string {
+	if p.LastSuccessAt == "" {
+		return "never"
+	}
+	if p.SecondsSinceLastSuccess == nil {
+		return p.LastSuccessAt
+	}
+	ago := (time.Duration(*p.SecondsSinceLastSuccess) * time.Second).Truncate(time.Minute)
+	return fmt.Sprintf("%s (%s ago)", p.LastSuccessAt, ago)
+}
+
+func (p DigestProject) growth() string {
+	if p.GrowthBytes == nil {
+		return "-"
+	}
+	sign := "+"
+	if *p.GrowthBytes < 0 {
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%s (%s%.1f%%)", sign, formatBytes(max(*p.GrowthBytes, -*p.GrowthBytes)), sign, max(*p.GrowthPercent, -*p.GrowthPercent))
+}
+
+func (p DigestProject) rpo() string {
+	switch {
+	case p.RPO == nil:
+		return "-"
+	case p.RPO.Compliant:
+		return "met"
+	default:
+		return "breached"
+	}
+}
+
+// formatBytes formats a size with decimal units, e.g. "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// sendDigest is the cron callback of DIGEST_CRON. It sends the digest of the
+// past DIGEST_PERIOD to DIGEST_URL and DIGEST_EMAIL_TO.
+func (s *Service) sendDigest() {
+	if err := s.SendDigest(s.config.DigestPeriod); err != nil {
+		s.logger.Error("Failed to send digest", zap.Error(err))
+	}
+}
+
+// SendDigest sends the digest of the past period to every configured
+// receiver, trying all of them before returning an error.
+func (s *Service) SendDigest(period time.Duration) error {
+	if s.config.DigestURL == "" && s.config.DigestEmailTo == "" {
+		return fmt.Errorf("no digest receivers configured (DIGEST_URL, DIGEST_EMAIL_TO)")
+	}
+	digest, err := s.Digest(period, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	if s.config.DigestURL != "" {
+		if err := postJSON(s.config.DigestURL, map[string]interface{}{"text": digest.Markdown(), "digest": digest}); err != nil {
+			s.logger.Error("Failed to POST digest", zap.Error(err))
+			failed = append(failed, "DIGEST_URL: "+err.Error())
+		}
+	}
+	if s.config.DigestEmailTo != "" {
+		if err := s.emailDigest(digest); err != nil {
+			s.logger.Error("Failed to email digest", zap.Error(err))
+			failed = append(failed, "DIGEST_EMAIL_TO: "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	s.logger.Info("Sent digest", zap.String("period_start", digest.PeriodStart), zap.Int("failed_backups", digest.Failed))
+	return nil
+}
+
+// emailDigest sends the digest as an HTML email through SMTP_HOST, with
+// STARTTLS if the server offers it. Credentials are only sent over TLS or to
+// localhost (net/smtp's PlainAuth).
+func (s *Service) emailDigest(digest *Digest) error {
+	from, err := mail.ParseAddress(s.config.SMTPFrom)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	recipients, err := mail.ParseAddressList(s.config.DigestEmailTo)
+	if err != nil {
+		return fmt.Errorf("invalid DIGEST_EMAIL_TO: %w", err)
+	}
+	body, err := digest.HTML()
+	if err != nil {
+		return err
+	}
+
+	to := make([]string, len(recipients))
+	header := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		to[i] = recipient.Address
+		header[i] = recipient.String()
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(header, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mimeHeader(digest.Title()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.config.SMTPUsername, s.config.SMTPPassword, s.config.SMTPHost)
+	}
+	addr := net.JoinHostPort(s.config.SMTPHost, strconv.Itoa(s.config.SMTPPort))
+	return smtp.SendMail(addr, auth, from.Address, to, msg.Bytes())
+}
+
+// mimeHeader encodes a header value that isn't plain ASCII.
+func mimeHeader(value string) string {
+	for _, r := range value {
+		if r > 127 {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
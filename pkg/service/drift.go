@@ -0,0 +1,32 @@
+package service
+
+import (
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"go.uber.org/zap"
+)
+
+// reportSchemaDrift adds the schema changes of a backup to its result and
+// POSTs them as JSON to SCHEMA_DRIFT_URL. A failed notification is only
+// logged.
+func (s *Service) reportSchemaDrift(result map[string]interface{}, manifest *backup.BackupManifest) {
+	drift := manifest.SchemaDrift
+	if drift == nil || !drift.Changed() {
+		return
+	}
+	result["schema_drift"] = drift
+	if s.config.SchemaDriftURL == "" {
+		return
+	}
+
+	body := map[string]interface{}{
+		"project":      manifest.DatabaseID,
+		"run_id":       manifest.RunID,
+		"finished_at":  manifest.FinishedAt,
+		"schema_drift": drift,
+	}
+	if err := postJSON(s.config.SchemaDriftURL, body); err != nil {
+		s.logger.Warn("Failed to send schema drift notification", zap.String("database", manifest.DatabaseID), zap.String("run_id", manifest.RunID), zap.Error(err))
+		return
+	}
+	s.logger.Info("Sent schema drift notification", zap.String("database", manifest.DatabaseID), zap.String("run_id", manifest.RunID))
+}
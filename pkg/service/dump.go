@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+)
+
+// Dump streams a one-off plain SQL dump of a project to w, for piping into
+// psql. It isn't stored or counted as a backup, runs alongside scheduled
+// backups and is bounded by the project's BACKUP_TIMEOUT.
+func (s *Service) Dump(ctx context.Context, projectID string, w io.Writer) error {
+	db := s.GetDatabase(projectID)
+	if db == nil {
+		return fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+	if err := docker.CheckDocker(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrDockerUnavailable, err)
+	}
+
+	ctx, cancel := s.backupContext(ctx, db.Identifier)
+	defer cancel()
+	return s.backupRunner.Dump(ctx, db, w)
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+)
+
+var (
+	// ErrBackupNotFound is returned when a requested backup doesn't exist on disk.
+	ErrBackupNotFound = errors.New("backup not found")
+	// ErrProjectNotFound is returned for projects that aren't configured.
+	ErrProjectNotFound = errors.New("project not found")
+	// ErrGroupNotFound is returned for groups no configured project is in.
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrAlreadyRunning is returned when a backup job is already in progress.
+	ErrAlreadyRunning = errors.New("backup job is already running")
+	// ErrProjectRunning is returned when a backup of the project is already in progress.
+	ErrProjectRunning = errors.New("backup of the project is already running")
+	// ErrRetentionRunning is returned when a retention run is already in progress.
+	ErrRetentionRunning = errors.New("retention is already running")
+	// ErrRehearsalRunning is returned when restore rehearsals are already in progress.
+	ErrRehearsalRunning = errors.New("rehearsals are already running")
+	// ErrDockerUnavailable is returned when the Docker daemon can't be reached.
+	ErrDockerUnavailable = errors.New("docker unavailable")
+	// ErrStorageFull is returned when the backup directory has no space left.
+	ErrStorageFull = errors.New("backup storage is full")
+	// ErrQuotaExceeded is returned when a backup doesn't fit a project's or
+	// namespace's quota.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrNotShareable is returned when a backup has no remote copy that can
+	// hand out download URLs.
+	ErrNotShareable = errors.New("backup has no shareable remote copy")
+	// ErrFileNotFound is returned for files that can't be read from a
+	// backup's archive, see OpenBackupFile.
+	ErrFileNotFound = errors.New("file not found in backup")
+	// ErrShuttingDown is returned for backups requested after Shutdown was
+	// called.
+	ErrShuttingDown = errors.New("the service is shutting down")
+)
+
+// CheckRunnable reports why a backup of projectID (or of all projects when
+// empty) can't start right now. It lets callers that run backups in the
+// background reject a trigger up front with a specific error.
+func (s *Service) CheckRunnable(ctx context.Context, projectID string) error {
+	if s.shuttingDown() {
+		return ErrShuttingDown
+	}
+	if projectID != "" && s.GetDatabase(projectID) == nil {
+		return fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+
+	// A project's backup only waits for another backup of the same project
+	if projectID != "" {
+		if s.ProjectRunning(projectID) {
+			return fmt.Errorf("%w: %s", ErrProjectRunning, projectID)
+		}
+	} else {
+		running, err := s.GetRunning()
+		if err != nil {
+			return fmt.Errorf("failed to get running status: %w", err)
+		}
+		if running {
+			return ErrAlreadyRunning
+		}
+	}
+
+	if err := docker.CheckDocker(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrDockerUnavailable, err)
+	}
+
+	// Pruning quotas make room once the backup runs
+	if projectID != "" {
+		if err := s.enforceQuotas(projectID, false); err != nil {
+			return err
+		}
+	}
+
+	return s.checkStorageWritable()
+}
+
+// checkStorageWritable writes and removes a small file in the backup
+// directory's temp area, where dumps are written first.
+func (s *Service) checkStorageWritable() error {
+	if err := os.MkdirAll(s.tempBaseDir(), 0755); err != nil {
+		return storageError(err)
+	}
+
+	probe, err := os.CreateTemp(s.tempBaseDir(), "write-check-")
+	if err != nil {
+		return storageError(err)
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+
+	if _, err := probe.Write(make([]byte, 4096)); err != nil {
+		return storageError(err)
+	}
+	return storageError(probe.Sync())
+}
+
+// storageError marks out-of-space errors with ErrStorageFull.
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %v", ErrStorageFull, err)
+	}
+	return fmt.Errorf("backup directory is not writable: %w", err)
+}
+
+// failedResult is the run report entry of a backup that failed in phase
+// before CreateBackup could describe it.
+func failedResult(projectID, phase string, err error) map[string]interface{} {
+	failure := backup.ClassifyFailure(err)
+	if errors.Is(err, ErrQuotaExceeded) {
+		failure = backup.FailureQuota
+	}
+	return map[string]interface{}{
+		"database_identifier": projectID,
+		"status":              "failed",
+		"error":               redact.String(err.Error()),
+		"failure":             failure,
+		"failed_phase":        phase,
+	}
+}
+
+// setFailure adds the failure cause and phase of manifest to its run report
+// entry. A backup stored locally but not on every remote is partial: it can
+// be restored, but not from everywhere it should be.
+func setFailure(result map[string]interface{}, manifest *backup.BackupManifest) {
+	if manifest.Failure != "" {
+		result["failure"] = manifest.Failure
+		result["failed_phase"] = manifest.FailedPhase
+		return
+	}
+	for _, stored := range manifest.Storage {
+		if stored.Status != "success" {
+			result["status"] = "partial"
+			result["failure"] = backup.FailureUpload
+			result["failed_phase"] = backup.PhaseUpload
+			return
+		}
+	}
+}
+
+// runFailures groups the projects of a run report by failure cause, for
+// routing alerts ("connection_failed": ["app", "crm"]).
+func runFailures(results []interface{}) map[string][]string {
+	failures := make(map[string][]string)
+	for _, r := range results {
+		result, _ := r.(map[string]interface{})
+		if failure, ok := result["failure"].(string); ok {
+			projectID, _ := result["database_identifier"].(string)
+			failures[failure] = append(failures[failure], projectID)
+		}
+	}
+	return failures
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"go.uber.org/zap"
+)
+
+// Lifecycle event types published to EVENTS_URL.
+const (
+	EventRunStarted             = "run_started"
+	EventProjectBackupSucceeded = "project_backup_succeeded"
+	EventProjectBackupFailed    = "project_backup_failed"
+	EventUploadCompleted        = "upload_completed"
+	EventRetentionPruned        = "retention_pruned"
+	EventRPOBreached            = "rpo_breached"
+	EventRPORecovered           = "rpo_recovered"
+)
+
+// eventBuffer is how many events may wait for delivery; further events are
+// dropped rather than holding up backups behind a slow receiver.
+const eventBuffer = 256
+
+// eventSender delivers lifecycle events in order, one at a time, to a
+// webhook or a message bus subject.
+type eventSender struct {
+	url       string
+	subject   string
+	publisher *busPublisher // nil for webhooks
+	instance  string
+	queue     chan map[string]interface{}
+	// done is closed when deliverEvents has returned
+	done chan struct{}
+}
+
+// newEventSender creates a sender whose events name instance, or the
+// hostname if it is empty.
+func newEventSender(url, subject, instance string) *eventSender {
+	sender := &eventSender{url: url, subject: subject, queue: make(chan map[string]interface{}, eventBuffer), done: make(chan struct{})}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		sender.publisher = &busPublisher{url: url}
+	}
+	sender.instance = instance
+	if sender.instance == "" {
+		sender.instance, _ = os.Hostname()
+	}
+	return sender
+}
+
+// emitEvent queues a lifecycle event of eventType with fields. Without
+// EVENTS_URL it does nothing.
+func (s *Service) emitEvent(eventType string, fields map[string]interface{}) {
+	if s.events == nil {
+		return
+	}
+	event := map[string]interface{}{
+		"type":      eventType,
+		"timestamp": time.Now().Format(time.RFC3339),
+		"instance":  s.events.instance,
+	}
+	for key, value := range fields {
+		event[key] = value
+	}
+	select {
+	case s.events.queue <- event:
+	default:
+		s.logger.Warn("Event queue full, dropping event", zap.String("type", eventType))
+	}
+}
+
+// deliverEvents sends queued events until Shutdown, and then those still
+// queued, so a process exiting after a backup (backup --once) doesn't drop
+// its events. Failed deliveries are logged and not retried.
+func (s *Service) deliverEvents() {
+	defer close(s.events.done)
+	for {
+		select {
+		case <-s.stopCh:
+			for {
+				select {
+				case event := <-s.events.queue:
+					s.deliverEvent(event)
+				default:
+					return
+				}
+			}
+		case event := <-s.events.queue:
+			s.deliverEvent(event)
+		}
+	}
+}
+
+func (s *Service) deliverEvent(event map[string]interface{}) {
+	var err error
+	if s.events.publisher != nil {
+		err = s.events.publisher.publish(s.events.subject, event)
+	} else {
+		err = postJSON(s.events.url, event)
+	}
+	if err != nil {
+		s.logger.Warn("Failed to deliver event", zap.Any("type", event["type"]), zap.Error(err))
+	}
+}
+
+// emitBackupEvent publishes the outcome of a project's backup: its result in
+// the run report, or err if it failed before producing one. Skipped backups
+// emit nothing.
+func (s *Service) emitBackupEvent(project, trigger string, result map[string]interface{}, err error) {
+	if err != nil {
+		s.emitEvent(EventProjectBackupFailed, map[string]interface{}{
+			"project": project,
+			"trigger": trigger,
+			"status":  "failed",
+			"error":   redact.String(err.Error()),
+		})
+		return
+	}
+	fields := map[string]interface{}{"project": project, "trigger": trigger}
+	for _, key := range []string{"run_id", "status", "error", "failure", "failed_phase", "tags", "stats", "phase_ms", "storage"} {
+		if value, ok := result[key]; ok && value != "" {
+			fields[key] = value
+		}
+	}
+	switch result["status"] {
+	case "success", "partial":
+		s.emitEvent(EventProjectBackupSucceeded, fields)
+	case "failed":
+		s.emitEvent(EventProjectBackupFailed, fields)
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// GroupInfo describes a project group (BACKUP_<PROJECT>_GROUP).
+type GroupInfo struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects"`
+	// Cron is the group's own schedule (GROUP_<NAME>_CRON); its projects are
+	// left out of the global job. Empty when the group uses BACKUP_CRON
+	Cron          string `json:"cron,omitempty"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// Groups returns the groups of the configured projects, sorted by name.
+func (s *Service) Groups() []GroupInfo {
+	projects := make(map[string][]string)
+	for _, db := range s.databases {
+		if group := s.config.ProjectGroup(db.Identifier); group != "" {
+			projects[group] = append(projects[group], db.Identifier)
+		}
+	}
+
+	groups := make([]GroupInfo, 0, len(projects))
+	for name, ids := range projects {
+		sort.Strings(ids)
+		groups = append(groups, GroupInfo{
+			Name:          name,
+			Projects:      ids,
+			Cron:          s.config.GroupOption(name, "CRON", ""),
+			RetentionDays: s.config.ProjectRetentionDays(ids[0]),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// groupDatabases returns the projects in group.
+func (s *Service) groupDatabases(group string) []*database.Database {
+	var databases []*database.Database
+	for _, db := range s.databases {
+		if s.config.ProjectGroup(db.Identifier) == group {
+			databases = append(databases, db)
+		}
+	}
+	return databases
+}
+
+// scheduledDatabases returns the projects a cron job backs up: those of a
+// group with its own schedule, or for the global job ("") all others.
+func (s *Service) scheduledDatabases(group string) []*database.Database {
+	if group != "" {
+		return s.groupDatabases(group)
+	}
+	var databases []*database.Database
+	for _, db := range s.databases {
+		if _, ok := s.groupEntries[s.config.ProjectGroup(db.Identifier)]; !ok {
+			databases = append(databases, db)
+		}
+	}
+	return databases
+}
+
+// scheduleFor returns the schedule a project is backed up on, or nil if the
+// scheduler isn't set up.
+func (s *Service) scheduleFor(projectID string) cron.Schedule {
+	if s.cron == nil {
+		return nil
+	}
+	if id, ok := s.groupEntries[s.config.ProjectGroup(projectID)]; ok {
+		return s.cron.Entry(id).Schedule
+	}
+	return s.cron.Entry(s.cronEntry).Schedule
+}
+
+// scheduleGroups adds a cron entry for every group with its own schedule.
+func (s *Service) scheduleGroups(c *cron.Cron) error {
+	s.groupEntries = make(map[string]cron.EntryID)
+	for _, group := range s.Groups() {
+		if group.Cron == "" {
+			continue
+		}
+		name := group.Name
+		id, err := c.AddFunc(cronSpec(group.Cron), func() { s.runScheduled(name) })
+		if err != nil {
+			return fmt.Errorf("invalid cron expression for group %s: %w", name, err)
+		}
+		s.groupEntries[name] = id
+		s.logger.Info("Scheduled group backups",
+			zap.String("group", name),
+			zap.String("cron", group.Cron),
+			zap.Strings("projects", group.Projects))
+	}
+	for name := range s.config.GroupOptions {
+		if len(s.groupDatabases(name)) == 0 {
+			s.logger.Warn("Group has settings but no projects", zap.String("group", name))
+		}
+	}
+	return nil
+}
+
+// cronSpec drops the seconds field of a 6-field expression; robfig/cron/v3
+// expects 5 fields (minute hour day month weekday).
+func cronSpec(expr string) string {
+	if parts := strings.Fields(expr); len(parts) == 6 {
+		return strings.Join(parts[1:], " ")
+	}
+	return expr
+}
+
+// RunBackupGroup backs up the projects of a group as one job, like
+// RunBackupJob, applying retention with the group's RETENTION_DAYS.
+func (s *Service) RunBackupGroup(ctx context.Context, group string) (map[string]interface{}, error) {
+	databases := s.groupDatabases(group)
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, group)
+	}
+	return s.runBackupJob(ctx, databases, group)
+}
+
+// CheckGroupRunnable is CheckRunnable for a group job.
+func (s *Service) CheckGroupRunnable(ctx context.Context, group string) error {
+	if len(s.groupDatabases(group)) == 0 {
+		return fmt.Errorf("%w: %s", ErrGroupNotFound, group)
+	}
+	return s.CheckRunnable(ctx, "")
+}
+
+// NextRunsForGroup returns the next n scheduled backups of a group's projects.
+func (s *Service) NextRunsForGroup(group string, n int) []time.Time {
+	databases := s.groupDatabases(group)
+	if len(databases) == 0 {
+		return nil
+	}
+	return nextRuns(s.scheduleFor(databases[0].Identifier), n)
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+)
+
+// healthCheckTimeout bounds each check that talks to another process, so a
+// hanging Docker daemon, remote or database fails its check instead of
+// holding the probe until the prober gives up.
+const healthCheckTimeout = 5 * time.Second
+
+// healthProbeKey is looked up on remotes by the deep health check. It
+// doesn't exist; a "not found" answer means the remote is reachable.
+const healthProbeKey = ".healthz"
+
+// HealthCheck is the result of one dependency check; Error is empty if it
+// passed.
+type HealthCheck struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Readiness checks what backups depend on right now: that the Docker daemon
+// answers and that LOCAL_BACKUP_DIR (and STAGING_DIR) is writable. The configuration was
+// checked when the service was created.
+func (s *Service) Readiness(ctx context.Context) []HealthCheck {
+	return []HealthCheck{
+		{Name: "config", OK: true},
+		runHealthCheck("docker", func() error { return checkDocker(ctx) }),
+		runHealthCheck("storage", s.checkWritable),
+	}
+}
+
+// DeepHealth checks every dependency individually: the Docker daemon, the
+// backup directory, each remote, and with databases each project's source
+// database. The checks run concurrently; the result is in that order,
+// remotes and databases sorted by name.
+func (s *Service) DeepHealth(ctx context.Context, databases bool) []HealthCheck {
+	names := []string{"docker", "storage"}
+	checks := []func() error{
+		func() error { return checkDocker(ctx) },
+		s.checkWritable,
+	}
+
+	remotes := make([]string, 0, len(s.backends))
+	for remote := range s.backends {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	for _, remote := range remotes {
+		backend := s.backends[remote]
+		names = append(names, "remote:"+backend.Name())
+		checks = append(checks, func() error { return checkRemote(ctx, backend) })
+	}
+
+	if databases {
+		dbs := append([]*database.Database(nil), s.databases...)
+		sort.Slice(dbs, func(i, j int) bool { return dbs[i].Identifier < dbs[j].Identifier })
+		for _, db := range dbs {
+			names = append(names, "database:"+db.Identifier)
+			checks = append(checks, func() error { return checkDatabase(ctx, db.ConnectionURL) })
+		}
+	}
+
+	results := make([]HealthCheck, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runHealthCheck(names[i], checks[i])
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// runHealthCheck runs check and records how long it took.
+func runHealthCheck(name string, check func() error) HealthCheck {
+	started := time.Now()
+	err := check()
+	result := HealthCheck{Name: name, OK: err == nil, LatencyMs: time.Since(started).Milliseconds()}
+	if err != nil {
+		result.Error = redact.String(err.Error())
+	}
+	return result
+}
+
+func checkDocker(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return docker.CheckDocker(ctx)
+}
+
+// checkRemote looks up healthProbeKey on backend, which takes a round trip
+// to the remote (and its credentials) without listing the backups.
+func checkRemote(ctx context.Context, backend storage.Backend) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if _, err := backend.Stat(ctx, healthProbeKey); err != nil && !errors.Is(err, storage.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// checkDatabase connects to the source database the way metrics collection
+// does and pings it.
+func checkDatabase(ctx context.Context, connURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, connURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	return conn.Ping(ctx)
+}
+
+// checkWritable creates and removes a file in the backup directory and in
+// STAGING_DIR if set.
+func (s *Service) checkWritable() error {
+	if err := checkDirWritable(s.baseDir, "backup directory"); err != nil {
+		return err
+	}
+	if s.config.StagingDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.config.StagingDir, 0755); err != nil {
+		return fmt.Errorf("staging directory is not writable: %w", err)
+	}
+	return checkDirWritable(s.config.StagingDir, "staging directory")
+}
+
+func checkDirWritable(dir, what string) error {
+	file, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", what, err)
+	}
+	name := file.Name()
+	_, err = file.WriteString("ok")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", what, err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package service
+
+import "fmt"
+
+// lockProject marks a backup of projectID as running until release is called.
+// It fails with ErrProjectRunning if one already is, so a project is never
+// dumped twice at once while different projects can be backed up
+// concurrently (a manual trigger during a scheduled job).
+func (s *Service) lockProject(projectID string) (release func(), err error) {
+	s.projectMu.Lock()
+	defer s.projectMu.Unlock()
+	if s.projectsRunning[projectID] {
+		return nil, fmt.Errorf("%w: %s", ErrProjectRunning, projectID)
+	}
+	s.projectsRunning[projectID] = true
+	return func() {
+		s.projectMu.Lock()
+		delete(s.projectsRunning, projectID)
+		s.projectMu.Unlock()
+	}, nil
+}
+
+// ProjectRunning reports whether a backup of projectID is running.
+func (s *Service) ProjectRunning(projectID string) bool {
+	s.projectMu.Lock()
+	defer s.projectMu.Unlock()
+	return s.projectsRunning[projectID]
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// metricFamily is a gauge in the Prometheus text format.
+type metricFamily struct {
+	name    string
+	help    string
+	samples []string
+
+	// labels are added to every sample, before the sample's own
+	labels []string
+}
+
+// newMetric creates a metric family whose samples carry the instance_name
+// label when INSTANCE_NAME is set.
+func (s *Service) newMetric(name, help string) *metricFamily {
+	family := &metricFamily{name: name, help: help}
+	if s.config.InstanceName != "" {
+		family.labels = []string{"instance_name", s.config.InstanceName}
+	}
+	return family
+}
+
+func (f *metricFamily) add(value float64, labels ...string) {
+	labels = append(f.labels[:len(f.labels):len(f.labels)], labels...)
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	name := f.name
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, name+" "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Metrics returns the sizes and speeds of each project's latest successful
+// backup, the space its backups take, the usage of quotas and RPO
+// compliance, in the Prometheus text format. Values come from the manifests
+// on disk, so they survive restarts.
+func (s *Service) Metrics() string {
+	lastSuccess := s.newMetric("pg_backup_last_success_timestamp_seconds", "Finish time of the latest successful backup.")
+	duration := s.newMetric("pg_backup_last_duration_seconds", "Duration of the latest successful backup.")
+	archiveBytes := s.newMetric("pg_backup_last_archive_bytes", "Compressed size of the latest successful backup.")
+	dumpBytes := s.newMetric("pg_backup_last_dump_bytes", "Uncompressed size of the dumps of the latest successful backup.")
+	ratio := s.newMetric("pg_backup_last_compression_ratio", "Uncompressed size divided by compressed size of the latest successful backup.")
+	dumpThroughput := s.newMetric("pg_backup_last_dump_throughput_bytes_per_second", "Dump throughput of the latest successful backup.")
+	uploadThroughput := s.newMetric("pg_backup_last_upload_throughput_bytes_per_second", "Archive upload throughput of the latest successful backup, per remote target.")
+	storedBytes := s.newMetric("pg_backup_stored_bytes", "Size of all local backups of a project.")
+	storedBackups := s.newMetric("pg_backup_stored_backups", "Number of local backups of a project.")
+	quotaBytes := s.newMetric("pg_backup_quota_bytes", "Size quota of a project's or namespace's backups.")
+	quotaBackups := s.newMetric("pg_backup_quota_backups", "Backup count quota of a project or namespace.")
+	quotaUsedBytes := s.newMetric("pg_backup_quota_used_bytes", "Size of the backups counted against a project's or namespace's quota.")
+	quotaUsedBackups := s.newMetric("pg_backup_quota_used_backups", "Number of backups counted against a project's or namespace's quota.")
+	quotaExceeded := s.newMetric("pg_backup_quota_exceeded", "1 if a project's or namespace's quota leaves no room for another backup.")
+	rpoTarget := s.newMetric("pg_backup_rpo_target_seconds", "RPO target of a project: how old its latest successful backup may get.")
+	rpoAge := s.newMetric("pg_backup_rpo_age_seconds", "Age of the recovery point of a project's latest successful backup, for projects with an RPO target.")
+	rpoCompliant := s.newMetric("pg_backup_rpo_compliant", "1 if a project's latest successful backup is within its RPO target.")
+	addQuota := func(quota *QuotaUsage, labels ...string) {
+		if quota.MaxBytes > 0 {
+			quotaBytes.add(float64(quota.MaxBytes), labels...)
+		}
+		if quota.MaxBackups > 0 {
+			quotaBackups.add(float64(quota.MaxBackups), labels...)
+		}
+		quotaUsedBytes.add(float64(quota.UsedBytes), labels...)
+		quotaUsedBackups.add(float64(quota.UsedBackups), labels...)
+		exceeded := 0.0
+		if quota.Exceeded {
+			exceeded = 1
+		}
+		quotaExceeded.add(exceeded, labels...)
+	}
+
+	for _, db := range s.GetDatabases() {
+		project := db.Identifier
+		backups, err := s.ListBackups(project, nil)
+		if err != nil {
+			s.logger.Warn("Failed to list backups for metrics", zap.String("project", project), zap.Error(err))
+			continue
+		}
+		var size int64
+		for _, entry := range backups {
+			size += entry.SizeBytes
+		}
+		storedBytes.add(float64(size), "project", project)
+		storedBackups.add(float64(len(backups)), "project", project)
+		if quota, err := s.ProjectQuota(project); err != nil {
+			s.logger.Warn("Failed to get quota usage for metrics", zap.String("project", project), zap.Error(err))
+		} else if quota != nil {
+			addQuota(quota, "scope", "project", "name", project)
+		}
+		if rpo, err := s.ProjectRPO(project); err != nil {
+			s.logger.Warn("Failed to get RPO status for metrics", zap.String("project", project), zap.Error(err))
+		} else if rpo != nil {
+			rpoTarget.add(float64(rpo.TargetSeconds), "project", project)
+			if rpo.AgeSeconds != nil {
+				rpoAge.add(float64(*rpo.AgeSeconds), "project", project)
+			}
+			compliant := 0.0
+			if rpo.Compliant {
+				compliant = 1
+			}
+			rpoCompliant.add(compliant, "project", project)
+		}
+
+		last, err := s.LastSuccessfulBackup(project)
+		if err != nil || last == nil {
+			continue
+		}
+		if finished := last.FinishedTime(); !finished.IsZero() {
+			lastSuccess.add(float64(finished.Unix()), "project", project)
+		}
+		duration.add((time.Duration(last.DurationMs) * time.Millisecond).Seconds(), "project", project)
+		archiveBytes.add(float64(last.SizeBytes), "project", project)
+		if last.Stats == nil {
+			continue
+		}
+		dumpBytes.add(float64(last.Stats.DumpBytes), "project", project)
+		ratio.add(last.Stats.CompressionRatio, "project", project)
+		dumpThroughput.add(last.Stats.DumpMBPerSec*1e6, "project", project)
+		targets := make([]string, 0, len(last.Stats.UploadMBPerSec))
+		for target := range last.Stats.UploadMBPerSec {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			uploadThroughput.add(last.Stats.UploadMBPerSec[target]*1e6, "project", project, "target", target)
+		}
+	}
+
+	for _, namespace := range s.Namespaces() {
+		if namespace.Quota != nil {
+			addQuota(namespace.Quota, "scope", "namespace", "name", namespace.Name)
+		}
+	}
+
+	return formatMetrics(lastSuccess, duration, archiveBytes, dumpBytes, ratio, dumpThroughput, uploadThroughput, storedBytes, storedBackups,
+		quotaBytes, quotaBackups, quotaUsedBytes, quotaUsedBackups, quotaExceeded, rpoTarget, rpoAge, rpoCompliant)
+}
+
+// formatMetrics writes families in the Prometheus text format, leaving out
+// those without samples.
+func formatMetrics(families ...*metricFamily) string {
+	var b strings.Builder
+	for _, family := range families {
+		if len(family.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", family.name, family.help, family.name)
+		for _, sample := range family.samples {
+			b.WriteString(sample + "\n")
+		}
+	}
+	return b.String()
+}
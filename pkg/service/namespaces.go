@@ -0,0 +1,64 @@
+package service
+
+import (
+	"sort"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"go.uber.org/zap"
+)
+
+// NamespaceInfo describes a namespace (BACKUP_<PROJECT>_NAMESPACE): the
+// projects of one team, with their own retention, remote and API tokens.
+type NamespaceInfo struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects"`
+	// RetentionDays applies to projects whose group doesn't set one
+	RetentionDays int `json:"retention_days"`
+	// RetentionMaxBytes caps the namespace's backups together (0 = no cap)
+	RetentionMaxBytes int64 `json:"retention_max_bytes,omitempty"`
+	// Remotes are the storage targets of projects without their own
+	Remotes []string `json:"remotes,omitempty"`
+	// Quota is the namespace's quota and its usage, if it has one
+	Quota *QuotaUsage `json:"quota,omitempty"`
+}
+
+// Namespaces returns the namespaces of the configured projects, sorted by
+// name.
+func (s *Service) Namespaces() []NamespaceInfo {
+	projects := make(map[string][]string)
+	for _, db := range s.databases {
+		if namespace := s.config.ProjectNamespace(db.Identifier); namespace != "" {
+			projects[namespace] = append(projects[namespace], db.Identifier)
+		}
+	}
+
+	namespaces := make([]NamespaceInfo, 0, len(projects))
+	for name, ids := range projects {
+		sort.Strings(ids)
+		quota, err := s.NamespaceQuota(name)
+		if err != nil {
+			s.logger.Warn("Failed to get quota usage", zap.String("namespace", name), zap.Error(err))
+		}
+		namespaces = append(namespaces, NamespaceInfo{
+			Name:              name,
+			Projects:          ids,
+			RetentionDays:     s.config.NamespaceRetentionDays(name),
+			RetentionMaxBytes: s.config.NamespaceRetentionMaxBytes(name),
+			Remotes:           splitTargets(s.config.NamespaceOption(name, "RCLONE_REMOTE", s.config.RcloneRemote)),
+			Quota:             quota,
+		})
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces
+}
+
+// namespaceDatabases returns the projects in namespace.
+func (s *Service) namespaceDatabases(namespace string) []*database.Database {
+	var databases []*database.Database
+	for _, db := range s.databases {
+		if s.config.ProjectNamespace(db.Identifier) == namespace {
+			databases = append(databases, db)
+		}
+	}
+	return databases
+}
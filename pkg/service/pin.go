@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// PinBackup exempts a backup from retention until until, or for good when
+// until is zero. Pinning a pinned backup replaces its pin.
+func (s *Service) PinBackup(projectID, runID string, until time.Time, reason string) (*catalog.Entry, error) {
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !until.IsZero() && !until.After(now) {
+		return nil, fmt.Errorf("pin expiry %s is in the past", until.Format(time.RFC3339))
+	}
+
+	pin := &catalog.Pin{PinnedAt: now.Format(time.RFC3339), Reason: reason}
+	if !until.IsZero() {
+		pin.Until = until.Format(time.RFC3339)
+	}
+	if err := catalog.SetPin(entry, pin); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Pinned backup",
+		zap.String("project", entry.Project),
+		zap.String("run_id", entry.RunID),
+		zap.String("until", pin.Until),
+		zap.String("reason", reason))
+	return entry, nil
+}
+
+// UnpinBackup lets retention delete a pinned backup again.
+func (s *Service) UnpinBackup(projectID, runID string) (*catalog.Entry, error) {
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, err
+	}
+	if err := catalog.RemovePin(entry); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Unpinned backup", zap.String("project", entry.Project), zap.String("run_id", entry.RunID))
+	return entry, nil
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"go.uber.org/zap"
+)
+
+const (
+	// progressSaveInterval throttles how often byte counts are written to
+	// running.json; phase changes are written immediately
+	progressSaveInterval = 5 * time.Second
+	// heartbeatInterval is how often running.json is refreshed while a backup
+	// runs, even if it makes no progress
+	heartbeatInterval = 30 * time.Second
+)
+
+// progressTracker records the progress of one project's backup in running.json.
+type progressTracker struct {
+	s        *Service
+	mu       sync.Mutex
+	current  metadata.RunProgress
+	lastSave time.Time
+	stop     chan struct{}
+	done     chan struct{}
+	finished sync.Once
+}
+
+// startProgress starts tracking a backup of projectID. finish must be called
+// when it ends.
+func (s *Service) startProgress(runID, projectID string) *progressTracker {
+	now := time.Now().Format(time.RFC3339)
+	t := &progressTracker{
+		s: s,
+		current: metadata.RunProgress{
+			RunID:          runID,
+			Project:        projectID,
+			Phase:          "starting",
+			StartedAt:      now,
+			PhaseStartedAt: now,
+			UpdatedAt:      now,
+			HeartbeatAt:    now,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	t.save()
+	t.mu.Unlock()
+
+	go t.heartbeat()
+	return t
+}
+
+// report is a backup.ProgressFunc.
+func (t *progressTracker) report(phase string, bytesWritten int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	phaseChanged := phase != t.current.Phase
+	if phaseChanged {
+		t.current.Phase = phase
+		t.current.PhaseStartedAt = now.Format(time.RFC3339)
+	}
+	if !phaseChanged && bytesWritten == t.current.BytesWritten {
+		return
+	}
+	t.current.BytesWritten = bytesWritten
+	t.current.UpdatedAt = now.Format(time.RFC3339)
+
+	if phaseChanged || now.Sub(t.lastSave) >= progressSaveInterval {
+		t.save()
+	}
+}
+
+func (t *progressTracker) heartbeat() {
+	defer close(t.done)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			t.current.HeartbeatAt = now.Format(time.RFC3339)
+			t.save()
+			t.mu.Unlock()
+		}
+	}
+}
+
+// save writes the current progress; t.mu must be held.
+func (t *progressTracker) save() {
+	t.lastSave = time.Now()
+	current := t.current
+	err := t.s.updateStatus(func(status *metadata.ServiceStatus) {
+		setProgress(status, current)
+	})
+	if err != nil {
+		t.s.logger.Warn("Failed to write backup progress", zap.Error(err))
+	}
+}
+
+// finish stops tracking and clears the progress from running.json. Calling
+// it more than once is harmless.
+func (t *progressTracker) finish() {
+	t.finished.Do(func() {
+		close(t.stop)
+		<-t.done
+
+		err := t.s.updateStatus(func(status *metadata.ServiceStatus) {
+			clearProgress(status, t.current.Project)
+		})
+		if err != nil {
+			t.s.logger.Warn("Failed to clear backup progress", zap.Error(err))
+		}
+	})
+}
+
+// setProgress adds or replaces the progress of a project's backup.
+func setProgress(status *metadata.ServiceStatus, progress metadata.RunProgress) {
+	backups := make([]metadata.RunProgress, 0, len(status.Backups)+1)
+	replaced := false
+	for _, backup := range status.Backups {
+		if backup.Project == progress.Project {
+			backup, replaced = progress, true
+		}
+		backups = append(backups, backup)
+	}
+	if !replaced {
+		backups = append(backups, progress)
+	}
+	status.Backups = backups
+	current := backups[0]
+	status.Current = &current
+}
+
+// clearProgress removes the progress of a project's backup.
+func clearProgress(status *metadata.ServiceStatus, projectID string) {
+	var backups []metadata.RunProgress
+	for _, backup := range status.Backups {
+		if backup.Project != projectID {
+			backups = append(backups, backup)
+		}
+	}
+	status.Backups = backups
+	status.Current = nil
+	if len(backups) > 0 {
+		current := backups[0]
+		status.Current = &current
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"go.uber.org/zap"
+)
+
+// pushMetrics sends Metrics, plus the outcome of the backup run that just
+// finished, to PUSHGATEWAY_URL, replacing what was pushed for the job before.
+// A CronJob or one-off container has exited before Prometheus would scrape
+// it, so the push happens synchronously before the run returns. Failures are
+// logged and don't affect the run.
+func (s *Service) pushMetrics(result map[string]interface{}) {
+	if s.config.PushgatewayURL == "" {
+		return
+	}
+
+	finished := s.newMetric("pg_backup_run_finished_timestamp_seconds", "Finish time of the latest backup run.")
+	duration := s.newMetric("pg_backup_run_duration_seconds", "Duration of the latest backup run.")
+	success := s.newMetric("pg_backup_run_success", "1 if every backup of the latest backup run succeeded, including its uploads.")
+	failed := s.newMetric("pg_backup_run_failed_backups", "Number of failed backups in the latest backup run.")
+	if t, err := time.Parse(time.RFC3339, stringField(result, "finished_at")); err == nil {
+		finished.add(float64(t.Unix()))
+	}
+	if ms, ok := result["duration_ms"].(int64); ok {
+		duration.add((time.Duration(ms) * time.Millisecond).Seconds())
+	}
+	succeeded := 0.0
+	if result["status"] == "success" {
+		succeeded = 1
+	}
+	success.add(succeeded)
+	// Jobs count their failed backups, a project backup is one
+	if count, ok := result["databases_failed"].(int); ok {
+		failed.add(float64(count))
+	} else if result["status"] == "failed" {
+		failed.add(1)
+	} else {
+		failed.add(0)
+	}
+
+	body := formatMetrics(finished, duration, success, failed) + s.Metrics()
+	target := fmt.Sprintf("%s/metrics/job/%s", s.config.PushgatewayURL, url.PathEscape(s.config.PushgatewayJob))
+	if s.config.InstanceName != "" {
+		// Group by instance too, so schedulers sharing a job don't replace
+		// each other's metrics
+		target += "/instance/" + url.PathEscape(s.config.InstanceName)
+	}
+	if err := putMetrics(target, body); err != nil {
+		s.logger.Warn("Failed to push metrics to the Pushgateway", zap.String("url", redact.String(s.config.PushgatewayURL)), zap.Error(err))
+		return
+	}
+	s.logger.Debug("Pushed metrics to the Pushgateway", zap.String("job", s.config.PushgatewayJob))
+}
+
+// putMetrics PUTs metrics in the text format to a Pushgateway group.
+// Credentials in the URL are sent as basic auth.
+func putMetrics(target, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reportPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+)
+
+// Trigger sources of backup jobs, see WithTrigger.
+const (
+	TriggerSchedule = "schedule"
+	TriggerAPI      = "api"
+	TriggerManual   = "manual"
+	TriggerBus      = "bus"
+	TriggerOnce     = "once"
+	TriggerCLI      = "cli"
+)
+
+// Job states in the queue.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+)
+
+// queueHistory is how many completed jobs the queue keeps.
+const queueHistory = 20
+
+type triggerKey struct{}
+
+// WithTrigger records where the backups started with ctx come from, shown in
+// the queue. Backups started without it are manual.
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+func triggerFrom(ctx context.Context) string {
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok {
+		return trigger
+	}
+	return TriggerManual
+}
+
+// QueuedJob is a backup job in the queue: a job of all projects or a group,
+// or the backup of a single project.
+type QueuedJob struct {
+	ID         string `json:"id"`
+	Trigger    string `json:"trigger"`
+	Group      string `json:"group,omitempty"`
+	State      string `json:"state"`
+	EnqueuedAt string `json:"enqueued_at"`
+	// EstimatedStart is set for pending jobs: when a scheduled job waiting
+	// out jitter or a blackout window starts
+	EstimatedStart string `json:"estimated_start,omitempty"`
+	StartedAt      string `json:"started_at,omitempty"`
+	FinishedAt     string `json:"finished_at,omitempty"`
+	// Status is the result of a completed job (success, partial, failed,
+	// cancelled)
+	Status   string          `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Projects []QueuedProject `json:"projects"`
+}
+
+// QueuedProject is a project of a queued job. A job backs up its projects one
+// at a time, so pending projects of a running job get an estimated start from
+// the durations of the last successful backups of the projects before them;
+// none if one of those has no successful backup.
+type QueuedProject struct {
+	Project        string `json:"project"`
+	State          string `json:"state"`
+	EstimatedStart string `json:"estimated_start,omitempty"`
+}
+
+// queuedJob is a job in the queue. Its projects are backed up in order, one
+// at a time; results holds the result status of those done.
+type queuedJob struct {
+	id         string
+	trigger    string
+	group      string
+	projects   []string
+	enqueuedAt time.Time
+	startAt    time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	// currentAt is when the project being backed up started
+	currentAt time.Time
+	results   []string
+	status    string
+	err       string
+}
+
+// jobQueue tracks pending, running and recently completed backup jobs. Jobs
+// don't wait in it for each other: they run as triggered and the queue only
+// reports on them.
+type jobQueue struct {
+	mu        sync.Mutex
+	seq       int
+	jobs      []*queuedJob
+	completed []*queuedJob
+}
+
+type queuedJobKey struct{}
+
+// withQueuedJob hands a job enqueued ahead of time to runBackupJob.
+func withQueuedJob(ctx context.Context, job *queuedJob) context.Context {
+	return context.WithValue(ctx, queuedJobKey{}, job)
+}
+
+func queuedJobFrom(ctx context.Context) *queuedJob {
+	job, _ := ctx.Value(queuedJobKey{}).(*queuedJob)
+	return job
+}
+
+// enqueue adds a pending job of databases starting at startAt.
+func (q *jobQueue) enqueue(trigger, group string, databases []*database.Database, startAt time.Time) *queuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	now := time.Now()
+	job := &queuedJob{
+		id:         fmt.Sprintf("job-%s-%d", now.Format("20060102-150405"), q.seq),
+		trigger:    trigger,
+		group:      group,
+		enqueuedAt: now,
+		startAt:    startAt,
+	}
+	for _, db := range databases {
+		job.projects = append(job.projects, db.Identifier)
+	}
+	q.jobs = append(q.jobs, job)
+	return job
+}
+
+// start marks a job running.
+func (q *jobQueue) start(job *queuedJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.startedAt = time.Now()
+	job.currentAt = job.startedAt
+}
+
+// progress records the result statuses of the projects backed up so far;
+// the next one starts now.
+func (q *jobQueue) progress(job *queuedJob, results []interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	statuses := make([]string, 0, len(results))
+	for _, r := range results {
+		result, _ := r.(map[string]interface{})
+		status, _ := result["status"].(string)
+		statuses = append(statuses, status)
+	}
+	if len(statuses) != len(job.results) {
+		job.currentAt = time.Now()
+	}
+	job.results = statuses
+}
+
+// finishResult finishes a job with the status and error of its result.
+func (q *jobQueue) finishResult(job *queuedJob, result map[string]interface{}, err error) {
+	status, _ := result["status"].(string)
+	errMsg, _ := result["error"].(string)
+	if err != nil {
+		status, errMsg = "failed", redact.String(err.Error())
+	}
+	q.mu.Lock()
+	if len(job.projects) == 1 && len(job.results) == 0 {
+		// A project backup has no per-project results
+		job.results = []string{status}
+	}
+	q.mu.Unlock()
+	q.finish(job, status, errMsg)
+}
+
+// finish moves a job to the completed jobs.
+func (q *jobQueue) finish(job *queuedJob, status, errMsg string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.finishedAt = time.Now()
+	job.status = status
+	job.err = errMsg
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	q.completed = append(q.completed, job)
+	if len(q.completed) > queueHistory {
+		q.completed = q.completed[len(q.completed)-queueHistory:]
+	}
+}
+
+// Queue returns the pending and running backup jobs, in the order they were
+// enqueued, followed by recently completed ones, newest first.
+func (s *Service) Queue() []QueuedJob {
+	q := &s.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	jobs := make([]QueuedJob, 0, len(q.jobs)+len(q.completed))
+	for _, job := range q.jobs {
+		jobs = append(jobs, s.queuedJobView(job, now))
+	}
+	for i := len(q.completed) - 1; i >= 0; i-- {
+		jobs = append(jobs, s.queuedJobView(q.completed[i], now))
+	}
+	return jobs
+}
+
+// queuedJobView renders a job; q.mu must be held.
+func (s *Service) queuedJobView(job *queuedJob, now time.Time) QueuedJob {
+	view := QueuedJob{
+		ID:         job.id,
+		Trigger:    job.trigger,
+		Group:      job.group,
+		State:      JobPending,
+		EnqueuedAt: job.enqueuedAt.Format(time.RFC3339),
+		Status:     job.status,
+		Error:      job.err,
+		Projects:   make([]QueuedProject, 0, len(job.projects)),
+	}
+	switch {
+	case !job.finishedAt.IsZero():
+		view.State = JobCompleted
+		view.FinishedAt = job.finishedAt.Format(time.RFC3339)
+	case !job.startedAt.IsZero():
+		view.State = JobRunning
+	default:
+		view.EstimatedStart = job.startAt.Format(time.RFC3339)
+	}
+	if !job.startedAt.IsZero() {
+		view.StartedAt = job.startedAt.Format(time.RFC3339)
+	}
+
+	// Pending projects start when the ones before them are expected to end
+	next := job.currentAt
+	for i, project := range job.projects {
+		p := QueuedProject{Project: project, State: JobPending}
+		switch {
+		case i < len(job.results):
+			p.State = job.results[i]
+		case view.State == JobCompleted:
+			// Not reached, e.g. the job was cancelled
+			p.State = "not_started"
+		case view.State == JobRunning && i == len(job.results):
+			p.State = JobRunning
+			next = s.estimatedEnd(project, job.currentAt, now)
+		case view.State == JobRunning && !next.IsZero():
+			p.EstimatedStart = next.Format(time.RFC3339)
+			next = s.estimatedEnd(project, next, now)
+		}
+		view.Projects = append(view.Projects, p)
+	}
+	return view
+}
+
+// estimatedEnd is when a backup of project started at start is expected to
+// end, going by its last successful backup, but not before now. Zero if the
+// project has no successful backup or start is unknown.
+func (s *Service) estimatedEnd(project string, start, now time.Time) time.Time {
+	if start.IsZero() {
+		return time.Time{}
+	}
+	last, err := s.LastSuccessfulBackup(project)
+	if err != nil || last == nil {
+		return time.Time{}
+	}
+	end := start.Add(time.Duration(last.DurationMs) * time.Millisecond)
+	if end.Before(now) {
+		return now
+	}
+	return end
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/retention"
+	"go.uber.org/zap"
+)
+
+// QuotaUsage is a quota and how much of it the backups it covers use.
+type QuotaUsage struct {
+	Policy      string `json:"policy"`
+	MaxBytes    int64  `json:"max_bytes,omitempty"`
+	MaxBackups  int    `json:"max_backups,omitempty"`
+	UsedBytes   int64  `json:"used_bytes"`
+	UsedBackups int    `json:"used_backups"`
+	// Exceeded reports whether there is no room for another backup
+	Exceeded bool `json:"exceeded"`
+}
+
+// quotaScope is a quota and the projects whose backups count against it.
+type quotaScope struct {
+	name     string
+	quota    config.Quota
+	projects []string
+}
+
+// ProjectQuota returns the usage of a project's own quota, or nil if it has
+// none.
+func (s *Service) ProjectQuota(projectID string) (*QuotaUsage, error) {
+	return s.quotaUsage(quotaScope{quota: s.config.ProjectQuota(projectID), projects: []string{projectID}})
+}
+
+// NamespaceQuota returns the usage of a namespace's quota, or nil if it has
+// none.
+func (s *Service) NamespaceQuota(namespace string) (*QuotaUsage, error) {
+	return s.quotaUsage(s.namespaceQuotaScope(namespace))
+}
+
+func (s *Service) quotaUsage(scope quotaScope) (*QuotaUsage, error) {
+	if !scope.quota.Enabled() {
+		return nil, nil
+	}
+	total, count, err := retention.Usage(s.baseDir, scope.projects)
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaUsage{
+		Policy:      scope.quota.Policy,
+		MaxBytes:    scope.quota.MaxBytes,
+		MaxBackups:  scope.quota.MaxBackups,
+		UsedBytes:   total,
+		UsedBackups: count,
+		Exceeded:    retention.OverQuota(total, count, scope.quota.MaxBytes, scope.quota.MaxBackups),
+	}, nil
+}
+
+func (s *Service) namespaceQuotaScope(namespace string) quotaScope {
+	scope := quotaScope{name: "namespace " + namespace, quota: s.config.NamespaceQuota(namespace)}
+	for _, db := range s.namespaceDatabases(namespace) {
+		scope.projects = append(scope.projects, db.Identifier)
+	}
+	return scope
+}
+
+// enforceQuotas makes room for a new backup of projectID under its own quota
+// and its namespace's. Quotas with the prune policy delete the oldest backups
+// when prune is set, protected like size caps; the backup is rejected with
+// ErrQuotaExceeded by quotas with the reject policy and by those only
+// protected backups are left under. Without prune, pruning quotas are
+// assumed to make room once the backup runs.
+func (s *Service) enforceQuotas(projectID string, prune bool) error {
+	scopes := []quotaScope{{name: "project " + projectID, quota: s.config.ProjectQuota(projectID), projects: []string{projectID}}}
+	if namespace := s.config.ProjectNamespace(projectID); namespace != "" {
+		scopes = append(scopes, s.namespaceQuotaScope(namespace))
+	}
+
+	for _, scope := range scopes {
+		quota := scope.quota
+		if !quota.Enabled() {
+			continue
+		}
+		total, count, err := retention.Usage(s.baseDir, scope.projects)
+		if err != nil {
+			return fmt.Errorf("failed to check quota: %w", err)
+		}
+		if !retention.OverQuota(total, count, quota.MaxBytes, quota.MaxBackups) {
+			continue
+		}
+		if quota.Policy != config.QuotaPrune {
+			return quotaError(scope, total, count, "")
+		}
+		if !prune {
+			continue
+		}
+
+		s.retentionMu.Lock()
+		pruned, total, count, err := retention.PruneToQuota(s.baseDir, scope.projects, quota.MaxBytes, quota.MaxBackups)
+		s.retentionMu.Unlock()
+		if len(pruned) > 0 {
+			s.invalidateLastSuccess()
+			var freed int64
+			for _, backup := range pruned {
+				freed += backup.SizeBytes
+			}
+			s.logger.Info("Pruned backups to make room under quota",
+				zap.String("scope", scope.name),
+				zap.Int("pruned", len(pruned)),
+				zap.Int64("freed_bytes", freed))
+			s.emitEvent(EventRetentionPruned, map[string]interface{}{
+				"trigger":     "quota",
+				"project":     projectID,
+				"pruned":      pruned,
+				"freed_bytes": freed,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to prune backups to quota: %w", err)
+		}
+		if retention.OverQuota(total, count, quota.MaxBytes, quota.MaxBackups) {
+			return quotaError(scope, total, count, "only protected backups are left")
+		}
+	}
+	return nil
+}
+
+// quotaError describes why a backup doesn't fit a quota.
+func quotaError(scope quotaScope, total int64, count int, reason string) error {
+	var limits []string
+	if scope.quota.MaxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes", scope.quota.MaxBytes))
+	}
+	if scope.quota.MaxBackups > 0 {
+		limits = append(limits, fmt.Sprintf("%d backups", scope.quota.MaxBackups))
+	}
+	if reason != "" {
+		reason = ": " + reason
+	}
+	return fmt.Errorf("%w: %s has %d backups taking %d bytes, quota is %s%s", ErrQuotaExceeded, scope.name, count, total, strings.Join(limits, " and "), reason)
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+// registerSecrets registers the credentials the service knows of with
+// package redact, so they are masked even where they show up verbatim: pgx
+// errors and container output may echo a password outside of its URL.
+// Besides database passwords, API tokens and the passwords of the message
+// bus and events URLs these are the credentials of rclone remotes configured
+// in the environment (RCLONE_CONFIG_*).
+func registerSecrets(cfg *config.Config) {
+	for _, connURL := range cfg.Databases {
+		if conn, err := database.ParseConnString(connURL); err == nil {
+			redact.AddSecret(conn.Password)
+		}
+	}
+	for token := range cfg.APITokens {
+		redact.AddSecret(token)
+	}
+	for _, rawURL := range []string{cfg.MessageBusURL, cfg.EventsURL} {
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			pass, _ := u.User.Password()
+			redact.AddSecret(pass)
+		}
+	}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if (strings.HasPrefix(name, "RCLONE_CONFIG_") || strings.HasPrefix(name, "AWS_")) && redact.SecretName(name) {
+			redact.AddSecret(value)
+		}
+	}
+}
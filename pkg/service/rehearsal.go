@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/rehearsal"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// What started a rehearsal, recorded in its report.
+const (
+	rehearsalTriggerSchedule = "schedule"
+	rehearsalTriggerAPI      = "api"
+)
+
+// reportPostTimeout bounds the POST of the monthly rehearsal report.
+const reportPostTimeout = 30 * time.Second
+
+// RehearsalProjects returns the projects rehearsed by REHEARSAL_CRON: all of
+// them, except those with BACKUP_<PROJECT>_REHEARSAL=false.
+func (s *Service) RehearsalProjects() []string {
+	var projects []string
+	for _, db := range s.databases {
+		if s.config.ProjectOptionBool(db.Identifier, "REHEARSAL", true) {
+			projects = append(projects, db.Identifier)
+		}
+	}
+	return projects
+}
+
+// StartRehearsals rehearses the restore of the latest successful backup of
+// each project in the background, one after another, and returns the
+// rehearsal IDs. Without projects, all projects with rehearsals enabled are
+// rehearsed.
+func (s *Service) StartRehearsals(projectIDs []string) ([]string, error) {
+	if len(projectIDs) == 0 {
+		projectIDs = s.RehearsalProjects()
+	}
+	for _, projectID := range projectIDs {
+		if s.GetDatabase(projectID) == nil {
+			return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+		}
+	}
+	if !s.rehearsalMu.TryLock() {
+		return nil, ErrRehearsalRunning
+	}
+
+	ids := make([]string, len(projectIDs))
+	for i, projectID := range projectIDs {
+		ids[i] = rehearsalID(projectID)
+	}
+	go func() {
+		defer s.rehearsalMu.Unlock()
+		for i, projectID := range projectIDs {
+			s.rehearse(ids[i], projectID, rehearsalTriggerAPI)
+		}
+	}()
+	return ids, nil
+}
+
+// runScheduledRehearsals is the cron callback of REHEARSAL_CRON. Like
+// backups, it is skipped while the scheduler is paused.
+func (s *Service) runScheduledRehearsals() {
+	if s.schedulerPaused() {
+		s.logger.Info("Scheduler is paused, skipping scheduled rehearsals")
+		return
+	}
+	if !s.rehearsalMu.TryLock() {
+		s.logger.Warn("Rehearsals are already running, skipping scheduled rehearsals")
+		return
+	}
+	defer s.rehearsalMu.Unlock()
+	for _, projectID := range s.RehearsalProjects() {
+		s.rehearse(rehearsalID(projectID), projectID, rehearsalTriggerSchedule)
+	}
+}
+
+// rehearse restores the latest successful backup of projectID into a
+// throwaway container and persists the report. s.rehearsalMu must be held.
+func (s *Service) rehearse(id, projectID, trigger string) {
+	report := rehearsal.NewReport(id, projectID, trigger)
+	save := func(r *rehearsal.Report) {
+		if err := metadata.WriteRehearsalReport(s.baseDir, r.ID, r); err != nil {
+			s.logger.Warn("Failed to write rehearsal report", zap.String("rehearsal_id", r.ID), zap.Error(err))
+		}
+	}
+
+	entry, err := catalog.LastSuccessful(s.baseDir, projectID)
+	if err == nil && entry == nil {
+		err = fmt.Errorf("%w: no successful backup of %s", ErrBackupNotFound, projectID)
+	}
+	if err != nil {
+		report.Fail(err)
+		save(report)
+		s.logger.Error("Restore rehearsal failed", zap.String("rehearsal_id", id), zap.Error(err))
+		return
+	}
+	save(report)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.RehearsalTimeout)
+	defer cancel()
+	_ = s.rehearser.Run(ctx, entry, report, save)
+}
+
+// GetRehearsal returns a persisted rehearsal report, or nil if it doesn't
+// exist.
+func (s *Service) GetRehearsal(id string) (map[string]interface{}, error) {
+	if !catalog.ValidName(id) {
+		return nil, nil
+	}
+	return metadata.ReadRehearsalReport(s.baseDir, id)
+}
+
+// RehearsalSummary summarizes the rehearsals started in month per project:
+// how many passed and failed, the restore durations (RTO) and the last
+// rehearsal. Projects with rehearsals enabled but none that month are listed
+// as untested.
+func (s *Service) RehearsalSummary(month time.Time) (map[string]interface{}, error) {
+	ids, err := metadata.ListRehearsalReports(s.baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type projectSummary struct {
+		rehearsals, passed, failed   int
+		totalRestoreMs, maxRestoreMs int64
+		last                         map[string]interface{}
+	}
+	summaries := make(map[string]*projectSummary)
+	for _, id := range ids {
+		report, err := metadata.ReadRehearsalReport(s.baseDir, id)
+		if err != nil || report == nil {
+			s.logger.Warn("Skipping unreadable rehearsal report", zap.String("rehearsal_id", id), zap.Error(err))
+			continue
+		}
+		started, err := time.Parse(time.RFC3339, stringField(report, "started_at"))
+		if err != nil {
+			continue
+		}
+		started = started.In(s.location)
+		if started.Year() != month.Year() || started.Month() != month.Month() {
+			continue
+		}
+		project := stringField(report, "project")
+		summary := summaries[project]
+		if summary == nil {
+			summary = &projectSummary{}
+			summaries[project] = summary
+		}
+		summary.rehearsals++
+		switch stringField(report, "status") {
+		case "success":
+			summary.passed++
+			restoreMs, _ := report["restore_ms"].(float64)
+			summary.totalRestoreMs += int64(restoreMs)
+			summary.maxRestoreMs = max(summary.maxRestoreMs, int64(restoreMs))
+		case "failed":
+			summary.failed++
+		}
+		if summary.last == nil || stringField(report, "started_at") >= stringField(summary.last, "started_at") {
+			summary.last = report
+		}
+	}
+
+	projects := make(map[string]interface{}, len(summaries))
+	for project, summary := range summaries {
+		result := map[string]interface{}{
+			"rehearsals": summary.rehearsals,
+			"passed":     summary.passed,
+			"failed":     summary.failed,
+			"last": map[string]interface{}{
+				"id":         summary.last["id"],
+				"run_id":     summary.last["run_id"],
+				"status":     summary.last["status"],
+				"error":      summary.last["error"],
+				"started_at": summary.last["started_at"],
+				"restore_ms": summary.last["restore_ms"],
+			},
+		}
+		if summary.passed > 0 {
+			result["avg_restore_ms"] = summary.totalRestoreMs / int64(summary.passed)
+			result["max_restore_ms"] = summary.maxRestoreMs
+		}
+		projects[project] = result
+	}
+	untested := []string{}
+	for _, project := range s.RehearsalProjects() {
+		if summary := summaries[project]; summary == nil || summary.passed == 0 {
+			untested = append(untested, project)
+		}
+	}
+	sort.Strings(untested)
+
+	return map[string]interface{}{
+		"month":        month.Format("2006-01"),
+		"generated_at": time.Now().Format(time.RFC3339),
+		"projects":     projects,
+		"untested":     untested,
+	}, nil
+}
+
+// sendRehearsalReport is the cron callback of REHEARSAL_REPORT_CRON. It
+// POSTs the summary of the previous month as JSON to REHEARSAL_REPORT_URL.
+func (s *Service) sendRehearsalReport() {
+	now := time.Now().In(s.location)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, s.location).AddDate(0, -1, 0)
+	summary, err := s.RehearsalSummary(month)
+	if err != nil {
+		s.logger.Error("Failed to summarize rehearsals", zap.Error(err))
+		return
+	}
+	if err := postJSON(s.config.RehearsalReportURL, summary); err != nil {
+		s.logger.Error("Failed to send rehearsal report", zap.String("month", month.Format("2006-01")), zap.Error(err))
+		return
+	}
+	s.logger.Info("Sent rehearsal report", zap.String("month", month.Format("2006-01")))
+}
+
+func postJSON(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reportPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func rehearsalID(projectID string) string {
+	return fmt.Sprintf("rehearsal-%s-%s", projectID, time.Now().Format("20060102-150405"))
+}
+
+func stringField(m map[string]interface{}, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/restore"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// FindBackup looks up a backup by run ID; "latest" selects the newest
+// successful backup of the project.
+func (s *Service) FindBackup(projectID, runID string) (*catalog.Entry, error) {
+	if !catalog.ValidName(projectID) || !catalog.ValidName(runID) {
+		return nil, ErrBackupNotFound
+	}
+
+	var entry *catalog.Entry
+	var err error
+	if runID == "latest" {
+		entry, err = catalog.LastSuccessful(s.baseDir, projectID)
+	} else {
+		entry, err = catalog.Get(s.baseDir, projectID, runID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, ErrBackupNotFound
+	}
+	return entry, nil
+}
+
+// FindRun looks up a backup by run ID alone. Run IDs start with the project
+// name, so one project holds it; projects are tried in configuration order.
+func (s *Service) FindRun(runID string) (*catalog.Entry, error) {
+	if !catalog.ValidName(runID) {
+		return nil, ErrBackupNotFound
+	}
+	for _, db := range s.databases {
+		if !strings.HasPrefix(runID, db.Identifier+"-") {
+			continue
+		}
+		entry, err := catalog.Get(s.baseDir, db.Identifier, runID)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			return entry, nil
+		}
+	}
+	return nil, ErrBackupNotFound
+}
+
+// ListBackups returns the backups of a project from oldest to newest,
+// only those carrying all of tags if any are given.
+func (s *Service) ListBackups(projectID string, tags []string) ([]*catalog.Entry, error) {
+	if !catalog.ValidName(projectID) {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+	entries, err := catalog.List(s.baseDir, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil && s.GetDatabase(projectID) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+
+	backups := make([]*catalog.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.HasTags(tags) {
+			backups = append(backups, entry)
+		}
+	}
+	return backups, nil
+}
+
+// History returns the backups of all configured projects (or of projectID)
+// started at or after since, ordered by start time.
+func (s *Service) History(projectID string, since time.Time) ([]*catalog.Entry, error) {
+	projects := make([]string, 0, len(s.databases))
+	if projectID != "" {
+		if s.GetDatabase(projectID) == nil {
+			return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+		}
+		projects = append(projects, projectID)
+	} else {
+		for _, db := range s.databases {
+			projects = append(projects, db.Identifier)
+		}
+	}
+
+	var history []*catalog.Entry
+	for _, project := range projects {
+		entries, err := catalog.List(s.baseDir, project)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entryStarted(entry).Before(since) {
+				history = append(history, entry)
+			}
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return entryStarted(history[i]).Before(entryStarted(history[j]))
+	})
+	return history, nil
+}
+
+// entryStarted is the start time of a backup, or the start of its date
+// directory's day for manifests without a valid one.
+func entryStarted(entry *catalog.Entry) time.Time {
+	if t, err := time.Parse(time.RFC3339, entry.StartedAt); err == nil {
+		return t
+	}
+	t, _ := time.ParseInLocation("2006-01-02", entry.Date, time.Local)
+	return t
+}
+
+// StartRestore validates the request and restores the backup in the
+// background. Progress is persisted as a restore report readable via GetRestore.
+func (s *Service) StartRestore(projectID, runID string, opts restore.Options) (*restore.Report, error) {
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Status != "success" {
+		return nil, fmt.Errorf("backup %s did not succeed and cannot be restored", entry.RunID)
+	}
+
+	id := fmt.Sprintf("restore-%s-%s", projectID, time.Now().Format("20060102-150405"))
+	report, err := restore.NewReport(id, entry, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	save := func(r *restore.Report) {
+		if err := metadata.WriteRestoreReport(s.baseDir, r.ID, r); err != nil {
+			s.logger.Warn("Failed to write restore report", zap.String("restore_id", r.ID), zap.Error(err))
+		}
+	}
+	save(report)
+
+	s.logger.Info("Starting restore",
+		zap.String("restore_id", id),
+		zap.String("project", projectID),
+		zap.String("run_id", entry.RunID),
+		zap.String("target_database", report.TargetDatabase))
+
+	// psql's output goes to a log next to the report, served at
+	// GET /restores/{id}/log
+	logFile, err := os.Create(metadata.RestoreLogPath(s.baseDir, id))
+	if err != nil {
+		s.logger.Warn("Failed to create restore log", zap.String("restore_id", id), zap.Error(err))
+	} else {
+		opts.Output = logFile
+	}
+
+	go func() {
+		_ = s.restorer.Restore(context.Background(), entry, opts, report, save)
+		if logFile != nil {
+			logFile.Close()
+		}
+	}()
+
+	return report, nil
+}
+
+// OpenRestoreLog opens the psql output of a restore. The log is nil for
+// restores without one, started before logs were kept.
+func (s *Service) OpenRestoreLog(id string) (*os.File, error) {
+	if !catalog.ValidName(id) {
+		return nil, nil
+	}
+	log, err := os.Open(metadata.RestoreLogPath(s.baseDir, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return log, err
+}
+
+// GetRestore returns a persisted restore report, or nil if it doesn't exist.
+func (s *Service) GetRestore(id string) (map[string]interface{}, error) {
+	if !catalog.ValidName(id) {
+		return nil, nil
+	}
+	return metadata.ReadRestoreReport(s.baseDir, id)
+}
+
+// ArchiveFiles are the files OpenBackupFile reads from backup archives: the
+// small SQL files worth reviewing on their own. The data dump is left out,
+// it is most of the archive.
+var ArchiveFiles = []string{"schema.sql", "roles.sql"}
+
+// OpenBackupFile opens one of ArchiveFiles in a backup's archive for reading,
+// without extracting the rest.
+func (s *Service) OpenBackupFile(projectID, runID, name string) (*catalog.Entry, io.ReadCloser, error) {
+	if !slices.Contains(ArchiveFiles, name) {
+		return nil, nil, fmt.Errorf("%w: %s (available: %s)", ErrFileNotFound, name, strings.Join(ArchiveFiles, ", "))
+	}
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.ArchivePath == "" {
+		return nil, nil, fmt.Errorf("%w: backup %s has no archive", ErrFileNotFound, entry.RunID)
+	}
+
+	file, err := restore.OpenArchiveFile(entry.ArchivePath, name)
+	if errors.Is(err, restore.ErrNotInArchive) {
+		return nil, nil, fmt.Errorf("%w: backup %s has no %s", ErrFileNotFound, entry.RunID, name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, file, nil
+}
+
+// BackupContents lists the schemas, tables and row counts stored in a backup.
+func (s *Service) BackupContents(projectID, runID string) (*catalog.Entry, *restore.Contents, error) {
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.ArchivePath == "" {
+		return nil, nil, fmt.Errorf("backup %s has no archive", entry.RunID)
+	}
+
+	contents, err := restore.ReadContents(entry.ArchivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read backup contents: %w", err)
+	}
+	return entry, contents, nil
+}
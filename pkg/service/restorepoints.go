@@ -0,0 +1,130 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+)
+
+// RestorePoint is a point in time a project can be restored to. Backups are
+// logical dumps, so every point is a single moment: the database as the dump
+// saw it when it started. There are no point-in-time recovery ranges, as WAL
+// isn't archived.
+type RestorePoint struct {
+	RunID string `json:"run_id"`
+	// Kind is "dump"; BackupType is "full" or "incremental" (BACKUP_MODE)
+	Kind       string `json:"kind"`
+	BackupType string `json:"backup_type"`
+	// RecoveryPoint is the moment restoring this point brings the database
+	// back to; AgeSeconds is how much data restoring it now loses
+	RecoveryPoint string `json:"recovery_point"`
+	AgeSeconds    int64  `json:"age_seconds"`
+	// GapSeconds is the time since the previous (older) restore point: the
+	// changes only this point holds. Unset for the oldest point.
+	GapSeconds *int64 `json:"gap_seconds,omitempty"`
+	SizeBytes  int64  `json:"size_bytes"`
+	// Requires are the backups restoring an incremental point also needs,
+	// from its full base backup to its parent
+	Requires []string `json:"requires,omitempty"`
+	// StoredIn are the storage targets holding a copy
+	StoredIn []string `json:"stored_in,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Pinned   bool     `json:"pinned"`
+}
+
+// RestorePointRPO summarizes the recovery point objective a project's
+// restore points achieve.
+type RestorePointRPO struct {
+	LatestPoint string `json:"latest_point,omitempty"`
+	// ExposureSeconds is the data lost if the database failed now
+	ExposureSeconds *int64 `json:"exposure_seconds,omitempty"`
+	// NextBackupAt is the next scheduled backup; WorstCaseSeconds the data
+	// lost if the database failed just before it
+	NextBackupAt     string `json:"next_backup_at,omitempty"`
+	WorstCaseSeconds *int64 `json:"worst_case_seconds,omitempty"`
+	// MaxGapSeconds is the longest time between two consecutive points
+	MaxGapSeconds *int64 `json:"max_gap_seconds,omitempty"`
+}
+
+// RestorePoints lists the points a project can be restored to, newest
+// first: its successful backups with an archive, leaving out incremental
+// backups whose chain back to a full backup is incomplete.
+func (s *Service) RestorePoints(projectID string) ([]RestorePoint, *RestorePointRPO, error) {
+	if !catalog.ValidName(projectID) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+	entries, err := catalog.List(s.baseDir, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entries == nil && s.GetDatabase(projectID) == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+
+	restorable := make([]*catalog.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Status == "success" && entry.ArchivePath != "" {
+			restorable = append(restorable, entry)
+		}
+	}
+
+	now := time.Now()
+	points := make([]RestorePoint, 0, len(restorable))
+	rpo := &RestorePointRPO{}
+	var previous time.Time
+	for _, entry := range restorable {
+		point := RestorePoint{
+			RunID:      entry.RunID,
+			Kind:       "dump",
+			BackupType: "full",
+			SizeBytes:  entry.SizeBytes,
+			StoredIn:   entry.StoredIn,
+			Tags:       entry.Tags,
+			Pinned:     entry.Pinned(now),
+		}
+		if entry.BackupType == "incremental" {
+			ancestors, missing := catalog.Ancestors(restorable, entry)
+			if missing != "" || len(ancestors) == 0 || ancestors[len(ancestors)-1].BackupType != "full" {
+				continue
+			}
+			point.BackupType = "incremental"
+			for i := len(ancestors) - 1; i >= 0; i-- {
+				point.Requires = append(point.Requires, ancestors[i].RunID)
+			}
+		}
+
+		started := entryStarted(entry)
+		point.RecoveryPoint = started.Format(time.RFC3339)
+		point.AgeSeconds = int64(now.Sub(started).Seconds())
+		if !previous.IsZero() {
+			gap := int64(started.Sub(previous).Seconds())
+			point.GapSeconds = &gap
+			if rpo.MaxGapSeconds == nil || gap > *rpo.MaxGapSeconds {
+				rpo.MaxGapSeconds = &gap
+			}
+		}
+		previous = started
+		points = append(points, point)
+	}
+
+	if len(points) > 0 {
+		latest := points[len(points)-1]
+		rpo.LatestPoint = latest.RecoveryPoint
+		rpo.ExposureSeconds = &latest.AgeSeconds
+		// Projects no longer configured won't be backed up again
+		if s.GetDatabase(projectID) != nil {
+			if next := s.NextRunsForProject(projectID, 1); len(next) > 0 {
+				rpo.NextBackupAt = next[0].Format(time.RFC3339)
+				worstCase := int64(next[0].Sub(previous).Seconds())
+				rpo.WorstCaseSeconds = &worstCase
+			}
+		}
+	}
+
+	// Newest first: the point DR tooling usually wants
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, rpo, nil
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/retention"
+	"go.uber.org/zap"
+)
+
+// What started a retention run, recorded in its report.
+const (
+	retentionTriggerJob      = "backup_job"
+	retentionTriggerSchedule = "schedule"
+	retentionTriggerAPI      = "api"
+)
+
+// StartRetention applies retention to all projects in the background and
+// returns the run ID. The report is readable via GetRetentionReport once the
+// run is done.
+func (s *Service) StartRetention() (string, error) {
+	if !s.retentionMu.TryLock() {
+		return "", ErrRetentionRunning
+	}
+	runID := retentionRunID()
+	go func() {
+		defer s.retentionMu.Unlock()
+		s.runRetention(runID, s.databases, retentionTriggerAPI)
+	}()
+	return runID, nil
+}
+
+// GetRetentionReport returns the report of the last retention run, or nil if
+// none has run yet.
+func (s *Service) GetRetentionReport() (map[string]interface{}, error) {
+	return metadata.ReadRetentionReport(s.baseDir)
+}
+
+// runScheduledRetention is the cron callback of RETENTION_CRON. Like backups,
+// it is skipped while the scheduler is paused.
+func (s *Service) runScheduledRetention() {
+	if s.schedulerPaused() {
+		s.logger.Info("Scheduler is paused, skipping scheduled retention")
+		return
+	}
+	if !s.retentionMu.TryLock() {
+		s.logger.Warn("Retention is already running, skipping scheduled retention")
+		return
+	}
+	defer s.retentionMu.Unlock()
+	s.runRetention(retentionRunID(), s.databases, retentionTriggerSchedule)
+}
+
+// runRetention deletes the expired backups of databases and persists a report
+// of the run. s.retentionMu must be held.
+func (s *Service) runRetention(runID string, databases []*database.Database, trigger string) map[string]interface{} {
+	started := time.Now()
+	ids := make([]string, len(databases))
+	for i, db := range databases {
+		ids[i] = db.Identifier
+	}
+
+	deleted, err := retention.CleanupAllDatabases(s.baseDir, ids, s.config.ProjectRetentionDays, s.config.ProjectKeepLastSuccess)
+	var pruned []retention.PrunedBackup
+	var exceeded []map[string]interface{}
+	if err == nil {
+		pruned, exceeded, err = s.pruneToSizeCaps(ids)
+	}
+	s.invalidateLastSuccess()
+	finished := time.Now()
+
+	report := map[string]interface{}{
+		"run_id":      runID,
+		"trigger":     trigger,
+		"started_at":  started.Format(time.RFC3339),
+		"finished_at": finished.Format(time.RFC3339),
+		"duration_ms": finished.Sub(started).Milliseconds(),
+		"status":      "success",
+		"projects":    ids,
+		"deleted":     deleted,
+	}
+	if len(pruned) > 0 {
+		var freed int64
+		for _, backup := range pruned {
+			freed += backup.SizeBytes
+		}
+		report["pruned"] = pruned
+		report["freed_bytes"] = freed
+	}
+	if len(exceeded) > 0 {
+		report["size_caps_exceeded"] = exceeded
+	}
+	if err != nil {
+		s.logger.Warn("Retention cleanup failed", zap.String("run_id", runID), zap.Error(err))
+		report["status"] = "failed"
+		report["error"] = err.Error()
+	} else {
+		s.logger.Info("Retention cleanup completed",
+			zap.String("run_id", runID),
+			zap.String("trigger", trigger),
+			zap.Any("deleted", deleted),
+			zap.Int("pruned", len(pruned)))
+		for _, sizeCap := range exceeded {
+			s.logger.Warn("Backups exceed size cap, only protected backups are left",
+				zap.Any("scope", sizeCap["scope"]),
+				zap.Any("max_bytes", sizeCap["max_bytes"]),
+				zap.Any("total_bytes", sizeCap["total_bytes"]))
+		}
+	}
+
+	if retentionDeleted(deleted) || len(pruned) > 0 {
+		fields := map[string]interface{}{
+			"run_id":  runID,
+			"trigger": trigger,
+			"deleted": deleted,
+		}
+		if len(pruned) > 0 {
+			fields["pruned"] = pruned
+			fields["freed_bytes"] = report["freed_bytes"]
+		}
+		s.emitEvent(EventRetentionPruned, fields)
+	}
+
+	if err := metadata.WriteRetentionReport(s.baseDir, report); err != nil {
+		s.logger.Warn("Failed to write retention report", zap.Error(err))
+	}
+	return report
+}
+
+// pruneToSizeCaps deletes the oldest backups of projects over their
+// BACKUP_<PROJECT>_RETENTION_MAX_BYTES cap, then of the namespaces of ids
+// over their NAMESPACE_<NAME>_RETENTION_MAX_BYTES, then of all configured
+// projects (not only ids, which may be a group) while they are over
+// RETENTION_MAX_BYTES together. Namespace and global caps cover all their
+// projects. exceeded lists the caps still exceeded because the remaining
+// backups are protected.
+func (s *Service) pruneToSizeCaps(ids []string) (pruned []retention.PrunedBackup, exceeded []map[string]interface{}, err error) {
+	prune := func(scope string, projects []string, maxBytes int64) error {
+		removed, total, err := retention.PruneToSize(s.baseDir, projects, maxBytes)
+		pruned = append(pruned, removed...)
+		if err != nil {
+			return err
+		}
+		if total > maxBytes {
+			exceeded = append(exceeded, map[string]interface{}{
+				"scope":       scope,
+				"max_bytes":   maxBytes,
+				"total_bytes": total,
+			})
+		}
+		return nil
+	}
+
+	for _, id := range ids {
+		if maxBytes := s.config.ProjectRetentionMaxBytes(id); maxBytes > 0 {
+			if err := prune(id, []string{id}, maxBytes); err != nil {
+				return pruned, exceeded, err
+			}
+		}
+	}
+	namespaces := make(map[string]bool)
+	for _, id := range ids {
+		namespaces[s.config.ProjectNamespace(id)] = true
+	}
+	for _, namespace := range slices.Sorted(maps.Keys(namespaces)) {
+		maxBytes := s.config.NamespaceRetentionMaxBytes(namespace)
+		if namespace == "" || maxBytes <= 0 {
+			continue
+		}
+		var projects []string
+		for _, db := range s.namespaceDatabases(namespace) {
+			projects = append(projects, db.Identifier)
+		}
+		if err := prune("namespace:"+namespace, projects, maxBytes); err != nil {
+			return pruned, exceeded, err
+		}
+	}
+	if s.config.RetentionMaxBytes > 0 {
+		all := make([]string, len(s.databases))
+		for i, db := range s.databases {
+			all[i] = db.Identifier
+		}
+		if err := prune("all", all, s.config.RetentionMaxBytes); err != nil {
+			return pruned, exceeded, err
+		}
+	}
+	return pruned, exceeded, nil
+}
+
+func retentionRunID() string {
+	return fmt.Sprintf("retention-%s", time.Now().Format("20060102-150405"))
+}
+
+// retentionDeleted reports whether a cleanup deleted any backup directory.
+func retentionDeleted(deleted map[string]int) bool {
+	for _, count := range deleted {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rpoCheckInterval is how often checkRPO looks for breached RPO targets.
+const rpoCheckInterval = time.Minute
+
+// RPOStatus is how a project's latest successful backup compares to its RPO
+// target (RPO_TARGET). Like restore points, a backup's recovery point is the
+// start of its dump.
+type RPOStatus struct {
+	TargetSeconds int64 `json:"target_seconds"`
+	// LatestPoint is the recovery point of the latest successful backup and
+	// AgeSeconds its age; both are unset if there is none
+	LatestPoint string `json:"latest_point,omitempty"`
+	AgeSeconds  *int64 `json:"age_seconds,omitempty"`
+	Compliant   bool   `json:"compliant"`
+	// BreachAt is when the latest point gets older than the target, in the
+	// past for a breached target
+	BreachAt string `json:"breach_at,omitempty"`
+}
+
+// ProjectRPO compares a project's latest successful backup to its RPO
+// target. It returns nil for projects without a target.
+func (s *Service) ProjectRPO(projectID string) (*RPOStatus, error) {
+	target := s.config.ProjectOptionDuration(projectID, "RPO_TARGET", s.config.RPOTarget)
+	if target <= 0 {
+		return nil, nil
+	}
+	status := &RPOStatus{TargetSeconds: int64(target.Seconds())}
+	last, err := s.LastSuccessfulBackup(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return status, nil
+	}
+
+	started := entryStarted(last)
+	age := int64(time.Since(started).Seconds())
+	status.LatestPoint = started.Format(time.RFC3339)
+	status.AgeSeconds = &age
+	status.BreachAt = started.Add(target).Format(time.RFC3339)
+	status.Compliant = time.Since(started) <= target
+	return status, nil
+}
+
+// hasRPOTargets reports whether any configured project has an RPO target.
+func (s *Service) hasRPOTargets() bool {
+	for _, db := range s.databases {
+		if s.config.ProjectOptionDuration(db.Identifier, "RPO_TARGET", s.config.RPOTarget) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRPO compares every project to its RPO target and emits an event when
+// a target becomes breached or is met again. A project breached at startup
+// is reported at the first check.
+func (s *Service) checkRPO() {
+	for _, db := range s.GetDatabases() {
+		project := db.Identifier
+		status, err := s.ProjectRPO(project)
+		if err != nil {
+			s.logger.Warn("Failed to check RPO target", zap.String("project", project), zap.Error(err))
+			continue
+		}
+
+		s.rpoMu.Lock()
+		wasBreached := s.rpoBreached[project]
+		breached := status != nil && !status.Compliant
+		s.rpoBreached[project] = breached
+		s.rpoMu.Unlock()
+		if breached == wasBreached {
+			continue
+		}
+
+		fields := map[string]interface{}{"project": project}
+		if status != nil {
+			fields["target_seconds"] = status.TargetSeconds
+			if status.AgeSeconds != nil {
+				fields["latest_point"] = status.LatestPoint
+				fields["age_seconds"] = *status.AgeSeconds
+			}
+		}
+		if breached {
+			s.logger.Warn("RPO target breached",
+				zap.String("project", project),
+				zap.Int64("target_seconds", status.TargetSeconds),
+				zap.String("latest_point", status.LatestPoint))
+			s.emitEvent(EventRPOBreached, fields)
+		} else {
+			s.logger.Info("RPO target met again", zap.String("project", project))
+			s.emitEvent(EventRPORecovered, fields)
+		}
+	}
+}
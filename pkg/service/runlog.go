@@ -0,0 +1,193 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// runLogFile is the name of a backup's run log in its temp directory.
+const runLogFile = "run.log"
+
+// runLogs copies log entries about projects being backed up into per-run
+// files, at debug level whatever LOG_LEVEL is. Entries belong to a project
+// by their "database" or "project" field. It is teed into the service's
+// logger, so the backup runner, uploads and storage backends write to it
+// without knowing.
+type runLogs struct {
+	encoder zapcore.Encoder
+	mu      sync.Mutex
+	files   map[string]*os.File
+	// active is len(files), so idle loggers skip this core without locking
+	active atomic.Int32
+}
+
+func newRunLogs(encoder zapcore.Encoder) *runLogs {
+	return &runLogs{encoder: encoder, files: make(map[string]*os.File)}
+}
+
+// start copies the entries of project into path until stop.
+func (l *runLogs) start(project, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create run log: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if previous, ok := l.files[project]; ok {
+		previous.Close()
+	} else {
+		l.active.Add(1)
+	}
+	l.files[project] = file
+	return nil
+}
+
+// stop closes the run log of project, if any.
+func (l *runLogs) stop(project string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.files[project]; ok {
+		file.Close()
+		delete(l.files, project)
+		l.active.Add(-1)
+	}
+}
+
+func (l *runLogs) write(project string, entry zapcore.Entry, fields []zapcore.Field) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, ok := l.files[project]
+	if !ok {
+		return nil
+	}
+	buf, err := l.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	_, err = file.Write(buf.Bytes())
+	return err
+}
+
+// core returns the zapcore.Core to tee into a logger.
+func (l *runLogs) core() zapcore.Core {
+	return &runLogCore{logs: l}
+}
+
+type runLogCore struct {
+	logs    *runLogs
+	fields  []zapcore.Field
+	project string
+}
+
+func (c *runLogCore) Enabled(zapcore.Level) bool {
+	return c.logs.active.Load() > 0
+}
+
+func (c *runLogCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &runLogCore{logs: c.logs, project: c.project}
+	clone.fields = append(append(clone.fields, c.fields...), fields...)
+	if project := projectField(fields); project != "" {
+		clone.project = project
+	}
+	return clone
+}
+
+func (c *runLogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *runLogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	project := projectField(fields)
+	if project == "" {
+		project = c.project
+	}
+	if project == "" {
+		return nil
+	}
+	all := fields
+	if len(c.fields) > 0 {
+		all = append(append([]zapcore.Field{}, c.fields...), fields...)
+	}
+	return c.logs.write(project, entry, all)
+}
+
+func (c *runLogCore) Sync() error {
+	return nil
+}
+
+// projectField returns the project an entry with fields is about.
+func projectField(fields []zapcore.Field) string {
+	for _, field := range fields {
+		if (field.Key == "database" || field.Key == "project") && field.Type == zapcore.StringType {
+			return field.String
+		}
+	}
+	return ""
+}
+
+// startRunLog starts the run log of a backup of project in its temp
+// directory. Failing to is logged; the backup runs without one.
+func (s *Service) startRunLog(project, tempDir string) {
+	if s.runLogs == nil {
+		return
+	}
+	if err := s.runLogs.start(project, filepath.Join(tempDir, runLogFile)); err != nil {
+		s.logger.Warn("Failed to start run log", zap.String("database", project), zap.Error(err))
+	}
+}
+
+// stopRunLog stops the run log of a backup of project, if any.
+func (s *Service) stopRunLog(project string) {
+	if s.runLogs != nil {
+		s.runLogs.stop(project)
+	}
+}
+
+// keepRunLog stops the run log of a backup and moves it into the backup's
+// directory, where the catalog finds it by catalog.RunLogName.
+func (s *Service) keepRunLog(project, tempDir, backupDir, runID string) {
+	if s.runLogs == nil {
+		return
+	}
+	s.runLogs.stop(project)
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		s.logger.Warn("Failed to keep run log", zap.String("run_id", runID), zap.Error(err))
+		return
+	}
+	if err := durable.Move(filepath.Join(tempDir, runLogFile), filepath.Join(backupDir, catalog.RunLogName(runID))); err != nil && !os.IsNotExist(err) {
+		s.logger.Warn("Failed to keep run log", zap.String("run_id", runID), zap.Error(err))
+	}
+}
+
+// OpenRunLog opens the run log of a backup. The log is nil for backups
+// without one, taken with RUN_LOGS off or before run logs existed.
+func (s *Service) OpenRunLog(projectID, runID string) (*catalog.Entry, io.ReadCloser, error) {
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry.LogPath == "" {
+		return entry, nil, nil
+	}
+	file, err := os.Open(entry.LogPath)
+	if os.IsNotExist(err) {
+		return entry, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open run log: %w", err)
+	}
+	return entry, file, nil
+}
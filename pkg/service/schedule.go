@@ -0,0 +1,202 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/robfig/cron/v3"
+)
+
+// maxPlannedRuns bounds the schedule preview, so a cron firing every minute
+// doesn't produce an unbounded response.
+const maxPlannedRuns = 1000
+
+// PlannedEvent is one scheduled action of the backup job for a project.
+type PlannedEvent struct {
+	// Type is "backup" or "retention" (the cleanup that follows each job)
+	Type    string `json:"type"`
+	Project string `json:"project"`
+	// Group is set for projects backed up by their group's own schedule
+	Group string `json:"group,omitempty"`
+	// ScheduledAt is the cron fire time. The job starts at EarliestStart, or
+	// up to LatestStart with SCHEDULE_JITTER, after deferral past blackouts.
+	ScheduledAt        string `json:"scheduled_at"`
+	EarliestStart      string `json:"earliest_start"`
+	LatestStart        string `json:"latest_start,omitempty"`
+	DeferredByBlackout bool   `json:"deferred_by_blackout,omitempty"`
+	// DeletesBefore and Expiring describe retention events: backup dates older
+	// than the cutoff, both on disk now and planned earlier in the preview
+	DeletesBefore string   `json:"deletes_before,omitempty"`
+	Expiring      []string `json:"expiring,omitempty"`
+
+	scheduledAt time.Time
+	startAt     time.Time
+}
+
+// PlannedSchedule lists the scheduled backup job events between now and
+// until, in order: the global job's and those of groups with their own
+// schedule, and with RETENTION_CRON the retention job's. truncated is set
+// when a job's preview was cut off at maxPlannedRuns runs. The scheduler's
+// paused state is not taken into account.
+func (s *Service) PlannedSchedule(until time.Time) (events []PlannedEvent, truncated bool) {
+	events = []PlannedEvent{}
+	if s.cron == nil {
+		return events, false
+	}
+
+	// Backup dates per project, so retention events can say what they remove
+	dates := make(map[string]map[string]bool, len(s.databases))
+	for _, db := range s.databases {
+		dates[db.Identifier] = s.backupDates(db.Identifier)
+	}
+
+	jobs := map[string]cron.EntryID{"": s.cronEntry}
+	for group, id := range s.groupEntries {
+		jobs[group] = id
+	}
+	for group, id := range jobs {
+		entry := s.cron.Entry(id)
+		databases := s.scheduledDatabases(group)
+		if entry.Schedule == nil || len(databases) == 0 {
+			continue
+		}
+		jobEvents, jobTruncated := s.plannedJob(entry.Schedule, databases, group, dates, until)
+		events = append(events, jobEvents...)
+		truncated = truncated || jobTruncated
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].scheduledAt.Before(events[j].scheduledAt) })
+
+	if s.config.RetentionCron != "" {
+		if schedule := s.cron.Entry(s.retentionEntry).Schedule; schedule != nil {
+			retentionEvents, retentionTruncated := s.plannedRetention(schedule, events, dates, until)
+			events = append(events, retentionEvents...)
+			truncated = truncated || retentionTruncated
+			sort.SliceStable(events, func(i, j int) bool { return events[i].scheduledAt.Before(events[j].scheduledAt) })
+		}
+	}
+	return events, truncated
+}
+
+// plannedJob lists the events of one scheduled job backing up databases,
+// followed by retention unless that is scheduled on its own.
+func (s *Service) plannedJob(schedule cron.Schedule, databases []*database.Database, group string, dates map[string]map[string]bool, until time.Time) (events []PlannedEvent, truncated bool) {
+	t := time.Now().In(s.location)
+	for runs := 0; ; runs++ {
+		t = schedule.Next(t)
+		if t.IsZero() || t.After(until) {
+			return events, false
+		}
+		if runs == maxPlannedRuns {
+			return events, true
+		}
+
+		start := deferPastBlackouts(t, s.blackouts)
+		backup := PlannedEvent{
+			Type:               "backup",
+			Group:              group,
+			ScheduledAt:        t.Format(time.RFC3339),
+			EarliestStart:      start.Format(time.RFC3339),
+			DeferredByBlackout: !start.Equal(t),
+			scheduledAt:        t,
+			startAt:            start,
+		}
+		if s.config.ScheduleJitter > 0 {
+			latest := deferPastBlackouts(t.Add(s.config.ScheduleJitter), s.blackouts)
+			backup.LatestStart = latest.Format(time.RFC3339)
+		}
+
+		for _, db := range databases {
+			event := backup
+			event.Project = db.Identifier
+			events = append(events, event)
+		}
+		if s.config.RetentionCron != "" {
+			continue
+		}
+		for _, db := range databases {
+			dates[db.Identifier][backupDateAt(start)] = true
+			event := backup
+			event.Type = "retention"
+			s.planRetention(&event, db.Identifier, start, dates)
+			events = append(events, event)
+		}
+	}
+}
+
+// plannedRetention lists the runs of the retention job scheduled on its own.
+// backups must be in order; their dates are on disk from the time they start.
+func (s *Service) plannedRetention(schedule cron.Schedule, backups []PlannedEvent, dates map[string]map[string]bool, until time.Time) (events []PlannedEvent, truncated bool) {
+	next := 0
+	t := time.Now().In(s.location)
+	for runs := 0; ; runs++ {
+		t = schedule.Next(t)
+		if t.IsZero() || t.After(until) {
+			return events, false
+		}
+		if runs == maxPlannedRuns {
+			return events, true
+		}
+
+		for ; next < len(backups) && !backups[next].startAt.After(t); next++ {
+			dates[backups[next].Project][backupDateAt(backups[next].startAt)] = true
+		}
+		for _, db := range s.databases {
+			event := PlannedEvent{
+				Type:          "retention",
+				Project:       db.Identifier,
+				ScheduledAt:   t.Format(time.RFC3339),
+				EarliestStart: t.Format(time.RFC3339),
+				scheduledAt:   t,
+				startAt:       t,
+			}
+			s.planRetention(&event, db.Identifier, t, dates)
+			events = append(events, event)
+		}
+	}
+}
+
+// planRetention fills in the cutoff of a retention event running at start
+// and moves the expiring dates from dates to the event.
+func (s *Service) planRetention(event *PlannedEvent, projectID string, start time.Time, dates map[string]map[string]bool) {
+	event.DeletesBefore = backupDateAt(start.Local().AddDate(0, 0, -s.config.ProjectRetentionDays(projectID)))
+	for date := range dates[projectID] {
+		if date < event.DeletesBefore {
+			event.Expiring = append(event.Expiring, date)
+			delete(dates[projectID], date)
+		}
+	}
+	sort.Strings(event.Expiring)
+}
+
+// backupDateAt returns the date directory of a backup or the retention cutoff
+// at t: the local date when the job runs.
+func backupDateAt(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// backupDates returns the dates of a project's backups on disk, and of
+// dated directories without manifests, which retention deletes as well.
+func (s *Service) backupDates(projectID string) map[string]bool {
+	dates := make(map[string]bool)
+	if entries, err := catalog.List(s.baseDir, projectID); err == nil {
+		for _, entry := range entries {
+			if entry.Date != "" {
+				dates[entry.Date] = true
+			}
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(s.baseDir, projectID))
+	if err != nil {
+		return dates
+	}
+	for _, entry := range entries {
+		if _, err := time.Parse("2006-01-02", entry.Name()); entry.IsDir() && err == nil {
+			dates[entry.Name()] = true
+		}
+	}
+	return dates
+}
@@ -0,0 +1,1179 @@
+// Package service schedules and runs the backups of the configured projects
+// and everything around them: retention, remote copies, restores and
+// rehearsals. The HTTP daemon (pkg/server) is a thin layer on top, so other
+// programs can embed the scheduler instead, e.g. a control plane backing up
+// tenants on demand:
+//
+//	cfg, err := config.Load() // environment and defaults
+//	if err != nil {
+//		return err
+//	}
+//	cfg.Databases = map[string]string{"tenant42": "postgresql://backup@db-42/app"}
+//	cfg.BackupCron = "" // no schedule, backups only run when triggered
+//
+//	svc, err := service.New(ctx, cfg, logger)
+//	if err != nil {
+//		return err
+//	}
+//	defer svc.Shutdown(ctx)
+//	result, err := svc.RunBackupForProject(ctx, "tenant42")
+//
+// Results of runs are the JSON-shaped maps the API returns; backups on disk
+// are described by catalog.Entry.
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/importer"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/layout"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/rehearsal"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/restore"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Service struct {
+	config       *config.Config
+	logger       *zap.Logger
+	backupRunner *backup.BackupRunner
+	restorer     *restore.Restorer
+	baseDir      string
+	layout       *layout.Layout
+	databases    []*database.Database
+	cron         *cron.Cron
+	cronEntry    cron.EntryID
+	groupEntries map[string]cron.EntryID
+	location     *time.Location
+	blackouts    []blackoutWindow
+	backends     map[string]storage.Backend
+	stopCh       chan struct{}
+	state        runState
+
+	// activeRuns counts running backup jobs and project backups, which
+	// Shutdown waits for; runsCtx is cancelled when its grace period ends
+	// with some still running
+	activeRuns atomic.Int32
+	runsCtx    context.Context
+	cancelRuns context.CancelFunc
+	// shutdownOnce makes Shutdown safe to call more than once; later calls
+	// return the first call's result
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	// retentionEntry is the RETENTION_CRON job, if configured
+	retentionEntry cron.EntryID
+	// retentionMu serializes retention runs
+	retentionMu sync.Mutex
+
+	rehearser *rehearsal.Rehearser
+	// rehearsalEntry and rehearsalReportEntry are the REHEARSAL_CRON and
+	// REHEARSAL_REPORT_CRON jobs, if configured
+	rehearsalEntry       cron.EntryID
+	rehearsalReportEntry cron.EntryID
+	// rehearsalMu serializes rehearsal runs
+	rehearsalMu sync.Mutex
+
+	// tempInUse holds the names of the temp directories of running backups
+	tempInUse map[string]bool
+	tempMu    sync.Mutex
+
+	// projectsRunning holds the projects being backed up, see lockProject
+	projectsRunning map[string]bool
+	projectMu       sync.Mutex
+
+	// queue reports pending, running and recent backup jobs
+	queue jobQueue
+
+	// runLogs copies the logs of running backups into their run logs; nil
+	// with RUN_LOGS off
+	runLogs *runLogs
+
+	// busPublisher publishes events to MESSAGE_BUS_URL, if configured
+	busPublisher *busPublisher
+	// events delivers lifecycle events to EVENTS_URL, if configured
+	events *eventSender
+
+	// rpoBreached holds the projects whose RPO target was breached at the
+	// last checkRPO
+	rpoBreached map[string]bool
+	rpoMu       sync.Mutex
+
+	// oneShot is set for services made by NewOneShot
+	oneShot bool
+}
+
+func New(ctx context.Context, cfg *config.Config, logger *zap.Logger) (*Service, error) {
+	return newService(ctx, cfg, logger, false)
+}
+
+// NewOneShot is New for a process that only runs the backups it is asked
+// for and exits (backup --once): nothing is scheduled and no background work
+// (catch-up, message bus requests) starts. Retention runs as part of every
+// backup job, even with RETENTION_CRON set.
+func NewOneShot(ctx context.Context, cfg *config.Config, logger *zap.Logger) (*Service, error) {
+	return newService(ctx, cfg, logger, true)
+}
+
+func newService(ctx context.Context, cfg *config.Config, logger *zap.Logger, oneShot bool) (*Service, error) {
+	// Before anything takes a timestamp, so run IDs, date directories and
+	// manifests all use the same zone
+	if loc, err := cfg.ApplyTimestampZone(); err != nil {
+		logger.Warn("Invalid timestamp time zone, keeping the local zone", zap.String("zone", loc.String()), zap.Error(err))
+	} else {
+		logger.Info("Using time zone for timestamps", zap.String("zone", loc.String()))
+	}
+
+	// Initialize Docker client
+	if _, err := docker.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize Docker client: %w", err)
+	}
+
+	// An unset policy (e.g. a Config built in code) keeps the default
+	if cfg.ImagePullPolicy != "" {
+		policy, err := docker.ParsePullPolicy(cfg.ImagePullPolicy)
+		if err != nil {
+			return nil, err
+		}
+		docker.SetPullPolicy(policy)
+	}
+	auth, unsupported, err := docker.LoadRegistryAuth(cfg.RegistryAuthFile)
+	if err != nil {
+		return nil, err
+	}
+	docker.SetRegistryAuth(auth)
+	if len(auth) > 0 {
+		logger.Info("Loaded registry credentials", zap.Strings("registries", auth.Registries()))
+	}
+	if len(unsupported) > 0 {
+		// Docker Desktop keeps everything in a helper, so only warn when
+		// the file was asked for explicitly
+		log := logger.Debug
+		if cfg.RegistryAuthFile != "" {
+			log = logger.Warn
+		}
+		log("Credential helpers aren't supported, pulls from these registries are anonymous",
+			zap.Strings("registries", unsupported))
+	}
+	if cfg.NetworkMode != "" {
+		mode, err := docker.ParseNetworkMode(cfg.NetworkMode)
+		if err != nil {
+			return nil, err
+		}
+		docker.SetNetworkMode(mode)
+	}
+	durable.SetEnabled(cfg.DurableWrites)
+
+	// Check Docker availability
+	if err := docker.CheckDocker(ctx); err != nil {
+		return nil, fmt.Errorf("Docker check failed: %w", err)
+	}
+
+	// Host networking isn't the host's network on Docker Desktop or rootless
+	// Docker, so auto mode falls back to bridge networking there
+	mode, reason, err := docker.ResolveNetworkMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		logger.Info("Using bridge networking for helper containers", zap.String("reason", reason))
+	} else {
+		logger.Debug("Helper container networking", zap.String("mode", string(mode)))
+	}
+
+	// No backup or restore runs yet, so helper containers that exist now were
+	// left behind by a process that crashed mid-run
+	removed, err := docker.RemoveManagedContainers(ctx)
+	if err != nil {
+		logger.Warn("Failed to remove leftover helper containers", zap.Error(err))
+	}
+	for _, c := range removed {
+		logger.Info("Removed leftover helper container",
+			zap.String("container", c.ID),
+			zap.String("task", c.Task),
+			zap.String("project", c.Project),
+			zap.String("run_id", c.RunID))
+	}
+
+	// Ensure base directory exists
+	if err := os.MkdirAll(cfg.LocalBackupDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	// Parse databases
+	var databases []*database.Database
+	for projectName, connURL := range cfg.Databases {
+		db, err := database.New(connURL, projectName)
+		if err != nil {
+			logger.Warn("Failed to parse database config", zap.String("project", projectName), zap.Error(err))
+			continue
+		}
+		databases = append(databases, db)
+	}
+
+	projects := make([]string, len(databases))
+	for i, db := range databases {
+		projects[i] = db.Identifier
+	}
+	backends, err := newBackends(cfg, projects)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure remote storage: %w", err)
+	}
+	for _, backend := range backends {
+		logger.Info("Remote storage configured", zap.String("backend", backend.Name()))
+	}
+
+	if len(databases) == 0 {
+		logger.Warn("No databases configured. Set environment variables like BACKUP_PROJECTNAME=postgresql://...")
+	} else {
+		logger.Info("Configured databases for backup", zap.Int("count", len(databases)))
+	}
+	for name := range cfg.NamespaceOptions {
+		if !slices.ContainsFunc(projects, func(project string) bool { return cfg.ProjectNamespace(project) == name }) {
+			logger.Warn("Namespace has settings but no projects", zap.String("namespace", name))
+		}
+	}
+
+	registerSecrets(cfg)
+
+	// Teed in before the logger is handed out, so everything logging about a
+	// project being backed up ends up in its run log
+	var logs *runLogs
+	if cfg.RunLogs {
+		logs = newRunLogs(config.NewLogEncoder(cfg))
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewTee(core, redact.Core(logs.core()))
+		}))
+	}
+
+	s := &Service{
+		config:       cfg,
+		logger:       logger,
+		backupRunner: backup.New(cfg, logger),
+		restorer:     restore.New(cfg, logger),
+		baseDir:      cfg.LocalBackupDir,
+		databases:    databases,
+		backends:     backends,
+		stopCh:       make(chan struct{}),
+		tempInUse:    make(map[string]bool),
+
+		projectsRunning: make(map[string]bool),
+		rpoBreached:     make(map[string]bool),
+		runLogs:         logs,
+		oneShot:         oneShot,
+	}
+	s.runsCtx, s.cancelRuns = context.WithCancel(context.Background())
+	s.rehearser = rehearsal.New(cfg, logger, s.restorer)
+	s.loadState()
+
+	if cfg.SigningKeyFile != "" {
+		key, err := backup.LoadSigningKey(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.backupRunner.SetSigningKey(key)
+		logger.Info("Signing backup manifests", zap.String("key_id", backup.KeyID(key.Public().(ed25519.PublicKey))))
+	}
+
+	s.layout, err = layout.Parse(cfg.LayoutTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LAYOUT_TEMPLATE: %w", err)
+	}
+	s.backupRunner.SetLayout(s.layout)
+
+	if cfg.ImportScan {
+		s.importScan()
+	}
+
+	// Nothing runs yet, so what's left in the temp area is from earlier runs
+	s.cleanupTempDirs()
+
+	// Setup scheduler
+	if err := s.setupScheduler(); err != nil {
+		return nil, fmt.Errorf("failed to setup scheduler: %w", err)
+	}
+
+	if cfg.Catchup && !oneShot {
+		go s.runCatchup(WithTrigger(context.Background(), TriggerSchedule))
+	}
+
+	if cfg.MessageBusURL != "" {
+		s.busPublisher = &busPublisher{url: cfg.MessageBusURL}
+		if !oneShot {
+			go s.consumeBus()
+		}
+	}
+	if cfg.EventsURL != "" {
+		s.events = newEventSender(cfg.EventsURL, cfg.EventsSubject, cfg.InstanceName)
+		go s.deliverEvents()
+	}
+
+	return s, nil
+}
+
+// importScan adopts backup files under the project directories that aren't
+// in the catalog yet (IMPORT_SCAN), before the scheduler can prune them.
+func (s *Service) importScan() {
+	projects := make([]string, len(s.databases))
+	for i, db := range s.databases {
+		projects[i] = db.Identifier
+	}
+	adopted, err := importer.Scan(s.baseDir, projects)
+	if err != nil {
+		s.logger.Warn("Import scan failed", zap.Error(err))
+	}
+	for _, entry := range adopted {
+		s.logger.Info("Imported existing backup",
+			zap.String("project", entry.Project),
+			zap.String("run_id", entry.RunID),
+			zap.String("format", entry.ImportFormat))
+	}
+	s.logger.Info("Import scan finished", zap.Int("imported", len(adopted)))
+}
+
+// runCatchup runs backups for projects whose last successful backup predates
+// a scheduled fire time that has already passed, e.g. because the host was
+// down during the backup window.
+func (s *Service) runCatchup(ctx context.Context) {
+	if s.schedulerPaused() {
+		s.logger.Info("Scheduler is paused, skipping catch-up")
+		return
+	}
+
+	now := time.Now()
+	var missed []*database.Database
+	for _, db := range s.databases {
+		schedule := s.scheduleFor(db.Identifier)
+		if schedule == nil {
+			continue
+		}
+		lastSuccess, err := s.LastSuccessfulBackup(db.Identifier)
+		if err != nil {
+			s.logger.Warn("Catch-up: failed to find last successful backup", zap.String("project", db.Identifier), zap.Error(err))
+			continue
+		}
+		if lastSuccess == nil {
+			s.logger.Info("Catch-up: no successful backup yet", zap.String("project", db.Identifier))
+			missed = append(missed, db)
+			continue
+		}
+		finished := lastSuccess.FinishedTime()
+		if next := schedule.Next(finished); !next.After(now) {
+			s.logger.Info("Catch-up: missed scheduled backup",
+				zap.String("project", db.Identifier),
+				zap.String("last_success", lastSuccess.FinishedAt),
+				zap.Time("missed_run", next))
+			missed = append(missed, db)
+		}
+	}
+
+	if len(missed) == 0 {
+		s.logger.Info("Catch-up: no missed backups")
+		return
+	}
+
+	// A catch-up run is a scheduled run: jitter and blackout windows apply
+	now, start := s.scheduledStart()
+	job := s.queue.enqueue(TriggerSchedule, "", missed, start)
+	if !s.awaitScheduledStart(job, now, start) {
+		return
+	}
+	if _, err := s.runBackupJob(withQueuedJob(ctx, job), missed, ""); err != nil {
+		s.logger.Error("Catch-up backup job failed", zap.Error(err))
+	}
+}
+
+func (s *Service) setupScheduler() error {
+	// User input format: "30 0 * * *" (minute hour day month weekday), with an
+	// optional leading seconds field
+	cronExpr := cronSpec(s.config.BackupCron)
+
+	loc, err := time.LoadLocation(s.config.TZ)
+	if err != nil {
+		s.logger.Warn("Invalid timezone, using UTC", zap.String("tz", s.config.TZ), zap.Error(err))
+		loc = time.UTC
+	}
+	s.location = loc
+
+	s.blackouts, err = parseBlackoutWindows(s.config.BlackoutWindows)
+	if err != nil {
+		return err
+	}
+
+	if s.oneShot {
+		return nil
+	}
+
+	c := cron.New(cron.WithLocation(loc))
+	// An empty BackupCron (a Config built in code) leaves backups to the
+	// caller, groups with their own schedule aside
+	if s.config.BackupCron != "" {
+		s.cronEntry, err = c.AddFunc(cronExpr, func() { s.runScheduled("") })
+		if err != nil {
+			return fmt.Errorf("invalid cron expression: %w", err)
+		}
+	}
+	if err := s.scheduleGroups(c); err != nil {
+		return err
+	}
+	if s.config.RetentionCron != "" {
+		s.retentionEntry, err = c.AddFunc(cronSpec(s.config.RetentionCron), s.runScheduledRetention)
+		if err != nil {
+			return fmt.Errorf("invalid retention cron expression: %w", err)
+		}
+		s.logger.Info("Scheduled retention cleanup", zap.String("cron", s.config.RetentionCron))
+	}
+	if s.config.RehearsalCron != "" {
+		s.rehearsalEntry, err = c.AddFunc(cronSpec(s.config.RehearsalCron), s.runScheduledRehearsals)
+		if err != nil {
+			return fmt.Errorf("invalid rehearsal cron expression: %w", err)
+		}
+		s.logger.Info("Scheduled restore rehearsals", zap.String("cron", s.config.RehearsalCron))
+	}
+	if s.config.RehearsalReportURL != "" {
+		s.rehearsalReportEntry, err = c.AddFunc(cronSpec(s.config.RehearsalReportCron), s.sendRehearsalReport)
+		if err != nil {
+			return fmt.Errorf("invalid rehearsal report cron expression: %w", err)
+		}
+	}
+	if s.config.DigestCron != "" {
+		if _, err := c.AddFunc(cronSpec(s.config.DigestCron), s.sendDigest); err != nil {
+			return fmt.Errorf("invalid digest cron expression: %w", err)
+		}
+		s.logger.Info("Scheduled digest reports", zap.String("cron", s.config.DigestCron))
+	}
+	if s.config.TempCleanupInterval > 0 {
+		if _, err := c.AddFunc(fmt.Sprintf("@every %s", s.config.TempCleanupInterval), s.cleanupTempDirs); err != nil {
+			return fmt.Errorf("failed to schedule temp directory cleanup: %w", err)
+		}
+	}
+	if s.hasRPOTargets() {
+		if _, err := c.AddFunc(fmt.Sprintf("@every %s", rpoCheckInterval), s.checkRPO); err != nil {
+			return fmt.Errorf("failed to schedule RPO checks: %w", err)
+		}
+	}
+
+	c.Start()
+	s.cron = c
+
+	if s.config.BackupCron != "" {
+		s.logger.Info("Scheduled daily backups",
+			zap.String("cron", cronExpr),
+			zap.String("timezone", s.config.TZ))
+	}
+
+	return nil
+}
+
+// StartWatchdog calls ping every interval from the cron scheduler, so pings
+// stop when the scheduler stops dispatching jobs and a supervisor (systemd's
+// WatchdogSec) can restart the service.
+func (s *Service) StartWatchdog(interval time.Duration, ping func()) error {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if _, err := s.cron.AddFunc(fmt.Sprintf("@every %s", interval), ping); err != nil {
+		return fmt.Errorf("failed to schedule watchdog: %w", err)
+	}
+	return nil
+}
+
+// runScheduled is the cron callback of the global job (group "") or a group
+// with its own schedule. It applies jitter and defers runs that fall into a
+// blackout window before starting the backup job.
+func (s *Service) runScheduled(group string) {
+	databases := s.scheduledDatabases(group)
+	if len(databases) == 0 && len(s.databases) > 0 {
+		s.logger.Debug("All projects are scheduled by their groups, skipping global backup job")
+		return
+	}
+	if s.schedulerPaused() {
+		s.logger.Info("Scheduler is paused, skipping scheduled backup job", zap.String("group", group))
+		return
+	}
+
+	now, start := s.scheduledStart()
+	job := s.queue.enqueue(TriggerSchedule, group, databases, start)
+	if !s.awaitScheduledStart(job, now, start) {
+		return
+	}
+
+	ctx := withQueuedJob(WithTrigger(context.Background(), TriggerSchedule), job)
+	if _, err := s.runBackupJob(ctx, databases, group); err != nil {
+		s.logger.Error("Scheduled backup job failed", zap.String("group", group), zap.Error(err))
+	}
+}
+
+// scheduledStart returns the current time and when a scheduled run due now
+// starts: after a random jitter and outside blackout windows.
+func (s *Service) scheduledStart() (now, start time.Time) {
+	now = time.Now().In(s.location)
+	start = now
+	if s.config.ScheduleJitter > 0 {
+		start = start.Add(time.Duration(rand.Int63n(int64(s.config.ScheduleJitter))))
+	}
+	return now, deferPastBlackouts(start, s.blackouts)
+}
+
+// awaitScheduledStart waits until start for the scheduled job enqueued as
+// job. It reports false, with the job cancelled, when the service shuts down
+// or the scheduler is paused in the meantime.
+func (s *Service) awaitScheduledStart(job *queuedJob, now, start time.Time) bool {
+	if delay := start.Sub(now); delay > 0 {
+		s.logger.Info("Delaying scheduled backup job", zap.Duration("delay", delay), zap.Time("start_at", start))
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.stopCh:
+			s.logger.Info("Scheduled backup job cancelled by shutdown")
+			s.queue.finish(job, "cancelled", "service shutting down")
+			return false
+		}
+	}
+
+	// The scheduler may have been paused while waiting
+	if s.schedulerPaused() {
+		s.logger.Info("Scheduler was paused, skipping delayed backup job")
+		s.queue.finish(job, "cancelled", "scheduler paused")
+		return false
+	}
+	return true
+}
+
+func (s *Service) schedulerPaused() bool {
+	state, err := s.GetSchedulerState()
+	if err != nil {
+		// Keep backing up if the state can't be read; missing backups are worse
+		s.logger.Warn("Failed to read scheduler state", zap.Error(err))
+		return false
+	}
+	return state.Paused
+}
+
+// PauseScheduler suspends cron-triggered backups until ResumeScheduler is
+// called. Manual triggers keep working. The state survives restarts.
+func (s *Service) PauseScheduler() (*metadata.SchedulerState, error) {
+	state := metadata.SchedulerState{
+		Paused:   true,
+		PausedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := s.setSchedulerState(state); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Scheduler paused")
+	return &state, nil
+}
+
+// ResumeScheduler re-enables cron-triggered backups.
+func (s *Service) ResumeScheduler() (*metadata.SchedulerState, error) {
+	state := metadata.SchedulerState{Paused: false}
+	if err := s.setSchedulerState(state); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Scheduler resumed")
+	return &state, nil
+}
+
+// RunBackupJob backs up all projects, then applies retention.
+func (s *Service) RunBackupJob(ctx context.Context) (map[string]interface{}, error) {
+	return s.runBackupJob(ctx, s.databases, "")
+}
+
+// RunBackupProjects runs a backup job of the given projects, in order, like
+// RunBackupJob does for all of them.
+func (s *Service) RunBackupProjects(ctx context.Context, projectIDs []string) (map[string]interface{}, error) {
+	var databases []*database.Database
+	for _, projectID := range projectIDs {
+		db := s.GetDatabase(strings.ToLower(projectID))
+		if db == nil {
+			return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+		}
+		if !slices.Contains(databases, db) {
+			databases = append(databases, db)
+		}
+	}
+	return s.runBackupJob(ctx, databases, "")
+}
+
+// runBackupJob backs up databases one after another and applies retention to
+// them. group is recorded in the result of group jobs.
+func (s *Service) runBackupJob(ctx context.Context, databases []*database.Database, group string) (map[string]interface{}, error) {
+	// Shutdown waits until everything below, including the deferred
+	// metadata updates, is done
+	ctx, runDone := s.trackRun(ctx)
+	defer runDone()
+
+	job := queuedJobFrom(ctx)
+	if job == nil {
+		job = s.queue.enqueue(triggerFrom(ctx), group, databases, time.Now())
+	}
+
+	// Check if already running and mark as running in one step
+	alreadyRunning := false
+	err := s.updateStatus(func(status *metadata.ServiceStatus) {
+		alreadyRunning = status.Running
+		status.Running = true
+	})
+	if alreadyRunning {
+		s.logger.Warn("Backup job already running, skipping")
+		s.queue.finish(job, "failed", "already_running")
+		return map[string]interface{}{
+			"status": "failed",
+			"error":  "already_running",
+		}, nil
+	}
+	if err != nil {
+		s.logger.Warn("Failed to write service status", zap.Error(err))
+	}
+
+	runStarted := time.Now()
+	runID := fmt.Sprintf("run-%s", runStarted.Format("20060102-150405"))
+
+	defer func() {
+		_ = s.updateStatus(func(status *metadata.ServiceStatus) {
+			status.Running = false
+		})
+	}()
+
+	s.logger.Info("Starting backup job", zap.String("run_id", runID), zap.String("group", group))
+
+	if s.config.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.RunTimeout)
+		defer cancel()
+	}
+
+	result := map[string]interface{}{
+		"run_id":     runID,
+		"started_at": runStarted.Format(time.RFC3339),
+		"status":     "failed",
+		"backups":    []interface{}{},
+	}
+	if group != "" {
+		result["group"] = group
+	}
+	s.queue.start(job)
+	defer func() { s.queue.finishResult(job, result, nil) }()
+	s.emitEvent(EventRunStarted, map[string]interface{}{
+		"run_id":   runID,
+		"job_id":   job.id,
+		"trigger":  job.trigger,
+		"group":    group,
+		"projects": job.projects,
+	})
+
+	if len(databases) == 0 {
+		result["error"] = "No databases configured"
+		result["finished_at"] = time.Now().Format(time.RFC3339)
+		result["duration_ms"] = 0
+		_ = s.setLastRun(result)
+		return result, nil
+	}
+
+	// Run backups
+	backupDate := time.Now().Format("2006-01-02")
+	var backupResults []interface{}
+	addResult := func(backupResult map[string]interface{}) {
+		backupResults = append(backupResults, backupResult)
+		s.emitBackupEvent(stringField(backupResult, "database_identifier"), job.trigger, backupResult, nil)
+	}
+	succeeded := 0
+	failed := 0
+	skipped := 0
+	uploadsFailed := 0
+	// interrupted is set when a shutdown skipped projects or cancelled one
+	interrupted := false
+
+	// Create temp base directory once for all backups
+	if err := os.MkdirAll(s.tempBaseDir(), 0755); err != nil {
+		s.logger.Error("Failed to create temp base directory", zap.Error(err))
+		result["error"] = fmt.Sprintf("failed to create temp base directory: %v", err)
+		result["finished_at"] = time.Now().Format(time.RFC3339)
+		result["duration_ms"] = time.Since(runStarted).Milliseconds()
+		_ = s.setLastRun(result)
+		return result, nil
+	}
+
+	for _, db := range databases {
+		s.queue.progress(job, backupResults)
+		if s.shuttingDown() {
+			s.logger.Warn("Service is shutting down, skipping backup", zap.String("database", db.Identifier))
+			addResult(map[string]interface{}{
+				"database_identifier": db.Identifier,
+				"status":              "skipped",
+				"error":               "not started: the service is shutting down",
+			})
+			skipped++
+			interrupted = true
+			continue
+		}
+		if ctx.Err() != nil {
+			s.logger.Error("Run timeout exceeded, skipping backup", zap.String("database", db.Identifier), zap.Duration("run_timeout", s.config.RunTimeout))
+			addResult(failedResult(db.Identifier, backup.PhaseSetup, fmt.Errorf("not started: run timeout of %s exceeded: %w", s.config.RunTimeout, ctx.Err())))
+			failed++
+			continue
+		}
+
+		// A manual backup of the project is running; it is as fresh as this
+		// one would be
+		releaseProject, err := s.lockProject(db.Identifier)
+		if err != nil {
+			s.logger.Warn("Backup of project already running, skipping", zap.String("database", db.Identifier))
+			addResult(map[string]interface{}{
+				"database_identifier": db.Identifier,
+				"status":              "skipped",
+				"error":               err.Error(),
+			})
+			skipped++
+			continue
+		}
+
+		if err := s.enforceQuotas(db.Identifier, true); err != nil {
+			s.logger.Error("Backup does not fit quota", zap.String("database", db.Identifier), zap.Error(err))
+			addResult(failedResult(db.Identifier, backup.PhaseSetup, err))
+			failed++
+			releaseProject()
+			continue
+		}
+
+		s.logger.Info("Backing up database", zap.String("database", db.Identifier))
+
+		tempDir, releaseTempDir, err := s.makeTempDir(db.Identifier, backupDate)
+		if err != nil {
+			s.logger.Error("Failed to create temp directory", zap.Error(err))
+			addResult(failedResult(db.Identifier, backup.PhaseSetup, err))
+			failed++
+			releaseProject()
+			continue
+		}
+
+		progress := s.startProgress(runID, db.Identifier)
+		backupCtx, cancel := s.backupContext(ctx, db.Identifier)
+		manifest, err := s.backupRunner.CreateBackup(backupCtx, db, tempDir, backupDate, progress.report)
+		cancel()
+		if s.interruptedByShutdown() {
+			interrupted = true
+		}
+		if err != nil {
+			progress.finish()
+			s.logger.Error("Backup failed", zap.String("database", db.Identifier), zap.Error(err))
+			addResult(failedResult(db.Identifier, backup.PhaseSetup, err))
+			failed++
+			releaseTempDir()
+			releaseProject()
+			continue
+		}
+
+		var uploads []interface{}
+		if manifest.Status == "success" && len(manifest.Files) > 0 {
+			// Move backup files to final location
+			relDir, err := s.backupDir(db.Identifier, manifest.RunID, backupDate)
+			if err != nil {
+				progress.finish()
+				s.logger.Error("Failed to place backup", zap.Error(err))
+				addResult(failedResult(db.Identifier, backup.PhaseArchive, err))
+				failed++
+				releaseTempDir()
+				releaseProject()
+				continue
+			}
+			backupDir := filepath.Join(s.baseDir, filepath.FromSlash(relDir))
+			if err := os.MkdirAll(backupDir, 0755); err != nil {
+				progress.finish()
+				s.logger.Error("Failed to create backup directory", zap.Error(err))
+				addResult(failedResult(db.Identifier, backup.PhaseArchive, err))
+				failed++
+				releaseTempDir()
+				releaseProject()
+				continue
+			}
+
+			// Move archive (or its parts) and manifest
+			manifestFile := fmt.Sprintf("manifest-%s.json", manifest.RunID)
+
+			srcManifest := filepath.Join(tempDir, manifestFile)
+			dstManifest := filepath.Join(backupDir, manifestFile)
+
+			for _, archiveFile := range manifest.ArchiveFiles() {
+				srcArchive := filepath.Join(tempDir, archiveFile)
+				dstArchive := filepath.Join(backupDir, archiveFile)
+				if _, err := os.Stat(srcArchive); err == nil {
+					if err := durable.Move(srcArchive, dstArchive); err != nil {
+						s.logger.Warn("Failed to move archive", zap.Error(err))
+					}
+				}
+			}
+
+			if _, err := os.Stat(srcManifest); err == nil {
+				if err := durable.Move(srcManifest, dstManifest); err != nil {
+					s.logger.Warn("Failed to move manifest", zap.Error(err))
+				}
+			}
+
+			s.syncBackupDir(backupDir)
+			s.invalidateLastSuccess(db.Identifier)
+
+			progress.report(backup.PhaseUpload, 0)
+			uploads = s.uploadBackup(ctx, db, relDir, manifest)
+		}
+		progress.finish()
+		if relDir, err := s.backupDir(db.Identifier, manifest.RunID, backupDate); err == nil {
+			s.keepRunLog(db.Identifier, tempDir, filepath.Join(s.baseDir, filepath.FromSlash(relDir)), manifest.RunID)
+		}
+
+		backupResult := map[string]interface{}{
+			"database_identifier": manifest.DatabaseID,
+			"run_id":              manifest.RunID,
+			"status":              manifest.Status,
+			"error":               manifest.Error,
+		}
+		if len(manifest.Tags) > 0 {
+			backupResult["tags"] = manifest.Tags
+		}
+		if uploads != nil {
+			backupResult["storage"] = uploads
+		}
+		if manifest.Stats != nil {
+			backupResult["stats"] = manifest.Stats
+		}
+		if len(manifest.PhaseMs) > 0 {
+			backupResult["phase_ms"] = manifest.PhaseMs
+		}
+		s.reportSchemaDrift(backupResult, manifest)
+		setFailure(backupResult, manifest)
+		addResult(backupResult)
+
+		switch backupResult["status"] {
+		case "success":
+			succeeded++
+		case "partial":
+			succeeded++
+			uploadsFailed++
+		default:
+			failed++
+		}
+
+		releaseTempDir()
+		releaseProject()
+	}
+
+	s.queue.progress(job, backupResults)
+
+	// Retention cleanup, unless it is scheduled on its own (RETENTION_CRON,
+	// which never fires in a one-shot process)
+	// A shutdown doesn't wait for it either; the next job catches up
+	var cleanupResults, prunedResults interface{}
+	if (s.config.RetentionCron == "" || s.oneShot) && !s.shuttingDown() {
+		s.retentionMu.Lock()
+		report := s.runRetention(runID, databases, retentionTriggerJob)
+		s.retentionMu.Unlock()
+		cleanupResults = report["deleted"]
+		prunedResults = report["pruned"]
+	}
+
+	runFinished := time.Now()
+	durationMs := runFinished.Sub(runStarted).Milliseconds()
+
+	// Backups that are only missing remote copies make the run partial
+	statusStr := "failed"
+	if failed == 0 && uploadsFailed == 0 {
+		statusStr = "success"
+	} else if succeeded > 0 {
+		statusStr = "partial"
+	}
+	// Projects a shutdown skipped or cancelled leave the run incomplete
+	if interrupted && statusStr == "success" {
+		statusStr = "partial"
+		if succeeded == 0 {
+			statusStr = "failed"
+		}
+	}
+
+	result["finished_at"] = runFinished.Format(time.RFC3339)
+	result["duration_ms"] = durationMs
+	result["status"] = statusStr
+	result["databases_total"] = len(databases)
+	result["databases_succeeded"] = succeeded
+	result["databases_failed"] = failed
+	if skipped > 0 {
+		result["databases_skipped"] = skipped
+	}
+	if interrupted {
+		result["interrupted"] = true
+	}
+	result["backups"] = backupResults
+	if failures := runFailures(backupResults); len(failures) > 0 {
+		result["failures"] = failures
+	}
+	if cleanupResults != nil {
+		result["retention_cleanup"] = cleanupResults
+	}
+	if prunedResults != nil {
+		result["retention_pruned"] = prunedResults
+	}
+
+	if err := s.setLastRun(result); err != nil {
+		s.logger.Warn("Failed to write last run", zap.Error(err))
+	}
+	s.pushMetrics(result)
+
+	s.logger.Info("Backup job completed",
+		zap.String("run_id", runID),
+		zap.Int("succeeded", succeeded),
+		zap.Int("failed", failed),
+		zap.Int64("duration_ms", durationMs))
+
+	return result, nil
+}
+
+// backupContext bounds one project's dump by BACKUP_TIMEOUT (global or
+// BACKUP_<PROJECT>_BACKUP_TIMEOUT). Uploads are not included.
+func (s *Service) backupContext(ctx context.Context, projectID string) (context.Context, context.CancelFunc) {
+	timeout := s.config.ProjectOptionDuration(projectID, "BACKUP_TIMEOUT", s.config.BackupTimeout)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// CheckProject runs the preflight checks for a project's backup without
+// dumping anything.
+func (s *Service) CheckProject(ctx context.Context, projectID string) (*backup.PreflightReport, error) {
+	db := s.GetDatabase(projectID)
+	if db == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+	return s.backupRunner.Preflight(ctx, db), nil
+}
+
+// HelperContainers lists the dump and restore containers that currently exist.
+func (s *Service) HelperContainers(ctx context.Context) ([]docker.ManagedContainer, error) {
+	containers, err := docker.ListManagedContainers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDockerUnavailable, err)
+	}
+	return containers, nil
+}
+
+// backupDir returns the directory of a backup under the configured layout,
+// relative to the backup directory with forward slashes.
+func (s *Service) backupDir(projectID, runID, date string) (string, error) {
+	dir, _, err := s.layout.Path(layout.Vars{
+		Project:   projectID,
+		Group:     s.config.ProjectGroup(projectID),
+		Namespace: s.config.ProjectNamespace(projectID),
+		RunID:     runID,
+		Date:      date,
+		Instance:  s.config.InstanceName,
+	})
+	return dir, err
+}
+
+func (s *Service) GetDatabases() []*database.Database {
+	return s.databases
+}
+
+func (s *Service) GetDatabase(identifier string) *database.Database {
+	for _, db := range s.databases {
+		if db.Identifier == identifier {
+			return db
+		}
+	}
+	return nil
+}
+
+// NextRuns returns the next n fire times of the global backup schedule.
+func (s *Service) NextRuns(n int) []time.Time {
+	if s.cron == nil {
+		return nil
+	}
+	return nextRuns(s.cron.Entry(s.cronEntry).Schedule, n)
+}
+
+// NextRunsForProject returns the next n scheduled backups of a project: its
+// group's schedule if the group has one, otherwise the global schedule.
+func (s *Service) NextRunsForProject(projectID string, n int) []time.Time {
+	return nextRuns(s.scheduleFor(projectID), n)
+}
+
+// nextRuns returns the next n fire times of schedule.
+func nextRuns(schedule cron.Schedule, n int) []time.Time {
+	if schedule == nil {
+		return nil
+	}
+	runs := make([]time.Time, 0, n)
+	t := time.Now()
+	for i := 0; i < n; i++ {
+		t = schedule.Next(t)
+		if t.IsZero() {
+			break
+		}
+		runs = append(runs, t)
+	}
+	return runs
+}
+
+// syncBackupDir makes the files moved into backupDir, and the directories
+// created for it, permanent (DURABLE_WRITES). A failure is only logged: the
+// files are in place, they just might not survive a host crash.
+func (s *Service) syncBackupDir(backupDir string) {
+	if err := durable.SyncDirs(s.baseDir, backupDir); err != nil {
+		s.logger.Warn("Failed to sync backup directory", zap.String("dir", backupDir), zap.Error(err))
+	}
+}
+
+// RunBackupForProject backs up a single project by identifier
+func (s *Service) RunBackupForProject(ctx context.Context, projectID string) (result map[string]interface{}, err error) {
+	db := s.GetDatabase(projectID)
+	if db == nil {
+		return nil, fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+
+	// Only another backup of this project blocks; a job backing up other
+	// projects doesn't
+	if s.shuttingDown() {
+		return nil, ErrShuttingDown
+	}
+	ctx, runDone := s.trackRun(ctx)
+	defer runDone()
+
+	releaseProject, err := s.lockProject(db.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseProject()
+
+	job := s.queue.enqueue(triggerFrom(ctx), "", []*database.Database{db}, time.Now())
+	s.queue.start(job)
+	defer func() { s.queue.finishResult(job, result, err) }()
+	s.emitEvent(EventRunStarted, map[string]interface{}{
+		"job_id":   job.id,
+		"trigger":  job.trigger,
+		"projects": job.projects,
+	})
+	defer func() { s.emitBackupEvent(db.Identifier, job.trigger, result, err) }()
+	defer func() {
+		if result != nil {
+			s.pushMetrics(result)
+		}
+	}()
+
+	if err := s.enforceQuotas(db.Identifier, true); err != nil {
+		return nil, err
+	}
+
+	backupDate := time.Now().Format("2006-01-02")
+	s.logger.Info("Backing up database", zap.String("database", db.Identifier))
+
+	tempDir, releaseTempDir, err := s.makeTempDir(db.Identifier, backupDate)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseTempDir()
+
+	progress := s.startProgress("", db.Identifier)
+	defer progress.finish()
+
+	backupCtx, cancel := s.backupContext(ctx, db.Identifier)
+	manifest, err := s.backupRunner.CreateBackup(backupCtx, db, tempDir, backupDate, progress.report)
+	cancel()
+	if err != nil && s.interruptedByShutdown() {
+		return nil, fmt.Errorf("backup interrupted by shutdown: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+
+	// Always move manifest to final location (even for failures, so we can see what went wrong)
+	relDir, err := s.backupDir(db.Identifier, manifest.RunID, backupDate)
+	if err != nil {
+		return nil, err
+	}
+	backupDir := filepath.Join(s.baseDir, filepath.FromSlash(relDir))
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	manifestFile := fmt.Sprintf("manifest-%s.json", manifest.RunID)
+	srcManifest := filepath.Join(tempDir, manifestFile)
+	dstManifest := filepath.Join(backupDir, manifestFile)
+
+	if _, err := os.Stat(srcManifest); err == nil {
+		if err := durable.Move(srcManifest, dstManifest); err != nil {
+			s.logger.Warn("Failed to move manifest", zap.Error(err))
+		}
+	}
+
+	// Only move archive if backup was successful
+	var uploads []interface{}
+	if manifest.Status == "success" && len(manifest.Files) > 0 {
+		for _, archiveFile := range manifest.ArchiveFiles() {
+			srcArchive := filepath.Join(tempDir, archiveFile)
+			dstArchive := filepath.Join(backupDir, archiveFile)
+			if _, err := os.Stat(srcArchive); err == nil {
+				if err := durable.Move(srcArchive, dstArchive); err != nil {
+					s.logger.Warn("Failed to move archive", zap.Error(err))
+				}
+			}
+		}
+
+		s.syncBackupDir(backupDir)
+		s.invalidateLastSuccess(db.Identifier)
+
+		progress.report(backup.PhaseUpload, 0)
+		uploads = s.uploadBackup(ctx, db, relDir, manifest)
+	}
+	s.keepRunLog(db.Identifier, tempDir, backupDir, manifest.RunID)
+
+	result = map[string]interface{}{
+		"database_identifier": manifest.DatabaseID,
+		"run_id":              manifest.RunID,
+		"status":              manifest.Status,
+		"started_at":          manifest.StartedAt,
+		"finished_at":         manifest.FinishedAt,
+		"duration_ms":         manifest.DurationMs,
+	}
+
+	if manifest.Error != "" {
+		result["error"] = manifest.Error
+	}
+	if len(manifest.Tags) > 0 {
+		result["tags"] = manifest.Tags
+	}
+	if uploads != nil {
+		result["storage"] = uploads
+	}
+	if manifest.Stats != nil {
+		result["stats"] = manifest.Stats
+	}
+	if len(manifest.PhaseMs) > 0 {
+		result["phase_ms"] = manifest.PhaseMs
+	}
+	s.reportSchemaDrift(result, manifest)
+	setFailure(result, manifest)
+	if s.interruptedByShutdown() {
+		result["interrupted"] = true
+	}
+
+	return result, nil
+}
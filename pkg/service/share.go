@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// Share is a set of expiring download URLs for a backup's remote copy.
+type Share struct {
+	Project   string       `json:"project"`
+	RunID     string       `json:"run_id"`
+	Target    string       `json:"target"`
+	ExpiresAt string       `json:"expires_at"`
+	Files     []SharedFile `json:"files"`
+}
+
+// SharedFile is a file of a shared backup: the archive (or its parts, in
+// order) and the manifest with the checksums to verify them.
+type SharedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size,omitempty"`
+	URL  string `json:"url"`
+}
+
+// ShareBackup creates download URLs for a backup's files in a remote target
+// holding a copy, so they can be handed out without passing through the API.
+// target selects the remote by name, else the first one that can share is
+// used. ttl defaults to SHARE_URL_TTL and may not exceed it.
+func (s *Service) ShareBackup(ctx context.Context, projectID, runID, target string, ttl time.Duration) (*Share, error) {
+	if ttl <= 0 {
+		ttl = s.config.ShareURLTTL
+	}
+	if ttl > s.config.ShareURLTTL {
+		return nil, fmt.Errorf("ttl %s exceeds SHARE_URL_TTL (%s)", ttl, s.config.ShareURLTTL)
+	}
+	entry, err := s.FindBackup(projectID, runID)
+	if err != nil {
+		return nil, err
+	}
+	if entry.ArchivePath == "" {
+		return nil, fmt.Errorf("%w: %s/%s has no archive", ErrNotShareable, entry.Project, entry.RunID)
+	}
+
+	var backend storage.Backend
+	var sharer storage.Sharer
+	for _, candidate := range s.backendsFor(entry.Project) {
+		if target != "" && candidate.Name() != target || !slices.Contains(entry.StoredIn, candidate.Name()) {
+			continue
+		}
+		if candidateSharer, ok := candidate.(storage.Sharer); ok {
+			backend, sharer = candidate, candidateSharer
+			break
+		}
+	}
+	if sharer == nil {
+		if target != "" {
+			return nil, fmt.Errorf("%w: %s/%s isn't stored in %s or it can't share", ErrNotShareable, entry.Project, entry.RunID, target)
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotShareable, entry.Project, entry.RunID)
+	}
+
+	relDir, err := filepath.Rel(s.baseDir, entry.Dir)
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{
+		Project:   entry.Project,
+		RunID:     entry.RunID,
+		Target:    backend.Name(),
+		ExpiresAt: time.Now().Add(ttl).Format(time.RFC3339),
+	}
+	for _, file := range append(archiveFiles(entry), entry.ManifestPath) {
+		name := filepath.Base(file)
+		url, err := sharer.ShareURL(ctx, path.Join(remoteDir(entry.Instance, filepath.ToSlash(relDir)), name), ttl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to share %s: %w", name, err)
+		}
+		shared := SharedFile{Name: name, URL: url}
+		if info, err := os.Stat(file); err == nil {
+			shared.Size = info.Size()
+		}
+		share.Files = append(share.Files, shared)
+	}
+
+	s.logger.Info("Shared backup",
+		zap.String("project", entry.Project),
+		zap.String("run_id", entry.RunID),
+		zap.String("target", share.Target),
+		zap.Duration("ttl", ttl))
+	return share, nil
+}
+
+// archiveFiles returns the paths an entry's archive was uploaded as: its
+// parts if it was split, else the archive. entry.Files lists the parts in
+// the manifest's order; they mustn't be sorted by name, which puts part1000
+// before part101.
+func archiveFiles(entry *catalog.Entry) []string {
+	var parts []string
+	for _, file := range entry.Files {
+		if strings.HasPrefix(file, entry.ArchivePath+".part") {
+			parts = append(parts, file)
+		}
+	}
+	if len(parts) > 0 {
+		return parts
+	}
+	return []string{entry.ArchivePath}
+}
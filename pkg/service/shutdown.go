@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runsPollInterval is how often Shutdown checks whether the running backups
+// are done.
+const runsPollInterval = 100 * time.Millisecond
+
+// trackRun registers a running backup job or project backup for Shutdown to
+// wait for. The returned context is cancelled when the shutdown grace period
+// ends; call done when the backup and its metadata are written.
+func (s *Service) trackRun(ctx context.Context) (context.Context, func()) {
+	s.activeRuns.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.runsCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.activeRuns.Add(-1)
+	}
+}
+
+// shuttingDown reports whether Shutdown was called: backup jobs don't start
+// further projects.
+func (s *Service) shuttingDown() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruptedByShutdown reports whether running backups were cancelled
+// because the grace period ended.
+func (s *Service) interruptedByShutdown() bool {
+	return s.runsCtx.Err() != nil
+}
+
+// waitForRuns waits until no backup is running or ctx is done.
+func (s *Service) waitForRuns(ctx context.Context) error {
+	ticker := time.NewTicker(runsPollInterval)
+	defer ticker.Stop()
+	for s.activeRuns.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Shutdown stops the scheduler and drains running backups: jobs finish the
+// project they are backing up and skip the rest. Backups still running after
+// SHUTDOWN_GRACE_PERIOD are cancelled and recorded as interrupted, so no
+// running state is left behind; without a grace period they may run until
+// ctx is done. It then waits for the scheduler's other jobs and the delivery
+// of queued events, each bounded by ctx. Only the first call shuts down,
+// later ones wait for it and return its result.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Service) shutdown(ctx context.Context) error {
+	// Release scheduled runs waiting out jitter or a blackout window
+	close(s.stopCh)
+
+	var cronCtx context.Context
+	if s.cron != nil {
+		cronCtx = s.cron.Stop()
+	}
+
+	if running := s.activeRuns.Load(); running > 0 {
+		s.logger.Info("Waiting for running backups to finish",
+			zap.Int32("running", running),
+			zap.Duration("grace_period", s.config.ShutdownGracePeriod))
+	}
+	graceCtx := ctx
+	if s.config.ShutdownGracePeriod > 0 {
+		var cancel context.CancelFunc
+		graceCtx, cancel = context.WithTimeout(ctx, s.config.ShutdownGracePeriod)
+		defer cancel()
+	}
+	if err := s.waitForRuns(graceCtx); err != nil {
+		if ctx.Err() != nil {
+			// Don't leave the backups running after Shutdown returned
+			s.cancelRuns()
+			return ctx.Err()
+		}
+		s.logger.Warn("Backups still running after the shutdown grace period, cancelling them",
+			zap.Int32("running", s.activeRuns.Load()),
+			zap.Duration("grace_period", s.config.ShutdownGracePeriod))
+		s.cancelRuns()
+		if err := s.waitForRuns(ctx); err != nil {
+			return err
+		}
+	}
+
+	if cronCtx != nil {
+		select {
+		case <-cronCtx.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Events of the last backups may still be queued
+	if s.events != nil {
+		select {
+		case <-s.events.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
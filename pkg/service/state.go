@@ -0,0 +1,193 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/metadata"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/catalog"
+	"go.uber.org/zap"
+)
+
+// runState is the in-memory copy of the metadata files (running.json,
+// latest.json, scheduler.json) and of each project's last successful backup.
+// The files are read once at startup; afterwards every change is applied here
+// and written through, so reads such as /status under monitoring scrape load
+// don't touch the disk.
+type runState struct {
+	mu        sync.RWMutex
+	status    metadata.ServiceStatus
+	lastRun   map[string]interface{}
+	scheduler metadata.SchedulerState
+	// lastSuccess caches catalog.LastSuccessful per project; a missing key
+	// means unknown, a nil entry means the project has no successful backup
+	lastSuccess map[string]*catalog.Entry
+}
+
+// loadState reads the persisted state into memory. A running flag left by a
+// process that died mid-backup is cleared: no backup can be running yet.
+// Corrupted files have been quarantined by the metadata package; they are
+// regenerated from the defaults, except latest.json, which the next run writes.
+func (s *Service) loadState() {
+	st := &s.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.lastSuccess = make(map[string]*catalog.Entry)
+
+	if err := metadata.RemoveTempFiles(s.baseDir); err != nil {
+		s.logger.Warn("Failed to remove leftover metadata temp files", zap.Error(err))
+	}
+
+	status, err := metadata.ReadServiceStatus(s.baseDir)
+	switch {
+	case errors.Is(err, metadata.ErrCorrupted):
+		s.logger.Warn("Service status was corrupted, regenerating it", zap.Error(err))
+		if err := metadata.WriteServiceStatus(s.baseDir, &st.status); err != nil {
+			s.logger.Warn("Failed to write service status", zap.Error(err))
+		}
+	case err != nil:
+		s.logger.Warn("Failed to read service status", zap.Error(err))
+	case status.Running || status.Current != nil || len(status.Backups) > 0:
+		s.logger.Warn("Previous backup job was interrupted, clearing running status")
+		if err := metadata.WriteServiceStatus(s.baseDir, &st.status); err != nil {
+			s.logger.Warn("Failed to write service status", zap.Error(err))
+		}
+	}
+
+	lastRun, err := metadata.ReadLastRun(s.baseDir)
+	if err != nil {
+		s.logger.Warn("Failed to read last run", zap.Error(err))
+	}
+	st.lastRun = lastRun
+
+	scheduler, err := metadata.ReadSchedulerState(s.baseDir)
+	switch {
+	case errors.Is(err, metadata.ErrCorrupted):
+		// Keep backing up: a lost pause is better than missed backups
+		s.logger.Warn("Scheduler state was corrupted, regenerating it as not paused", zap.Error(err))
+		if err := metadata.WriteSchedulerState(s.baseDir, &st.scheduler); err != nil {
+			s.logger.Warn("Failed to write scheduler state", zap.Error(err))
+		}
+	case err != nil:
+		// Keep backing up if the state can't be read; missing backups are worse
+		s.logger.Warn("Failed to read scheduler state", zap.Error(err))
+	default:
+		st.scheduler = *scheduler
+	}
+}
+
+// updateStatus applies fn to the running status and persists it. Job runs and
+// progress updates both change it, so changes go through the state lock.
+func (s *Service) updateStatus(fn func(*metadata.ServiceStatus)) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	fn(&s.state.status)
+	status := copyStatus(&s.state.status)
+	return metadata.WriteServiceStatus(s.baseDir, status)
+}
+
+// GetRunStatus returns the running status, including the progress of the
+// backup currently running.
+func (s *Service) GetRunStatus() (*metadata.ServiceStatus, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	return copyStatus(&s.state.status), nil
+}
+
+func copyStatus(status *metadata.ServiceStatus) *metadata.ServiceStatus {
+	c := *status
+	if status.Current != nil {
+		current := *status.Current
+		c.Current = &current
+	}
+	c.Backups = append([]metadata.RunProgress(nil), status.Backups...)
+	return &c
+}
+
+func (s *Service) GetRunning() (bool, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	return s.state.status.Running, nil
+}
+
+// GetLastRun returns the result of the last backup job, or nil if none has
+// run yet. The map must not be modified.
+func (s *Service) GetLastRun() (map[string]interface{}, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	return s.state.lastRun, nil
+}
+
+// setLastRun records the result of a backup job and persists it.
+func (s *Service) setLastRun(result map[string]interface{}) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.state.lastRun = result
+	return metadata.WriteLastRun(s.baseDir, result)
+}
+
+func (s *Service) GetSchedulerState() (*metadata.SchedulerState, error) {
+	s.state.mu.RLock()
+	defer s.state.mu.RUnlock()
+	scheduler := s.state.scheduler
+	return &scheduler, nil
+}
+
+// setSchedulerState records a pause or resume and persists it. The in-memory
+// state only changes if the write succeeds, so a reported pause survives a
+// restart.
+func (s *Service) setSchedulerState(scheduler metadata.SchedulerState) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if err := metadata.WriteSchedulerState(s.baseDir, &scheduler); err != nil {
+		return err
+	}
+	s.state.scheduler = scheduler
+	return nil
+}
+
+// LastSuccessfulBackup returns the newest successful backup of a project on
+// disk. Results are cached until invalidateLastSuccess is called.
+func (s *Service) LastSuccessfulBackup(projectID string) (*catalog.Entry, error) {
+	s.state.mu.RLock()
+	entry, ok := s.state.lastSuccess[projectID]
+	s.state.mu.RUnlock()
+	if ok {
+		return entry, nil
+	}
+
+	entry, err := catalog.LastSuccessful(s.baseDir, projectID)
+	if err != nil {
+		return nil, err
+	}
+	s.state.mu.Lock()
+	s.state.lastSuccess[projectID] = entry
+	s.state.mu.Unlock()
+	return entry, nil
+}
+
+// LastBackup returns the newest backup of a project on disk, whatever its
+// status, or nil if there is none.
+func (s *Service) LastBackup(projectID string) (*catalog.Entry, error) {
+	entries, err := catalog.List(s.baseDir, projectID)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[len(entries)-1], nil
+}
+
+// invalidateLastSuccess drops cached last successful backups after backups
+// were added or removed; without projects, all are dropped.
+func (s *Service) invalidateLastSuccess(projects ...string) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	if len(projects) == 0 {
+		s.state.lastSuccess = make(map[string]*catalog.Entry)
+		return
+	}
+	for _, project := range projects {
+		delete(s.state.lastSuccess, project)
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TempDir is an entry of the temp area (STAGING_DIR, by default .tmp in the
+// backup directory), where dumps are written before they are moved into
+// place.
+type TempDir struct {
+	Name      string    `json:"name"`
+	SizeBytes int64     `json:"size_bytes"`
+	ModTime   time.Time `json:"modified_at"`
+	// InUse is set for the temp directories of running backups, which
+	// cleanup never touches
+	InUse bool `json:"in_use"`
+	// Orphaned entries are older than TEMP_MAX_AGE and not in use; the next
+	// cleanup removes them
+	Orphaned bool `json:"orphaned"`
+}
+
+// tempBaseDir is where backups write their dumps: STAGING_DIR, or baseDir
+// to avoid cross-device moves (the system /tmp is often tmpfs).
+func (s *Service) tempBaseDir() string {
+	if s.config.StagingDir != "" {
+		return s.config.StagingDir
+	}
+	return filepath.Join(s.baseDir, ".tmp")
+}
+
+// makeTempDir creates the temp directory of a backup, starts its run log in
+// it and marks it in use until release is called, which also removes it.
+func (s *Service) makeTempDir(projectID, backupDate string) (dir string, release func(), err error) {
+	if err := os.MkdirAll(s.tempBaseDir(), 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create temp base directory: %w", err)
+	}
+	dir, err = os.MkdirTemp(s.tempBaseDir(), fmt.Sprintf("backup-%s-%s-", projectID, backupDate))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	s.tempMu.Lock()
+	s.tempInUse[filepath.Base(dir)] = true
+	s.tempMu.Unlock()
+	s.startRunLog(projectID, dir)
+	return dir, func() {
+		s.stopRunLog(projectID)
+		_ = os.RemoveAll(dir)
+		s.tempMu.Lock()
+		delete(s.tempInUse, filepath.Base(dir))
+		s.tempMu.Unlock()
+	}, nil
+}
+
+// TempDirs lists the temp area, oldest first. An entry's modification time is
+// the newest of anything inside it, so a dump still being written is never
+// mistaken for an old one.
+func (s *Service) TempDirs() ([]TempDir, error) {
+	entries, err := os.ReadDir(s.tempBaseDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read temp directory: %w", err)
+	}
+
+	s.tempMu.Lock()
+	inUse := make(map[string]bool, len(s.tempInUse))
+	for name := range s.tempInUse {
+		inUse[name] = true
+	}
+	s.tempMu.Unlock()
+
+	cutoff := time.Now().Add(-s.config.TempMaxAge)
+	dirs := make([]TempDir, 0, len(entries))
+	for _, entry := range entries {
+		dir := TempDir{Name: entry.Name(), InUse: inUse[entry.Name()]}
+		dir.SizeBytes, dir.ModTime = diskUsage(filepath.Join(s.tempBaseDir(), entry.Name()))
+		dir.Orphaned = !dir.InUse && s.config.TempMaxAge > 0 && dir.ModTime.Before(cutoff)
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].ModTime.Before(dirs[j].ModTime) })
+	return dirs, nil
+}
+
+// diskUsage returns the total size of the files below path and the newest
+// modification time of path and anything inside it.
+func diskUsage(path string) (size int64, modTime time.Time) {
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			size += info.Size()
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+	return size, modTime
+}
+
+// CleanupTempDirs removes orphaned temp directories (see TempDir.Orphaned),
+// left behind by runs that crashed or were killed, and returns them.
+func (s *Service) CleanupTempDirs() ([]TempDir, error) {
+	dirs, err := s.TempDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []TempDir
+	var reclaimed int64
+	for _, dir := range dirs {
+		if !dir.Orphaned {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.tempBaseDir(), dir.Name)); err != nil {
+			s.logger.Warn("Failed to remove orphaned temp directory", zap.String("name", dir.Name), zap.Error(err))
+			continue
+		}
+		s.logger.Info("Removed orphaned temp directory",
+			zap.String("name", dir.Name),
+			zap.Int64("size_bytes", dir.SizeBytes),
+			zap.Time("modified_at", dir.ModTime))
+		removed = append(removed, dir)
+		reclaimed += dir.SizeBytes
+	}
+	if len(removed) > 0 {
+		s.logger.Info("Cleaned up temp directories", zap.Int("removed", len(removed)), zap.Int64("reclaimed_bytes", reclaimed))
+	}
+	return removed, nil
+}
+
+// cleanupTempDirs is the TEMP_CLEANUP_INTERVAL job.
+func (s *Service) cleanupTempDirs() {
+	if _, err := s.CleanupTempDirs(); err != nil {
+		s.logger.Warn("Temp directory cleanup failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+	"go.uber.org/zap"
+)
+
+// newBackends creates one backend per distinct remote named in RCLONE_REMOTE
+// or any NAMESPACE_<NAME>_RCLONE_REMOTE or BACKUP_<PROJECT>_RCLONE_REMOTE
+// override, keyed by remote.
+// "<scheme>://..." targets use the backend registered for the scheme, all
+// others are rclone remotes.
+func newBackends(cfg *config.Config, projects []string) (map[string]storage.Backend, error) {
+	backends := make(map[string]storage.Backend)
+	for _, project := range projects {
+		for _, remote := range storageTargets(cfg, project) {
+			if _, ok := backends[remote]; ok {
+				continue
+			}
+			backend, registered, err := storage.Open(remote)
+			if err != nil {
+				return nil, err
+			}
+			if registered {
+				backends[remote] = backend
+				continue
+			}
+			rclone, err := storage.NewRclone(cfg.RcloneBinary, remote, strings.Fields(cfg.RcloneFlags), cfg.RcloneVerify)
+			if err != nil {
+				return nil, err
+			}
+			backends[remote] = rclone
+		}
+	}
+	return backends, nil
+}
+
+// storageTargets lists the remotes a project's backups are mirrored to: its
+// own RCLONE_REMOTE, else its namespace's, else the global one. "none"
+// disables remote copies for a project.
+func storageTargets(cfg *config.Config, project string) []string {
+	return splitTargets(cfg.ProjectOption(project, "RCLONE_REMOTE", cfg.NamespaceOption(cfg.ProjectNamespace(project), "RCLONE_REMOTE", cfg.RcloneRemote)))
+}
+
+// splitTargets parses a comma-separated RCLONE_REMOTE value.
+func splitTargets(value string) []string {
+	var targets []string
+	for _, remote := range strings.Split(value, ",") {
+		remote = strings.TrimSpace(remote)
+		if remote == "" || strings.EqualFold(remote, "none") {
+			continue
+		}
+		targets = append(targets, remote)
+	}
+	return targets
+}
+
+func (s *Service) backendsFor(project string) []storage.Backend {
+	var backends []storage.Backend
+	for _, remote := range storageTargets(s.config, project) {
+		if backend, ok := s.backends[remote]; ok {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+// remoteDir returns where the backup directory relDir of a backup taken by
+// instance (INSTANCE_NAME) is stored on remotes: below the instance name, so
+// schedulers sharing a bucket never write to the same keys.
+func remoteDir(instance, relDir string) string {
+	if instance == "" {
+		return relDir
+	}
+	return path.Join(instance, relDir)
+}
+
+// uploadBackup mirrors a stored backup to every remote target of its project.
+// Each target is tracked independently in the manifest's storage list (next to
+// the local copy), so one failing target doesn't hide copies that succeeded.
+// Remote keys follow the local layout, relDir being the backup's directory,
+// below the instance name if set (remoteDir).
+// Returns the storage results for the run report, or nil without remotes.
+func (s *Service) uploadBackup(ctx context.Context, db *database.Database, relDir string, manifest *backup.BackupManifest) []interface{} {
+	backends := s.backendsFor(db.Identifier)
+	if len(backends) == 0 {
+		return nil
+	}
+
+	backupDir := filepath.Join(s.baseDir, filepath.FromSlash(relDir))
+	keyDir := remoteDir(manifest.Instance, relDir)
+	manifestFile := fmt.Sprintf("manifest-%s.json", manifest.RunID)
+	manifestPath := filepath.Join(backupDir, manifestFile)
+
+	uploadStarted := time.Now()
+	results := []backup.StorageResult{{Target: "local", Status: "success"}}
+	for _, backend := range backends {
+		result := backup.StorageResult{Target: backend.Name(), Status: "success"}
+		started := time.Now()
+		if err := putArchive(ctx, backend, backupDir, keyDir, manifest.ArchiveFiles()); err != nil {
+			s.logger.Error("Upload failed",
+				zap.String("database", db.Identifier),
+				zap.String("backend", backend.Name()),
+				zap.Error(err))
+			result.Status = "failed"
+			result.Error = redact.String(err.Error())
+		} else {
+			elapsed := time.Since(started)
+			result.UploadedAt = time.Now().Format(time.RFC3339)
+			result.DurationMs = elapsed.Milliseconds()
+			result.MBPerSec = backup.MBPerSec(manifest.Files[0].Size, elapsed)
+			s.emitEvent(EventUploadCompleted, map[string]interface{}{
+				"project":     db.Identifier,
+				"run_id":      manifest.RunID,
+				"target":      result.Target,
+				"path":        keyDir,
+				"size_bytes":  manifest.Files[0].Size,
+				"duration_ms": result.DurationMs,
+				"mb_per_s":    result.MBPerSec,
+			})
+		}
+		results = append(results, result)
+	}
+
+	// Record archive results before uploading the manifest, so remote copies
+	// of the manifest show which other targets hold the backup
+	manifest.Storage = results
+	if manifest.PhaseMs != nil {
+		manifest.PhaseMs[backup.PhaseUpload] = time.Since(uploadStarted).Milliseconds()
+	}
+	if err := backup.SaveManifest(manifestPath, manifest); err != nil {
+		s.logger.Warn("Failed to update manifest with storage results", zap.Error(err))
+	}
+
+	manifestFailed := false
+	for i, backend := range backends {
+		result := &manifest.Storage[i+1]
+		if result.Status != "success" {
+			continue
+		}
+		if _, err := os.Stat(manifestPath); err != nil {
+			continue
+		}
+		key := path.Join(keyDir, manifestFile)
+		if err := backend.Put(ctx, manifestPath, key); err != nil {
+			s.logger.Error("Manifest upload failed",
+				zap.String("database", db.Identifier),
+				zap.String("backend", backend.Name()),
+				zap.Error(err))
+			result.Status = "failed"
+			result.Error = redact.String(fmt.Sprintf("manifest upload failed: %v", err))
+			manifestFailed = true
+			continue
+		}
+		s.logger.Info("Upload completed", zap.String("database", db.Identifier), zap.String("backend", backend.Name()))
+	}
+
+	if manifestFailed {
+		if err := backup.SaveManifest(manifestPath, manifest); err != nil {
+			s.logger.Warn("Failed to update manifest with storage results", zap.Error(err))
+		}
+	}
+
+	report := make([]interface{}, len(manifest.Storage))
+	for i, result := range manifest.Storage {
+		entry := map[string]interface{}{
+			"target": result.Target,
+			"status": result.Status,
+		}
+		if result.Error != "" {
+			entry["error"] = result.Error
+		}
+		if result.MBPerSec > 0 {
+			entry["mb_per_s"] = result.MBPerSec
+		}
+		report[i] = entry
+	}
+	return report
+}
+
+// partUploadConcurrency is how many parts of a split archive are uploaded to
+// a target at once.
+const partUploadConcurrency = 4
+
+// putArchive uploads the files of an archive from backupDir to keyDir on a
+// target: the archive, or its parts in parallel. Parts that fail don't stop the others; their errors
+// are joined.
+func putArchive(ctx context.Context, backend storage.Backend, backupDir, keyDir string, files []string) error {
+	if len(files) == 1 {
+		return backend.Put(ctx, filepath.Join(backupDir, files[0]), path.Join(keyDir, files[0]))
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	slots := make(chan struct{}, partUploadConcurrency)
+	for _, file := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := backend.Put(ctx, filepath.Join(backupDir, file), path.Join(keyDir, file)); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", file, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
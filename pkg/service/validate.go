@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/database"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/docker"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/layout"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/msgbus"
+	"github.com/mxschmitt/pg-backup-scheduler/internal/redact"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/backup"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/storage"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+// ValidateConfig checks a configuration the way New and the backup runs
+// would use it, without Docker or database connections, and returns every
+// problem found rather than stopping at the first. Storage backends
+// implementing storage.Checker are asked to check their own configuration.
+func ValidateConfig(ctx context.Context, cfg *config.Config) []error {
+	problems := cfg.Validate()
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	crons := map[string]string{
+		"BACKUP_CRON":    cfg.BackupCron,
+		"RETENTION_CRON": cfg.RetentionCron,
+		"REHEARSAL_CRON": cfg.RehearsalCron,
+	}
+	if cfg.RehearsalReportURL != "" {
+		crons["REHEARSAL_REPORT_CRON"] = cfg.RehearsalReportCron
+		if u, err := url.Parse(cfg.RehearsalReportURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("REHEARSAL_REPORT_URL: expected an http(s) URL, got %q", cfg.RehearsalReportURL)
+		}
+	}
+	if cfg.DigestCron != "" {
+		crons["DIGEST_CRON"] = cfg.DigestCron
+		if cfg.DigestURL == "" && cfg.DigestEmailTo == "" {
+			add("DIGEST_CRON: set DIGEST_URL or DIGEST_EMAIL_TO to receive the digest")
+		}
+	}
+	if cfg.DigestURL != "" {
+		if u, err := url.Parse(cfg.DigestURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("DIGEST_URL: expected an http(s) URL, got %q", redact.String(cfg.DigestURL))
+		}
+	}
+	if cfg.DigestEmailTo != "" {
+		if _, err := mail.ParseAddressList(cfg.DigestEmailTo); err != nil {
+			add("DIGEST_EMAIL_TO: invalid address list %q: %v", cfg.DigestEmailTo, err)
+		}
+		if cfg.SMTPHost == "" {
+			add("SMTP_HOST: required to email digests")
+		}
+		if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+			add("SMTP_FROM: expected the sender address of digest emails, got %q", cfg.SMTPFrom)
+		}
+		if cfg.SMTPPort < 1 || cfg.SMTPPort > 65535 {
+			add("SMTP_PORT: must be between 1 and 65535, got %d", cfg.SMTPPort)
+		}
+	}
+	if cfg.SchemaDriftURL != "" {
+		if u, err := url.Parse(cfg.SchemaDriftURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("SCHEMA_DRIFT_URL: expected an http(s) URL, got %q", cfg.SchemaDriftURL)
+		}
+	}
+	if cfg.MessageBusURL != "" {
+		if err := msgbus.ValidateURL(cfg.MessageBusURL); err != nil {
+			add("MESSAGE_BUS_URL: %s", redact.String(err.Error()))
+		}
+	}
+	if cfg.EventsURL != "" {
+		webhook := strings.HasPrefix(cfg.EventsURL, "http://") || strings.HasPrefix(cfg.EventsURL, "https://")
+		if u, err := url.Parse(cfg.EventsURL); webhook && (err != nil || u.Host == "") || !webhook && msgbus.ValidateURL(cfg.EventsURL) != nil {
+			add("EVENTS_URL: expected an http(s), nats:// or redis:// URL, got %q", redact.String(cfg.EventsURL))
+		}
+	}
+	if cfg.PushgatewayURL != "" {
+		if u, err := url.Parse(cfg.PushgatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("PUSHGATEWAY_URL: expected an http(s) URL, got %q", redact.String(cfg.PushgatewayURL))
+		}
+		if cfg.PushgatewayJob == "" || strings.Contains(cfg.PushgatewayJob, "/") {
+			add("PUSHGATEWAY_JOB: expected a job name without slashes, got %q", cfg.PushgatewayJob)
+		}
+	}
+	for group := range cfg.GroupOptions {
+		if expr := cfg.GroupOption(group, "CRON", ""); expr != "" {
+			crons["GROUP_"+strings.ToUpper(group)+"_CRON"] = expr
+		}
+	}
+	keys := make([]string, 0, len(crons))
+	for key := range crons {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if crons[key] == "" {
+			continue
+		}
+		if _, err := cron.ParseStandard(cronSpec(crons[key])); err != nil {
+			add("%s: invalid cron expression %q: %v", key, crons[key], err)
+		}
+	}
+
+	if _, err := parseBlackoutWindows(cfg.BlackoutWindows); err != nil {
+		add("BLACKOUT_WINDOWS: %v", err)
+	}
+	if _, err := layout.Parse(cfg.LayoutTemplate); err != nil {
+		add("LAYOUT_TEMPLATE: %v", err)
+	}
+	if cfg.ImagePullPolicy != "" {
+		if _, err := docker.ParsePullPolicy(cfg.ImagePullPolicy); err != nil {
+			add("IMAGE_PULL_POLICY: %v", err)
+		}
+	}
+	if cfg.RegistryAuthFile != "" {
+		if _, _, err := docker.LoadRegistryAuth(cfg.RegistryAuthFile); err != nil {
+			add("REGISTRY_AUTH_FILE: %v", err)
+		}
+	}
+	if cfg.NetworkMode != "" {
+		if _, err := docker.ParseNetworkMode(cfg.NetworkMode); err != nil {
+			add("NETWORK_MODE: %v", err)
+		}
+	}
+	if cfg.SigningKeyFile != "" {
+		if _, err := backup.LoadSigningKey(cfg.SigningKeyFile); err != nil {
+			add("SIGNING_KEY_FILE: %v", err)
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Databases))
+	for name := range cfg.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	runner := backup.New(cfg, zap.NewNop())
+	var projects []string
+	for _, name := range names {
+		db, err := database.New(cfg.Databases[name], name)
+		if err != nil {
+			add("project %s: invalid connection URL: %v", name, err)
+			continue
+		}
+		projects = append(projects, db.Identifier)
+		problems = append(problems, runner.ValidateProject(db)...)
+	}
+
+	backends, err := newBackends(cfg, projects)
+	if err != nil {
+		add("RCLONE_REMOTE: %v", err)
+		return problems
+	}
+	remotes := make([]string, 0, len(backends))
+	for remote := range backends {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	for _, remote := range remotes {
+		checker, ok := backends[remote].(storage.Checker)
+		if !ok {
+			continue
+		}
+		if err := checker.Check(ctx); err != nil {
+			add("storage %s: %v", backends[remote].Name(), err)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rclone exit codes for missing directories and files
+const (
+	rcloneDirNotFound  = 3
+	rcloneFileNotFound = 4
+)
+
+// Rclone uploads through the rclone binary, giving access to every remote
+// rclone supports (B2, Drive, OneDrive, Swift, S3, SFTP, ...). Remotes are
+// configured the usual rclone way (rclone.conf or RCLONE_CONFIG_* env vars).
+type Rclone struct {
+	binary string
+	remote string
+	flags  []string
+	verify bool
+}
+
+// NewRclone creates a backend uploading below remote (e.g. "b2:bucket/backups").
+// With verify set, every upload is checked against the local file using the
+// strongest hash both sides support (falling back to size).
+func NewRclone(binary, remote string, flags []string, verify bool) (*Rclone, error) {
+	if binary == "" {
+		binary = "rclone"
+	}
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("rclone binary not found: %w", err)
+	}
+	if !strings.Contains(remote, ":") {
+		return nil, fmt.Errorf("invalid rclone remote %q (expected <remote>:<path>)", remote)
+	}
+
+	return &Rclone{
+		binary: path,
+		remote: strings.TrimSuffix(remote, "/"),
+		flags:  flags,
+		verify: verify,
+	}, nil
+}
+
+func (r *Rclone) Name() string {
+	return "rclone:" + r.remote
+}
+
+func (r *Rclone) Put(ctx context.Context, localPath, key string) error {
+	if err := r.run(ctx, "copyto", localPath, r.target(key)); err != nil {
+		return err
+	}
+	if !r.verify {
+		return nil
+	}
+
+	// rclone check compares directories; restrict it to the uploaded file
+	name := path.Base(key)
+	if err := r.run(ctx, "check", "--one-way", "--include", "/"+name, filepath.Dir(localPath), r.target(path.Dir(key))); err != nil {
+		return fmt.Errorf("upload verification failed: %w", err)
+	}
+	return nil
+}
+
+func (r *Rclone) Get(ctx context.Context, key, localPath string) error {
+	_, err := r.output(ctx, "copyto", r.target(key), localPath)
+	return err
+}
+
+// rcloneEntry is an entry of rclone lsjson output.
+type rcloneEntry struct {
+	Path    string    `json:"Path"`
+	Size    int64     `json:"Size"`
+	ModTime time.Time `json:"ModTime"`
+}
+
+func (r *Rclone) List(ctx context.Context, prefix string) ([]Object, error) {
+	// lsjson lists directories; filter the last path element by name
+	dir, namePrefix := path.Dir(prefix), path.Base(prefix)
+	if strings.HasSuffix(prefix, "/") || prefix == "" {
+		dir, namePrefix = strings.TrimSuffix(prefix, "/"), ""
+	}
+	if dir == "." {
+		dir = ""
+	}
+	out, err := r.output(ctx, "lsjson", "--recursive", "--files-only", r.target(dir))
+	if errors.Is(err, ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []rcloneEntry
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+	}
+	var objects []Object
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Path, namePrefix) {
+			continue
+		}
+		objects = append(objects, Object{Key: path.Join(dir, entry.Path), Size: entry.Size, ModTime: entry.ModTime})
+	}
+	return objects, nil
+}
+
+func (r *Rclone) Delete(ctx context.Context, key string) error {
+	_, err := r.output(ctx, "deletefile", r.target(key))
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (r *Rclone) Stat(ctx context.Context, key string) (Object, error) {
+	out, err := r.output(ctx, "lsjson", "--stat", "--files-only", r.target(key))
+	if err != nil {
+		return Object{}, err
+	}
+	var entry rcloneEntry
+	if err := json.Unmarshal(out, &entry); err != nil {
+		return Object{}, fmt.Errorf("failed to parse rclone lsjson output: %w", err)
+	}
+	return Object{Key: key, Size: entry.Size, ModTime: entry.ModTime}, nil
+}
+
+// ShareURL creates a link to key with `rclone link --expire`, a presigned URL
+// on S3-compatible (GCS through its S3 API) and Azure Blob remotes. Remotes
+// without link support fail; some (Drive, Dropbox) ignore the expiry and
+// create links that last until revoked.
+func (r *Rclone) ShareURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	out, err := r.output(ctx, "link", "--expire", fmt.Sprintf("%ds", int64(ttl.Seconds())), r.target(key))
+	if err != nil {
+		return "", err
+	}
+	url := strings.TrimSpace(string(out))
+	if url == "" {
+		return "", fmt.Errorf("rclone link returned no URL for %s", key)
+	}
+	return url, nil
+}
+
+// Check makes sure the remote is configured, in RCLONE_CONFIG_<NAME>_TYPE
+// or the rclone config file. On-the-fly remotes (":s3,...:bucket") configure
+// themselves and local paths need no remote.
+func (r *Rclone) Check(ctx context.Context) error {
+	name, _, ok := strings.Cut(r.remote, ":")
+	if !ok || name == "" || strings.ContainsAny(name, `/\`) {
+		return nil
+	}
+	if os.Getenv("RCLONE_CONFIG_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))+"_TYPE") != "" {
+		return nil
+	}
+	out, err := r.output(ctx, "listremotes")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == name+":" {
+			return nil
+		}
+	}
+	return fmt.Errorf("rclone remote %q is not configured", name)
+}
+
+func (r *Rclone) target(key string) string {
+	if strings.HasSuffix(r.remote, ":") {
+		return r.remote + key
+	}
+	return r.remote + "/" + key
+}
+
+func (r *Rclone) run(ctx context.Context, args ...string) error {
+	_, err := r.output(ctx, args...)
+	return err
+}
+
+// output runs rclone and returns its stdout. Missing files and directories
+// are reported as ErrNotExist.
+func (r *Rclone) output(ctx context.Context, args ...string) ([]byte, error) {
+	args = append(args, r.flags...)
+	cmd := exec.CommandContext(ctx, r.binary, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && (exitErr.ExitCode() == rcloneDirNotFound || exitErr.ExitCode() == rcloneFileNotFound) {
+			err = fmt.Errorf("%w: %w", ErrNotExist, err)
+		}
+		if out := strings.TrimSpace(stderr.String() + stdout.String()); out != "" {
+			return nil, fmt.Errorf("rclone %s failed: %w: %s", args[0], err, out)
+		}
+		return nil, fmt.Errorf("rclone %s failed: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
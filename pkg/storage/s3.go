@@ -0,0 +1,698 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxschmitt/pg-backup-scheduler/internal/durable"
+	"github.com/mxschmitt/pg-backup-scheduler/pkg/config"
+)
+
+const (
+	// defaultS3PartSize is the part size of multipart uploads without
+	// S3_PART_SIZE.
+	defaultS3PartSize = 64 << 20
+	// S3 limits: parts are at least 5MiB (but the last) and at most 5GiB,
+	// an upload has at most 10000 parts
+	minS3PartSize = 5 << 20
+	maxS3PartSize = 5 << 30
+	maxS3Parts    = 10000
+	// defaultS3Attempts is how often an upload is tried without
+	// S3_UPLOAD_ATTEMPTS.
+	defaultS3Attempts = 5
+	// maxS3PresignTTL is the longest validity S3 accepts for presigned URLs.
+	maxS3PresignTTL = 7 * 24 * time.Hour
+)
+
+func init() {
+	Register("s3", func(target string) (Backend, error) {
+		return NewS3(target)
+	})
+}
+
+// S3 stores backups in an S3 bucket (AWS or a compatible store such as MinIO
+// or Ceph) without rclone. Files larger than a part are sent as multipart
+// uploads with a SHA-256 checksum per part, which S3 verifies on receipt. A
+// failed upload is retried from the parts S3 already has: the upload ID and
+// the ETags of the uploaded parts are kept in a state file next to the local
+// file until the upload completes.
+type S3 struct {
+	target    string
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	pathStyle bool
+	creds     s3Credentials
+	partSize  int64
+	attempts  int
+	client    *http.Client
+	// retryDelay is the wait before the second attempt, doubling after
+	retryDelay time.Duration
+}
+
+// NewS3 creates a backend for a target "s3://<bucket>[/<prefix>]". Settings
+// come from the environment: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// (and AWS_SESSION_TOKEN for temporary credentials), AWS_REGION (or
+// AWS_DEFAULT_REGION, else us-east-1), S3_ENDPOINT for stores other than AWS
+// with S3_PATH_STYLE, S3_PART_SIZE and S3_UPLOAD_ATTEMPTS.
+func NewS3(target string) (*S3, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 target %q (expected s3://<bucket>[/<prefix>])", target)
+	}
+	s := &S3{
+		target: strings.TrimSuffix(target, "/"),
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		creds: s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		partSize:   defaultS3PartSize,
+		attempts:   defaultS3Attempts,
+		client:     &http.Client{Transport: s3Transport()},
+		retryDelay: time.Second,
+	}
+	if s.creds.accessKey == "" || s.creds.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for %s", target)
+	}
+
+	s.region = os.Getenv("AWS_REGION")
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	s.pathStyle = endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" || s.endpoint.Scheme != "http" && s.endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q (expected http(s)://host[:port])", endpoint)
+	}
+	if value := os.Getenv("S3_PATH_STYLE"); value != "" {
+		if s.pathStyle, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid S3_PATH_STYLE %q", value)
+		}
+	}
+	if value := os.Getenv("S3_PART_SIZE"); value != "" {
+		if s.partSize, err = config.ParseBytes(value); err != nil || s.partSize < minS3PartSize || s.partSize > maxS3PartSize {
+			return nil, fmt.Errorf("invalid S3_PART_SIZE %q (5MiB to 5GiB)", value)
+		}
+	}
+	if value := os.Getenv("S3_UPLOAD_ATTEMPTS"); value != "" {
+		if s.attempts, err = strconv.Atoi(value); err != nil || s.attempts < 1 {
+			return nil, fmt.Errorf("invalid S3_UPLOAD_ATTEMPTS %q", value)
+		}
+	}
+	return s, nil
+}
+
+// s3Transport gives up on servers that accept a request but never answer,
+// which would otherwise stall an upload until the backup times out.
+func s3Transport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 2 * time.Minute
+	return transport
+}
+
+func (s *S3) Name() string {
+	return s.target
+}
+
+// Put uploads localPath, retrying failed attempts with backoff. Attempts of
+// a multipart upload continue it where the previous one stopped.
+func (s *S3) Put(ctx context.Context, localPath, key string) error {
+	delay := s.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.put(ctx, localPath, key)
+		if err == nil || attempt >= s.attempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (s *S3) put(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= s.partSize {
+		return s.putObject(ctx, file, info.Size(), key)
+	}
+	return s.putMultipart(ctx, file, info, key)
+}
+
+// putObject uploads a file in one request.
+func (s *S3) putObject(ctx context.Context, file *os.File, size int64, key string) error {
+	section := io.NewSectionReader(file, 0, size)
+	sum, err := sectionSHA256(section)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(sum)}}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, section, size, hex.EncodeToString(sum))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadState is the progress of a multipart upload, saved after every part.
+// It belongs to one version of the local file: a file of another size or
+// modification time (or a different part size) starts a new upload.
+type uploadState struct {
+	Target   string         `json:"target"`
+	Key      string         `json:"key"`
+	UploadID string         `json:"upload_id"`
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mod_time"`
+	PartSize int64          `json:"part_size"`
+	Parts    []uploadedPart `json:"parts"`
+}
+
+type uploadedPart struct {
+	Number         int    `json:"number"`
+	ETag           string `json:"etag"`
+	ChecksumSHA256 string `json:"checksum_sha256"`
+}
+
+// uploadStatePrefix starts the names of upload state files:
+// upload-<file>-<hash of target and key>.json.
+const uploadStatePrefix = "upload-"
+
+// uploadStatePath is where the state of uploading localPath to key is kept.
+func (s *S3) uploadStatePath(localPath, key string) string {
+	sum := sha256.Sum256([]byte(s.target + "\n" + key))
+	name := fmt.Sprintf("%s%s-%s.json", uploadStatePrefix, filepath.Base(localPath), hex.EncodeToString(sum[:4]))
+	return filepath.Join(filepath.Dir(localPath), name)
+}
+
+// RemoveUploadState deletes the state of unfinished S3 uploads of localPath,
+// for when the file itself is deleted.
+func RemoveUploadState(localPath string) error {
+	entries, err := os.ReadDir(filepath.Dir(localPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	prefix := uploadStatePrefix + filepath.Base(localPath) + "-"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(filepath.Dir(localPath), name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// putMultipart uploads a file in parts, continuing the upload in the state
+// file if there is one for this file.
+func (s *S3) putMultipart(ctx context.Context, file *os.File, info fs.FileInfo, key string) error {
+	size := info.Size()
+	partSize := s.partSize
+	if size > partSize*maxS3Parts {
+		// Round up to whole MiB so the part count stays within the limit
+		partSize = ((size+maxS3Parts-1)/maxS3Parts + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	statePath := s.uploadStatePath(file.Name(), key)
+
+	state, err := s.resumeUpload(ctx, statePath, key, info, partSize)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		uploadID, err := s.createMultipartUpload(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to start multipart upload: %w", err)
+		}
+		state = &uploadState{Target: s.target, Key: key, UploadID: uploadID, Size: size, ModTime: info.ModTime().UTC(), PartSize: partSize}
+		if err := saveUploadState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	done := make(map[int]bool, len(state.Parts))
+	for _, part := range state.Parts {
+		done[part.Number] = true
+	}
+	partCount := int((size + partSize - 1) / partSize)
+	for number := 1; number <= partCount; number++ {
+		if done[number] {
+			continue
+		}
+		offset := int64(number-1) * partSize
+		part, err := s.uploadPart(ctx, key, state.UploadID, number, io.NewSectionReader(file, offset, min(partSize, size-offset)))
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d of %d: %w", number, partCount, err)
+		}
+		state.Parts = append(state.Parts, part)
+		if err := saveUploadState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].Number < state.Parts[j].Number })
+	if err := s.completeMultipartUpload(ctx, key, state); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	if err := os.Remove(statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload state: %w", err)
+	}
+	return nil
+}
+
+// resumeUpload returns the saved state of uploading this version of the file
+// to key, keeping the parts S3 has with the recorded checksum, or nil to
+// start over. An upload for an older version of the file is aborted.
+func (s *S3) resumeUpload(ctx context.Context, statePath, key string, info fs.FileInfo, partSize int64) (*uploadState, error) {
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload state: %w", err)
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil || state.UploadID == "" {
+		return nil, nil
+	}
+	if state.Target != s.target || state.Key != key || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) || state.PartSize != partSize {
+		// Best effort: an upload nobody completes is also removed by the
+		// bucket's lifecycle rules, if it has any
+		_ = s.abortMultipartUpload(ctx, state.Key, state.UploadID)
+		return nil, nil
+	}
+
+	listed, err := s.listParts(ctx, key, state.UploadID)
+	if errors.Is(err, ErrNotExist) {
+		// Completed or aborted in the meantime
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+	}
+	parts := state.Parts[:0]
+	for _, part := range state.Parts {
+		if stored, ok := listed[part.Number]; ok && stored.ETag == part.ETag && (stored.ChecksumSHA256 == "" || stored.ChecksumSHA256 == part.ChecksumSHA256) {
+			parts = append(parts, part)
+		}
+	}
+	state.Parts = parts
+	return &state, nil
+}
+
+func saveUploadState(statePath string, state *uploadState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := durable.WriteFile(statePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
+
+func (s *S3) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	header := http.Header{"X-Amz-Checksum-Algorithm": {"SHA256"}}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, emptyPayload)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("invalid CreateMultipartUpload response: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart sends one part with its SHA-256, both as the signed payload
+// hash and as the part checksum S3 stores and checks on completion.
+func (s *S3) uploadPart(ctx context.Context, key, uploadID string, number int, section *io.SectionReader) (uploadedPart, error) {
+	sum, err := sectionSHA256(section)
+	if err != nil {
+		return uploadedPart{}, err
+	}
+	checksum := base64.StdEncoding.EncodeToString(sum)
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	header := http.Header{"X-Amz-Checksum-Sha256": {checksum}}
+	resp, err := s.do(ctx, http.MethodPut, key, query, header, section, section.Size(), hex.EncodeToString(sum))
+	if err != nil {
+		return uploadedPart{}, err
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return uploadedPart{}, fmt.Errorf("no ETag for part %d", number)
+	}
+	return uploadedPart{Number: number, ETag: etag, ChecksumSHA256: checksum}, nil
+}
+
+// listParts returns the parts S3 has of an upload by number.
+func (s *S3) listParts(ctx context.Context, key, uploadID string) (map[int]uploadedPart, error) {
+	parts := make(map[int]uploadedPart)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		resp, err := s.do(ctx, http.MethodGet, key, query, nil, nil, 0, emptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+			Parts                []struct {
+				PartNumber     int    `xml:"PartNumber"`
+				ETag           string `xml:"ETag"`
+				ChecksumSHA256 string `xml:"ChecksumSHA256"`
+			} `xml:"Part"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ListParts response: %w", err)
+		}
+		for _, part := range result.Parts {
+			parts[part.PartNumber] = uploadedPart{Number: part.PartNumber, ETag: part.ETag, ChecksumSHA256: part.ChecksumSHA256}
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+type completedPart struct {
+	PartNumber     int    `xml:"PartNumber"`
+	ETag           string `xml:"ETag"`
+	ChecksumSHA256 string `xml:"ChecksumSHA256"`
+}
+
+func (s *S3) completeMultipartUpload(ctx context.Context, key string, state *uploadState) error {
+	request := struct {
+		XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for _, part := range state.Parts {
+		request.Parts = append(request.Parts, completedPart{PartNumber: part.Number, ETag: part.ETag, ChecksumSHA256: part.ChecksumSHA256})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"uploadId": {state.UploadID}}
+	resp, err := s.do(ctx, http.MethodPost, key, query, nil, bytes.NewReader(body), int64(len(body)), sha256Hex(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 may report a failure after it has sent 200 OK, in the body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return parseS3Error(http.StatusInternalServerError, data)
+	}
+	return nil
+}
+
+func (s *S3) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key, localPath string) error {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return file.Close()
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.fullKey(prefix)}}
+		if strings.HasSuffix(prefix, "/") || prefix == "" {
+			query.Set("prefix", strings.TrimPrefix(s.fullKey(prefix)+"/", "/"))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.doBucket(ctx, http.MethodGet, query)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ListObjectsV2 response: %w", err)
+		}
+		for _, object := range result.Contents {
+			key := object.Key
+			if s.prefix != "" {
+				key = strings.TrimPrefix(key, s.prefix+"/")
+			}
+			objects = append(objects, Object{Key: key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, 0, emptyPayload)
+	if errors.Is(err, ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, 0, emptyPayload)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// ShareURL presigns a GET of key. S3 accepts presigned URLs for up to 7 days.
+func (s *S3) ShareURL(_ context.Context, key string, ttl time.Duration) (string, error) {
+	if ttl > maxS3PresignTTL {
+		return "", fmt.Errorf("S3 presigned URLs are valid for at most %s", maxS3PresignTTL)
+	}
+	return presignURL(s.objectURL(key), s.creds, s.region, ttl, time.Now()), nil
+}
+
+// Check makes sure the bucket exists and the credentials can access it.
+func (s *S3) Check(ctx context.Context) error {
+	resp, err := s.doBucket(ctx, http.MethodHead, nil)
+	if err != nil {
+		return fmt.Errorf("bucket %s: %w", s.bucket, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// fullKey is key below the target's prefix.
+func (s *S3) fullKey(key string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, key), "/")
+}
+
+// objectURL is the URL of key, in the bucket's host name or (path style)
+// its first path segment.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + s.fullKey(key)
+	if s.pathStyle {
+		objectPath = "/" + s.bucket + objectPath
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+// doBucket sends a request for the bucket itself.
+func (s *S3) doBucket(ctx context.Context, method string, query url.Values) (*http.Response, error) {
+	u := *s.endpoint
+	bucketPath := "/"
+	if s.pathStyle {
+		bucketPath = "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + bucketPath
+	u.RawPath = uriEncode(u.Path, false)
+	return s.send(ctx, method, &u, query, nil, nil, 0, emptyPayload)
+}
+
+// do sends a signed request for key. Error responses are returned as
+// *s3Error, which matches ErrNotExist for 404s.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	return s.send(ctx, method, s.objectURL(key), query, header, body, size, payloadHash)
+}
+
+func (s *S3) send(ctx context.Context, method string, u *url.URL, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u.RawQuery = canonicalQuery(query)
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signRequest(req, s.creds, s.region, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, parseS3Error(resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// s3Error is an error response of S3.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.Status)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	return target == ErrNotExist && e.Status == http.StatusNotFound
+}
+
+func parseS3Error(status int, body []byte) error {
+	var result struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	_ = xml.Unmarshal(body, &result)
+	return &s3Error{Status: status, Code: result.Code, Message: result.Message}
+}
+
+// retryable reports whether another attempt may succeed: after network
+// errors, server errors, throttling and checksum mismatches, which are
+// usually corruption in transit. Local file errors and other client errors
+// (access denied, missing bucket) fail right away.
+func retryable(err error) bool {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "BadDigest", "XAmzContentSHA256Mismatch", "InvalidDigest", "RequestTimeout", "SlowDown":
+			return true
+		}
+		return s3Err.Status >= 500 || s3Err.Status == http.StatusRequestTimeout || s3Err.Status == http.StatusTooManyRequests
+	}
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// sectionSHA256 hashes a section and rewinds it.
+func sectionSHA256(section *io.SectionReader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, section); err != nil {
+		return nil, err
+	}
+	if _, err := section.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
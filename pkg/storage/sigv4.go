@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 for S3:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+	// unsignedPayload is the payload hash of presigned URLs
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayload is the SHA-256 of an empty body
+	emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Credentials are static AWS credentials.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// signRequest signs req for region in the Authorization header. payloadHash
+// is the hex SHA-256 of the body, which S3 checks against the body received.
+func signRequest(req *http.Request, creds s3Credentials, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := credentialScope(now, region)
+	signature := signature(creds.secretKey, now, region, stringToSign(amzDate, scope, canonical))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, creds.accessKey, scope, signedHeaders, signature))
+}
+
+// presignURL returns u with a query string signature valid for ttl, for a
+// GET by anyone holding the URL.
+func presignURL(u *url.URL, creds s3Credentials, region string, ttl time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format(amzDateFormat)
+	scope := credentialScope(now, region)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigAlgorithm)
+	query.Set("X-Amz-Credential", creds.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl.Seconds()), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		canonicalURI(u),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := signature(creds.secretKey, now, region, stringToSign(amzDate, scope, canonical))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return signed.String()
+}
+
+func credentialScope(now time.Time, region string) string {
+	return now.UTC().Format("20060102") + "/" + region + "/s3/aws4_request"
+}
+
+func stringToSign(amzDate, scope, canonicalRequest string) string {
+	return sigAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+}
+
+func signature(secretKey string, now time.Time, region, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.UTC().Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalHeaders signs the host, the x-amz-* headers and the content
+// headers S3 interprets.
+func canonicalHeaders(req *http.Request) (signed, canonical string) {
+	values := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		values["host"] = req.Host
+	}
+	for name, vals := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" || name == "range" {
+			trimmed := make([]string, len(vals))
+			for i, v := range vals {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			values[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// canonicalURI is the URI-encoded path, slashes kept.
+func canonicalURI(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return uriEncode(u.Path, false)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters (and
+// slashes unless encodeSlash), as SigV4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
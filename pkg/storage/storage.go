@@ -0,0 +1,136 @@
+// Package storage defines the backends that receive copies of finished
+// backups. Besides the built-in rclone and s3 backends, programs embedding
+// the service can register their own with Register and select them with
+// "<scheme>://..." targets in RCLONE_REMOTE.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotExist is returned by Get and Stat (possibly wrapped) when a key
+// doesn't exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// Backend is a remote destination that receives copies of finished backups.
+// Keys are slash-separated paths mirroring the local layout
+// (<project>/<date>/<file>). Implementations must be safe for concurrent use.
+type Backend interface {
+	// Name identifies the backend in logs and run results
+	Name() string
+	// Put uploads the local file at localPath to key
+	Put(ctx context.Context, localPath, key string) error
+	// Get downloads key to the local file at localPath
+	Get(ctx context.Context, key, localPath string) error
+	// List returns the objects whose keys start with prefix, in any order
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Delete removes key. Deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// Stat returns the object stored at key
+	Stat(ctx context.Context, key string) (Object, error)
+}
+
+// Checker is implemented by backends that can check their configuration
+// (credentials, remote names) without transferring anything. It is optional;
+// --validate-config runs it for the backends that have it.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Sharer is implemented by backends that can hand out expiring download
+// URLs for stored objects (presigned URLs), so files can be fetched from the
+// remote directly. It is optional; backups in other backends can't be shared.
+type Sharer interface {
+	ShareURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// Object describes a stored file.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Factory creates a backend for a target such as "objstore://bucket/prefix".
+// The whole target is passed, scheme included; credentials and other settings
+// are up to the backend (typically environment variables).
+type Factory func(target string) (Backend, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a backend available for targets of the form
+// "<scheme>://...". It is meant to be called from an init function and
+// panics if the scheme is invalid or already registered.
+func Register(scheme string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if !validScheme(scheme) {
+		panic(fmt.Sprintf("storage: invalid scheme %q", scheme))
+	}
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := factories[scheme]; dup {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates the registered backend for a "<scheme>://..." target. ok is
+// false for targets without a scheme, which are rclone remotes; targets with
+// an unregistered scheme are an error.
+func Open(target string) (backend Backend, ok bool, err error) {
+	scheme, _, found := strings.Cut(target, "://")
+	if !found || !validScheme(scheme) {
+		return nil, false, nil
+	}
+	factoriesMu.RLock()
+	factory := factories[scheme]
+	factoriesMu.RUnlock()
+	if factory == nil {
+		registered := strings.Join(Schemes(), ", ")
+		if registered == "" {
+			registered = "none"
+		}
+		return nil, true, fmt.Errorf("no storage backend registered for %q (registered: %s)", scheme+"://", registered)
+	}
+	backend, err = factory(target)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open storage target %s: %w", target, err)
+	}
+	return backend, true, nil
+}
+
+// validScheme accepts lowercase URL schemes ("objstore", "my-store").
+func validScheme(scheme string) bool {
+	if scheme == "" || scheme[0] < 'a' || scheme[0] > 'z' {
+		return false
+	}
+	for _, r := range scheme {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}